@@ -24,6 +24,7 @@ package connectivity
 
 import (
 	"errors"
+	"net/url"
 	"sync"
 	"time"
 
@@ -45,6 +46,9 @@ type ConnectivityConfig struct {
 	ConnectivityCheckURL string `json:"connectivity_check_url"`
 	// The expected MD5 of the content at the ConnectivityCheckURL
 	ConnectivityCheckMD5 string `json:"connectivity_check_md5"`
+	// The HTTP proxy for the client's HTTP requests, including the
+	// connectivity check; empty to use the environment's ($http_proxy).
+	HTTPProxy string `json:"http_proxy"`
 }
 
 // ConnectedState helps tracking connectivity.
@@ -70,9 +74,10 @@ type ConnectedState struct {
 // New makes a ConnectedState for connectivity tracking.
 //
 // The endpoint need not be dialed; Track()  will Dial() and
-// Close() it as it sees fit.
-func New(endp bus.Endpoint, config ConnectivityConfig, log logger.Logger) *ConnectedState {
-	wg := NewWebchecker(config.ConnectivityCheckURL, config.ConnectivityCheckMD5, 10*time.Second, log)
+// Close() it as it sees fit. The connectivity check goes through
+// proxy, as parsed from config.HTTPProxy by util.ParseProxyURL.
+func New(endp bus.Endpoint, config ConnectivityConfig, proxy *url.URL, log logger.Logger) *ConnectedState {
+	wg := NewWebchecker(config.ConnectivityCheckURL, config.ConnectivityCheckMD5, 10*time.Second, proxy, log)
 	return &ConnectedState{
 		config: config,
 		log:    log,
@@ -322,6 +322,21 @@ func (s *ConnSuite) TestSteps(c *C) {
    tests for ConnectedState()
 */
 
+func (s *ConnSuite) TestNewChecksThroughProxy(c *C) {
+	proxy := httptest.NewServer(mkHandler(staticText))
+	defer proxy.Close()
+
+	cfg := ConnectivityConfig{
+		ConnectivityCheckURL: "http://start.example.com/connectivity-check.html",
+		ConnectivityCheckMD5: staticHash,
+	}
+	cs := New(nil, cfg, helpers.ParseURL(proxy.URL), s.log)
+	defer cs.webchk.Close()
+	ch := make(chan bool, 1)
+	cs.webchk.Webcheck(ch)
+	c.Check(<-ch, Equals, true)
+}
+
 // yes, this is an integration test
 func (s *ConnSuite) TestRun(c *C) {
 	ts := httptest.NewServer(mkHandler(staticText))
@@ -348,7 +363,7 @@ func (s *ConnSuite) TestRun(c *C) {
 	out := make(chan bool)
 	dt := time.Second / 10
 	timer := time.NewTimer(dt)
-	cs := New(endp, cfg, s.log)
+	cs := New(endp, cfg, nil, s.log)
 	defer cs.Cancel()
 	go cs.Track(out)
 	var v bool
@@ -413,7 +428,7 @@ func (s *ConnSuite) TestRun4Active(c *C) {
 	out := make(chan bool)
 	dt := time.Second / 10
 	timer := time.NewTimer(dt)
-	cs := New(endp, cfg, s.log)
+	cs := New(endp, cfg, nil, s.log)
 	defer cs.Cancel()
 	go cs.Track(out)
 	var v bool
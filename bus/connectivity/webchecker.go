@@ -26,11 +26,13 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"net/url"
 	"time"
 
 	http13 "github.com/ubports/ubuntu-push/http13client"
 
 	"github.com/ubports/ubuntu-push/logger"
+	"github.com/ubports/ubuntu-push/util"
 )
 
 // how much web would a webchecker check
@@ -52,10 +54,11 @@ type webchecker struct {
 }
 
 // Build a webchecker for the given URL, that should match the target MD5.
-func NewWebchecker(url string, target string, timeout time.Duration, log logger.Logger) Webchecker {
+// It goes through proxy, or the environment's proxy if proxy is nil.
+func NewWebchecker(url string, target string, timeout time.Duration, proxy *url.URL, log logger.Logger) Webchecker {
 	cli := &http13.Client{
 		Timeout:   timeout,
-		Transport: &http13.Transport{TLSHandshakeTimeout: timeout},
+		Transport: util.NewHTTPTransport(proxy, timeout),
 	}
 	return &webchecker{log, url, target, cli}
 }
@@ -80,7 +80,23 @@ func (s *WebcheckerSuite) TestWorks(c *C) {
 	ts := httptest.NewServer(mkHandler(staticText))
 	defer ts.Close()
 
-	ck := NewWebchecker(ts.URL, staticHash, 5*time.Second, s.log)
+	ck := NewWebchecker(ts.URL, staticHash, 5*time.Second, nil, s.log)
+	defer ck.Close()
+	ch := make(chan bool, 1)
+	ck.Webcheck(ch)
+	c.Check(<-ch, Equals, true)
+}
+
+// Webchecker goes through the given proxy
+func (s *WebcheckerSuite) TestWorksThroughProxy(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.String(), Equals, "http://start.example.com/connectivity-check.html")
+		w.Write([]byte(staticText))
+	}))
+	defer proxy.Close()
+
+	proxyURL := helpers.ParseURL("http://" + proxy.Listener.Addr().String())
+	ck := NewWebchecker("http://start.example.com/connectivity-check.html", staticHash, 5*time.Second, proxyURL, s.log)
 	defer ck.Close()
 	ch := make(chan bool, 1)
 	ck.Webcheck(ch)
@@ -89,7 +105,7 @@ func (s *WebcheckerSuite) TestWorks(c *C) {
 
 // Webchecker sends false if the download fails.
 func (s *WebcheckerSuite) TestActualFails(c *C) {
-	ck := NewWebchecker("garbage://", "", 5*time.Second, s.log)
+	ck := NewWebchecker("garbage://", "", 5*time.Second, nil, s.log)
 	defer ck.Close()
 	ch := make(chan bool, 1)
 	ck.Webcheck(ch)
@@ -101,7 +117,7 @@ func (s *WebcheckerSuite) TestHashFails(c *C) {
 	ts := httptest.NewServer(mkHandler(""))
 	defer ts.Close()
 
-	ck := NewWebchecker(ts.URL, staticHash, 5*time.Second, s.log)
+	ck := NewWebchecker(ts.URL, staticHash, 5*time.Second, nil, s.log)
 	defer ck.Close()
 	ch := make(chan bool, 1)
 	ck.Webcheck(ch)
@@ -114,7 +130,7 @@ func (s *WebcheckerSuite) TestTooBigFails(c *C) {
 	ts := httptest.NewServer(mkHandler(bigText))
 	defer ts.Close()
 
-	ck := NewWebchecker(ts.URL, bigHash, 5*time.Second, s.log)
+	ck := NewWebchecker(ts.URL, bigHash, 5*time.Second, nil, s.log)
 	defer ck.Close()
 	ch := make(chan bool, 1)
 	ck.Webcheck(ch)
@@ -134,7 +150,7 @@ func (s *WebcheckerSuite) TestTooSlowFails(c *C) {
 		finish <- true
 	}()
 
-	ck := NewWebchecker(ts.URL, bigHash, time.Second, s.log)
+	ck := NewWebchecker(ts.URL, bigHash, time.Second, nil, s.log)
 	defer ck.Close()
 	ch := make(chan bool, 1)
 	ck.Webcheck(ch)
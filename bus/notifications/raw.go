@@ -24,6 +24,8 @@ package notifications
 import (
 	"encoding/json"
 	"errors"
+	"sync"
+	"time"
 
 	"launchpad.net/go-dbus/v1"
 
@@ -61,11 +63,28 @@ type RawNotifications struct {
 	bus   bus.Endpoint
 	log   logger.Logger
 	sound sounds.Sound
+	lock  sync.Mutex
+	// the ids of the bubbles of cards that expire, to close them
+	expiring map[string]uint32
+	// the latest bubbles of each app and tag, to replace them
+	tagged map[string]taggedBubble
 }
 
+// a bubble that can be replaced by the next one with the same tag
+type taggedBubble struct {
+	id    uint32
+	shown time.Time
+}
+
+// how long bubbles stay up
+const bubbleTimeout = 30 * time.Second
+
+// timeNow is time.Now, swappable for testing
+var timeNow = time.Now
+
 // Raw returns a new RawNotifications that'll use the provided bus.Endpoint
 func Raw(endp bus.Endpoint, log logger.Logger, sound sounds.Sound) *RawNotifications {
-	return &RawNotifications{endp, log, sound}
+	return &RawNotifications{bus: endp, log: log, sound: sound}
 }
 
 /*
@@ -92,6 +111,35 @@ func (raw *RawNotifications) Notify(
 	return res, nil
 }
 
+// Close closes the bubble of notification nid, if it's still around
+// and its card expires (others aren't kept track of).
+func (raw *RawNotifications) Close(nid string) error {
+	raw.lock.Lock()
+	id, ok := raw.expiring[nid]
+	delete(raw.expiring, nid)
+	if ok {
+		raw.forgetTagged(func(b taggedBubble) bool { return b.id == id })
+	}
+	raw.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	if raw.bus == nil {
+		return errors.New("unconfigured (missing bus)")
+	}
+	return raw.bus.Call("CloseNotification", bus.Args(id))
+}
+
+// forgetTagged drops the tagged bubbles that are gone, as told by
+// gone. Called with the lock held.
+func (raw *RawNotifications) forgetTagged(gone func(taggedBubble) bool) {
+	for key, b := range raw.tagged {
+		if gone(b) {
+			delete(raw.tagged, key)
+		}
+	}
+}
+
 // WatchActions listens for ActionInvoked signals from the notification daemon
 // and sends them over the channel provided
 func (raw *RawNotifications) WatchActions() (<-chan *RawAction, error) {
@@ -169,6 +217,19 @@ func (raw *RawNotifications) Present(app *click.AppId, nid string, notification
 		}
 	}
 
+	if card.Image != "" {
+		hints["image-path"] = &dbus.Variant{card.Image}
+	}
+	if card.Progress != nil {
+		progress := int32(*card.Progress)
+		if progress < 0 {
+			progress = 0
+		} else if progress > 100 {
+			progress = 100
+		}
+		hints["value"] = &dbus.Variant{progress}
+	}
+
 	appId := app.Original()
 	actions := make([]string, 2*len(card.Actions))
 	for i, action := range card.Actions {
@@ -196,14 +257,47 @@ func (raw *RawNotifications) Present(app *click.AppId, nid string, notification
 		hints["x-canonical-switch-to-application"] = &dbus.Variant{"true"}
 	}
 
-	raw.log.Debugf("[%s] creating popup (or snap decision) for %s (summary: %s)", nid, app.Base(), card.Summary)
+	var reuseId uint32
+	tagKey := ""
+	if notification.Tag != "" {
+		tagKey = appId + "\x00" + notification.Tag
+		raw.lock.Lock()
+		if b, ok := raw.tagged[tagKey]; ok && timeNow().Sub(b.shown) < bubbleTimeout {
+			reuseId = b.id
+		}
+		raw.lock.Unlock()
+	}
 
-	_, err := raw.Notify(appId, 0, card.Icon, card.Summary, card.Body, actions, hints, 30*1000)
+	if reuseId != 0 {
+		raw.log.Debugf("[%s] replacing popup %d for %s (summary: %s)", nid, reuseId, app.Base(), card.Summary)
+	} else {
+		raw.log.Debugf("[%s] creating popup (or snap decision) for %s (summary: %s)", nid, app.Base(), card.Summary)
+	}
+
+	id, err := raw.Notify(appId, reuseId, card.Icon, card.Summary, card.Body, actions, hints, int32(bubbleTimeout/time.Millisecond))
 
 	if err != nil {
 		raw.log.Errorf("[%s] call to Notify failed: %v", nid, err)
 		return false
 	}
 
+	raw.lock.Lock()
+	if tagKey != "" {
+		if raw.tagged == nil {
+			raw.tagged = make(map[string]taggedBubble)
+		}
+		// the bubbles that timed out can't be replaced anymore
+		now := timeNow()
+		raw.forgetTagged(func(b taggedBubble) bool { return now.Sub(b.shown) >= bubbleTimeout })
+		raw.tagged[tagKey] = taggedBubble{id, now}
+	}
+	if !card.Expire().IsZero() {
+		if raw.expiring == nil {
+			raw.expiring = make(map[string]uint32)
+		}
+		raw.expiring[nid] = id
+	}
+	raw.lock.Unlock()
+
 	return true
 }
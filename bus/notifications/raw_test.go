@@ -253,6 +253,92 @@ func (s *RawSuite) TestPresentUsesSymbolic(c *C) {
 	c.Check(hints["x-canonical-secondary-icon"].Value.(string), Equals, "-symbolic")
 }
 
+func (s *RawSuite) TestPresentImageAndProgress(c *C) {
+	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(1))
+	raw := Raw(endp, s.log, nil)
+	progress := 142
+	worked := raw.Present(s.app, "notifId", &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true, Image: "/tmp/a.png", Progress: &progress}})
+	c.Assert(worked, Equals, true)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 1)
+	hints, ok := callArgs[0].Args[6].(map[string]*dbus.Variant)
+	c.Assert(ok, Equals, true)
+	c.Check(hints["image-path"].Value, Equals, "/tmp/a.png")
+	c.Check(hints["value"].Value, Equals, int32(100))
+}
+
+func (s *RawSuite) TestPresentReplacesSameTag(c *C) {
+	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(7), uint32(8), uint32(9), uint32(7))
+	raw := Raw(endp, s.log, nil)
+	app2 := clickhelp.MustParseAppId("com.example.test_test-app-2_0")
+	f := func(tag string) *launch_helper.Notification {
+		return &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true}, Tag: tag}
+	}
+	c.Assert(raw.Present(s.app, "n1", f("one")), Equals, true)
+	c.Assert(raw.Present(s.app, "n2", f("")), Equals, true)
+	c.Assert(raw.Present(app2, "n3", f("one")), Equals, true)
+	c.Assert(raw.Present(s.app, "n4", f("one")), Equals, true)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 4)
+	reuseIds := make([]uint32, len(callArgs))
+	for i, args := range callArgs {
+		reuseIds[i] = args.Args[1].(uint32)
+	}
+	// only the last one replaces an earlier one
+	c.Check(reuseIds, DeepEquals, []uint32{0, 0, 0, 7})
+	c.Check(s.log.Captured(), Matches, `(?s).*\[n4\] replacing popup 7 for com.example.test_test-app .*`)
+}
+
+func (s *RawSuite) TestPresentForgetsTimedOutTags(c *C) {
+	defer func() { timeNow = time.Now }()
+	t0 := time.Now()
+	timeNow = func() time.Time { return t0 }
+	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(7), uint32(8), uint32(9))
+	raw := Raw(endp, s.log, nil)
+	f := func(tag string) *launch_helper.Notification {
+		return &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true}, Tag: tag}
+	}
+	c.Assert(raw.Present(s.app, "n1", f("one")), Equals, true)
+	c.Check(raw.tagged, HasLen, 1)
+	// the bubble has timed out by now
+	timeNow = func() time.Time { return t0.Add(bubbleTimeout) }
+	c.Assert(raw.Present(s.app, "n2", f("two")), Equals, true)
+	c.Check(raw.tagged, HasLen, 1)
+	c.Assert(raw.Present(s.app, "n3", f("one")), Equals, true)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 3)
+	// so it isn't replaced
+	c.Check(callArgs[2].Args[1], Equals, uint32(0))
+	c.Check(raw.tagged, HasLen, 2)
+}
+
+func (s *RawSuite) TestCloseForgetsTag(c *C) {
+	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(7))
+	raw := Raw(endp, s.log, nil)
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true, RawExpire: 1400000000}, Tag: "one"}
+	c.Assert(raw.Present(s.app, "n1", notif), Equals, true)
+	c.Check(raw.tagged, HasLen, 1)
+	c.Check(raw.Close("n1"), IsNil)
+	// the closed bubble can't be replaced
+	c.Check(raw.tagged, HasLen, 0)
+}
+
+func (s *RawSuite) TestCloseExpiring(c *C) {
+	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(7), uint32(8))
+	raw := Raw(endp, s.log, nil)
+	c.Assert(raw.Present(s.app, "n1", &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true}}), Equals, true)
+	c.Assert(raw.Present(s.app, "n2", &launch_helper.Notification{Card: &launch_helper.Card{Summary: "summary", Popup: true, RawExpire: 1400000000}}), Equals, true)
+	// only the expiring one is tracked
+	c.Check(raw.Close("n1"), IsNil)
+	c.Check(raw.Close("n2"), IsNil)
+	// and only once
+	c.Check(raw.Close("n2"), IsNil)
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(callArgs, HasLen, 3)
+	c.Check(callArgs[2].Member, Equals, "CloseNotification")
+	c.Check(callArgs[2].Args, DeepEquals, []interface{}{uint32(8)})
+}
+
 func (s *RawSuite) TestPresentNoNotificationPanics(c *C) {
 	endp := testibus.NewTestingEndpoint(nil, condition.Work(true), uint32(1))
 	raw := Raw(endp, s.log, nil)
@@ -36,6 +36,22 @@ package cnotificationsettings
 #define USE_BUBBLES_NOTIFICATIONS_KEY "use-bubbles-notifications"
 #define USE_LIST_NOTIFICATIONS_KEY "use-list-notifications"
 
+int settings_available() {
+    GSettingsSchemaSource *source = g_settings_schema_source_get_default();
+    GSettingsSchema *schema = NULL;
+
+    if (!source) {
+        return 0;
+    }
+    schema = g_settings_schema_source_lookup(source, NOTIFICATION_SETTINGS_SCHEMA_ID, TRUE);
+    if (!schema) {
+        return 0;
+    }
+
+    g_settings_schema_unref(schema);
+    return 1;
+}
+
 GSettings* get_settings() {
     // Check if GSettings schema exists
     GSettingsSchemaSource *source = g_settings_schema_source_get_default();
@@ -180,6 +196,12 @@ import (
 	"github.com/ubports/ubuntu-push/click"
 )
 
+// Available returns true if the platform has per-app notification
+// settings at all; without them the checks below allow everything
+func Available() bool {
+	return C.settings_available() != 0
+}
+
 // VibrateInSilentMode returns true if applications can use vibrations notify when in silent mode
 func VibrateInSilentMode() bool {
 	return C.vibrate_in_silent_mode() != 0
@@ -0,0 +1,62 @@
+//go:build !cgo
+// +build !cgo
+
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cnotificationsettings
+
+// Without cgo there is no access to the g_settings notification
+// settings; this behaves as when their schema is missing.
+
+import (
+	"github.com/ubports/ubuntu-push/click"
+)
+
+// Available returns false: there are no platform notification settings
+func Available() bool {
+	return false
+}
+
+// VibrateInSilentMode returns true, as with no settings
+func VibrateInSilentMode() bool {
+	return true
+}
+
+// AreNotificationsEnabled returns true, as with no settings
+func AreNotificationsEnabled(app *click.AppId) bool {
+	return true
+}
+
+// CanUseSoundsNotify returns true, as with no settings
+func CanUseSoundsNotify(app *click.AppId) bool {
+	return true
+}
+
+// CanUseVibrationsNotify returns true, as with no settings
+func CanUseVibrationsNotify(app *click.AppId) bool {
+	return true
+}
+
+// CanUseBubblesNotify returns true, as with no settings
+func CanUseBubblesNotify(app *click.AppId) bool {
+	return true
+}
+
+// CanUseListNotify returns true, as with no settings
+func CanUseListNotify(app *click.AppId) bool {
+	return true
+}
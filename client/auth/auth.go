@@ -0,0 +1,142 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package auth implements ways to obtain the device authorization
+// sent to the server on connect.
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	http13 "github.com/ubports/ubuntu-push/http13client"
+	"github.com/ubports/ubuntu-push/util"
+)
+
+var (
+	ErrNoToken   = errors.New("no authorization token")
+	ErrRequest   = errors.New("request was not accepted")
+	ErrTemporary = errors.New("remote had a temporary error")
+)
+
+// FileGetter reads a signed device token from a file.
+type FileGetter struct {
+	path  string
+	lock  sync.Mutex
+	token string
+}
+
+// NewFileGetter makes a FileGetter reading the token from path.
+func NewFileGetter(path string) *FileGetter {
+	return &FileGetter{path: path}
+}
+
+// Authorization returns the token, reading the file the first time
+// around or if refresh is true.
+func (fg *FileGetter) Authorization(refresh bool) (string, error) {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+	if fg.token != "" && !refresh {
+		return fg.token, nil
+	}
+	b, err := ioutil.ReadFile(fg.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", ErrNoToken
+	}
+	fg.token = token
+	return token, nil
+}
+
+// EndpointGetter obtains a device token from a remote endpoint.
+type EndpointGetter struct {
+	deviceId    string
+	endpointUrl string
+	cli         *http13.Client
+	lock        sync.Mutex
+	token       string
+}
+
+// NewEndpointGetter makes an EndpointGetter asking endpointUrl for
+// tokens for deviceId, through proxy (or the environment's proxy if
+// proxy is nil).
+func NewEndpointGetter(deviceId, endpointUrl string, timeout time.Duration, proxy *url.URL) *EndpointGetter {
+	return &EndpointGetter{
+		deviceId:    deviceId,
+		endpointUrl: endpointUrl,
+		cli: &http13.Client{
+			Transport: util.NewHTTPTransport(proxy, timeout),
+			Timeout:   timeout,
+		},
+	}
+}
+
+type authRequest struct {
+	DeviceId string `json:"deviceid"`
+}
+
+type authReply struct {
+	Token string `json:"token"`
+}
+
+// Authorization returns the token, asking the endpoint for one the
+// first time around or if refresh is true.
+func (eg *EndpointGetter) Authorization(refresh bool) (string, error) {
+	eg.lock.Lock()
+	defer eg.lock.Unlock()
+	if eg.token != "" && !refresh {
+		return eg.token, nil
+	}
+	body, err := json.Marshal(authRequest{eg.deviceId})
+	if err != nil {
+		return "", err
+	}
+	resp, err := eg.cli.Post(eg.endpointUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return "", ErrTemporary
+		}
+		return "", ErrRequest
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var reply authReply
+	err = json.Unmarshal(body, &reply)
+	if err != nil {
+		return "", ErrTemporary
+	}
+	if reply.Token == "" {
+		return "", ErrNoToken
+	}
+	eg.token = reply.Token
+	return reply.Token, nil
+}
@@ -0,0 +1,124 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	helpers "github.com/ubports/ubuntu-push/testing"
+)
+
+func TestAuth(t *testing.T) { TestingT(t) }
+
+type authSuite struct{}
+
+var _ = Suite(&authSuite{})
+
+func (s *authSuite) TestFileGetter(c *C) {
+	path := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(path, []byte("tok1\n"), 0600), IsNil)
+	fg := NewFileGetter(path)
+	auth, err := fg.Authorization(false)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok1")
+	c.Assert(ioutil.WriteFile(path, []byte("tok2"), 0600), IsNil)
+	// cached
+	auth, err = fg.Authorization(false)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok1")
+	// refreshed
+	auth, err = fg.Authorization(true)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok2")
+}
+
+func (s *authSuite) TestFileGetterFails(c *C) {
+	path := filepath.Join(c.MkDir(), "token")
+	_, err := NewFileGetter(path).Authorization(false)
+	c.Check(err, NotNil)
+	c.Assert(ioutil.WriteFile(path, []byte("  \n"), 0600), IsNil)
+	_, err = NewFileGetter(path).Authorization(false)
+	c.Check(err, Equals, ErrNoToken)
+}
+
+func (s *authSuite) TestEndpointGetter(c *C) {
+	n := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		c.Assert(err, IsNil)
+		c.Check(req.DeviceId, Equals, "foobar")
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"tok%d"}`, n)
+	}))
+	defer ts.Close()
+	eg := NewEndpointGetter("foobar", ts.URL, 1*time.Second, nil)
+	auth, err := eg.Authorization(false)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok1")
+	auth, err = eg.Authorization(false)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok1")
+	auth, err = eg.Authorization(true)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok2")
+}
+
+func (s *authSuite) TestEndpointGetterThroughProxy(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.String(), Equals, "http://auth.example.com/token")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"tok"}`)
+	}))
+	defer proxy.Close()
+	proxyURL := helpers.ParseURL("http://" + proxy.Listener.Addr().String())
+	eg := NewEndpointGetter("foobar", "http://auth.example.com/token", 1*time.Second, proxyURL)
+	auth, err := eg.Authorization(false)
+	c.Assert(err, IsNil)
+	c.Check(auth, Equals, "tok")
+}
+
+func (s *authSuite) TestEndpointGetterFails(c *C) {
+	for i, t := range []struct {
+		status int
+		body   string
+		err    error
+	}{
+		{http.StatusForbidden, "", ErrRequest},
+		{http.StatusServiceUnavailable, "", ErrTemporary},
+		{http.StatusOK, "garbage", ErrTemporary},
+		{http.StatusOK, `{}`, ErrNoToken},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(t.status)
+			w.Write([]byte(t.body))
+		}))
+		_, err := NewEndpointGetter("foobar", ts.URL, 1*time.Second, nil).Authorization(false)
+		c.Check(err, Equals, t.err, Commentf("iteration #%d", i))
+		ts.Close()
+	}
+}
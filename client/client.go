@@ -29,16 +29,21 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/bus/connectivity"
 	"github.com/ubports/ubuntu-push/bus/networkmanager"
 	"github.com/ubports/ubuntu-push/bus/systemimage"
 	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/client/auth"
+	"github.com/ubports/ubuntu-push/client/e2e"
 	"github.com/ubports/ubuntu-push/client/service"
 	"github.com/ubports/ubuntu-push/client/session"
 	"github.com/ubports/ubuntu-push/client/session/seenstate"
+	"github.com/ubports/ubuntu-push/client/signing"
 	"github.com/ubports/ubuntu-push/config"
 	"github.com/ubports/ubuntu-push/identifier"
 	"github.com/ubports/ubuntu-push/launch_helper"
@@ -64,15 +69,51 @@ type ClientConfig struct {
 	// Host list management
 	HostsCachingExpiryTime config.ConfigTimeDuration `json:"hosts_cache_expiry"`  // potentially refresh host list after
 	ExpectAllRepairedTime  config.ConfigTimeDuration `json:"expect_all_repaired"` // worth retrying all servers after
+	// How to reach the delivery hosts: "tls" (directly), "websocket"
+	// (only wss:// hosts), "proxy" (through the HTTP proxy at
+	// transport_proxy, given like http_proxy) or "pipe" (in memory,
+	// to a server in the same process, see SetPipe)
+	Transport      string `json:"transport"`
+	TransportProxy string `json:"transport_proxy"`
 	// The PEM-encoded server certificate
 	CertPEMFile string `json:"cert_pem_file"`
 	SessionURL      string `json:"session_url"`
 	RegistrationURL string `json:"registration_url"`
+	// Where to get the device authorization sent on connect from:
+	// either a file holding a signed device token, or an endpoint
+	// handing them out (both can be left empty)
+	AuthTokenFile string `json:"auth_token_file"`
+	AuthURL       string `json:"auth_url"`
+	// How many seen message ids to remember, and for how long
+	SeenRetentionCount int                       `json:"seen_retention_count"`
+	SeenRetentionAge   config.ConfigTimeDuration `json:"seen_retention_age"`
+	// Base64 encoded (PKIX DER) public keys that payloads must be
+	// signed with: for system broadcasts, and per app id (without
+	// version) for unicast ones. Empty means no checking.
+	BroadcastSigningKeys []string            `json:"broadcast_signing_keys"`
+	UnicastSigningKeys   map[string][]string `json:"unicast_signing_keys"`
 	// The logging level (one of "debug", "info", "error")
 	LogLevel logger.ConfigLogLevel `json:"log_level"`
 	// fallback values for simplified notification usage
 	FallbackVibration *launch_helper.Vibration `json:"fallback_vibration"`
 	FallbackSound     string                   `json:"fallback_sound"`
+	// How much (in bytes; 128KB if 0) and for how long (forever if
+	// 0) to keep messages waiting for each app to pick them up
+	MailboxMaxSize int                       `json:"mailbox_max_size"`
+	MailboxTTL     config.ConfigTimeDuration `json:"mailbox_ttl"`
+	// Daily quiet hours (local HH:MM, both empty for none), and the
+	// app ids (without version) whose notifications get through
+	QuietHoursStart      string   `json:"quiet_hours_start"`
+	QuietHoursEnd        string   `json:"quiet_hours_end"`
+	QuietHoursExceptions []string `json:"quiet_hours_exceptions"`
+	// How close together notifications for an app need to arrive
+	// to get grouped into one summarised card (0 for no grouping)
+	GroupingWindow config.ConfigTimeDuration `json:"grouping_window"`
+	// How many presented notifications to remember per app (100 if 0)
+	HistoryMaxEntries int `json:"history_max_entries"`
+	// Whether to tell the server about notifications being acted on
+	// or dismissed, for app servers that asked for it
+	ReportEvents bool `json:"report_events"`
 	// times for the poller
 	PollInterval    config.ConfigTimeDuration `json:"poll_interval"`
 	PollSettle      config.ConfigTimeDuration `json:"poll_settle"`
@@ -88,11 +129,17 @@ type PushService interface {
 	Start() error
 	// Unregister unregisters the token for appId.
 	Unregister(appId string) error
+	// ReportEvent reports the user acting on, or dismissing, a
+	// notification to the server.
+	ReportEvent(appId, nid, event, action string) error
 }
 
 type PostalService interface {
 	// Starts the service
 	Start() error
+	// PendingCounts returns the number of messages waiting in
+	// each application's mailbox.
+	PendingCounts() map[string]int
 	// Post converts a push message into a presentable notification
 	// and a postal message, presents the former and stores the
 	// latter in the application's mailbox.
@@ -124,22 +171,52 @@ type PushClient struct {
 	trackAddressees    map[string]*click.AppId
 	installedChecker   click.InstalledChecker
 	poller             poller.Poller
+	seenState          seenstate.SeenState
+	keyring            *e2e.Keyring
+	broadcastVerifier  *signing.Verifier
+	unicastVerifiers   map[string]*signing.Verifier
+	dialer             session.Dialer
+	pipe               *session.PipeDialer
+	httpProxy          *url.URL
+	mailboxes          service.Mailboxes
+	history            service.History
+	settings           service.Settings
+	dnd                *service.DoNotDisturb
 	// session-side channels
 	broadcastCh     chan *session.BroadcastNotification
 	notificationsCh chan session.AddressedNotification
 }
 
+// besideLevels returns the path of name in the directory of the
+// levels database, or "" if that isn't on disk.
+func besideLevels(leveldbPath, name string) string {
+	if leveldbPath == "" || leveldbPath == ":memory:" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(leveldbPath), name)
+}
+
 // Creates a new Ubuntu Push Notifications client-side daemon that will use
 // the given configuration file.
 func NewPushClient(configPath string, leveldbPath string) *PushClient {
+	// without a levels database on disk the keys are made anew on
+	// restart, and published again when apps register
+	keysDir := besideLevels(leveldbPath, "keys")
 	return &PushClient{
 		configPath:      configPath,
 		leveldbPath:     leveldbPath,
+		keyring:         e2e.NewKeyring(keysDir),
 		broadcastCh:     make(chan *session.BroadcastNotification),
 		notificationsCh: make(chan session.AddressedNotification),
 	}
 }
 
+// SetPipe gives the "pipe" transport the PipeDialer to connect
+// through; a server in the same process accepts from it.
+func (client *PushClient) SetPipe(pipe *session.PipeDialer) {
+	client.pipe = pipe
+}
+
 var newIdentifier = identifier.New
 
 // configure loads its configuration, and sets it up.
@@ -181,6 +258,33 @@ func (client *PushClient) configure() error {
 	client.connCh = make(chan bool, 1)
 	client.sessionConnectedCh = make(chan uint32, 1)
 
+	client.dialer, err = session.NewDialer(client.config.Transport, client.config.TransportProxy, client.pipe,
+		client.config.ConnectTimeout.TimeDuration(), client.config.ExchangeTimeout.TimeDuration())
+	if err != nil {
+		return fmt.Errorf("transport: %v", err)
+	}
+	client.httpProxy, err = util.ParseProxyURL(client.config.HTTPProxy)
+	if err != nil {
+		return fmt.Errorf("http proxy: %v", err)
+	}
+	client.dnd, err = service.NewDoNotDisturb(client.config.QuietHoursStart,
+		client.config.QuietHoursEnd, client.config.QuietHoursExceptions)
+	if err != nil {
+		return fmt.Errorf("quiet hours: %v", err)
+	}
+
+	client.broadcastVerifier, err = signing.NewVerifier(client.config.BroadcastSigningKeys)
+	if err != nil {
+		return fmt.Errorf("broadcast signing keys: %v", err)
+	}
+	client.unicastVerifiers = make(map[string]*signing.Verifier, len(client.config.UnicastSigningKeys))
+	for appId, keys := range client.config.UnicastSigningKeys {
+		client.unicastVerifiers[appId], err = signing.NewVerifier(keys)
+		if err != nil {
+			return fmt.Errorf("signing keys for %s: %v", appId, err)
+		}
+	}
+
 	if client.config.CertPEMFile != "" {
 		client.pem, err = ioutil.ReadFile(client.config.CertPEMFile)
 		if err != nil {
@@ -203,14 +307,31 @@ func (client *PushClient) deriveSessionConfig(info map[string]interface{}) sessi
 		ExchangeTimeout:        client.config.ExchangeTimeout.TimeDuration(),
 		HostsCachingExpiryTime: client.config.HostsCachingExpiryTime.TimeDuration(),
 		ExpectAllRepairedTime:  client.config.ExpectAllRepairedTime.TimeDuration(),
-		PEM:              client.pem,
-		Info:             info,
-		AddresseeChecker: client,
-		BroadcastCh:      client.broadcastCh,
-		NotificationsCh:  client.notificationsCh,
+		PEM:                    client.pem,
+		Info:                   info,
+		AddresseeChecker:       client,
+		BroadcastCh:            client.broadcastCh,
+		NotificationsCh:        client.notificationsCh,
+		AuthGetter:             client.deriveAuthGetter(),
+		BroadcastVerifier:      client.broadcastVerifier,
+		Dialer:                 client.dialer,
+		HTTPProxy:              client.httpProxy,
 	}
 }
 
+// deriveAuthGetter derives the session's authorization getter from the
+// client configuration bits; nil if none is configured.
+func (client *PushClient) deriveAuthGetter() session.AuthGetter {
+	switch {
+	case client.config.AuthTokenFile != "":
+		return auth.NewFileGetter(client.config.AuthTokenFile)
+	case client.config.AuthURL != "":
+		return auth.NewEndpointGetter(client.deviceId, client.config.AuthURL,
+			client.config.ExchangeTimeout.TimeDuration(), client.httpProxy)
+	}
+	return nil
+}
+
 // derivePushServiceSetup derives the service setup from the client configuration bits.
 func (client *PushClient) derivePushServiceSetup() (*service.PushServiceSetup, error) {
 	setup := new(service.PushServiceSetup)
@@ -221,15 +342,31 @@ func (client *PushClient) derivePushServiceSetup() (*service.PushServiceSetup, e
 	setup.RegURL = purl
 	setup.DeviceId = client.deviceId
 	setup.InstalledChecker = client.installedChecker
+	setup.Status = client.status
+	setup.KeyPublisher = client.keyring
+	setup.HTTPProxy = client.httpProxy
 	return setup, nil
 }
 
 // derivePostalServiceSetup derives the service setup from the client configuration bits.
 func (client *PushClient) derivePostalServiceSetup() *service.PostalServiceSetup {
+	var events service.EventReporter
+	if client.config.ReportEvents {
+		events = client
+	}
 	return &service.PostalServiceSetup{
 		InstalledChecker:  client.installedChecker,
 		FallbackVibration: client.config.FallbackVibration,
 		FallbackSound:     client.config.FallbackSound,
+		DeliveryTracker:   client,
+		Decrypter:         client.keyring,
+		Mailboxes:         client.mailboxes,
+		DoNotDisturb:      client.dnd,
+		GroupingWindow:    client.config.GroupingWindow.TimeDuration(),
+		History:           client.history,
+		EventReporter:     events,
+		Settings:          client.settings,
+		HTTPProxy:         client.httpProxy,
 	}
 }
 
@@ -264,7 +401,7 @@ func (client *PushClient) getDeviceId() error {
 // takeTheBus starts the connection(s) to D-Bus and sets up associated event channels
 func (client *PushClient) takeTheBus() error {
 	cs := connectivity.New(client.connectivityEndp,
-		client.config.ConnectivityConfig, client.log)
+		client.config.ConnectivityConfig, client.httpProxy, client.log)
 	go cs.Track(client.connCh)
 	util.NewAutoRedialer(client.systemImageEndp).Redial()
 	sysimg := systemimage.New(client.systemImageEndp, client.log)
@@ -301,6 +438,9 @@ func (client *PushClient) initSessionAndPoller() error {
 		return err
 	}
 	client.session = sess
+	// replay before connecting, so that what the session gets
+	// delivered again is not presented twice
+	client.replayPending()
 	sess.KeepConnection()
 	client.poller = poller.New(client.derivePollerSetup())
 	return nil
@@ -317,13 +457,173 @@ func (client *PushClient) runPoller() error {
 	return nil
 }
 
+// sessionStatus is the session part of what Status reports.
+type sessionStatus struct {
+	State           string           `json:"state"`
+	HasConnectivity bool             `json:"has_connectivity"`
+	Host            string           `json:"host"`
+	PingInterval    string           `json:"ping_interval"`
+	LastAck         *time.Time       `json:"last_ack,omitempty"`
+	RedialDelay     string           `json:"redial_delay"`
+	Levels          map[string]int64 `json:"levels"`
+}
+
+// pollerStatus is the poller part of what Status reports.
+type pollerStatus struct {
+	HasConnectivity bool       `json:"has_connectivity"`
+	NextWakeup      *time.Time `json:"next_wakeup,omitempty"`
+	HoldsWakeLock   bool       `json:"holds_wake_lock"`
+}
+
+// clientStatus is what the push service's Status method reports.
+type clientStatus struct {
+	Session *sessionStatus `json:"session"`
+	Poller  *pollerStatus  `json:"poller"`
+	Pending map[string]int `json:"pending"`
+}
+
+// status returns a snapshot of the client state, for introspection
+func (client *PushClient) status() interface{} {
+	st := &clientStatus{}
+	if client.session != nil {
+		sst := client.session.Status()
+		st.Session = &sessionStatus{
+			State:           sst.State.String(),
+			HasConnectivity: sst.HasConnectivity,
+			Host:            sst.Host,
+			PingInterval:    sst.PingInterval.String(),
+			RedialDelay:     sst.RedialDelay.String(),
+			Levels:          sst.Levels,
+		}
+		if !sst.LastAck.IsZero() {
+			st.Session.LastAck = &sst.LastAck
+		}
+	}
+	if client.poller != nil {
+		pst := client.poller.Status()
+		st.Poller = &pollerStatus{
+			HasConnectivity: pst.HasConnectivity,
+			HoldsWakeLock:   pst.HoldsWakeLock,
+		}
+		if !pst.NextWakeup.IsZero() {
+			st.Poller.NextWakeup = &pst.NextWakeup
+		}
+	}
+	if client.postalService != nil {
+		st.Pending = client.postalService.PendingCounts()
+	}
+	return st
+}
+
 // seenStateFactory returns a SeenState for the session
 func (client *PushClient) seenStateFactory() (seenstate.SeenState, error) {
+	var err error
+	retention := client.deriveRetention()
 	if client.leveldbPath == "" {
-		return seenstate.NewSeenState()
+		client.seenState, err = seenstate.NewSeenStateRetaining(retention)
 	} else {
-		return seenstate.NewSqliteSeenState(client.leveldbPath)
+		client.seenState, err = seenstate.NewSqliteSeenStateRetaining(client.leveldbPath, retention)
+	}
+	return client.seenState, err
+}
+
+// deriveRetention returns the seen messages retention from the config
+func (client *PushClient) deriveRetention() seenstate.Retention {
+	retention := seenstate.DefaultRetention
+	retention.MaxCount = client.config.SeenRetentionCount
+	retention.MaxAge = client.config.SeenRetentionAge.TimeDuration()
+	return retention
+}
+
+// historyFactory returns the History for the postal service; without
+// a levels database on disk it starts empty on every restart.
+func (client *PushClient) historyFactory() (service.History, error) {
+	path := besideLevels(client.leveldbPath, "history.db")
+	if path == "" {
+		return service.NewMemHistory(client.config.HistoryMaxEntries), nil
 	}
+	return service.NewSqliteHistory(path, client.config.HistoryMaxEntries)
+}
+
+// settingsFactory returns the Settings for the postal service;
+// without a levels database on disk apps are back to the defaults on
+// every restart.
+func (client *PushClient) settingsFactory() (service.Settings, error) {
+	path := besideLevels(client.leveldbPath, "settings.db")
+	if path == "" {
+		return service.NewMemSettings(), nil
+	}
+	return service.NewSqliteSettings(path)
+}
+
+// mailboxesFactory returns the Mailboxes for the postal service;
+// without a levels database on disk they are emptied on every
+// restart.
+func (client *PushClient) mailboxesFactory() (service.Mailboxes, error) {
+	limits := service.MailboxLimits{
+		MaxSize: client.config.MailboxMaxSize,
+		TTL:     client.config.MailboxTTL.TimeDuration(),
+	}
+	path := besideLevels(client.leveldbPath, "mailboxes.db")
+	if path == "" {
+		return service.NewMemMailboxes(limits), nil
+	}
+	return service.NewSqliteMailboxes(path, limits)
+}
+
+// Delivered drops a notification that made it through the postal
+// service from the inbox.
+func (client *PushClient) Delivered(nid string) {
+	if client.seenState == nil {
+		return
+	}
+	err := client.seenState.DropNotification(nid)
+	if err != nil {
+		client.log.Errorf("unable to drop %s from the inbox: %v", nid, err)
+	}
+}
+
+// ReportEvent tells the server, in the background, about notification
+// nid of appId being acted on or dismissed.
+func (client *PushClient) ReportEvent(appId, nid, event, action string) {
+	if client.pushService == nil {
+		return
+	}
+	go func() {
+		err := client.pushService.ReportEvent(appId, nid, event, action)
+		if err != nil {
+			client.log.Errorf("unable to report %s on %s for %s: %v", event, nid, appId, err)
+		}
+	}()
+}
+
+// replayPending posts the notifications left in the inbox, i.e. the
+// ones acked to the server that didn't get delivered last time around.
+func (client *PushClient) replayPending() error {
+	if client.seenState == nil {
+		return nil
+	}
+	pending, err := client.seenState.PendingNotifications()
+	if err != nil {
+		client.log.Errorf("unable to get pending notifications: %v", err)
+		return nil
+	}
+	for i := range pending {
+		notif := &pending[i]
+		app, err := click.ParseAndVerifyAppId(notif.AppId, client.installedChecker)
+		if err != nil {
+			client.log.Debugf("dropping pending notification %#v for app id %#v: %v", notif.MsgId, notif.AppId, err)
+			client.Delivered(notif.MsgId)
+			continue
+		}
+		payload, ok := client.verifyUnicast(app, notif)
+		if !ok {
+			continue
+		}
+		client.postalService.Post(app, notif.MsgId, payload)
+		client.log.Debugf("replayed pending notification %s for %s.", notif.MsgId, notif.AppId)
+	}
+	return nil
 }
 
 // StartAddresseeBatch starts a batch of checks for addressees.
@@ -424,11 +724,32 @@ func (client *PushClient) handleBroadcastNotification(msg *session.BroadcastNoti
 func (client *PushClient) handleUnicastNotification(anotif session.AddressedNotification) error {
 	app := anotif.To
 	msg := anotif.Notification
-	client.postalService.Post(app, msg.MsgId, msg.Payload)
+	payload, ok := client.verifyUnicast(app, msg)
+	if !ok {
+		return nil
+	}
+	client.postalService.Post(app, msg.MsgId, payload)
 	client.log.Debugf("posted unicast notification %s for %s.", msg.MsgId, msg.AppId)
 	return nil
 }
 
+// verifyUnicast checks the notification is signed if its app wants
+// them to be, returning the payload to post. Unverifiable ones get
+// dropped.
+func (client *PushClient) verifyUnicast(app *click.AppId, msg *protocol.Notification) (json.RawMessage, bool) {
+	verifier := client.unicastVerifiers[app.Base()]
+	if verifier == nil {
+		return msg.Payload, true
+	}
+	payload, err := verifier.Verify(msg.Payload, app.Base(), msg.MsgId)
+	if err != nil {
+		client.log.Errorf("dropping unverifiable notification %s for %s: %v", msg.MsgId, msg.AppId, err)
+		client.Delivered(msg.MsgId)
+		return nil, false
+	}
+	return payload, true
+}
+
 func (client *PushClient) handeConnNotification(conn bool) {
 	client.session.HasConnectivity(conn)
 	client.poller.HasConnectivity(conn)
@@ -490,6 +811,21 @@ func (client *PushClient) startPushService() error {
 }
 
 func (client *PushClient) setupPostalService() error {
+	mailboxes, err := client.mailboxesFactory()
+	if err != nil {
+		return fmt.Errorf("mailboxes: %v", err)
+	}
+	client.mailboxes = mailboxes
+	history, err := client.historyFactory()
+	if err != nil {
+		return fmt.Errorf("history: %v", err)
+	}
+	client.history = history
+	settings, err := client.settingsFactory()
+	if err != nil {
+		return fmt.Errorf("settings: %v", err)
+	}
+	client.settings = settings
 	setup := client.derivePostalServiceSetup()
 	client.postalService = service.NewPostalService(setup, client.log)
 	return nil
@@ -0,0 +1,256 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package e2e implements end-to-end encryption of unicast payloads,
+// so that only the device can read what app servers send.
+//
+// Each app gets its own P-256 key pair; the public half gets
+// published at registration time, and app servers look it up with
+// the token through the server's /publickey endpoint. They encrypt
+// payloads with an ephemeral ECDH exchange against it, deriving an
+// AES-256-GCM key, and send
+//
+//	{"e2e": {"key": <ephemeral public key>, "nonce": <nonce>, "data": <ciphertext>}}
+//
+// with the values base64 encoded (standard encoding, padded).
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ubports/ubuntu-push/nih"
+)
+
+var (
+	ErrBadKey     = errors.New("bad public key")
+	ErrNoKey      = errors.New("no key for app")
+	ErrBadPayload = errors.New("bad encrypted payload")
+)
+
+var curve = elliptic.P256()
+
+// encrypted is the wire form of an encrypted payload.
+type encrypted struct {
+	Key   []byte `json:"key"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+type envelope struct {
+	E2E *encrypted `json:"e2e"`
+}
+
+// Keyring holds the per-app private keys, persisting them in a
+// directory (if one is given).
+type Keyring struct {
+	dir  string
+	lock sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+}
+
+// NewKeyring makes a Keyring keeping its keys in dir. With dir empty
+// keys are only kept in memory.
+func NewKeyring(dir string) *Keyring {
+	return &Keyring{dir: dir, keys: make(map[string]*ecdsa.PrivateKey)}
+}
+
+func (kr *Keyring) keyPath(appId string) string {
+	return filepath.Join(kr.dir, string(nih.Quote([]byte(appId)))+".pem")
+}
+
+// load gets the key for appId from memory or disk; nil if none.
+func (kr *Keyring) load(appId string) (*ecdsa.PrivateKey, error) {
+	key := kr.keys[appId]
+	if key != nil || kr.dir == "" {
+		return key, nil
+	}
+	b, err := ioutil.ReadFile(kr.keyPath(appId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", kr.keyPath(appId))
+	}
+	key, err = x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	kr.keys[appId] = key
+	return key, nil
+}
+
+func (kr *Keyring) save(appId string, key *ecdsa.PrivateKey) error {
+	if kr.dir == "" {
+		return nil
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(kr.dir, 0700)
+	if err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return ioutil.WriteFile(kr.keyPath(appId), b, 0600)
+}
+
+// PublicKey returns the base64 encoded public key for appId,
+// generating a key pair if there wasn't one.
+func (kr *Keyring) PublicKey(appId string) (string, error) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	key, err := kr.load(appId)
+	if err != nil {
+		return "", fmt.Errorf("cannot load key: %v", err)
+	}
+	if key == nil {
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return "", fmt.Errorf("cannot generate key: %v", err)
+		}
+		err = kr.save(appId, key)
+		if err != nil {
+			return "", fmt.Errorf("cannot save key: %v", err)
+		}
+		kr.keys[appId] = key
+	}
+	pub := elliptic.Marshal(curve, key.X, key.Y)
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Forget drops the key for appId.
+func (kr *Keyring) Forget(appId string) error {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	delete(kr.keys, appId)
+	if kr.dir == "" {
+		return nil
+	}
+	err := os.Remove(kr.keyPath(appId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IsEncrypted returns whether payload is an encrypted one.
+func IsEncrypted(payload json.RawMessage) bool {
+	var env envelope
+	return json.Unmarshal(payload, &env) == nil && env.E2E != nil
+}
+
+// Decrypt returns the plain payload for appId. Payloads that weren't
+// encrypted are returned as they are.
+func (kr *Keyring) Decrypt(appId string, payload json.RawMessage) (json.RawMessage, error) {
+	var env envelope
+	if json.Unmarshal(payload, &env) != nil || env.E2E == nil {
+		// not for us
+		return payload, nil
+	}
+	kr.lock.Lock()
+	key, err := kr.load(appId)
+	kr.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load key: %v", err)
+	}
+	if key == nil {
+		return nil, ErrNoKey
+	}
+	x, y := elliptic.Unmarshal(curve, env.E2E.Key)
+	if x == nil {
+		return nil, ErrBadPayload
+	}
+	gcm, err := newGCM(key.D, x, y, env.E2E.Key, elliptic.Marshal(curve, key.X, key.Y))
+	if err != nil {
+		return nil, err
+	}
+	if len(env.E2E.Nonce) != gcm.NonceSize() {
+		return nil, ErrBadPayload
+	}
+	plain, err := gcm.Open(nil, env.E2E.Nonce, env.E2E.Data, nil)
+	if err != nil {
+		return nil, ErrBadPayload
+	}
+	return json.RawMessage(plain), nil
+}
+
+// Encrypt encrypts payload to the given base64 encoded public key,
+// as an app server would.
+func Encrypt(publicKey string, payload []byte) (json.RawMessage, error) {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	x, y := elliptic.Unmarshal(curve, pub)
+	if x == nil {
+		return nil, ErrBadKey
+	}
+	eph, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephPub := elliptic.Marshal(curve, eph.X, eph.Y)
+	gcm, err := newGCM(eph.D, x, y, ephPub, pub)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	data := gcm.Seal(nil, nonce, payload, nil)
+	return json.Marshal(envelope{&encrypted{ephPub, nonce, data}})
+}
+
+// newGCM does the ECDH between priv and (x, y) and derives the
+// AES-GCM key from the shared secret and both public keys.
+func newGCM(priv, x, y *big.Int, ephPub, recipientPub []byte) (cipher.AEAD, error) {
+	sx, _ := curve.ScalarMult(x, y, priv.Bytes())
+	h := sha256.New()
+	shared := make([]byte, (curve.Params().BitSize+7)/8)
+	sxb := sx.Bytes()
+	copy(shared[len(shared)-len(sxb):], sxb)
+	h.Write(shared)
+	h.Write(ephPub)
+	h.Write(recipientPub)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,135 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package e2e
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestE2E(t *testing.T) { TestingT(t) }
+
+type e2eSuite struct{}
+
+var _ = Suite(&e2eSuite{})
+
+const appId = "com.example.test_test-app"
+
+func (s *e2eSuite) TestRoundTrip(c *C) {
+	kr := NewKeyring("")
+	pub, err := kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	// stable
+	pub2, err := kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	c.Check(pub2, Equals, pub)
+
+	enc, err := Encrypt(pub, []byte(`{"secret":42}`))
+	c.Assert(err, IsNil)
+	c.Check(string(enc), Not(Matches), ".*secret.*")
+	plain, err := kr.Decrypt(appId, enc)
+	c.Assert(err, IsNil)
+	c.Check(string(plain), Equals, `{"secret":42}`)
+}
+
+func (s *e2eSuite) TestPlainPassesThrough(c *C) {
+	kr := NewKeyring("")
+	payload := json.RawMessage(`{"a":1}`)
+	plain, err := kr.Decrypt(appId, payload)
+	c.Assert(err, IsNil)
+	c.Check(string(plain), Equals, `{"a":1}`)
+	plain, err = kr.Decrypt(appId, json.RawMessage(`[1]`))
+	c.Assert(err, IsNil)
+	c.Check(string(plain), Equals, `[1]`)
+}
+
+func (s *e2eSuite) TestIsEncrypted(c *C) {
+	kr := NewKeyring("")
+	pub, err := kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	enc, err := Encrypt(pub, []byte(`{"secret":42}`))
+	c.Assert(err, IsNil)
+	c.Check(IsEncrypted(enc), Equals, true)
+	c.Check(IsEncrypted(json.RawMessage(`{"a":1}`)), Equals, false)
+	c.Check(IsEncrypted(json.RawMessage(`[1]`)), Equals, false)
+}
+
+func (s *e2eSuite) TestDecryptFails(c *C) {
+	kr := NewKeyring("")
+	other := NewKeyring("")
+	pub, err := other.PublicKey(appId)
+	c.Assert(err, IsNil)
+	enc, err := Encrypt(pub, []byte(`{}`))
+	c.Assert(err, IsNil)
+	// no key yet
+	_, err = kr.Decrypt(appId, enc)
+	c.Check(err, Equals, ErrNoKey)
+	// the wrong key
+	_, err = kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	_, err = kr.Decrypt(appId, enc)
+	c.Check(err, Equals, ErrBadPayload)
+	// garbage
+	_, err = kr.Decrypt(appId, json.RawMessage(`{"e2e":{"key":"AAAA"}}`))
+	c.Check(err, Equals, ErrBadPayload)
+}
+
+func (s *e2eSuite) TestEncryptBadKey(c *C) {
+	_, err := Encrypt("!!", nil)
+	c.Check(err, Equals, ErrBadKey)
+	_, err = Encrypt("AAAA", nil)
+	c.Check(err, Equals, ErrBadKey)
+}
+
+func (s *e2eSuite) TestKeysPersist(c *C) {
+	dir := filepath.Join(c.MkDir(), "keys")
+	pub, err := NewKeyring(dir).PublicKey(appId)
+	c.Assert(err, IsNil)
+	fi, err := os.Stat(NewKeyring(dir).keyPath(appId))
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	enc, err := Encrypt(pub, []byte(`"hi"`))
+	c.Assert(err, IsNil)
+	kr := NewKeyring(dir)
+	plain, err := kr.Decrypt(appId, enc)
+	c.Assert(err, IsNil)
+	c.Check(string(plain), Equals, `"hi"`)
+	pub2, err := kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	c.Check(pub2, Equals, pub)
+}
+
+func (s *e2eSuite) TestForget(c *C) {
+	dir := c.MkDir()
+	kr := NewKeyring(dir)
+	pub, err := kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	c.Assert(kr.Forget(appId), IsNil)
+	_, err = os.Stat(kr.keyPath(appId))
+	c.Check(os.IsNotExist(err), Equals, true)
+	// forgetting twice is fine
+	c.Assert(kr.Forget(appId), IsNil)
+	// and a new key gets made afterwards
+	pub2, err := kr.PublicKey(appId)
+	c.Assert(err, IsNil)
+	c.Check(pub2, Not(Equals), pub)
+}
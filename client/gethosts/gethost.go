@@ -23,10 +23,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/ubports/ubuntu-push/external/murmur3"
 	http13 "github.com/ubports/ubuntu-push/http13client"
+	"github.com/ubports/ubuntu-push/util"
 )
 
 // GetHost implements finding hosts to connect to consulting a remote endpoint providing a hash of the device identifier.
@@ -36,14 +38,15 @@ type GetHost struct {
 	cli         *http13.Client
 }
 
-// New makes a GetHost.
-func New(deviceId, endpointUrl string, timeout time.Duration) *GetHost {
+// New makes a GetHost. Requests go through proxy, or the
+// environment's proxy if proxy is nil.
+func New(deviceId, endpointUrl string, timeout time.Duration, proxy *url.URL) *GetHost {
 	hash := murmur3.Sum64([]byte(deviceId))
 	return &GetHost{
 		hash:        fmt.Sprintf("%x", hash),
 		endpointUrl: endpointUrl,
 		cli: &http13.Client{
-			Transport: &http13.Transport{TLSHandshakeTimeout: timeout},
+			Transport: util.NewHTTPTransport(proxy, timeout),
 			Timeout:   timeout,
 		},
 	}
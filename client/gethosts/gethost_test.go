@@ -27,6 +27,7 @@ import (
 	. "launchpad.net/gocheck"
 
 	"github.com/ubports/ubuntu-push/external/murmur3"
+	helpers "github.com/ubports/ubuntu-push/testing"
 )
 
 func TestGetHosts(t *testing.T) { TestingT(t) }
@@ -36,11 +37,26 @@ type getHostsSuite struct{}
 var _ = Suite(&getHostsSuite{})
 
 func (s *getHostsSuite) TestNew(c *C) {
-	gh := New("foobar", "http://where/hosts", 10*time.Second)
+	gh := New("foobar", "http://where/hosts", 10*time.Second, nil)
 	c.Check(gh.hash, Equals, fmt.Sprintf("%x", murmur3.Sum64([]byte("foobar"))))
 	c.Check(gh.endpointUrl, Equals, "http://where/hosts")
 }
 
+func (s *getHostsSuite) TestGetThroughProxy(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Host, Equals, "hosts.example.com")
+		c.Check(r.Header.Get("Proxy-Authorization"), Equals, "Basic dXNlcjpwYXNz")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"domain":"example.com","hosts":["http://h"]}`))
+	}))
+	defer proxy.Close()
+	proxyURL := helpers.ParseURL("http://user:pass@" + proxy.Listener.Addr().String())
+	gh := New("foobar", "http://hosts.example.com/hosts", 1*time.Second, proxyURL)
+	res, err := gh.Get()
+	c.Assert(err, IsNil)
+	c.Check(*res, DeepEquals, Host{Domain: "example.com", Hosts: []string{"http://h"}})
+}
+
 func (s *getHostsSuite) TestGet(c *C) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		x := r.FormValue("h")
@@ -55,7 +71,7 @@ func (s *getHostsSuite) TestGet(c *C) {
 		w.Write(b)
 	}))
 	defer ts.Close()
-	gh := New("foobar", ts.URL, 1*time.Second)
+	gh := New("foobar", ts.URL, 1*time.Second, nil)
 	res, err := gh.Get()
 	c.Assert(err, IsNil)
 	c.Check(*res, DeepEquals,
@@ -72,7 +88,7 @@ func (s *getHostsSuite) TestGetTimeout(c *C) {
 		<-started
 		ts.Close()
 	}()
-	gh := New("foobar", ts.URL, 500*time.Millisecond)
+	gh := New("foobar", ts.URL, 500*time.Millisecond, nil)
 	_, err := gh.Get()
 	c.Check(err, ErrorMatches, ".*closed.*")
 }
@@ -85,7 +101,7 @@ func (s *getHostsSuite) TestGetErrorScenarios(c *C) {
 		fmt.Fprintf(w, "%s", <-body)
 	}))
 	defer ts.Close()
-	gh := New("foobar", ts.URL, 1*time.Second)
+	gh := New("foobar", ts.URL, 1*time.Second, nil)
 	scenario := func(st int, bdy string, expectedErr error) {
 		status <- st
 		body <- bdy
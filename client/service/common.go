@@ -53,6 +53,7 @@ var (
 	ErrBadArgType     = errors.New("bad argument type")
 	ErrBadJSON        = errors.New("bad json data")
 	ErrAppIdMismatch  = errors.New("package must be prefix of app id")
+	ErrNoSuchMessage  = errors.New("no such message")
 )
 
 // IsRunning() returns whether the service's state is StateRunning
@@ -0,0 +1,146 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/launch_helper"
+)
+
+var ErrHalfQuietHours = errors.New("quiet hours need both a start and an end")
+
+// DoNotDisturb is the policy on when notifications shouldn't make
+// noise or pop up: while switched on, or during the daily quiet
+// hours. Some apps can be let through, as can notifications with
+// high priority.
+type DoNotDisturb struct {
+	lock sync.Mutex
+	on   bool
+	// the quiet hours, as time since midnight; equal if there are none
+	start, end time.Duration
+	// app ids (without version) let through
+	exceptions map[string]bool
+	// hook for testing
+	now func() time.Time
+}
+
+// NewDoNotDisturb makes a DoNotDisturb with the given quiet hours (see
+// SetQuietHours), letting the excepted apps (app ids without version)
+// through.
+func NewDoNotDisturb(start, end string, exceptions []string) (*DoNotDisturb, error) {
+	dnd := &DoNotDisturb{
+		exceptions: make(map[string]bool, len(exceptions)),
+		now:        time.Now,
+	}
+	for _, appId := range exceptions {
+		dnd.exceptions[appId] = true
+	}
+	err := dnd.SetQuietHours(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return dnd, nil
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day %#v", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// SetQuietHours sets the daily quiet hours, from start to end (local
+// times as HH:MM; they can span midnight). With both empty there are
+// no quiet hours.
+func (dnd *DoNotDisturb) SetQuietHours(start, end string) error {
+	if (start == "") != (end == "") {
+		return ErrHalfQuietHours
+	}
+	var startTod, endTod time.Duration
+	if start != "" {
+		var err error
+		startTod, err = parseTimeOfDay(start)
+		if err != nil {
+			return err
+		}
+		endTod, err = parseTimeOfDay(end)
+		if err != nil {
+			return err
+		}
+	}
+	dnd.lock.Lock()
+	defer dnd.lock.Unlock()
+	dnd.start, dnd.end = startTod, endTod
+	return nil
+}
+
+// Set switches do-not-disturb on or off, regardless of quiet hours.
+func (dnd *DoNotDisturb) Set(on bool) {
+	dnd.lock.Lock()
+	defer dnd.lock.Unlock()
+	dnd.on = on
+}
+
+// Active returns whether do-not-disturb is in force now.
+func (dnd *DoNotDisturb) Active() bool {
+	dnd.lock.Lock()
+	defer dnd.lock.Unlock()
+	if dnd.on {
+		return true
+	}
+	if dnd.start == dnd.end {
+		return false
+	}
+	now := dnd.now()
+	tod := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if dnd.start < dnd.end {
+		return tod >= dnd.start && tod < dnd.end
+	}
+	// spanning midnight
+	return tod >= dnd.start || tod < dnd.end
+}
+
+// Suppresses returns whether the notification for app should be kept
+// quiet.
+func (dnd *DoNotDisturb) Suppresses(app *click.AppId, notif *launch_helper.Notification) bool {
+	if notif.Priority == launch_helper.PriorityHigh || dnd.exceptions[app.Base()] {
+		return false
+	}
+	return dnd.Active()
+}
+
+// quieted returns a copy of notif that makes no sound, doesn't
+// vibrate and doesn't pop up; persistent cards and emblem counters
+// are left alone.
+func quieted(notif *launch_helper.Notification) *launch_helper.Notification {
+	quiet := *notif
+	quiet.RawSound = nil
+	quiet.RawVibration = nil
+	if notif.Card != nil {
+		card := *notif.Card
+		card.Popup = false
+		quiet.Card = &card
+	}
+	return &quiet
+}
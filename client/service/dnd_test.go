@@ -0,0 +1,157 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	"github.com/ubports/ubuntu-push/launch_helper"
+)
+
+type dndSuite struct{}
+
+var _ = Suite(&dndSuite{})
+
+// at returns a clock stuck at the given time of day
+func at(hour, min int) func() time.Time {
+	return func() time.Time {
+		return time.Date(2014, 6, 1, hour, min, 0, 0, time.Local)
+	}
+}
+
+func (s *dndSuite) TestNewNoQuietHours(c *C) {
+	dnd, err := NewDoNotDisturb("", "", nil)
+	c.Assert(err, IsNil)
+	for _, h := range []int{0, 7, 12, 23} {
+		dnd.now = at(h, 0)
+		c.Check(dnd.Active(), Equals, false, Commentf("at %d", h))
+	}
+}
+
+func (s *dndSuite) TestNewFails(c *C) {
+	_, err := NewDoNotDisturb("22:00", "", nil)
+	c.Check(err, Equals, ErrHalfQuietHours)
+	_, err = NewDoNotDisturb("", "07:00", nil)
+	c.Check(err, Equals, ErrHalfQuietHours)
+	_, err = NewDoNotDisturb("22:00", "7am", nil)
+	c.Check(err, ErrorMatches, `bad time of day "7am"`)
+	_, err = NewDoNotDisturb("25:00", "07:00", nil)
+	c.Check(err, ErrorMatches, `bad time of day "25:00"`)
+}
+
+func (s *dndSuite) TestQuietHours(c *C) {
+	dnd, err := NewDoNotDisturb("13:00", "14:30", nil)
+	c.Assert(err, IsNil)
+	for _, t := range []struct {
+		hour, min int
+		active    bool
+	}{
+		{12, 59, false},
+		{13, 0, true},
+		{14, 29, true},
+		{14, 30, false},
+		{23, 0, false},
+	} {
+		dnd.now = at(t.hour, t.min)
+		c.Check(dnd.Active(), Equals, t.active, Commentf("at %02d:%02d", t.hour, t.min))
+	}
+}
+
+func (s *dndSuite) TestQuietHoursSpanningMidnight(c *C) {
+	dnd, err := NewDoNotDisturb("22:00", "07:00", nil)
+	c.Assert(err, IsNil)
+	for _, t := range []struct {
+		hour, min int
+		active    bool
+	}{
+		{21, 59, false},
+		{22, 0, true},
+		{0, 0, true},
+		{6, 59, true},
+		{7, 0, false},
+		{12, 0, false},
+	} {
+		dnd.now = at(t.hour, t.min)
+		c.Check(dnd.Active(), Equals, t.active, Commentf("at %02d:%02d", t.hour, t.min))
+	}
+}
+
+func (s *dndSuite) TestSetQuietHours(c *C) {
+	dnd, err := NewDoNotDisturb("", "", nil)
+	c.Assert(err, IsNil)
+	dnd.now = at(23, 0)
+	c.Assert(dnd.SetQuietHours("22:00", "07:00"), IsNil)
+	c.Check(dnd.Active(), Equals, true)
+	// a bad one leaves things as they were
+	c.Check(dnd.SetQuietHours("22:00", ""), Equals, ErrHalfQuietHours)
+	c.Check(dnd.Active(), Equals, true)
+	c.Assert(dnd.SetQuietHours("", ""), IsNil)
+	c.Check(dnd.Active(), Equals, false)
+}
+
+func (s *dndSuite) TestSet(c *C) {
+	dnd, err := NewDoNotDisturb("22:00", "07:00", nil)
+	c.Assert(err, IsNil)
+	dnd.now = at(12, 0)
+	c.Check(dnd.Active(), Equals, false)
+	dnd.Set(true)
+	c.Check(dnd.Active(), Equals, true)
+	dnd.Set(false)
+	c.Check(dnd.Active(), Equals, false)
+}
+
+func (s *dndSuite) TestSuppresses(c *C) {
+	dnd, err := NewDoNotDisturb("", "", []string{"com.example.vip_vip"})
+	c.Assert(err, IsNil)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	vip := clickhelp.MustParseAppId("com.example.vip_vip_1.0")
+	notif := &launch_helper.Notification{}
+	urgent := &launch_helper.Notification{Priority: launch_helper.PriorityHigh}
+
+	c.Check(dnd.Suppresses(app, notif), Equals, false)
+	dnd.Set(true)
+	c.Check(dnd.Suppresses(app, notif), Equals, true)
+	c.Check(dnd.Suppresses(app, urgent), Equals, false)
+	c.Check(dnd.Suppresses(vip, notif), Equals, false)
+}
+
+func (s *dndSuite) TestQuieted(c *C) {
+	card := &launch_helper.Card{Summary: "hello", Popup: true, Persist: true}
+	emb := &launch_helper.EmblemCounter{Count: 2, Visible: true}
+	notif := &launch_helper.Notification{
+		Card:          card,
+		EmblemCounter: emb,
+		RawSound:      json.RawMessage(`true`),
+		RawVibration:  json.RawMessage(`true`),
+		Tag:           "a-tag",
+	}
+	quiet := quieted(notif)
+	c.Check(quiet.RawSound, IsNil)
+	c.Check(quiet.RawVibration, IsNil)
+	c.Check(quiet.Card, DeepEquals, &launch_helper.Card{Summary: "hello", Popup: false, Persist: true})
+	c.Check(quiet.EmblemCounter, Equals, emb)
+	c.Check(quiet.Tag, Equals, "a-tag")
+	// the original is untouched
+	c.Check(card.Popup, Equals, true)
+	c.Check(string(notif.RawSound), Equals, "true")
+	// no card is fine too
+	c.Check(quieted(&launch_helper.Notification{}).Card, IsNil)
+}
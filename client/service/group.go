@@ -0,0 +1,88 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ubports/ubuntu-push/click"
+	"github.com/ubports/ubuntu-push/launch_helper"
+)
+
+// a notifGroup is a burst of notifications for an app and tag
+type notifGroup struct {
+	// the notification id of the card standing for the group
+	nid   string
+	count int
+	last  time.Time
+}
+
+// grouper collapses bursts of notifications with cards for the same
+// app and tag, within window of each other, into one summarised card.
+// It's only used from messageHandler, so under the service lock.
+type grouper struct {
+	window time.Duration
+	groups map[string]*notifGroup
+	// hook for testing
+	now func() time.Time
+}
+
+// newGrouper makes a grouper with the given window; a zero window
+// means no grouping.
+func newGrouper(window time.Duration) *grouper {
+	return &grouper{
+		window: window,
+		groups: make(map[string]*notifGroup),
+		now:    time.Now,
+	}
+}
+
+// group returns what to present instead of notif (with id nid) for
+// app, and the id of the summarised card it replaces, if any.
+func (g *grouper) group(app *click.AppId, nid string, notif *launch_helper.Notification) (*launch_helper.Notification, string) {
+	if g.window == 0 || notif.Card == nil {
+		return notif, ""
+	}
+	now := g.now()
+	for key, grp := range g.groups {
+		if now.Sub(grp.last) >= g.window {
+			delete(g.groups, key)
+		}
+	}
+	key := app.Base() + "\x00" + notif.Tag
+	grp := g.groups[key]
+	if grp == nil {
+		g.groups[key] = &notifGroup{nid: nid, count: 1, last: now}
+		return notif, ""
+	}
+	replaced := grp.nid
+	grp.nid = nid
+	grp.count++
+	grp.last = now
+	return summarised(notif, grp.count), replaced
+}
+
+// summarised returns a quiet copy of notif whose card stands for the
+// whole group of count notifications; the latest one's summary
+// becomes the body.
+func summarised(notif *launch_helper.Notification, count int) *launch_helper.Notification {
+	summary := quieted(notif)
+	summary.Card.Body = summary.Card.Summary
+	summary.Card.Summary = fmt.Sprintf("%d new messages", count)
+	return summary
+}
@@ -0,0 +1,128 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	"github.com/ubports/ubuntu-push/launch_helper"
+)
+
+type groupSuite struct {
+	t0  time.Time
+	now time.Time
+}
+
+var _ = Suite(&groupSuite{})
+
+func (s *groupSuite) SetUpTest(c *C) {
+	s.t0 = time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.now = s.t0
+}
+
+func (s *groupSuite) newGrouper(window time.Duration) *grouper {
+	g := newGrouper(window)
+	g.now = func() time.Time { return s.now }
+	return g
+}
+
+func cardNotif(summary, tag string) *launch_helper.Notification {
+	return &launch_helper.Notification{
+		Card:     &launch_helper.Card{Summary: summary, Popup: true},
+		RawSound: json.RawMessage(`true`),
+		Tag:      tag,
+	}
+}
+
+func (s *groupSuite) TestGroupsBurst(c *C) {
+	g := s.newGrouper(time.Minute)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+
+	n1 := cardNotif("one", "")
+	notif, replaced := g.group(app, "n1", n1)
+	c.Check(notif, Equals, n1)
+	c.Check(replaced, Equals, "")
+
+	s.now = s.t0.Add(10 * time.Second)
+	notif, replaced = g.group(app, "n2", cardNotif("two", ""))
+	c.Check(replaced, Equals, "n1")
+	c.Check(notif.Card.Summary, Equals, "2 new messages")
+	c.Check(notif.Card.Body, Equals, "two")
+	c.Check(notif.Card.Popup, Equals, false)
+	c.Check(notif.RawSound, IsNil)
+
+	// the window is from the latest one
+	s.now = s.t0.Add(65 * time.Second)
+	notif, replaced = g.group(app, "n3", cardNotif("three", ""))
+	c.Check(replaced, Equals, "n2")
+	c.Check(notif.Card.Summary, Equals, "3 new messages")
+
+	// and then it's over
+	s.now = s.t0.Add(3 * time.Minute)
+	n4 := cardNotif("four", "")
+	notif, replaced = g.group(app, "n4", n4)
+	c.Check(notif, Equals, n4)
+	c.Check(replaced, Equals, "")
+}
+
+func (s *groupSuite) TestGroupsPerAppAndTag(c *C) {
+	g := s.newGrouper(time.Minute)
+	app1 := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	app1v2 := clickhelp.MustParseAppId("com.example.test_test-app_1")
+	app2 := clickhelp.MustParseAppId("com.example.other_other-app_0")
+
+	_, replaced := g.group(app1, "n1", cardNotif("one", "a"))
+	c.Check(replaced, Equals, "")
+	_, replaced = g.group(app1, "n2", cardNotif("two", "b"))
+	c.Check(replaced, Equals, "")
+	_, replaced = g.group(app2, "n3", cardNotif("three", "a"))
+	c.Check(replaced, Equals, "")
+	_, replaced = g.group(app1v2, "n4", cardNotif("four", "a"))
+	c.Check(replaced, Equals, "n1")
+}
+
+func (s *groupSuite) TestNoGrouping(c *C) {
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	// with no window
+	g := s.newGrouper(0)
+	g.group(app, "n1", cardNotif("one", ""))
+	n2 := cardNotif("two", "")
+	notif, replaced := g.group(app, "n2", n2)
+	c.Check(notif, Equals, n2)
+	c.Check(replaced, Equals, "")
+	// or with no card
+	g = s.newGrouper(time.Minute)
+	emb := &launch_helper.Notification{EmblemCounter: &launch_helper.EmblemCounter{Count: 1}}
+	g.group(app, "n1", emb)
+	notif, replaced = g.group(app, "n2", emb)
+	c.Check(notif, Equals, emb)
+	c.Check(replaced, Equals, "")
+	c.Check(g.groups, HasLen, 0)
+}
+
+func (s *groupSuite) TestForgetsOldGroups(c *C) {
+	g := s.newGrouper(time.Minute)
+	g.group(clickhelp.MustParseAppId("com.example.test_test-app_0"), "n1", cardNotif("one", ""))
+	c.Check(g.groups, HasLen, 1)
+	s.now = s.t0.Add(time.Hour)
+	g.group(clickhelp.MustParseAppId("com.example.other_other-app_0"), "n2", cardNotif("two", ""))
+	c.Check(g.groups, HasLen, 1)
+}
@@ -0,0 +1,144 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultHistoryMaxEntries is how many entries are kept per app unless
+// told otherwise.
+const DefaultHistoryMaxEntries = 100
+
+// A HistoryEntry records a notification that got presented.
+type HistoryEntry struct {
+	AppId   string `json:"app_id"`
+	Nid     string `json:"nid"`
+	Summary string `json:"summary"`
+	Body    string `json:"body"`
+	// seconds since the epoch
+	Timestamp int64 `json:"timestamp"`
+	// the presenters that fired for it
+	Presenters []string `json:"presenters"`
+	// the action the user took on it, if any
+	Action string `json:"action,omitempty"`
+}
+
+// matches returns whether the summary or body of the entry contain
+// (lowercased) text.
+func (entry *HistoryEntry) matches(text string) bool {
+	return strings.Contains(strings.ToLower(entry.Summary), text) ||
+		strings.Contains(strings.ToLower(entry.Body), text)
+}
+
+// History keeps a record of the notifications presented for each
+// application.
+type History interface {
+	// Add records entry, forgetting the oldest ones of its app if
+	// there are too many.
+	Add(entry *HistoryEntry) error
+	// SetAction records the action taken by the user on the
+	// notification with id nid for appId.
+	SetAction(appId, nid, action string) error
+	// List returns the entries for appId, newest first and at most
+	// limit of them (0 for no limit). If text isn't empty, only
+	// those whose summary or body contain it (ignoring case) are
+	// returned.
+	List(appId, text string, limit int) ([]*HistoryEntry, error)
+	// Clear forgets the entries for appId, returning how many there
+	// were.
+	Clear(appId string) (int, error)
+	// Close closes the history.
+	Close()
+}
+
+// memHistory keeps the history in memory.
+type memHistory struct {
+	lock       sync.Mutex
+	maxEntries int
+	// oldest first
+	entries map[string][]*HistoryEntry
+}
+
+// NewMemHistory returns a History kept in memory, with at most
+// maxEntries per app (DefaultHistoryMaxEntries if 0).
+func NewMemHistory(maxEntries int) History {
+	if maxEntries == 0 {
+		maxEntries = DefaultHistoryMaxEntries
+	}
+	return &memHistory{
+		maxEntries: maxEntries,
+		entries:    make(map[string][]*HistoryEntry),
+	}
+}
+
+func (mh *memHistory) Add(entry *HistoryEntry) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	entryCopy := *entry
+	entries := append(mh.entries[entry.AppId], &entryCopy)
+	if len(entries) > mh.maxEntries {
+		entries = append([]*HistoryEntry(nil), entries[len(entries)-mh.maxEntries:]...)
+	}
+	mh.entries[entry.AppId] = entries
+	return nil
+}
+
+func (mh *memHistory) SetAction(appId, nid, action string) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	entries := mh.entries[appId]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Nid == nid {
+			entries[i].Action = action
+			break
+		}
+	}
+	return nil
+}
+
+func (mh *memHistory) List(appId, text string, limit int) ([]*HistoryEntry, error) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	text = strings.ToLower(text)
+	entries := mh.entries[appId]
+	var res []*HistoryEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		if limit > 0 && len(res) == limit {
+			break
+		}
+		if text != "" && !entries[i].matches(text) {
+			continue
+		}
+		// a copy, as the action can change under it
+		entryCopy := *entries[i]
+		res = append(res, &entryCopy)
+	}
+	return res, nil
+}
+
+func (mh *memHistory) Clear(appId string) (int, error) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	n := len(mh.entries[appId])
+	delete(mh.entries, appId)
+	return n, nil
+}
+
+func (mh *memHistory) Close() {
+}
@@ -0,0 +1,151 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"fmt"
+
+	. "launchpad.net/gocheck"
+)
+
+type historySuite struct {
+	constructor func(maxEntries int) (History, error)
+}
+
+var _ = Suite(&historySuite{})
+
+func (s *historySuite) SetUpSuite(c *C) {
+	s.constructor = func(maxEntries int) (History, error) {
+		return NewMemHistory(maxEntries), nil
+	}
+}
+
+func testEntry(appId, nid, summary string) *HistoryEntry {
+	return &HistoryEntry{
+		AppId:      appId,
+		Nid:        nid,
+		Summary:    summary,
+		Body:       "body of " + summary,
+		Timestamp:  1400000000,
+		Presenters: []string{"bubble", "notification-centre"},
+	}
+}
+
+func nidsOf(entries []*HistoryEntry) []string {
+	nids := make([]string, len(entries))
+	for i, e := range entries {
+		nids[i] = e.Nid
+	}
+	return nids
+}
+
+func (s *historySuite) TestAddList(c *C) {
+	h, err := s.constructor(0)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	entries, err := h.List("app1", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 0)
+
+	c.Assert(h.Add(testEntry("app1", "n1", "one")), IsNil)
+	c.Assert(h.Add(testEntry("app2", "n2", "two")), IsNil)
+	c.Assert(h.Add(testEntry("app1", "n3", "three")), IsNil)
+	entries, err = h.List("app1", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []*HistoryEntry{testEntry("app1", "n3", "three"), testEntry("app1", "n1", "one")})
+	// with a limit
+	entries, err = h.List("app1", "", 1)
+	c.Assert(err, IsNil)
+	c.Check(nidsOf(entries), DeepEquals, []string{"n3"})
+}
+
+func (s *historySuite) TestMaxEntriesIsPerApp(c *C) {
+	h, err := s.constructor(3)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	c.Assert(h.Add(testEntry("app2", "o1", "other")), IsNil)
+	for i := 1; i <= 5; i++ {
+		c.Assert(h.Add(testEntry("app1", fmt.Sprintf("n%d", i), "a message")), IsNil)
+	}
+	entries, err := h.List("app1", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(nidsOf(entries), DeepEquals, []string{"n5", "n4", "n3"})
+	entries, err = h.List("app2", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(nidsOf(entries), DeepEquals, []string{"o1"})
+}
+
+func (s *historySuite) TestSearch(c *C) {
+	h, err := s.constructor(0)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	c.Assert(h.Add(testEntry("app1", "n1", "Lunch today?")), IsNil)
+	c.Assert(h.Add(testEntry("app1", "n2", "Meeting moved")), IsNil)
+	c.Assert(h.Add(testEntry("app1", "n3", "lunch tomorrow")), IsNil)
+	c.Assert(h.Add(testEntry("app2", "n4", "lunch with them")), IsNil)
+	entries, err := h.List("app1", "LUNCH", 0)
+	c.Assert(err, IsNil)
+	c.Check(nidsOf(entries), DeepEquals, []string{"n3", "n1"})
+	// the body counts too
+	entries, err = h.List("app1", "body of meeting", 0)
+	c.Assert(err, IsNil)
+	c.Check(nidsOf(entries), DeepEquals, []string{"n2"})
+	entries, err = h.List("app1", "lunch", 1)
+	c.Assert(err, IsNil)
+	c.Check(nidsOf(entries), DeepEquals, []string{"n3"})
+	entries, err = h.List("app1", "dinner", 0)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
+
+func (s *historySuite) TestSetAction(c *C) {
+	h, err := s.constructor(0)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	c.Assert(h.Add(testEntry("app1", "n1", "one")), IsNil)
+	c.Assert(h.Add(testEntry("app1", "n2", "two")), IsNil)
+	c.Assert(h.SetAction("app1", "n1", "app://foo"), IsNil)
+	// unknown ones are ignored
+	c.Assert(h.SetAction("app1", "n9", "app://bar"), IsNil)
+	c.Assert(h.SetAction("app2", "n2", "app://baz"), IsNil)
+	entries, err := h.List("app1", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Check(entries[0].Action, Equals, "")
+	c.Check(entries[1].Action, Equals, "app://foo")
+}
+
+func (s *historySuite) TestClear(c *C) {
+	h, err := s.constructor(0)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	c.Assert(h.Add(testEntry("app1", "n1", "one")), IsNil)
+	c.Assert(h.Add(testEntry("app1", "n2", "two")), IsNil)
+	c.Assert(h.Add(testEntry("app2", "n3", "three")), IsNil)
+	n, err := h.Clear("app1")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 2)
+	entries, err := h.List("app1", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 0)
+	entries, err = h.List("app2", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 1)
+	n, err = h.Clear("app1")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 0)
+}
@@ -0,0 +1,180 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ubports/ubuntu-push/click"
+	http13 "github.com/ubports/ubuntu-push/http13client"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/util"
+)
+
+const (
+	// the most bytes of a card image that get downloaded
+	maxImageSize = 2 << 20
+	// how long downloading a card image can take
+	imageTimeout = 20 * time.Second
+	// how many card images get downloaded at the same time
+	maxImageFetches = 4
+	// how long a cached card image is kept after it was last used
+	imageCacheAge = 7 * 24 * time.Hour
+	// the prefix of the names of cached card images
+	imagePrefix = "push-image"
+)
+
+var (
+	ErrImageTooBig      = errors.New("image too big")
+	ErrTooManyDownloads = errors.New("too many images being downloaded")
+)
+
+// imageWaitTimeout is how long a card image waits for its turn to be
+// downloaded (a var for testing)
+var imageWaitTimeout = imageTimeout
+
+// newImageClient makes the client card images are downloaded with,
+// through proxy (or the environment's proxy if proxy is nil).
+func newImageClient(proxy *url.URL) *http13.Client {
+	return &http13.Client{
+		Transport: util.NewHTTPTransport(proxy, imageTimeout),
+		Timeout:   imageTimeout,
+	}
+}
+
+// isRemoteImage returns whether image is an url to fetch.
+func isRemoteImage(image string) bool {
+	u, err := url.Parse(image)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// fetchImage downloads with cli the card image at imageURL into the
+// cache of app (unless it's there already), returning its path.
+func fetchImage(cli *http13.Client, app *click.AppId, imageURL string) (string, error) {
+	dir, err := launch_helper.GetTempDir(app.Package)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%x%s", imagePrefix, sha1.Sum([]byte(imageURL)), path.Ext(u.Path))
+	filename := filepath.Join(dir, name)
+	if _, err := os.Stat(filename); err == nil {
+		// it's been used now, so it's kept for longer
+		now := timeNow()
+		os.Chtimes(filename, now, now)
+		return filename, nil
+	}
+	pruneImages(dir)
+
+	resp, err := cli.Get(imageURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %v", resp.Status)
+	}
+	if resp.ContentLength > maxImageSize {
+		return "", ErrImageTooBig
+	}
+	f, err := ioutil.TempFile(dir, imagePrefix)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxImageSize+1))
+	f.Close()
+	if err == nil && n > maxImageSize {
+		err = ErrImageTooBig
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return filename, nil
+}
+
+// timeNow is time.Now, swappable for testing
+var timeNow = time.Now
+
+// pruneImages removes from dir the cached card images that haven't
+// been used in imageCacheAge, as well as leftovers of downloads.
+func pruneImages(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := timeNow().Add(-imageCacheAge)
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), imagePrefix) && fi.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
+
+// hasRemoteImage returns whether notif has a card image to download.
+func hasRemoteImage(notif *launch_helper.Notification) bool {
+	return notif != nil && notif.Card != nil && isRemoteImage(notif.Card.Image)
+}
+
+// fetchImageInTurn is fetchImage with svc's client, waiting (up to
+// imageWaitTimeout) while maxImageFetches others are at it.
+func (svc *PostalService) fetchImageInTurn(app *click.AppId, imageURL string) (string, error) {
+	select {
+	case svc.imageFetches <- true:
+		defer func() { <-svc.imageFetches }()
+	case <-time.After(imageWaitTimeout):
+		return "", ErrTooManyDownloads
+	}
+	return fetchImage(svc.imageClient, app, imageURL)
+}
+
+// withLocalImage returns notif with the image of its card, if it's an
+// url, swapped for the path to the downloaded copy; or without an
+// image if it can't be downloaded. It goes on the network, so it
+// mustn't be called with the lock held.
+func (svc *PostalService) withLocalImage(app *click.AppId, nid string, notif *launch_helper.Notification) *launch_helper.Notification {
+	if !hasRemoteImage(notif) {
+		return notif
+	}
+	filename, err := svc.fetchImageInTurn(app, notif.Card.Image)
+	if err != nil {
+		svc.Log.Errorf("[%s] unable to fetch image %#v: %v", nid, notif.Card.Image, err)
+		filename = ""
+	}
+	notifCopy := *notif
+	cardCopy := *notif.Card
+	cardCopy.Image = filename
+	notifCopy.Card = &cardCopy
+	return &notifCopy
+}
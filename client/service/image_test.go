@@ -0,0 +1,293 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	testibus "github.com/ubports/ubuntu-push/bus/testing"
+	"github.com/ubports/ubuntu-push/click"
+	clickhelp "github.com/ubports/ubuntu-push/click/testing"
+	"github.com/ubports/ubuntu-push/launch_helper"
+	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/testing/condition"
+)
+
+type imageSuite struct {
+	dir        string
+	getTempDir func(string) (string, error)
+}
+
+var _ = Suite(&imageSuite{})
+
+func (s *imageSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.getTempDir = launch_helper.GetTempDir
+	launch_helper.GetTempDir = func(pkgName string) (string, error) {
+		tmpDir := filepath.Join(s.dir, pkgName)
+		return tmpDir, os.MkdirAll(tmpDir, 0700)
+	}
+}
+
+func (s *imageSuite) TearDownTest(c *C) {
+	launch_helper.GetTempDir = s.getTempDir
+	timeNow = time.Now
+}
+
+func (s *imageSuite) TestIsRemoteImage(c *C) {
+	c.Check(isRemoteImage("http://example.com/a.png"), Equals, true)
+	c.Check(isRemoteImage("https://example.com/a.png"), Equals, true)
+	c.Check(isRemoteImage("/usr/share/icons/a.png"), Equals, false)
+	c.Check(isRemoteImage(""), Equals, false)
+}
+
+func (s *imageSuite) TestFetchImage(c *C) {
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte("PNG!"))
+	}))
+	defer ts.Close()
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	filename, err := fetchImage(newImageClient(nil), app, ts.URL+"/images/a.png")
+	c.Assert(err, IsNil)
+	c.Check(filepath.Dir(filename), Equals, filepath.Join(s.dir, "com.example.test"))
+	c.Check(strings.HasSuffix(filename, ".png"), Equals, true)
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "PNG!")
+	// the second time around it's in the cache
+	again, err := fetchImage(newImageClient(nil), app, ts.URL+"/images/a.png")
+	c.Assert(err, IsNil)
+	c.Check(again, Equals, filename)
+	c.Check(hits, Equals, 1)
+}
+
+func (s *imageSuite) TestFetchImageThroughProxy(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// proxies get the whole url
+		if r.URL.String() != "http://images.example.com/a.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("PNG!"))
+	}))
+	defer proxy.Close()
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	cli := newImageClient(helpers.ParseURL(proxy.URL))
+	filename, err := fetchImage(cli, app, "http://images.example.com/a.png")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "PNG!")
+}
+
+func (s *imageSuite) TestFetchImagePrunesCache(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PNG!"))
+	}))
+	defer ts.Close()
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	cli := newImageClient(nil)
+	old, err := fetchImage(cli, app, ts.URL+"/old.png")
+	c.Assert(err, IsNil)
+	used, err := fetchImage(cli, app, ts.URL+"/used.png")
+	c.Assert(err, IsNil)
+	other, err := ioutil.TempFile(filepath.Dir(old), "other")
+	c.Assert(err, IsNil)
+	other.Close()
+
+	// a while later, one of them gets used again
+	now := time.Now()
+	timeNow = func() time.Time { return now.Add(imageCacheAge / 2) }
+	again, err := fetchImage(cli, app, ts.URL+"/used.png")
+	c.Assert(err, IsNil)
+	c.Check(again, Equals, used)
+	// and by the time another one is fetched the other's too old
+	timeNow = func() time.Time { return now.Add(imageCacheAge + time.Hour) }
+	fresh, err := fetchImage(cli, app, ts.URL+"/new.png")
+	c.Assert(err, IsNil)
+
+	_, err = os.Stat(old)
+	c.Check(os.IsNotExist(err), Equals, true)
+	for _, kept := range []string{used, fresh, other.Name()} {
+		_, err = os.Stat(kept)
+		c.Check(err, IsNil)
+	}
+}
+
+func (s *imageSuite) TestFetchImageTooBig(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Length, so it has to be counted
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte("x"), maxImageSize+1))
+	}))
+	defer ts.Close()
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	_, err := fetchImage(newImageClient(nil), app, ts.URL+"/big.png")
+	c.Check(err, Equals, ErrImageTooBig)
+	// nothing is left behind
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, "com.example.test"))
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 0)
+}
+
+func (s *imageSuite) TestFetchImageFails(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	_, err := fetchImage(newImageClient(nil), app, ts.URL+"/a.png")
+	c.Check(err, ErrorMatches, "got 404.*")
+}
+
+func (s *imageSuite) TestWithLocalImage(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("PNG!"))
+	}))
+	defer ts.Close()
+	log := helpers.NewTestLogger(c, "debug")
+	svc := NewPostalService(&PostalServiceSetup{}, log)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+
+	// local images, or no card, are left alone
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Image: "/tmp/a.png"}}
+	c.Check(svc.withLocalImage(app, "m1", notif), Equals, notif)
+	notif = &launch_helper.Notification{}
+	c.Check(svc.withLocalImage(app, "m1", notif), Equals, notif)
+
+	notif = &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi", Image: ts.URL + "/a.png"}}
+	local := svc.withLocalImage(app, "m1", notif)
+	c.Check(local.Card.Summary, Equals, "hi")
+	c.Check(filepath.Dir(local.Card.Image), Equals, filepath.Join(s.dir, "com.example.test"))
+	// the original is left alone
+	c.Check(notif.Card.Image, Equals, ts.URL+"/a.png")
+
+	// and images that can't be fetched are dropped
+	notif = &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi", Image: ts.URL + "/b.png"}}
+	local = svc.withLocalImage(app, "m1", notif)
+	c.Check(local.Card.Image, Equals, "")
+	c.Check(log.Captured(), Matches, `(?s).*\[m1\] unable to fetch image .*: got 404.*`)
+}
+
+func (s *imageSuite) TestHelperResultFetchesImageUnlocked(c *C) {
+	var svc *PostalService
+	locked := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the service can be used while the image is fetched
+		got := make(chan bool)
+		go func() {
+			svc.lock.Lock()
+			svc.lock.Unlock()
+			close(got)
+		}()
+		select {
+		case <-got:
+			locked <- false
+		case <-time.After(time.Second):
+			locked <- true
+		}
+		w.Write([]byte("PNG!"))
+	}))
+	defer ts.Close()
+	log := helpers.NewTestLogger(c, "debug")
+	svc = NewPostalService(&PostalServiceSetup{}, log)
+	svc.Bus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
+	images := make(chan string, 1)
+	svc.SetMessageHandler(func(app *click.AppId, nid string, output *launch_helper.HelperOutput) bool {
+		images <- output.Notification.Card.Image
+		return false
+	})
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi", Image: ts.URL + "/a.png"}}
+	svc.handleHelperResult(&launch_helper.HelperResult{
+		Input:        &launch_helper.HelperInput{App: app, NotificationId: "m1"},
+		HelperOutput: launch_helper.HelperOutput{Notification: notif},
+	})
+	c.Check(<-locked, Equals, false)
+	c.Check(filepath.Dir(<-images), Equals, filepath.Join(s.dir, "com.example.test"))
+}
+
+func (s *imageSuite) TestWithLocalImageWaitsItsTurn(c *C) {
+	imageWaitTimeout = 10 * time.Millisecond
+	defer func() { imageWaitTimeout = imageTimeout }()
+	log := helpers.NewTestLogger(c, "debug")
+	svc := NewPostalService(&PostalServiceSetup{}, log)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	// everybody's busy
+	for i := 0; i < maxImageFetches; i++ {
+		svc.imageFetches <- true
+	}
+
+	notif := &launch_helper.Notification{Card: &launch_helper.Card{Summary: "hi", Image: "http://images.example.com/a.png"}}
+	local := svc.withLocalImage(app, "m1", notif)
+	c.Check(local.Card.Image, Equals, "")
+	c.Check(log.Captured(), Matches, `(?s).*\[m1\] unable to fetch image .*: too many images being downloaded.*`)
+}
+
+func (s *imageSuite) TestHandleHelperResultFetchesImageOnTheSide(c *C) {
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("PNG!"))
+	}))
+	defer ts.Close()
+	log := helpers.NewTestLogger(c, "debug")
+	svc := NewPostalService(&PostalServiceSetup{}, log)
+	svc.Bus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
+	posted := make(chan *launch_helper.HelperOutput, 1)
+	svc.SetMessageHandler(func(_ *click.AppId, _ string, output *launch_helper.HelperOutput) bool {
+		posted <- output
+		return true
+	})
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+
+	card := &launch_helper.Card{Summary: "hi", Image: ts.URL + "/a.png", Popup: true}
+	output := launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card}}
+	svc.handleHelperResult(&launch_helper.HelperResult{
+		HelperOutput: output,
+		Input:        &launch_helper.HelperInput{App: app, NotificationId: "m1"},
+	})
+	// not held up by the download
+	select {
+	case <-posted:
+		c.Fatal("posted before the image was downloaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case output := <-posted:
+		c.Check(filepath.Dir(output.Notification.Card.Image), Equals, filepath.Join(s.dir, "com.example.test"))
+	case <-time.After(5 * time.Second):
+		c.Fatal("not posted after the image was downloaded")
+	}
+}
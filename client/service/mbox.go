@@ -18,16 +18,71 @@ package service
 
 import (
 	"encoding/json"
+	"sync"
+	"time"
 )
 
 var mBoxMaxMessagesSize = 128 * 1024
 
+// Mailboxes keep the notification messages for each application
+// until the application asks for them.
+type Mailboxes interface {
+	// Append adds a message with notification id to the mailbox of appId.
+	Append(appId string, message json.RawMessage, nid string) error
+	// PopAll takes all the (unexpired) messages out of the mailbox of appId.
+	PopAll(appId string) ([]string, error)
+	// PopById takes the message with notification id nid out of the
+	// mailbox of appId, if it's there.
+	PopById(appId, nid string) (message string, found bool, err error)
+	// MessagesSince returns, without taking them out, the messages
+	// in the mailbox of appId that came after the one with
+	// notification id cursor, and their notification ids. With
+	// cursor empty or no longer in the mailbox, that's all of them.
+	MessagesSince(appId, cursor string) (nids []string, messages []string, err error)
+	// Count returns the number of (unexpired) messages in the
+	// mailbox of appId.
+	Count(appId string) (int, error)
+	// Counts returns the number of (unexpired) messages waiting in
+	// each non-empty mailbox.
+	Counts() (map[string]int, error)
+	// Close closes the mailboxes.
+	Close()
+}
+
+// MailboxLimits are the limits on what is kept in each mailbox.
+type MailboxLimits struct {
+	// the total size of the messages; older ones get evicted to
+	// make room for new ones
+	MaxSize int
+	// how long messages are kept for; forever if zero
+	TTL time.Duration
+}
+
+// DefaultMailboxLimits are the mailbox limits used unless told
+// otherwise.
+var DefaultMailboxLimits = MailboxLimits{
+	MaxSize: 128 * 1024,
+	TTL:     7 * 24 * time.Hour,
+}
+
+// cutoff returns the time before which messages are expired; the
+// zero time if they never expire.
+func (limits *MailboxLimits) cutoff(now time.Time) time.Time {
+	if limits.TTL <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-limits.TTL)
+}
+
 // mBox can hold a size-limited amount of notification messages for one application.
 type mBox struct {
+	// size limit; mBoxMaxMessagesSize if zero
+	maxSize  int
 	evicted  int
 	curSize  int
 	messages []string
 	nids     []string
+	times    []time.Time
 }
 
 func (box *mBox) evictFor(sz int) {
@@ -38,6 +93,7 @@ func (box *mBox) evictFor(sz int) {
 		evictedSize += len(box.messages[i])
 		box.messages[i] = ""
 		box.nids[i] = ""
+		box.times[i] = time.Time{}
 		box.evicted++
 		i++
 	}
@@ -46,8 +102,18 @@ func (box *mBox) evictFor(sz int) {
 
 // Append appends a message with notification id to the mbox.
 func (box *mBox) Append(message json.RawMessage, nid string) {
+	box.appendAt(message, nid, time.Now())
+}
+
+// appendAt appends a message with notification id, received at t, to
+// the mbox.
+func (box *mBox) appendAt(message json.RawMessage, nid string, t time.Time) {
+	maxSize := box.maxSize
+	if maxSize == 0 {
+		maxSize = mBoxMaxMessagesSize
+	}
 	sz := len(message)
-	if box.curSize+sz > mBoxMaxMessagesSize {
+	if box.curSize+sz > maxSize {
 		// make space
 		box.evictFor(sz)
 	}
@@ -58,6 +124,7 @@ func (box *mBox) Append(message json.RawMessage, nid string) {
 			// all evicted, just start from scratch
 			box.messages = box.messages[0:0]
 			box.nids = box.nids[0:0]
+			box.times = box.times[0:0]
 			box.evicted = 0
 		} else if evicted >= cap(box.messages)/2 {
 			// amortize: do a copy only each cap/2 evicted
@@ -66,15 +133,164 @@ func (box *mBox) Append(message json.RawMessage, nid string) {
 			box.messages = box.messages[0:kept]
 			copy(box.nids, box.nids[box.evicted:])
 			box.nids = box.nids[0:kept]
+			copy(box.times, box.times[box.evicted:])
+			box.times = box.times[0:kept]
 			box.evicted = 0
 		}
 	}
 	box.messages = append(box.messages, string(message))
 	box.nids = append(box.nids, nid)
+	box.times = append(box.times, t)
 	box.curSize += sz
 }
 
+// expire evicts the messages received before cutoff.
+func (box *mBox) expire(cutoff time.Time) {
+	evictedSize := 0
+	for i := box.evicted; i < len(box.times) && box.times[i].Before(cutoff); i++ {
+		evictedSize += len(box.messages[i])
+	}
+	if evictedSize > 0 {
+		box.evictFor(evictedSize)
+	}
+}
+
 // AllMessages gets all messages from the mbox.
 func (box *mBox) AllMessages() []string {
 	return box.messages[box.evicted:]
 }
+
+// AllNids gets the notification ids of all messages in the mbox, in
+// the same order as AllMessages.
+func (box *mBox) AllNids() []string {
+	return box.nids[box.evicted:]
+}
+
+// index returns the index into AllMessages of the message with
+// notification id nid; -1 if there's none.
+func (box *mBox) index(nid string) int {
+	for i, boxNid := range box.AllNids() {
+		if boxNid == nid {
+			return i
+		}
+	}
+	return -1
+}
+
+// Remove takes the message with notification id nid out of the mbox.
+func (box *mBox) Remove(nid string) (string, bool) {
+	i := box.index(nid)
+	if i < 0 {
+		return "", false
+	}
+	i += box.evicted
+	message := box.messages[i]
+	box.messages = append(box.messages[:i], box.messages[i+1:]...)
+	box.nids = append(box.nids[:i], box.nids[i+1:]...)
+	box.times = append(box.times[:i], box.times[i+1:]...)
+	box.curSize -= len(message)
+	return message, true
+}
+
+// memMailboxes keeps the mailboxes in memory.
+type memMailboxes struct {
+	lock   sync.Mutex
+	limits MailboxLimits
+	boxes  map[string]*mBox
+	// hook for testing
+	now func() time.Time
+}
+
+// NewMemMailboxes returns Mailboxes kept in memory only.
+func NewMemMailboxes(limits MailboxLimits) Mailboxes {
+	return &memMailboxes{
+		limits: limits,
+		boxes:  make(map[string]*mBox),
+		now:    time.Now,
+	}
+}
+
+// box gets the unexpired mailbox for appId, nil if there's none.
+func (mm *memMailboxes) box(appId string) *mBox {
+	box := mm.boxes[appId]
+	if box != nil {
+		box.expire(mm.limits.cutoff(mm.now()))
+	}
+	return box
+}
+
+func (mm *memMailboxes) Append(appId string, message json.RawMessage, nid string) error {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	box := mm.box(appId)
+	if box == nil {
+		box = &mBox{maxSize: mm.limits.MaxSize}
+		mm.boxes[appId] = box
+	}
+	box.appendAt(message, nid, mm.now())
+	return nil
+}
+
+func (mm *memMailboxes) PopAll(appId string) ([]string, error) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	box := mm.box(appId)
+	if box == nil {
+		return nil, nil
+	}
+	delete(mm.boxes, appId)
+	return box.AllMessages(), nil
+}
+
+func (mm *memMailboxes) PopById(appId, nid string) (string, bool, error) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	box := mm.box(appId)
+	if box == nil {
+		return "", false, nil
+	}
+	message, found := box.Remove(nid)
+	return message, found, nil
+}
+
+func (mm *memMailboxes) MessagesSince(appId, cursor string) ([]string, []string, error) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	box := mm.box(appId)
+	if box == nil {
+		return nil, nil, nil
+	}
+	start := 0
+	if cursor != "" {
+		start = box.index(cursor) + 1
+	}
+	// copies, as the box changes under them
+	nids := append([]string(nil), box.AllNids()[start:]...)
+	messages := append([]string(nil), box.AllMessages()[start:]...)
+	return nids, messages, nil
+}
+
+func (mm *memMailboxes) Count(appId string) (int, error) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	box := mm.box(appId)
+	if box == nil {
+		return 0, nil
+	}
+	return len(box.AllMessages()), nil
+}
+
+func (mm *memMailboxes) Counts() (map[string]int, error) {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	counts := make(map[string]int, len(mm.boxes))
+	for appId := range mm.boxes {
+		if n := len(mm.box(appId).AllMessages()); n > 0 {
+			counts[appId] = n
+		}
+	}
+	return counts, nil
+}
+
+func (mm *memMailboxes) Close() {
+}
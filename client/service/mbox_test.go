@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	. "launchpad.net/gocheck"
 )
@@ -130,3 +131,198 @@ func (s *mBoxSuite) TestAppendEvictEverything(c *C) {
 	c.Check(mbox.AllMessages(), DeepEquals, []string{string(m4)})
 	c.Check(mbox.nids, DeepEquals, []string{"n4"})
 }
+
+func (s *mBoxSuite) TestExpire(c *C) {
+	mbox := &mBox{}
+	t0 := time.Now()
+	mbox.appendAt(json.RawMessage(`{"m":1}`), "n1", t0)
+	mbox.appendAt(json.RawMessage(`{"m":2}`), "n2", t0.Add(time.Minute))
+	mbox.appendAt(json.RawMessage(`{"m":3}`), "n3", t0.Add(2*time.Minute))
+	mbox.expire(t0.Add(90 * time.Second))
+	c.Check(mbox.AllMessages(), DeepEquals, []string{`{"m":3}`})
+	c.Check(mbox.curSize, Equals, 7)
+	mbox.expire(t0.Add(time.Hour))
+	c.Check(mbox.AllMessages(), HasLen, 0)
+	c.Check(mbox.curSize, Equals, 0)
+}
+
+func (s *mBoxSuite) TestRemove(c *C) {
+	mbox := &mBox{}
+	m1 := blobMessage(1, 25)
+	m2 := blobMessage(2, 25)
+	m3 := blobMessage(3, 50)
+	m4 := blobMessage(4, 23)
+	mbox.Append(m1, "n1")
+	mbox.Append(m2, "n2")
+	mbox.Append(m3, "n3")
+	mbox.Append(m4, "n4")
+	c.Assert(mbox.evicted, Equals, 1)
+	_, found := mbox.Remove("n1")
+	c.Check(found, Equals, false)
+	msg, found := mbox.Remove("n3")
+	c.Check(found, Equals, true)
+	c.Check(msg, Equals, string(m3))
+	c.Check(mbox.curSize, Equals, 25+23)
+	c.Check(mbox.AllMessages(), DeepEquals, []string{string(m2), string(m4)})
+	c.Check(mbox.AllNids(), DeepEquals, []string{"n2", "n4"})
+	c.Check(mbox.times, HasLen, 3)
+}
+
+type mailboxesSuite struct {
+	constructor func(MailboxLimits) (Mailboxes, error)
+}
+
+var _ = Suite(&mailboxesSuite{})
+
+func (s *mailboxesSuite) SetUpSuite(c *C) {
+	s.constructor = func(limits MailboxLimits) (Mailboxes, error) {
+		return NewMemMailboxes(limits), nil
+	}
+}
+
+// mailboxesClock digs out the clock of mb
+func mailboxesClock(mb Mailboxes) *func() time.Time {
+	switch x := mb.(type) {
+	case *memMailboxes:
+		return &x.now
+	case *sqliteMailboxes:
+		return &x.now
+	}
+	panic("unknown Mailboxes implementation")
+}
+
+func (s *mailboxesSuite) TestAppendPopAll(c *C) {
+	mb, err := s.constructor(DefaultMailboxLimits)
+	c.Assert(err, IsNil)
+	defer mb.Close()
+	msgs, err := mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, HasLen, 0)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":1}`), "n1"), IsNil)
+	c.Assert(mb.Append("app2", json.RawMessage(`{"m":2}`), "n2"), IsNil)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":3}`), "n3"), IsNil)
+	counts, err := mb.Counts()
+	c.Assert(err, IsNil)
+	c.Check(counts, DeepEquals, map[string]int{"app1": 2, "app2": 1})
+	msgs, err = mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, DeepEquals, []string{`{"m":1}`, `{"m":3}`})
+	msgs, err = mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, HasLen, 0)
+	counts, err = mb.Counts()
+	c.Assert(err, IsNil)
+	c.Check(counts, DeepEquals, map[string]int{"app2": 1})
+}
+
+func (s *mailboxesSuite) TestMaxSizeIsPerApp(c *C) {
+	mb, err := s.constructor(MailboxLimits{MaxSize: 100})
+	c.Assert(err, IsNil)
+	defer mb.Close()
+	m1 := blobMessage(1, 25)
+	m2 := blobMessage(2, 25)
+	m3 := blobMessage(3, 50)
+	m4 := blobMessage(4, 23)
+	for i, m := range []json.RawMessage{m1, m2, m3, m4} {
+		c.Assert(mb.Append("app1", m, fmt.Sprintf("n%d", i)), IsNil)
+	}
+	c.Assert(mb.Append("app2", m3, "n"), IsNil)
+	msgs, err := mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, DeepEquals, []string{string(m2), string(m3), string(m4)})
+	msgs, err = mb.PopAll("app2")
+	c.Assert(err, IsNil)
+	c.Check(msgs, DeepEquals, []string{string(m3)})
+}
+
+func (s *mailboxesSuite) TestExpires(c *C) {
+	mb, err := s.constructor(MailboxLimits{MaxSize: 100, TTL: time.Hour})
+	c.Assert(err, IsNil)
+	defer mb.Close()
+	now := mailboxesClock(mb)
+	t0 := time.Now()
+	*now = func() time.Time { return t0 }
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":1}`), "n1"), IsNil)
+	c.Assert(mb.Append("app2", json.RawMessage(`{"m":2}`), "n2"), IsNil)
+	*now = func() time.Time { return t0.Add(30 * time.Minute) }
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":3}`), "n3"), IsNil)
+	counts, err := mb.Counts()
+	c.Assert(err, IsNil)
+	c.Check(counts, DeepEquals, map[string]int{"app1": 2, "app2": 1})
+	// the first ones are too old now
+	*now = func() time.Time { return t0.Add(80 * time.Minute) }
+	counts, err = mb.Counts()
+	c.Assert(err, IsNil)
+	c.Check(counts, DeepEquals, map[string]int{"app1": 1})
+	msgs, err := mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, DeepEquals, []string{`{"m":3}`})
+	msgs, err = mb.PopAll("app2")
+	c.Assert(err, IsNil)
+	c.Check(msgs, HasLen, 0)
+}
+
+func (s *mailboxesSuite) TestPopById(c *C) {
+	mb, err := s.constructor(DefaultMailboxLimits)
+	c.Assert(err, IsNil)
+	defer mb.Close()
+	_, found, err := mb.PopById("app1", "n1")
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, false)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":1}`), "n1"), IsNil)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":2}`), "n2"), IsNil)
+	c.Assert(mb.Append("app2", json.RawMessage(`{"m":3}`), "n3"), IsNil)
+	_, found, err = mb.PopById("app1", "n3")
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, false)
+	msg, found, err := mb.PopById("app1", "n1")
+	c.Assert(err, IsNil)
+	c.Check(found, Equals, true)
+	c.Check(msg, Equals, `{"m":1}`)
+	n, err := mb.Count("app1")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	msgs, err := mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, DeepEquals, []string{`{"m":2}`})
+}
+
+func (s *mailboxesSuite) TestMessagesSince(c *C) {
+	mb, err := s.constructor(DefaultMailboxLimits)
+	c.Assert(err, IsNil)
+	defer mb.Close()
+	nids, msgs, err := mb.MessagesSince("app1", "")
+	c.Assert(err, IsNil)
+	c.Check(nids, HasLen, 0)
+	c.Check(msgs, HasLen, 0)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":1}`), "n1"), IsNil)
+	c.Assert(mb.Append("app2", json.RawMessage(`{"m":2}`), "n2"), IsNil)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":3}`), "n3"), IsNil)
+	nids, msgs, err = mb.MessagesSince("app1", "")
+	c.Assert(err, IsNil)
+	c.Check(nids, DeepEquals, []string{"n1", "n3"})
+	c.Check(msgs, DeepEquals, []string{`{"m":1}`, `{"m":3}`})
+	nids, msgs, err = mb.MessagesSince("app1", "n1")
+	c.Assert(err, IsNil)
+	c.Check(nids, DeepEquals, []string{"n3"})
+	c.Check(msgs, DeepEquals, []string{`{"m":3}`})
+	nids, _, err = mb.MessagesSince("app1", "n3")
+	c.Assert(err, IsNil)
+	c.Check(nids, HasLen, 0)
+	// a cursor that's gone gets everything
+	_, _, err = mb.PopById("app1", "n1")
+	c.Assert(err, IsNil)
+	nids, _, err = mb.MessagesSince("app1", "n1")
+	c.Assert(err, IsNil)
+	c.Check(nids, DeepEquals, []string{"n3"})
+	// and nothing got taken out
+	n, err := mb.Count("app1")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	n, err = mb.Count("app2")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 1)
+	n, err = mb.Count("app3")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 0)
+}
@@ -18,8 +18,11 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 
@@ -32,6 +35,8 @@ import (
 	"github.com/ubports/ubuntu-push/bus/windowstack"
 	"github.com/ubports/ubuntu-push/click"
 	"github.com/ubports/ubuntu-push/click/cnotificationsettings"
+	"github.com/ubports/ubuntu-push/client/e2e"
+	http13 "github.com/ubports/ubuntu-push/http13client"
 	"github.com/ubports/ubuntu-push/launch_helper"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/messaging"
@@ -57,17 +62,60 @@ type notificationCentre interface {
 	Clear(*click.AppId, ...string) int
 }
 
+// a DeliveryTracker gets told when a notification has been through
+// the helper and the presentation pipeline, and kept in its mailbox
+type DeliveryTracker interface {
+	Delivered(nid string)
+}
+
+// a Decrypter turns end-to-end encrypted payloads back into plain
+// ones (returning plain ones unchanged)
+type Decrypter interface {
+	Decrypt(appId string, payload json.RawMessage) (json.RawMessage, error)
+}
+
+// an EventReporter passes on to the server the user acting on, or
+// dismissing, notifications
+type EventReporter interface {
+	ReportEvent(appId, nid, event, action string)
+}
+
+// the events reported to an EventReporter
+const (
+	EventAction    = "action"
+	EventDismissed = "dismissed"
+	EventReply     = "reply"
+)
+
 // PostalServiceSetup is a configuration object for the service
 type PostalServiceSetup struct {
 	InstalledChecker  click.InstalledChecker
 	FallbackVibration *launch_helper.Vibration
 	FallbackSound     string
+	DeliveryTracker   DeliveryTracker
+	Decrypter         Decrypter
+	// where messages wait for their app; in memory if not set
+	Mailboxes Mailboxes
+	// when to keep notifications quiet; never if not set
+	DoNotDisturb *DoNotDisturb
+	// how close together notifications for an app (and tag) need
+	// to be to get grouped into one card; no grouping if zero
+	GroupingWindow time.Duration
+	// the record of presented notifications; in memory if not set
+	History History
+	// where to report actions and dismissals; nowhere if not set
+	EventReporter EventReporter
+	// the per-app notification settings; in memory if not set
+	Settings Settings
+	// the proxy for downloading card images; the environment's
+	// if not set
+	HTTPProxy *url.URL
 }
 
 // PostalService is the dbus api
 type PostalService struct {
 	DBusService
-	mbox          map[string]*mBox
+	mbox          Mailboxes
 	msgHandler    messageHandler
 	launchers     map[string]launch_helper.HelperLauncher
 	HelperPool    launch_helper.HelperPool
@@ -94,6 +142,18 @@ type PostalService struct {
 	// fallback values for simplified notification usage
 	fallbackVibration *launch_helper.Vibration
 	fallbackSound     string
+	deliveryTracker   DeliveryTracker
+	decrypter         Decrypter
+	dnd               *DoNotDisturb
+	grouper           *grouper
+	history           History
+	events            EventReporter
+	settings          Settings
+	imageClient       *http13.Client
+	imageFetches      chan bool
+	// the apps that got end-to-end encrypted notifications; only
+	// cards from this run can be replied to, so it needn't persist
+	e2eApps map[string]bool
 }
 
 var (
@@ -117,6 +177,29 @@ func NewPostalService(setup *PostalServiceSetup, log logger.Logger) *PostalServi
 	svc.installedChecker = setup.InstalledChecker
 	svc.fallbackVibration = setup.FallbackVibration
 	svc.fallbackSound = setup.FallbackSound
+	svc.deliveryTracker = setup.DeliveryTracker
+	svc.decrypter = setup.Decrypter
+	svc.mbox = setup.Mailboxes
+	if svc.mbox == nil {
+		svc.mbox = NewMemMailboxes(DefaultMailboxLimits)
+	}
+	svc.dnd = setup.DoNotDisturb
+	if svc.dnd == nil {
+		svc.dnd, _ = NewDoNotDisturb("", "", nil)
+	}
+	svc.grouper = newGrouper(setup.GroupingWindow)
+	svc.history = setup.History
+	if svc.history == nil {
+		svc.history = NewMemHistory(0)
+	}
+	svc.events = setup.EventReporter
+	svc.settings = setup.Settings
+	if svc.settings == nil {
+		svc.settings = NewMemSettings()
+	}
+	svc.imageClient = newImageClient(setup.HTTPProxy)
+	svc.imageFetches = make(chan bool, maxImageFetches)
+	svc.e2eApps = make(map[string]bool)
 	svc.NotificationsEndp = bus.SessionBus.Endpoint(notifications.BusAddress, log)
 	svc.EmblemCounterEndp = bus.SessionBus.Endpoint(emblemcounter.BusAddress, log)
 	svc.AccountsEndp = bus.SystemBus.Endpoint(accounts.BusAddress, log)
@@ -146,6 +229,18 @@ func (svc *PostalService) GetMessageHandler() messageHandler {
 func (svc *PostalService) Start() error {
 	return svc.DBusService.Start(bus.DispatchMap{
 		"PopAll":          svc.popAll,
+		"PopById":         svc.popById,
+		"Peek":            svc.peek,
+		"MessagesSince":   svc.messagesSince,
+		"Count":           svc.count,
+		"SetDoNotDisturb": svc.setDoNotDisturb,
+		"SetQuietHours":   svc.setQuietHours,
+		"DoNotDisturb":    svc.doNotDisturb,
+		"History":         svc.listHistory,
+		"SearchHistory":   svc.searchHistory,
+		"ClearHistory":    svc.clearHistory,
+		"Settings":        svc.getSettings,
+		"SetSetting":      svc.setSetting,
 		"Post":            svc.post,
 		"ListPersistent":  svc.listPersistent,
 		"ClearPersistent": svc.clearPersistent,
@@ -170,7 +265,11 @@ func (svc *PostalService) init() error {
 	svc.notifications = notifications.Raw(svc.NotificationsEndp, svc.Log, svc.sound)
 	svc.emblemCounter = emblemcounter.New(svc.EmblemCounterEndp, svc.Log)
 	svc.haptic = haptic.New(svc.HapticEndp, svc.Log, svc.accounts, svc.fallbackVibration)
-	svc.messagingMenu = messaging.New(svc.Log)
+	mmu := messaging.New(svc.Log)
+	mmu.OnDismiss = func(app *click.AppId, nid string) {
+		svc.reportEvent(app, nid, EventDismissed, "")
+	}
+	svc.messagingMenu = mmu
 	svc.Presenters = []Presenter{
 		svc.notifications,
 		svc.emblemCounter,
@@ -205,6 +304,8 @@ Handle:
 				svc.Log.Debugf("handleActions got nil action; ignoring")
 			} else {
 				url := action.Action
+				svc.recordAction(action.App, action.Nid, url)
+				svc.reportEvent(action.App, action.Nid, EventAction, url)
 				// remove the notification from the messaging menu
 				svc.messagingMenu.RemoveNotification(action.Nid, true)
 				// this ignores the error (it's been logged already)
@@ -218,17 +319,94 @@ Handle:
 				svc.Log.Debugf("handleActions (MMU) got nil action; ignoring")
 			} else {
 				svc.Log.Debugf("handleActions (MMU) got: %v", mmuAction)
-				url := mmuAction.Action
 				// remove the notification from the messagingmenu map
 				svc.messagingMenu.RemoveNotification(mmuAction.Notification, false)
-				// this ignores the error (it's been logged already)
-				svc.urlDispatcher.DispatchURL(url, mmuAction.App)
+				if mmuAction.Reply != "" {
+					svc.handleReply(mmuAction.App, mmuAction.Notification, mmuAction.Reply)
+				} else {
+					url := mmuAction.Action
+					svc.recordAction(mmuAction.App, mmuAction.Notification, url)
+					svc.reportEvent(mmuAction.App, mmuAction.Notification, EventAction, url)
+					// this ignores the error (it's been logged already)
+					svc.urlDispatcher.DispatchURL(url, mmuAction.App)
+				}
 			}
 
 		}
 	}
 }
 
+// replyMessage is what goes in the mailbox of an app when the user
+// replies to one of its notifications
+type replyMessage struct {
+	Reply struct {
+		Id   string `json:"id"`
+		Nid  string `json:"nid"`
+		Text string `json:"text"`
+	} `json:"reply"`
+}
+
+// handleReply passes on to app the text the user replied to its
+// notification nid with: it goes in the app's mailbox and in a Reply
+// signal, under an id of its own, and upstream if events are reported
+// (without the text for apps that get end-to-end encrypted
+// notifications, as it would go in the clear).
+func (svc *PostalService) handleReply(app *click.AppId, nid string, text string) {
+	if app == nil {
+		return
+	}
+	appId := app.Original()
+	svc.recordAction(app, nid, EventReply)
+	var msg replyMessage
+	msg.Reply.Id = newNid()
+	msg.Reply.Nid = nid
+	msg.Reply.Text = text
+	payload, err := json.Marshal(&msg)
+	if err != nil {
+		svc.Log.Errorf("unable to marshal reply to %#v for %s: %v", nid, appId, err)
+		return
+	}
+	err = svc.mbox.Append(appId, payload, msg.Reply.Id)
+	if err != nil {
+		svc.Log.Errorf("unable to keep reply to %#v for %s: %v", nid, appId, err)
+	} else {
+		svc.mailboxChanged(app)
+	}
+	svc.Bus.Signal("Reply", "/"+string(nih.Quote([]byte(app.Package))), []interface{}{appId, nid, text, msg.Reply.Id})
+	if svc.usesE2E(appId) {
+		text = ""
+	}
+	svc.reportEvent(app, nid, EventReply, text)
+}
+
+// usesE2E returns whether appId got end-to-end encrypted notifications.
+func (svc *PostalService) usesE2E(appId string) bool {
+	svc.lock.RLock()
+	defer svc.lock.RUnlock()
+	return svc.e2eApps[appId]
+}
+
+// recordAction notes in the history the action the user took on
+// notification nid of app.
+func (svc *PostalService) recordAction(app *click.AppId, nid string, action string) {
+	if app == nil {
+		return
+	}
+	err := svc.history.SetAction(app.Original(), nid, action)
+	if err != nil {
+		svc.Log.Errorf("unable to record action on notification %#v for %s: %v", nid, app.Original(), err)
+	}
+}
+
+// reportEvent passes event on notification nid of app to the
+// EventReporter, if any.
+func (svc *PostalService) reportEvent(app *click.AppId, nid, event, action string) {
+	if svc.events == nil || app == nil || nid == "" {
+		return
+	}
+	svc.events.ReportEvent(app.Original(), nid, event, action)
+}
+
 func (svc *PostalService) takeTheBus() (<-chan *notifications.RawAction, error) {
 	endps := []struct {
 		name string
@@ -315,21 +493,264 @@ func (svc *PostalService) popAll(path string, args, _ []interface{}) ([]interfac
 		return nil, err
 	}
 
-	svc.lock.Lock()
-	defer svc.lock.Unlock()
+	msgs, err := svc.mbox.PopAll(app.Original())
+	if err != nil {
+		svc.Log.Errorf("unable to get notifications for %s: %v", app.Original(), err)
+		return nil, err
+	}
+	if len(msgs) > 0 {
+		svc.mailboxChanged(app)
+	}
 
-	if svc.mbox == nil {
-		return []interface{}{[]string(nil)}, nil
+	return []interface{}{msgs}, nil
+}
+
+func (svc *PostalService) popById(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 1)
+	if err != nil {
+		return nil, err
 	}
-	appId := app.Original()
-	box, ok := svc.mbox[appId]
+	nid, ok := args[1].(string)
 	if !ok {
-		return []interface{}{[]string(nil)}, nil
+		return nil, ErrBadArgType
 	}
-	msgs := box.AllMessages()
-	delete(svc.mbox, appId)
 
-	return []interface{}{msgs}, nil
+	msg, found, err := svc.mbox.PopById(app.Original(), nid)
+	if err != nil {
+		svc.Log.Errorf("unable to get notification %#v for %s: %v", nid, app.Original(), err)
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNoSuchMessage
+	}
+	svc.mailboxChanged(app)
+
+	return []interface{}{msg}, nil
+}
+
+func (svc *PostalService) peek(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return svc.readMailbox(app, "")
+}
+
+func (svc *PostalService) messagesSince(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	cursor, ok := args[1].(string)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+
+	return svc.readMailbox(app, cursor)
+}
+
+// readMailbox returns the notification ids and messages in the
+// mailbox of app after cursor, without taking them out.
+func (svc *PostalService) readMailbox(app *click.AppId, cursor string) ([]interface{}, error) {
+	nids, msgs, err := svc.mbox.MessagesSince(app.Original(), cursor)
+	if err != nil {
+		svc.Log.Errorf("unable to get notifications for %s: %v", app.Original(), err)
+		return nil, err
+	}
+
+	return []interface{}{nids, msgs}, nil
+}
+
+func (svc *PostalService) count(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := svc.mbox.Count(app.Original())
+	if err != nil {
+		svc.Log.Errorf("unable to count notifications for %s: %v", app.Original(), err)
+		return nil, err
+	}
+
+	return []interface{}{uint32(n)}, nil
+}
+
+// mailboxChanged signals the number of messages now in the mailbox
+// of app.
+func (svc *PostalService) mailboxChanged(app *click.AppId) {
+	n, err := svc.mbox.Count(app.Original())
+	if err != nil {
+		svc.Log.Errorf("unable to count notifications for %s: %v", app.Original(), err)
+		return
+	}
+	svc.Bus.Signal("MailboxChanged", "/"+string(nih.Quote([]byte(app.Package))), []interface{}{app.Original(), uint32(n)})
+}
+
+func (svc *PostalService) setDoNotDisturb(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 1 {
+		return nil, ErrBadArgCount
+	}
+	on, ok := args[0].(bool)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+
+	svc.dnd.Set(on)
+	return nil, nil
+}
+
+func (svc *PostalService) setQuietHours(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 2 {
+		return nil, ErrBadArgCount
+	}
+	start, ok1 := args[0].(string)
+	end, ok2 := args[1].(string)
+	if !ok1 || !ok2 {
+		return nil, ErrBadArgType
+	}
+
+	return nil, svc.dnd.SetQuietHours(start, end)
+}
+
+func (svc *PostalService) doNotDisturb(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 0 {
+		return nil, ErrBadArgCount
+	}
+
+	return []interface{}{svc.dnd.Active()}, nil
+}
+
+func (svc *PostalService) listHistory(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	limit, ok := args[1].(uint32)
+	if !ok {
+		return nil, ErrBadArgType
+	}
+
+	return svc.readHistory(app, "", limit)
+}
+
+func (svc *PostalService) searchHistory(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	text, ok1 := args[1].(string)
+	limit, ok2 := args[2].(uint32)
+	if !ok1 || !ok2 {
+		return nil, ErrBadArgType
+	}
+
+	return svc.readHistory(app, text, limit)
+}
+
+// readHistory returns the (JSON-encoded) history entries for app that
+// match text, newest first and at most limit of them.
+func (svc *PostalService) readHistory(app *click.AppId, text string, limit uint32) ([]interface{}, error) {
+	entries, err := svc.history.List(app.Original(), text, int(limit))
+	if err != nil {
+		svc.Log.Errorf("unable to get history for %s: %v", app.Original(), err)
+		return nil, err
+	}
+	res := make([]string, len(entries))
+	for i, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = string(b)
+	}
+
+	return []interface{}{res}, nil
+}
+
+func (svc *PostalService) clearHistory(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := svc.history.Clear(app.Original())
+	if err != nil {
+		svc.Log.Errorf("unable to clear history for %s: %v", app.Original(), err)
+		return nil, err
+	}
+
+	return []interface{}{uint32(n)}, nil
+}
+
+func (svc *PostalService) getSettings(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := svc.settings.Get(app.Base())
+	if err != nil {
+		svc.Log.Errorf("unable to get settings for %s: %v", app.Base(), err)
+		return nil, err
+	}
+	b, err := json.Marshal(&settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{string(b)}, nil
+}
+
+func (svc *PostalService) setSetting(path string, args, _ []interface{}) ([]interface{}, error) {
+	app, err := svc.grabDBusPackageAndAppId(path, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	key, ok1 := args[1].(string)
+	value, ok2 := args[2].(bool)
+	if !ok1 || !ok2 {
+		return nil, ErrBadArgType
+	}
+
+	settings, err := svc.settings.Get(app.Base())
+	if err != nil {
+		svc.Log.Errorf("unable to get settings for %s: %v", app.Base(), err)
+		return nil, err
+	}
+	err = settings.set(key, value)
+	if err != nil {
+		return nil, err
+	}
+	err = svc.settings.Set(app.Base(), settings)
+	if err != nil {
+		svc.Log.Errorf("unable to set settings for %s: %v", app.Base(), err)
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// appSettings returns the notification settings of app, falling back
+// to the defaults if they can't be read.
+func (svc *PostalService) appSettings(app *click.AppId) AppSettings {
+	settings, err := svc.settings.Get(app.Base())
+	if err != nil {
+		svc.Log.Errorf("unable to get settings for %s: %v", app.Base(), err)
+		return DefaultAppSettings
+	}
+	return settings
+}
+
+// PendingCounts returns the number of messages waiting in each
+// application's mailbox.
+func (svc *PostalService) PendingCounts() map[string]int {
+	counts, err := svc.mbox.Counts()
+	if err != nil {
+		svc.Log.Errorf("unable to count notifications: %v", err)
+	}
+	return counts
 }
 
 var newNid = uuid.New
@@ -355,8 +776,26 @@ func (svc *PostalService) post(path string, args, _ []interface{}) ([]interface{
 }
 
 // Post() signals to an application over dbus that a notification
-// has arrived. If nid is "" generate one.
+// has arrived. If nid is "" generate one. End-to-end encrypted
+// payloads get decrypted first.
 func (svc *PostalService) Post(app *click.AppId, nid string, payload json.RawMessage) {
+	if svc.decrypter != nil {
+		if e2e.IsEncrypted(payload) {
+			svc.lock.Lock()
+			svc.e2eApps[app.Original()] = true
+			svc.lock.Unlock()
+		}
+		plain, err := svc.decrypter.Decrypt(app.Original(), payload)
+		if err != nil {
+			svc.Log.Errorf("unable to decrypt notification %#v for %s: %v", nid, app.Original(), err)
+			// it's never going to work, so don't keep it around
+			if svc.deliveryTracker != nil && nid != "" {
+				svc.deliveryTracker.Delivered(nid)
+			}
+			return
+		}
+		payload = plain
+	}
 	if nid == "" {
 		nid = newNid()
 	}
@@ -381,23 +820,36 @@ func (svc *PostalService) consumeHelperResults(ch chan *launch_helper.HelperResu
 }
 
 func (svc *PostalService) handleHelperResult(res *launch_helper.HelperResult) {
-	svc.lock.Lock()
-	defer svc.lock.Unlock()
-	if svc.mbox == nil {
-		svc.mbox = make(map[string]*mBox)
-	}
-
 	app := res.Input.App
 	nid := res.Input.NotificationId
 	output := res.HelperOutput
+	if !hasRemoteImage(output.Notification) {
+		svc.postOutput(app, nid, output)
+		return
+	}
+	// the card's image is downloaded on the side, so the network
+	// doesn't hold up the notifications that come after; it's
+	// posted once that's done, with or without the image
+	go func() {
+		output.Notification = svc.withLocalImage(app, nid, output.Notification)
+		svc.postOutput(app, nid, output)
+	}()
+}
+
+// postOutput keeps the helper's output for app in its mailbox, and
+// presents it.
+func (svc *PostalService) postOutput(app *click.AppId, nid string, output launch_helper.HelperOutput) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
 
 	appId := app.Original()
-	box, ok := svc.mbox[appId]
-	if !ok {
-		box = new(mBox)
-		svc.mbox[appId] = box
+	err := svc.mbox.Append(appId, output.Message, nid)
+	kept := err == nil
+	if !kept {
+		svc.Log.Errorf("unable to keep notification %#v for %s: %v", nid, appId, err)
+	} else {
+		svc.mailboxChanged(app)
 	}
-	box.Append(output.Message, nid)
 
 	if svc.msgHandler != nil {
 		b := svc.msgHandler(app, nid, &output)
@@ -405,10 +857,34 @@ func (svc *PostalService) handleHelperResult(res *launch_helper.HelperResult) {
 			svc.Log.Debugf("msgHandler did not present the notification")
 		}
 	}
+	// if it wasn't kept, it stays in the client's inbox to be
+	// tried again on the next start
+	if svc.deliveryTracker != nil && nid != "" && kept {
+		svc.deliveryTracker.Delivered(nid)
+	}
 
 	svc.Bus.Signal("Post", "/"+string(nih.Quote([]byte(app.Package))), []interface{}{appId})
 }
 
+// addToHistory records notif (with id nid) for app in the history,
+// along with the presenters that fired for it.
+func (svc *PostalService) addToHistory(app *click.AppId, nid string, notif *launch_helper.Notification, presenters []string) {
+	entry := &HistoryEntry{
+		AppId:      app.Original(),
+		Nid:        nid,
+		Timestamp:  time.Now().Unix(),
+		Presenters: presenters,
+	}
+	if notif.Card != nil {
+		entry.Summary = notif.Card.Summary
+		entry.Body = notif.Card.Body
+	}
+	err := svc.history.Add(entry)
+	if err != nil {
+		svc.Log.Errorf("unable to record notification %#v for %s in history: %v", nid, app.Original(), err)
+	}
+}
+
 func (svc *PostalService) validateActions(app *click.AppId, notif *launch_helper.Notification) bool {
 	if notif.Card == nil || len(notif.Card.Actions) == 0 {
 		return true
@@ -417,16 +893,40 @@ func (svc *PostalService) validateActions(app *click.AppId, notif *launch_helper
 }
 
 var areNotificationsEnabled = cnotificationsettings.AreNotificationsEnabled
+var platformSettingsAvailable = cnotificationsettings.Available
+
+// notificationsEnabled returns whether app has its notifications on, by
+// its settings and by the platform's where there are any; without those
+// (off the phone, or built without cgo) the settings alone decide.
+func notificationsEnabled(app *click.AppId, settings AppSettings) bool {
+	if !settings.Enabled {
+		return false
+	}
+	return !platformSettingsAvailable() || areNotificationsEnabled(app)
+}
 
+// messageHandler presents the notification, recording it in the
+// history if it was.
 func (svc *PostalService) messageHandler(app *click.AppId, nid string, output *launch_helper.HelperOutput) bool {
+	presenters := svc.present(app, nid, output)
+	if len(presenters) == 0 {
+		return false
+	}
+	svc.addToHistory(app, nid, output.Notification, presenters)
+	return true
+}
+
+// present presents the notification, returning the names of the
+// presenters that fired for it (none if it wasn't presented).
+func (svc *PostalService) present(app *click.AppId, nid string, output *launch_helper.HelperOutput) []string {
 	if output == nil || output.Notification == nil {
 		svc.Log.Debugf("skipping notification: nil.")
-		return false
+		return nil
 	}
 	// validate actions
 	if !svc.validateActions(app, output.Notification) {
 		// no need to log, (it's been logged already)
-		return false
+		return nil
 	}
 
 	locked := svc.unityGreeter.IsActive()
@@ -434,18 +934,99 @@ func (svc *PostalService) messageHandler(app *click.AppId, nid string, output *l
 
 	if !locked && focused {
 		svc.Log.Debugf("notification skipped because app is focused.")
-		return false
+		return nil
 	}
 
-	if !areNotificationsEnabled(app) {
+	settings := svc.appSettings(app)
+
+	if !notificationsEnabled(app, settings) {
 		svc.Log.Debugf("notification skipped (except emblem counter) because app has notifications disabled")
-		return svc.emblemCounter.Present(app, nid, output.Notification)
+		if !settings.EmblemCounter || !svc.emblemCounter.Present(app, nid, output.Notification) {
+			return nil
+		}
+		return []string{svc.presenterName(svc.emblemCounter)}
 	}
 
-	b := false
+	notif := output.Notification
+	if !settings.Sounds && notif.RawSound != nil {
+		svc.Log.Debugf("notification sound skipped because of the app's settings.")
+		notifCopy := *notif
+		notifCopy.RawSound = nil
+		notif = &notifCopy
+	}
+	if svc.dnd.Suppresses(app, notif) {
+		svc.Log.Debugf("notification quieted because of do not disturb.")
+		notif = quieted(notif)
+	}
+	notif, replaced := svc.grouper.group(app, nid, notif)
+	if replaced != "" {
+		svc.Log.Debugf("notification %#v grouped with earlier ones for %s.", nid, app.Base())
+		svc.messagingMenu.RemoveNotification(replaced, true)
+	}
+	var expire time.Time
+	if notif.Card != nil {
+		expire = notif.Card.Expire()
+		if !expire.IsZero() && !expire.After(time.Now()) {
+			svc.Log.Debugf("[%s] card skipped because it has expired.", nid)
+			notifCopy := *notif
+			notifCopy.Card = nil
+			notif = &notifCopy
+			expire = time.Time{}
+		}
+	}
+	var fired []string
 	for _, p := range svc.Presenters {
+		name := svc.presenterName(p)
+		if !settings.allows(name) {
+			svc.Log.Debugf("[%s] %s skipped because of the app's settings.", nid, name)
+			// without bubbles there's still the sound, as with the
+			// platform's settings
+			if p == Presenter(svc.notifications) && svc.sound != nil && svc.sound.Present(app, nid, notif) {
+				fired = append(fired, "sound")
+			}
+			continue
+		}
 		// we don't want this to shortcut :)
-		b = p.Present(app, nid, output.Notification) || b
+		if p.Present(app, nid, notif) {
+			fired = append(fired, name)
+		}
+	}
+	if len(fired) > 0 && !expire.IsZero() {
+		svc.expireCard(nid, expire)
+	}
+	return fired
+}
+
+// afterFunc is time.AfterFunc, swappable for testing
+var afterFunc = time.AfterFunc
+
+// expireCard takes the card of notification nid out of the
+// notification centre and bubbles when it expires.
+func (svc *PostalService) expireCard(nid string, expire time.Time) {
+	afterFunc(expire.Sub(time.Now()), func() {
+		svc.Log.Debugf("[%s] card expired.", nid)
+		svc.messagingMenu.RemoveNotification(nid, true)
+		if svc.notifications == nil {
+			return
+		}
+		err := svc.notifications.Close(nid)
+		if err != nil {
+			svc.Log.Errorf("[%s] unable to close expired bubble: %v", nid, err)
+		}
+	})
+}
+
+// presenterName returns what to call p in the history.
+func (svc *PostalService) presenterName(p Presenter) string {
+	switch p {
+	case Presenter(svc.notifications):
+		return "bubble"
+	case Presenter(svc.emblemCounter):
+		return "emblem-counter"
+	case Presenter(svc.haptic):
+		return "vibration"
+	case Presenter(svc.messagingMenu):
+		return "notification-centre"
 	}
-	return b
+	return fmt.Sprintf("%T", p)
 }
@@ -37,6 +37,7 @@ import (
 	"github.com/ubports/ubuntu-push/click"
 	clickhelp "github.com/ubports/ubuntu-push/click/testing"
 	"github.com/ubports/ubuntu-push/launch_helper"
+	"github.com/ubports/ubuntu-push/messaging"
 	"github.com/ubports/ubuntu-push/messaging/reply"
 	"github.com/ubports/ubuntu-push/nih"
 	helpers "github.com/ubports/ubuntu-push/testing"
@@ -177,6 +178,8 @@ type postalSuite struct {
 	getTempDir      func(string) (string, error)
 	oldAreEnabled   func(*click.AppId) bool
 	notifyEnabled   bool
+
+	oldPlatformSettings func() bool
 }
 
 type ualPostalSuite struct {
@@ -193,6 +196,8 @@ var _ = Suite(&trivialPostalSuite{})
 func (ps *postalSuite) SetUpTest(c *C) {
 	ps.oldAreEnabled = areNotificationsEnabled
 	areNotificationsEnabled = func(*click.AppId) bool { return ps.notifyEnabled }
+	ps.oldPlatformSettings = platformSettingsAvailable
+	platformSettingsAvailable = func() bool { return true }
 	ps.log = helpers.NewTestLogger(c, "debug")
 	ps.cfg = &PostalServiceSetup{}
 	ps.bus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true))
@@ -224,6 +229,7 @@ func (ps *postalSuite) SetUpTest(c *C) {
 
 func (ps *postalSuite) TearDownTest(c *C) {
 	areNotificationsEnabled = ps.oldAreEnabled
+	platformSettingsAvailable = ps.oldPlatformSettings
 	launch_helper.GetTempDir = ps.getTempDir
 	close(ps.accountsCh)
 }
@@ -348,8 +354,9 @@ func (ps *postalSuite) TestPostHappyPath(c *C) {
 
 	c.Check(takeNextBool(ch), Equals, false) // one,
 	// xxx here?
-	c.Assert(svc.mbox, HasLen, 1)
-	box, ok := svc.mbox[anAppId]
+	boxes := svc.mbox.(*memMailboxes).boxes
+	c.Assert(boxes, HasLen, 1)
+	box, ok := boxes[anAppId]
 	c.Check(ok, Equals, true)
 	msgs := box.AllMessages()
 	c.Assert(msgs, HasLen, 1)
@@ -421,15 +428,16 @@ func (ps *postalSuite) TestPostWorks(c *C) {
 	}
 	c.Check(takeNextBool(ch), Equals, false) // two,
 	c.Check(takeNextBool(ch), Equals, false) // three posts
-	c.Assert(svc.mbox, HasLen, 2)
-	box, ok := svc.mbox[anAppId]
+	boxes := svc.mbox.(*memMailboxes).boxes
+	c.Assert(boxes, HasLen, 2)
+	box, ok := boxes[anAppId]
 	c.Check(ok, Equals, true)
 	msgs := box.AllMessages()
 	c.Assert(msgs, HasLen, 2)
 	c.Check(msgs[0], Equals, `{"world":1}`)
 	c.Check(msgs[1], Equals, `{"moon":1}`)
 	c.Check(box.nids, DeepEquals, []string{"m1", "m2"})
-	box, ok = svc.mbox["_classic-app"]
+	box, ok = boxes["_classic-app"]
 	c.Assert(ok, Equals, true)
 	msgs = box.AllMessages()
 	c.Assert(msgs, HasLen, 1)
@@ -463,6 +471,52 @@ func (ps *postalSuite) TestPostCallsMessageHandlerDetails(c *C) {
 	c.Check(takeNextHelperOutput(ch), DeepEquals, &launch_helper.HelperOutput{})
 }
 
+type testDecrypter struct {
+	err error
+}
+
+func (td *testDecrypter) Decrypt(appId string, payload json.RawMessage) (json.RawMessage, error) {
+	if td.err != nil {
+		return nil, td.err
+	}
+	return json.RawMessage(`{"message":{"plain":1}}`), nil
+}
+
+func (ps *postalSuite) TestPostDecrypts(c *C) {
+	ch := make(chan *launch_helper.HelperOutput)
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	svc.decrypter = &testDecrypter{}
+	svc.launchers = map[string]launch_helper.HelperLauncher{
+		"click": ps.fakeLauncher,
+	}
+	c.Assert(svc.Start(), IsNil)
+	app := clickhelp.MustParseAppId(anAppId)
+	svc.SetMessageHandler(func(app *click.AppId, nid string, s *launch_helper.HelperOutput) bool {
+		ch <- s
+		return true
+	})
+	svc.Post(app, "m7", json.RawMessage(`{"e2e":{}}`))
+
+	if ps.fakeLauncher.done != nil {
+		c.Check(string(takeNextBytes(ps.fakeLauncher.ch)), Equals, `{"message":{"plain":1}}`)
+
+		go ps.fakeLauncher.done("0") // OneDone
+	}
+
+	c.Check(string(takeNextHelperOutput(ch).Message), Equals, `{"plain":1}`)
+}
+
+func (ps *postalSuite) TestPostDropsUndecryptable(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	svc.decrypter = &testDecrypter{errors.New("bad")}
+	tracker := new(testDeliveryTracker)
+	svc.deliveryTracker = tracker
+	// not started, so this would panic if it got to the helpers
+	svc.Post(clickhelp.MustParseAppId(anAppId), "m7", json.RawMessage(`{"e2e":{}}`))
+	c.Check(*tracker, DeepEquals, testDeliveryTracker{"m7"})
+	c.Check(ps.log.Captured(), Matches, `(?ms).*unable to decrypt notification "m7".*`)
+}
+
 func (ps *postalSuite) TestAfterMessageHandlerSignal(c *C) {
 	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
 	svc.msgHandler = nil
@@ -500,8 +554,60 @@ func (ps *postalSuite) TestFailingMessageHandlerSurvived(c *C) {
 	c.Check(ps.log.Captured(), Equals, "DEBUG msgHandler did not present the notification\n")
 	// we actually want to send a signal even if we didn't do anything
 	callArgs := testibus.GetCallArgs(ps.bus)
-	c.Assert(len(callArgs), Equals, 1)
+	c.Assert(len(callArgs), Equals, 2)
 	c.Check(callArgs[0].Member, Equals, "::Signal")
+	c.Check(callArgs[0].Args[0], Equals, "MailboxChanged")
+	c.Check(callArgs[1].Member, Equals, "::Signal")
+	c.Check(callArgs[1].Args[0], Equals, "Post")
+}
+
+type testDeliveryTracker []string
+
+func (tdt *testDeliveryTracker) Delivered(nid string) {
+	*tdt = append(*tdt, nid)
+}
+
+func (ps *postalSuite) TestHelperResultTracksDelivery(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	tracker := new(testDeliveryTracker)
+	svc.deliveryTracker = tracker
+	svc.msgHandler = nil
+
+	hInp := &launch_helper.HelperInput{
+		App:            clickhelp.MustParseAppId(anAppId),
+		NotificationId: "m7",
+	}
+	svc.handleHelperResult(&launch_helper.HelperResult{Input: hInp})
+	// broadcasts have no nid, and aren't tracked
+	hInp = &launch_helper.HelperInput{
+		App: clickhelp.MustParseAppId(anAppId),
+	}
+	svc.handleHelperResult(&launch_helper.HelperResult{Input: hInp})
+	c.Check(*tracker, DeepEquals, testDeliveryTracker{"m7"})
+}
+
+type brokenMailboxes struct {
+	Mailboxes
+}
+
+func (*brokenMailboxes) Append(string, json.RawMessage, string) error {
+	return errors.New("broken.")
+}
+
+func (ps *postalSuite) TestHelperResultNotKeptNotDelivered(c *C) {
+	ps.cfg.Mailboxes = &brokenMailboxes{NewMemMailboxes(DefaultMailboxLimits)}
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	tracker := new(testDeliveryTracker)
+	svc.deliveryTracker = tracker
+	svc.msgHandler = nil
+
+	hInp := &launch_helper.HelperInput{
+		App:            clickhelp.MustParseAppId(anAppId),
+		NotificationId: "m7",
+	}
+	svc.handleHelperResult(&launch_helper.HelperResult{Input: hInp})
+	c.Check(*tracker, HasLen, 0)
+	c.Check(ps.log.Captured(), Matches, `(?s).*unable to keep notification "m7" for .*: broken.*`)
 }
 
 //
@@ -513,24 +619,104 @@ func (ps *postalSuite) TestNotificationsWorks(c *C) {
 	c.Assert(nots, NotNil)
 	c.Assert(nots, HasLen, 1)
 	c.Check(nots[0], HasLen, 0)
-	c.Assert(svc.mbox, IsNil)
-	svc.mbox = make(map[string]*mBox)
-	nots, err = svc.popAll(aPackageOnBus, []interface{}{anAppId}, nil)
-	c.Assert(err, IsNil)
-	c.Assert(nots, NotNil)
-	c.Assert(nots, HasLen, 1)
-	c.Check(nots[0], HasLen, 0)
-	box := new(mBox)
-	svc.mbox[anAppId] = box
 	m1 := json.RawMessage(`"m1"`)
 	m2 := json.RawMessage(`"m2"`)
-	box.Append(m1, "n1")
-	box.Append(m2, "n2")
+	c.Assert(svc.mbox.Append(anAppId, m1, "n1"), IsNil)
+	c.Assert(svc.mbox.Append(anAppId, m2, "n2"), IsNil)
 	nots, err = svc.popAll(aPackageOnBus, []interface{}{anAppId}, nil)
 	c.Assert(err, IsNil)
 	c.Assert(nots, NotNil)
 	c.Assert(nots, HasLen, 1)
 	c.Check(nots[0], DeepEquals, []string{string(m1), string(m2)})
+	// and they're gone
+	nots, err = svc.popAll(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(nots[0], HasLen, 0)
+}
+
+func (ps *postalSuite) TestNotificationsUsesGivenMailboxes(c *C) {
+	mboxes, err := NewSqliteMailboxes(":memory:", DefaultMailboxLimits)
+	c.Assert(err, IsNil)
+	ps.cfg.Mailboxes = mboxes
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(mboxes.Append(anAppId, json.RawMessage(`"m1"`), "n1"), IsNil)
+	nots, err := svc.popAll(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(nots, DeepEquals, []interface{}{[]string{`"m1"`}})
+}
+
+func (ps *postalSuite) TestPopById(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.mbox.Append(anAppId, json.RawMessage(`"m1"`), "n1"), IsNil)
+	c.Assert(svc.mbox.Append(anAppId, json.RawMessage(`"m2"`), "n2"), IsNil)
+	rvs, err := svc.popById(aPackageOnBus, []interface{}{anAppId, "n2"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{`"m2"`})
+	_, err = svc.popById(aPackageOnBus, []interface{}{anAppId, "n2"}, nil)
+	c.Check(err, Equals, ErrNoSuchMessage)
+	nots, err := svc.popAll(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(nots, DeepEquals, []interface{}{[]string{`"m1"`}})
+	// it signalled the mailbox changes
+	callArgs := testibus.GetCallArgs(ps.bus)
+	c.Assert(callArgs, HasLen, 2)
+	c.Check(callArgs[0].Args, DeepEquals, []interface{}{"MailboxChanged", aPackageOnBus, []interface{}{anAppId, uint32(1)}})
+	c.Check(callArgs[1].Args, DeepEquals, []interface{}{"MailboxChanged", aPackageOnBus, []interface{}{anAppId, uint32(0)}})
+}
+
+func (ps *postalSuite) TestPeekAndMessagesSince(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	rvs, err := svc.peek(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(rvs, HasLen, 2)
+	c.Check(rvs[0], HasLen, 0)
+	c.Check(rvs[1], HasLen, 0)
+	c.Assert(svc.mbox.Append(anAppId, json.RawMessage(`"m1"`), "n1"), IsNil)
+	c.Assert(svc.mbox.Append(anAppId, json.RawMessage(`"m2"`), "n2"), IsNil)
+	rvs, err = svc.peek(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{[]string{"n1", "n2"}, []string{`"m1"`, `"m2"`}})
+	rvs, err = svc.messagesSince(aPackageOnBus, []interface{}{anAppId, "n1"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{[]string{"n2"}, []string{`"m2"`}})
+	rvs, err = svc.messagesSince(aPackageOnBus, []interface{}{anAppId, "n2"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs[0], HasLen, 0)
+	// peeking leaves them there
+	rvs, err = svc.count(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{uint32(2)})
+}
+
+func (ps *postalSuite) TestSelectiveAccessFailsIfBadArgs(c *C) {
+	type dbusMethod func(string, []interface{}, []interface{}) ([]interface{}, error)
+	svc := new(PostalService)
+	for name, m := range map[string]dbusMethod{"Peek": svc.peek, "Count": svc.count} {
+		for i, s := range []struct {
+			args []interface{}
+			errt error
+		}{
+			{nil, ErrBadArgCount},
+			{[]interface{}{1}, ErrBadArgType},
+			{[]interface{}{"potato"}, click.ErrInvalidAppId},
+		} {
+			_, err := m(aPackageOnBus, s.args, nil)
+			c.Check(err, Equals, s.errt, Commentf("%s iteration #%d", name, i))
+		}
+	}
+	for name, m := range map[string]dbusMethod{"PopById": svc.popById, "MessagesSince": svc.messagesSince} {
+		for i, s := range []struct {
+			args []interface{}
+			errt error
+		}{
+			{[]interface{}{anAppId}, ErrBadArgCount},
+			{[]interface{}{anAppId, 1}, ErrBadArgType},
+			{[]interface{}{"potato", "n1"}, click.ErrInvalidAppId},
+		} {
+			_, err := m(aPackageOnBus, s.args, nil)
+			c.Check(err, Equals, s.errt, Commentf("%s iteration #%d", name, i))
+		}
+	}
 }
 
 func (ps *postalSuite) TestNotificationsFailsIfBadArgs(c *C) {
@@ -549,6 +735,18 @@ func (ps *postalSuite) TestNotificationsFailsIfBadArgs(c *C) {
 	}
 }
 
+func (ps *postalSuite) TestPendingCounts(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Check(svc.PendingCounts(), HasLen, 0)
+	c.Assert(svc.mbox.Append(anAppId, json.RawMessage(`"m1"`), "n1"), IsNil)
+	c.Assert(svc.mbox.Append(anAppId, json.RawMessage(`"m2"`), "n2"), IsNil)
+	svc.mbox.(*memMailboxes).boxes["com.example.other_app"] = new(mBox)
+	c.Check(svc.PendingCounts(), DeepEquals, map[string]int{anAppId: 2})
+	_, err := svc.popAll(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(svc.PendingCounts(), HasLen, 0)
+}
+
 func (ps *postalSuite) TestMessageHandlerPublicAPI(c *C) {
 	svc := new(PostalService)
 	c.Assert(svc.msgHandler, IsNil)
@@ -604,6 +802,423 @@ func (ps *postalSuite) TestMessageHandlerPresents(c *C) {
 	c.Check(ps.log.Captured(), Matches, `(?sm).* notification has no Sound:.*`)
 }
 
+func (ps *postalSuite) TestMessageHandlerExpiresCards(c *C) {
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), uint32(1))
+	svc := NewPostalService(ps.cfg, ps.log)
+	svc.Bus = endp
+	svc.EmblemCounterEndp = endp
+	svc.AccountsEndp = ps.accountsBus
+	svc.HapticEndp = endp
+	svc.NotificationsEndp = endp
+	svc.UnityGreeterEndp = ps.unityGreeterBus
+	svc.WindowStackEndp = ps.winStackBus
+	nopTicker := make(chan []interface{})
+	testibus.SetWatchSource(endp, "ActionInvoked", nopTicker)
+	defer close(nopTicker)
+	svc.launchers = map[string]launch_helper.HelperLauncher{}
+	c.Assert(svc.Start(), IsNil)
+	var expireIn time.Duration
+	var expireFunc func()
+	oldAfterFunc := afterFunc
+	defer func() { afterFunc = oldAfterFunc }()
+	afterFunc = func(d time.Duration, f func()) *time.Timer {
+		expireIn = d
+		expireFunc = f
+		return nil
+	}
+
+	expire := time.Now().Add(time.Hour)
+	card := &launch_helper.Card{Summary: "summary-value", Popup: true, RawExpire: int(expire.Unix())}
+	output := &launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card}}
+	b := svc.messageHandler(clickhelp.MustParseAppId("com.example.test_test-app_0"), "m1", output)
+	c.Assert(b, Equals, true)
+	c.Assert(expireFunc, NotNil)
+	c.Check(expireIn > 59*time.Minute && expireIn <= time.Hour, Equals, true)
+
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	expireFunc()
+	c.Check(fmm.calls, DeepEquals, []string{"remove:m1:true"})
+	callArgs := testibus.GetCallArgs(endp)
+	c.Assert(len(callArgs) >= 2, Equals, true)
+	c.Check(callArgs[len(callArgs)-2].Member, Equals, "Notify")
+	c.Check(callArgs[len(callArgs)-1].Member, Equals, "CloseNotification")
+	c.Check(callArgs[len(callArgs)-1].Args, DeepEquals, []interface{}{uint32(1)})
+}
+
+func (ps *postalSuite) TestMessageHandlerSkipsExpiredCards(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	card := &launch_helper.Card{Summary: "summary-value", Popup: true, Persist: true, RawExpire: int(time.Now().Add(-time.Minute).Unix())}
+	emb := &launch_helper.EmblemCounter{Count: 2, Visible: true}
+	output := &launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card, EmblemCounter: emb}}
+	fired := svc.present(clickhelp.MustParseAppId("com.example.test_test-app_0"), "m1", output)
+	// the emblem counter is still updated
+	c.Check(fired, DeepEquals, []string{"emblem-counter"})
+	c.Check(ps.log.Captured(), Matches, `(?sm).*\[m1\] card skipped because it has expired.*`)
+}
+
+func (ps *postalSuite) TestMessageHandlerQuietedByDoNotDisturb(c *C) {
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), uint32(1))
+	svc := NewPostalService(ps.cfg, ps.log)
+	svc.Bus = endp
+	svc.EmblemCounterEndp = endp
+	svc.AccountsEndp = ps.accountsBus
+	svc.HapticEndp = endp
+	svc.NotificationsEndp = endp
+	svc.UnityGreeterEndp = ps.unityGreeterBus
+	svc.WindowStackEndp = ps.winStackBus
+	nopTicker := make(chan []interface{})
+	testibus.SetWatchSource(endp, "ActionInvoked", nopTicker)
+	defer close(nopTicker)
+	svc.launchers = map[string]launch_helper.HelperLauncher{}
+	svc.fallbackVibration = &launch_helper.Vibration{Pattern: []uint32{1}}
+	c.Assert(svc.Start(), IsNil)
+	started := len(testibus.GetCallArgs(endp))
+	svc.dnd.Set(true)
+
+	card := &launch_helper.Card{Icon: "icon-value", Summary: "summary-value", Body: "body-value", Popup: true, Persist: true}
+	emb := &launch_helper.EmblemCounter{Count: 2, Visible: true}
+	notif := &launch_helper.Notification{Card: card, EmblemCounter: emb, RawVibration: json.RawMessage(`true`), RawSound: json.RawMessage(`true`)}
+	output := &launch_helper.HelperOutput{Notification: notif}
+	b := svc.messageHandler(clickhelp.MustParseAppId("com.example.test_test-app_0"), "", output)
+	c.Assert(b, Equals, true)
+	mm := []string{}
+	for _, m := range testibus.GetCallArgs(endp)[started:] {
+		mm = append(mm, m.Member)
+	}
+	sort.Strings(mm)
+	// the emblem counter is still set, but no bubble and no vibration
+	c.Check(mm, DeepEquals, []string{"::SetProperty", "::SetProperty"})
+	c.Check(ps.log.Captured(), Matches, `(?sm).* notification quieted because of do not disturb.*`)
+	c.Check(ps.log.Captured(), Matches, `(?sm).* notification has no popup card:.*`)
+	c.Check(ps.log.Captured(), Matches, `(?sm).* notification has no Vibrate.*`)
+	// the persistent card is still there
+	c.Check(ps.log.Captured(), Matches, `(?sm).* creating notification centre entry for com.example.test_test-app .*`)
+	// and the original is left alone
+	c.Check(card.Popup, Equals, true)
+	c.Check(notif.RawSound, NotNil)
+}
+
+func (ps *postalSuite) TestMessageHandlerHonoursSettings(c *C) {
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), uint32(1))
+	svc := NewPostalService(ps.cfg, ps.log)
+	svc.Bus = endp
+	svc.EmblemCounterEndp = endp
+	svc.AccountsEndp = ps.accountsBus
+	svc.HapticEndp = endp
+	svc.NotificationsEndp = endp
+	svc.UnityGreeterEndp = ps.unityGreeterBus
+	svc.WindowStackEndp = ps.winStackBus
+	nopTicker := make(chan []interface{})
+	testibus.SetWatchSource(endp, "ActionInvoked", nopTicker)
+	defer close(nopTicker)
+	svc.launchers = map[string]launch_helper.HelperLauncher{}
+	svc.fallbackVibration = &launch_helper.Vibration{Pattern: []uint32{1}}
+	c.Assert(svc.Start(), IsNil)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+	c.Assert(svc.settings.Set(app.Base(), AppSettings{Enabled: true, EmblemCounter: true}), IsNil)
+
+	card := &launch_helper.Card{Summary: "summary-value", Popup: true, Persist: true}
+	emb := &launch_helper.EmblemCounter{Count: 2, Visible: true}
+	notif := &launch_helper.Notification{Card: card, EmblemCounter: emb, RawVibration: json.RawMessage(`true`), RawSound: json.RawMessage(`true`)}
+	output := &launch_helper.HelperOutput{Notification: notif}
+	fired := svc.present(app, "m1", output)
+	// only the emblem counter went through
+	c.Check(fired, DeepEquals, []string{"emblem-counter"})
+	for _, m := range testibus.GetCallArgs(endp) {
+		c.Check(m.Member, Not(Equals), "Notify")
+		c.Check(m.Member, Not(Equals), "VibratePattern")
+	}
+	c.Check(ps.log.Captured(), Matches, `(?sm).*notification sound skipped because of the app's settings.*`)
+	c.Check(ps.log.Captured(), Matches, `(?sm).*\[m1\] bubble skipped because of the app's settings.*`)
+	c.Check(ps.log.Captured(), Matches, `(?sm).*\[m1\] vibration skipped because of the app's settings.*`)
+	c.Check(ps.log.Captured(), Matches, `(?sm).*\[m1\] notification-centre skipped because of the app's settings.*`)
+	// and the original is left alone
+	c.Check(notif.RawSound, NotNil)
+}
+
+func (ps *postalSuite) TestMessageHandlerSettingsWithoutPlatform(c *C) {
+	// without the platform's notification settings the app's
+	// settings are all there is
+	platformSettingsAvailable = func() bool { return false }
+	ps.notifyEnabled = false
+	// presenting twice, so the greeter and window stack get asked twice
+	ps.unityGreeterBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), false, false)
+	ps.winStackBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), []windowstack.WindowsInfo{}, []windowstack.WindowsInfo{})
+	svc := NewPostalService(ps.cfg, ps.log)
+	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), uint32(1))
+	svc.Bus = endp
+	svc.EmblemCounterEndp = endp
+	svc.AccountsEndp = ps.accountsBus
+	svc.HapticEndp = endp
+	svc.NotificationsEndp = endp
+	svc.UnityGreeterEndp = ps.unityGreeterBus
+	svc.WindowStackEndp = ps.winStackBus
+	nopTicker := make(chan []interface{})
+	testibus.SetWatchSource(endp, "ActionInvoked", nopTicker)
+	defer close(nopTicker)
+	svc.launchers = map[string]launch_helper.HelperLauncher{}
+	svc.fallbackVibration = &launch_helper.Vibration{Pattern: []uint32{1}}
+	c.Assert(svc.Start(), IsNil)
+	app := clickhelp.MustParseAppId("com.example.test_test-app_0")
+
+	card := &launch_helper.Card{Summary: "summary-value", Popup: true}
+	emb := &launch_helper.EmblemCounter{Count: 2, Visible: true}
+	output := &launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card, EmblemCounter: emb}}
+	// the platform saying no doesn't count
+	c.Check(svc.present(app, "m1", output), DeepEquals, []string{"bubble", "emblem-counter"})
+
+	// the app's settings do
+	settings := DefaultAppSettings
+	settings.Enabled = false
+	c.Assert(svc.settings.Set(app.Base(), settings), IsNil)
+	c.Check(svc.present(app, "m2", output), DeepEquals, []string{"emblem-counter"})
+	c.Check(ps.log.Captured(), Matches, `(?sm).*notification skipped \(except emblem counter\) because app has notifications disabled.*`)
+}
+
+func (ps *postalSuite) TestSettingsMethods(c *C) {
+	svc := NewPostalService(ps.cfg, ps.log)
+	rvs, err := svc.getSettings(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{`{"enabled":true,"bubbles":true,"sounds":true,"vibrations":true,"emblem_counter":true,"notification_centre":true}`})
+
+	_, err = svc.setSetting(aPackageOnBus, []interface{}{anAppId, "sounds", false}, nil)
+	c.Assert(err, IsNil)
+	_, err = svc.setSetting(aPackageOnBus, []interface{}{anAppId, "notification_centre", false}, nil)
+	c.Assert(err, IsNil)
+	rvs, err = svc.getSettings(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{`{"enabled":true,"bubbles":true,"sounds":false,"vibrations":true,"emblem_counter":true,"notification_centre":false}`})
+	// they're kept by app id without version
+	settings, err := svc.settings.Get(clickhelp.MustParseAppId(anAppId).Base())
+	c.Assert(err, IsNil)
+	c.Check(settings.Sounds, Equals, false)
+
+	_, err = svc.setSetting(aPackageOnBus, []interface{}{anAppId, "telepathy", true}, nil)
+	c.Check(err, Equals, ErrUnknownSetting)
+}
+
+func (ps *postalSuite) TestSettingsMethodsFailIfBadArgs(c *C) {
+	svc := NewPostalService(ps.cfg, ps.log)
+	_, err := svc.getSettings(aPackageOnBus, nil, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.setSetting(aPackageOnBus, []interface{}{anAppId, "sounds"}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.setSetting(aPackageOnBus, []interface{}{anAppId, "sounds", "no"}, nil)
+	c.Check(err, Equals, ErrBadArgType)
+	_, err = svc.setSetting(aPackageOnBus, []interface{}{anAppId, 1, false}, nil)
+	c.Check(err, Equals, ErrBadArgType)
+}
+
+func (ps *postalSuite) TestNewPostalServiceUsesGivenSettings(c *C) {
+	settings := NewMemSettings()
+	setup := *ps.cfg
+	setup.Settings = settings
+	svc := NewPostalService(&setup, ps.log)
+	c.Check(svc.settings, Equals, settings)
+}
+
+func (ps *postalSuite) TestDoNotDisturbMethods(c *C) {
+	svc := NewPostalService(ps.cfg, ps.log)
+	rvs, err := svc.doNotDisturb(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{false})
+
+	_, err = svc.setDoNotDisturb(aPackageOnBus, []interface{}{true}, nil)
+	c.Assert(err, IsNil)
+	rvs, err = svc.doNotDisturb(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{true})
+	_, err = svc.setDoNotDisturb(aPackageOnBus, []interface{}{false}, nil)
+	c.Assert(err, IsNil)
+
+	svc.dnd.now = func() time.Time { return time.Date(2014, 1, 1, 23, 0, 0, 0, time.Local) }
+	_, err = svc.setQuietHours(aPackageOnBus, []interface{}{"22:00", "07:00"}, nil)
+	c.Assert(err, IsNil)
+	rvs, err = svc.doNotDisturb(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{true})
+	_, err = svc.setQuietHours(aPackageOnBus, []interface{}{"", ""}, nil)
+	c.Assert(err, IsNil)
+	rvs, err = svc.doNotDisturb(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{false})
+
+	_, err = svc.setQuietHours(aPackageOnBus, []interface{}{"22:00", "potato"}, nil)
+	c.Check(err, ErrorMatches, "bad time of day .*")
+}
+
+func (ps *postalSuite) TestDoNotDisturbMethodsFailIfBadArgs(c *C) {
+	svc := NewPostalService(ps.cfg, ps.log)
+	_, err := svc.doNotDisturb(aPackageOnBus, []interface{}{1}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.setDoNotDisturb(aPackageOnBus, nil, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.setDoNotDisturb(aPackageOnBus, []interface{}{"yes"}, nil)
+	c.Check(err, Equals, ErrBadArgType)
+	_, err = svc.setQuietHours(aPackageOnBus, []interface{}{"22:00"}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+	_, err = svc.setQuietHours(aPackageOnBus, []interface{}{"22:00", 7}, nil)
+	c.Check(err, Equals, ErrBadArgType)
+}
+
+func (ps *postalSuite) TestNewPostalServiceUsesGivenDoNotDisturb(c *C) {
+	dnd, err := NewDoNotDisturb("", "", nil)
+	c.Assert(err, IsNil)
+	setup := *ps.cfg
+	setup.DoNotDisturb = dnd
+	svc := NewPostalService(&setup, ps.log)
+	c.Check(svc.dnd, Equals, dnd)
+}
+
+type recordingPresenter struct {
+	nids   []string
+	notifs []*launch_helper.Notification
+}
+
+func (rp *recordingPresenter) Present(_ *click.AppId, nid string, notif *launch_helper.Notification) bool {
+	rp.nids = append(rp.nids, nid)
+	rp.notifs = append(rp.notifs, notif)
+	return true
+}
+
+func (ps *postalSuite) TestMessageHandlerGroupsBursts(c *C) {
+	ps.winStackBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), []windowstack.WindowsInfo{},
+		[]windowstack.WindowsInfo{},
+		[]windowstack.WindowsInfo{})
+	ps.unityGreeterBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), false, false, false)
+	setup := *ps.cfg
+	setup.GroupingWindow = time.Minute
+	svc := ps.replaceBuses(NewPostalService(&setup, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	rec := new(recordingPresenter)
+	svc.Presenters = []Presenter{rec}
+
+	app := clickhelp.MustParseAppId(anAppId)
+	for i, summary := range []string{"one", "two", "three"} {
+		card := &launch_helper.Card{Summary: summary, Popup: true, Persist: true}
+		svc.handleHelperResult(&launch_helper.HelperResult{
+			HelperOutput: launch_helper.HelperOutput{
+				Message:      json.RawMessage(fmt.Sprintf(`"m%d"`, i+1)),
+				Notification: &launch_helper.Notification{Card: card},
+			},
+			Input: &launch_helper.HelperInput{App: app, NotificationId: fmt.Sprintf("n%d", i+1)},
+		})
+	}
+	c.Check(rec.nids, DeepEquals, []string{"n1", "n2", "n3"})
+	c.Assert(rec.notifs, HasLen, 3)
+	c.Check(rec.notifs[0].Card.Summary, Equals, "one")
+	c.Check(rec.notifs[0].Card.Popup, Equals, true)
+	c.Check(rec.notifs[1].Card.Summary, Equals, "2 new messages")
+	c.Check(rec.notifs[2].Card.Summary, Equals, "3 new messages")
+	c.Check(rec.notifs[2].Card.Body, Equals, "three")
+	c.Check(rec.notifs[2].Card.Popup, Equals, false)
+	c.Check(rec.notifs[2].Card.Persist, Equals, true)
+	// each summarised card replaces the previous one
+	c.Check(fmm.calls, DeepEquals, []string{"remove:n1:true", "remove:n2:true"})
+	// but all the messages are still in the mailbox
+	nids, msgs, err := svc.mbox.MessagesSince(anAppId, "")
+	c.Assert(err, IsNil)
+	c.Check(nids, DeepEquals, []string{"n1", "n2", "n3"})
+	c.Check(msgs, DeepEquals, []string{`"m1"`, `"m2"`, `"m3"`})
+}
+
+func (ps *postalSuite) TestHandleHelperResultRecordsHistory(c *C) {
+	ps.winStackBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), []windowstack.WindowsInfo{},
+		[]windowstack.WindowsInfo{})
+	ps.unityGreeterBus = testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), false, false)
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	svc.Presenters = []Presenter{new(recordingPresenter)}
+
+	app := clickhelp.MustParseAppId(anAppId)
+	card := &launch_helper.Card{Summary: "summary-value", Body: "body-value", Popup: true}
+	svc.handleHelperResult(&launch_helper.HelperResult{
+		HelperOutput: launch_helper.HelperOutput{Notification: &launch_helper.Notification{Card: card}},
+		Input:        &launch_helper.HelperInput{App: app, NotificationId: "n1"},
+	})
+	// nothing presented, no record
+	ps.notifyEnabled = false
+	svc.handleHelperResult(&launch_helper.HelperResult{
+		HelperOutput: launch_helper.HelperOutput{Notification: &launch_helper.Notification{}},
+		Input:        &launch_helper.HelperInput{App: app, NotificationId: "n2"},
+	})
+	// no notification, no record
+	svc.handleHelperResult(&launch_helper.HelperResult{
+		Input: &launch_helper.HelperInput{App: app, NotificationId: "n3"},
+	})
+
+	entries, err := svc.history.List(anAppId, "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Nid, Equals, "n1")
+	c.Check(entries[0].Summary, Equals, "summary-value")
+	c.Check(entries[0].Body, Equals, "body-value")
+	c.Check(entries[0].Presenters, DeepEquals, []string{"*service.recordingPresenter"})
+	c.Check(entries[0].Timestamp > 0, Equals, true)
+}
+
+func (ps *postalSuite) TestPresenterName(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	names := make([]string, len(svc.Presenters))
+	for i, p := range svc.Presenters {
+		names[i] = svc.presenterName(p)
+	}
+	c.Check(names, DeepEquals, []string{"bubble", "emblem-counter", "vibration", "notification-centre"})
+}
+
+func (ps *postalSuite) TestHistoryMethods(c *C) {
+	svc := NewPostalService(ps.cfg, ps.log)
+	for i, summary := range []string{"lunch?", "meeting", "more lunch"} {
+		c.Assert(svc.history.Add(&HistoryEntry{AppId: anAppId, Nid: fmt.Sprintf("n%d", i+1), Summary: summary, Timestamp: 1400000000}), IsNil)
+	}
+
+	rvs, err := svc.listHistory(aPackageOnBus, []interface{}{anAppId, uint32(2)}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{[]string{
+		`{"app_id":"com.example.test_test-number-one","nid":"n3","summary":"more lunch","body":"","timestamp":1400000000,"presenters":null}`,
+		`{"app_id":"com.example.test_test-number-one","nid":"n2","summary":"meeting","body":"","timestamp":1400000000,"presenters":null}`,
+	}})
+
+	rvs, err = svc.searchHistory(aPackageOnBus, []interface{}{anAppId, "LUNCH", uint32(0)}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(rvs, HasLen, 1)
+	c.Check(rvs[0], HasLen, 2)
+
+	rvs, err = svc.clearHistory(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{uint32(3)})
+	rvs, err = svc.listHistory(aPackageOnBus, []interface{}{anAppId, uint32(0)}, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{[]string{}})
+}
+
+func (ps *postalSuite) TestHistoryMethodsFailIfBadArgs(c *C) {
+	svc := new(PostalService)
+	for i, s := range []struct {
+		m    func(string, []interface{}, []interface{}) ([]interface{}, error)
+		args []interface{}
+		errt error
+	}{
+		{svc.listHistory, []interface{}{anAppId}, ErrBadArgCount},
+		{svc.listHistory, []interface{}{anAppId, 2}, ErrBadArgType},
+		{svc.listHistory, []interface{}{"potato", uint32(2)}, click.ErrInvalidAppId},
+		{svc.searchHistory, []interface{}{anAppId, "x"}, ErrBadArgCount},
+		{svc.searchHistory, []interface{}{anAppId, 1, uint32(2)}, ErrBadArgType},
+		{svc.searchHistory, []interface{}{anAppId, "x", 2}, ErrBadArgType},
+		{svc.clearHistory, nil, ErrBadArgCount},
+		{svc.clearHistory, []interface{}{1}, ErrBadArgType},
+		{svc.clearHistory, []interface{}{"potato"}, click.ErrInvalidAppId},
+	} {
+		_, err := s.m(aPackageOnBus, s.args, nil)
+		c.Check(err, Equals, s.errt, Commentf("iteration #%d", i))
+	}
+}
+
 func (ps *postalSuite) TestMessageHandlerReportsFailedNotifies(c *C) {
 	endp := testibus.NewTestingEndpoint(condition.Work(true), condition.Work(true), 1)
 	nopTicker := make(chan []interface{})
@@ -678,6 +1293,9 @@ func (ps *postalSuite) TestHandleActionsDispatches(c *C) {
 	svc.urlDispatcher = fakeDisp
 	fakeDisp.NextTestURLResult = true
 	svc.messagingMenu = fmm
+	events := new(fakeEventReporter)
+	svc.events = events
+	c.Assert(svc.history.Add(&HistoryEntry{AppId: app.Original(), Nid: "xyzzy"}), IsNil)
 	aCh := make(chan *notifications.RawAction)
 	rCh := make(chan *reply.MMActionReply)
 	go func() {
@@ -693,6 +1311,11 @@ func (ps *postalSuite) TestHandleActionsDispatches(c *C) {
 	c.Assert(fakeDisp.DispatchCalls[0][0], Equals, "potato://")
 	c.Assert(fakeDisp.DispatchCalls[0][1], Equals, app.DispatchPackage())
 	c.Check(fmm.calls, DeepEquals, []string{"remove:xyzzy:true"})
+	entries, err := svc.history.List(app.Original(), "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Action, Equals, "potato://")
+	c.Check(events.events, DeepEquals, []string{"com.example.test_test-app xyzzy action potato://"})
 }
 
 func (ps *postalSuite) TestHandleMMUActionsDispatches(c *C) {
@@ -703,6 +1326,9 @@ func (ps *postalSuite) TestHandleMMUActionsDispatches(c *C) {
 	fakeDisp.DispatchDone = make(chan bool)
 	fakeDisp.NextTestURLResult = true
 	app, _ := click.ParseAppId("com.example.test_test-app")
+	events := new(fakeEventReporter)
+	svc.events = events
+	c.Assert(svc.history.Add(&HistoryEntry{AppId: app.Original(), Nid: "foo.bar"}), IsNil)
 	aCh := make(chan *notifications.RawAction)
 	rCh := make(chan *reply.MMActionReply)
 	go func() {
@@ -717,6 +1343,105 @@ func (ps *postalSuite) TestHandleMMUActionsDispatches(c *C) {
 	c.Assert(len(fakeDisp.DispatchCalls), Equals, 1)
 	c.Assert(fakeDisp.DispatchCalls[0][0], Equals, "potato://")
 	c.Assert(fakeDisp.DispatchCalls[0][1], Equals, app.DispatchPackage())
+	entries, err := svc.history.List(app.Original(), "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Action, Equals, "potato://")
+	c.Check(events.events, DeepEquals, []string{"com.example.test_test-app foo.bar action potato://"})
+}
+
+func (ps *postalSuite) TestHandleMMUReply(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	fmm := new(fakeMM)
+	svc.messagingMenu = fmm
+	fakeDisp := new(fakeUrlDispatcher)
+	svc.urlDispatcher = fakeDisp
+	events := new(fakeEventReporter)
+	svc.events = events
+	app := clickhelp.MustParseAppId(anAppId)
+	c.Assert(svc.history.Add(&HistoryEntry{AppId: anAppId, Nid: "foo.bar"}), IsNil)
+	aCh := make(chan *notifications.RawAction)
+	rCh := make(chan *reply.MMActionReply)
+	go func() {
+		rCh <- &reply.MMActionReply{App: app, Notification: "foo.bar", Reply: "on my way"}
+		close(rCh)
+	}()
+	oldNewNid := newNid
+	defer func() { newNid = oldNewNid }()
+	newNid = func() string { return "reply-1" }
+	svc.handleActions(aCh, rCh)
+	// no url gets dispatched
+	c.Check(fakeDisp.DispatchCalls, HasLen, 0)
+	c.Check(fmm.calls, DeepEquals, []string{"remove:foo.bar:false"})
+	// the reply is in the mailbox, under its own id
+	nids, msgs, err := svc.mbox.MessagesSince(anAppId, "")
+	c.Assert(err, IsNil)
+	c.Check(nids, DeepEquals, []string{"reply-1"})
+	c.Check(msgs, DeepEquals, []string{`{"reply":{"id":"reply-1","nid":"foo.bar","text":"on my way"}}`})
+	// and signalled
+	callArgs := testibus.GetCallArgs(ps.bus)
+	c.Assert(callArgs, HasLen, 2)
+	c.Check(callArgs[0].Args, DeepEquals, []interface{}{"MailboxChanged", aPackageOnBus, []interface{}{anAppId, uint32(1)}})
+	c.Check(callArgs[1].Args, DeepEquals, []interface{}{"Reply", aPackageOnBus, []interface{}{anAppId, "foo.bar", "on my way", "reply-1"}})
+	// and recorded
+	entries, err := svc.history.List(anAppId, "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Action, Equals, "reply")
+	// and reported
+	c.Check(events.events, DeepEquals, []string{anAppId + " foo.bar reply on my way"})
+}
+
+func (ps *postalSuite) TestHandleReplyE2EKeepsTextLocal(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	svc.decrypter = &testDecrypter{errors.New("bad")}
+	events := new(fakeEventReporter)
+	svc.events = events
+	app := clickhelp.MustParseAppId(anAppId)
+	// not started, so this would panic if it got to the helpers
+	svc.Post(app, "m1", json.RawMessage(`{"e2e":{}}`))
+
+	svc.handleReply(app, "m1", "on my way")
+	// the app gets the text
+	callArgs := testibus.GetCallArgs(ps.bus)
+	c.Assert(callArgs, Not(HasLen), 0)
+	last := callArgs[len(callArgs)-1]
+	c.Check(last.Args[0], Equals, "Reply")
+	c.Check(last.Args[2].([]interface{})[2], Equals, "on my way")
+	// but it doesn't go upstream
+	c.Check(events.events, DeepEquals, []string{anAppId + " m1 reply "})
+}
+
+type fakeEventReporter struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (fer *fakeEventReporter) ReportEvent(appId, nid, event, action string) {
+	fer.lock.Lock()
+	defer fer.lock.Unlock()
+	fer.events = append(fer.events, appId+" "+nid+" "+event+" "+action)
+}
+
+func (ps *postalSuite) TestReportsDismissals(c *C) {
+	events := new(fakeEventReporter)
+	ps.cfg.EventReporter = events
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Assert(svc.Start(), IsNil)
+	mmu, ok := svc.messagingMenu.(*messaging.MessagingMenu)
+	c.Assert(ok, Equals, true)
+	c.Assert(mmu.OnDismiss, NotNil)
+	mmu.OnDismiss(clickhelp.MustParseAppId(anAppId), "xyzzy")
+	// nothing to report for broadcasts
+	mmu.OnDismiss(clickhelp.MustParseAppId(anAppId), "")
+	c.Check(events.events, DeepEquals, []string{anAppId + " xyzzy dismissed "})
+}
+
+func (ps *postalSuite) TestNoEventReporter(c *C) {
+	svc := ps.replaceBuses(NewPostalService(ps.cfg, ps.log))
+	c.Check(svc.events, IsNil)
+	// doesn't panic
+	svc.reportEvent(clickhelp.MustParseAppId(anAppId), "xyzzy", EventAction, "potato://")
 }
 
 func (ps *postalSuite) TestValidateActions(c *C) {
@@ -32,13 +32,29 @@ import (
 	"github.com/ubports/ubuntu-push/click"
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/nih"
+	"github.com/ubports/ubuntu-push/util"
 )
 
+// a KeyPublisher hands out the per-app public keys that get sent
+// along registration requests, for app servers to encrypt payloads
+// to.
+type KeyPublisher interface {
+	PublicKey(appId string) (string, error)
+	Forget(appId string) error
+}
+
 // PushServiceSetup encapsulates the params for setting up a PushService.
 type PushServiceSetup struct {
 	RegURL           *url.URL
 	DeviceId         string
 	InstalledChecker click.InstalledChecker
+	KeyPublisher     KeyPublisher
+	// HTTPProxy is the proxy for registration requests; the
+	// environment's if nil.
+	HTTPProxy *url.URL
+	// Status, if set, returns a snapshot of the client state for
+	// the Status method; it gets marshalled to JSON.
+	Status func() interface{}
 }
 
 // PushService is the dbus api
@@ -47,6 +63,8 @@ type PushService struct {
 	regURL     *url.URL
 	deviceId   string
 	httpCli    http13.Client
+	status     func() interface{}
+	keys       KeyPublisher
 }
 
 var (
@@ -65,6 +83,9 @@ func NewPushService(setup *PushServiceSetup, log logger.Logger) *PushService {
 	svc.installedChecker = setup.InstalledChecker
 	svc.regURL = setup.RegURL
 	svc.deviceId = setup.DeviceId
+	svc.status = setup.Status
+	svc.keys = setup.KeyPublisher
+	svc.httpCli.Transport = util.NewHTTPTransport(setup.HTTPProxy, 0)
 	return svc
 }
 
@@ -85,6 +106,7 @@ func (svc *PushService) Start() error {
 	return svc.DBusService.Start(bus.DispatchMap{
 		"Register":   svc.register,
 		"Unregister": svc.unregister,
+		"Status":     svc.getStatus,
 	}, PushServiceBusAddress, nil)
 }
 
@@ -93,11 +115,13 @@ var (
 	ErrBadRequest = errors.New("bad request")
 	ErrBadToken   = errors.New("bad token")
 	ErrBadAuth    = errors.New("bad auth")
+	ErrNoStatus   = errors.New("no status available")
 )
 
 type registrationRequest struct {
-	DeviceId string `json:"deviceid"`
-	AppId    string `json:"appid"`
+	DeviceId  string `json:"deviceid"`
+	AppId     string `json:"appid"`
+	PublicKey string `json:"publickey,omitempty"`
 }
 
 type registrationReply struct {
@@ -107,8 +131,22 @@ type registrationReply struct {
 	Message string `json:"message"` //
 }
 
-func (svc *PushService) manageReg(op, appId string) (*registrationReply, error) {
-	req_body, err := json.Marshal(registrationRequest{svc.deviceId, appId})
+// statusError maps the non-OK status code of a reply from the
+// registration HTTP endpoint to an error.
+func statusError(statusCode int) error {
+	switch {
+	case statusCode >= http.StatusInternalServerError:
+		// XXX retry on 503
+		return ErrBadServer
+	case statusCode == http.StatusUnauthorized:
+		return ErrBadAuth
+	default:
+		return ErrBadRequest
+	}
+}
+
+func (svc *PushService) manageReg(op, appId, publicKey string) (*registrationReply, error) {
+	req_body, err := json.Marshal(registrationRequest{svc.deviceId, appId, publicKey})
 	if err != nil {
 		return nil, fmt.Errorf("unable to marshal register request body: %v", err)
 	}
@@ -128,15 +166,7 @@ func (svc *PushService) manageReg(op, appId string) (*registrationReply, error)
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		svc.Log.Errorf("register endpoint replied %d", resp.StatusCode)
-		switch {
-		case resp.StatusCode >= http.StatusInternalServerError:
-			// XXX retry on 503
-			return nil, ErrBadServer
-		case resp.StatusCode == http.StatusUnauthorized:
-			return nil, ErrBadAuth
-		default:
-			return nil, ErrBadRequest
-		}
+		return nil, statusError(resp.StatusCode)
 	}
 	// errors below here Can't Happen (tm).
 	body, err := ioutil.ReadAll(resp.Body)
@@ -167,7 +197,16 @@ func (svc *PushService) register(path string, args, _ []interface{}) ([]interfac
 		return []interface{}{rv}, nil
 	}
 
-	reply, err := svc.manageReg("/register", app.Original())
+	var publicKey string
+	if svc.keys != nil {
+		publicKey, err = svc.keys.PublicKey(app.Original())
+		if err != nil {
+			svc.Log.Errorf("unable to get public key for %s: %v", app.Original(), err)
+			return nil, err
+		}
+	}
+
+	reply, err := svc.manageReg("/register", app.Original(), publicKey)
 	if err != nil {
 		return nil, err
 	}
@@ -190,6 +229,62 @@ func (svc *PushService) unregister(path string, args, _ []interface{}) ([]interf
 }
 
 func (svc *PushService) Unregister(appId string) error {
-	_, err := svc.manageReg("/unregister", appId)
+	_, err := svc.manageReg("/unregister", appId, "")
+	if err == nil && svc.keys != nil {
+		err = svc.keys.Forget(appId)
+		if err != nil {
+			svc.Log.Errorf("unable to forget key for %s: %v", appId, err)
+		}
+	}
 	return err
 }
+
+// getStatus returns the JSON-encoded snapshot of the client state.
+func (svc *PushService) getStatus(path string, args, _ []interface{}) ([]interface{}, error) {
+	if len(args) != 0 {
+		return nil, ErrBadArgCount
+	}
+	if svc.status == nil {
+		return nil, ErrNoStatus
+	}
+	b, err := json.Marshal(svc.status())
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal status: %v", err)
+	}
+	return []interface{}{string(b)}, nil
+}
+
+type eventRequest struct {
+	DeviceId string `json:"deviceid"`
+	AppId    string `json:"appid"`
+	MsgId    string `json:"msgid"`
+	Event    string `json:"event"`
+	Action   string `json:"action,omitempty"`
+}
+
+// ReportEvent tells the server that the user took action on (event
+// "action"), or dismissed (event "dismissed"), the notification with
+// id nid of appId, for it to pass on to the app server.
+func (svc *PushService) ReportEvent(appId, nid, event, action string) error {
+	req_body, err := json.Marshal(eventRequest{svc.deviceId, appId, nid, event, action})
+	if err != nil {
+		return fmt.Errorf("unable to marshal event request body: %v", err)
+	}
+
+	req, err := http13.NewRequest("POST", svc.getParsedUrl("/event"), bytes.NewReader(req_body))
+	if err != nil {
+		panic(fmt.Errorf("unable to build event request: %v", err))
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := svc.httpCli.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to report event: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		svc.Log.Errorf("event endpoint replied %d", resp.StatusCode)
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
@@ -18,8 +18,10 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -30,7 +32,6 @@ import (
 	"github.com/ubports/ubuntu-push/bus"
 	testibus "github.com/ubports/ubuntu-push/bus/testing"
 	"github.com/ubports/ubuntu-push/click"
-	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/nih"
 	helpers "github.com/ubports/ubuntu-push/testing"
 	"github.com/ubports/ubuntu-push/testing/condition"
@@ -41,7 +42,7 @@ func TestService(t *testing.T) {
 }
 
 type serviceSuite struct {
-	log logger.Logger
+	log *helpers.TestLogger
 	bus bus.Endpoint
 }
 
@@ -175,7 +176,7 @@ func (ss *serviceSuite) TestRegistrationWorks(c *C) {
 		c.Assert(e, IsNil)
 		req := registrationRequest{}
 		c.Assert(json.Unmarshal(buf[:n], &req), IsNil)
-		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId})
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, ""})
 		c.Check(r.URL.Path, Equals, "/register")
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintln(w, `{"ok":true,"token":"blob-of-bytes"}`)
@@ -196,6 +197,26 @@ func (ss *serviceSuite) TestRegistrationWorks(c *C) {
 	c.Check(regs, Equals, "blob-of-bytes")
 }
 
+func (ss *serviceSuite) TestRegistrationThroughProxy(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.String(), Equals, "http://reg.example.com/register")
+		c.Check(r.Header.Get("Proxy-Authorization"), Equals, "Basic dXNlcjpwYXNz")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true,"token":"blob-of-bytes"}`)
+	}))
+	defer proxy.Close()
+	setup := &PushServiceSetup{
+		DeviceId:  "fake-device-id",
+		RegURL:    helpers.ParseURL("http://reg.example.com/"),
+		HTTPProxy: helpers.ParseURL("http://user:pass@" + proxy.Listener.Addr().String()),
+	}
+	svc := NewPushService(setup, ss.log)
+	svc.Bus = ss.bus
+	reg, err := svc.register(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(reg, DeepEquals, []interface{}{"blob-of-bytes"})
+}
+
 func (ss *serviceSuite) TestRegistrationOverrideWorks(c *C) {
 	envar := "PUSH_REG_" + string(nih.Quote([]byte(anAppId)))
 	os.Setenv(envar, "42")
@@ -277,7 +298,7 @@ func (ss *serviceSuite) TestManageRegFailsOnBadJSON(c *C) {
 		c.Assert(e, IsNil)
 		req := registrationRequest{}
 		c.Assert(json.Unmarshal(buf[:n], &req), IsNil)
-		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId})
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, ""})
 
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintln(w, `{`)
@@ -303,7 +324,7 @@ func (ss *serviceSuite) TestManageRegFailsOnBadJSONDocument(c *C) {
 		c.Assert(e, IsNil)
 		req := registrationRequest{}
 		c.Assert(json.Unmarshal(buf[:n], &req), IsNil)
-		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId})
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, ""})
 
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintln(w, `{"bananas": "very yes"}`)
@@ -329,7 +350,7 @@ func (ss *serviceSuite) TestDBusUnregisterWorks(c *C) {
 		c.Assert(e, IsNil)
 		req := registrationRequest{}
 		c.Assert(json.Unmarshal(buf[:n], &req), IsNil)
-		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId})
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, ""})
 		c.Check(r.URL.Path, Equals, "/unregister")
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintln(w, `{"ok":true,"token":"blob-of-bytes"}`)
@@ -356,7 +377,7 @@ func (ss *serviceSuite) TestUnregistrationWorks(c *C) {
 		c.Assert(e, IsNil)
 		req := registrationRequest{}
 		c.Assert(json.Unmarshal(buf[:n], &req), IsNil)
-		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId})
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, ""})
 		c.Check(r.URL.Path, Equals, "/unregister")
 		invoked <- true
 		w.Header().Set("Content-Type", "application/json")
@@ -373,3 +394,131 @@ func (ss *serviceSuite) TestUnregistrationWorks(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(invoked, HasLen, 1)
 }
+
+type fakeKeys struct {
+	err       error
+	forgotten []string
+}
+
+func (fk *fakeKeys) PublicKey(appId string) (string, error) {
+	return "pubkey-for-" + appId, fk.err
+}
+
+func (fk *fakeKeys) Forget(appId string) error {
+	fk.forgotten = append(fk.forgotten, appId)
+	return nil
+}
+
+func (ss *serviceSuite) TestRegistrationSendsPublicKey(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := registrationRequest{}
+		c.Assert(json.NewDecoder(r.Body).Decode(&req), IsNil)
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, "pubkey-for-" + anAppId})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true,"token":"blob-of-bytes"}`)
+	}))
+	defer ts.Close()
+	setup := &PushServiceSetup{
+		DeviceId:     "fake-device-id",
+		RegURL:       helpers.ParseURL(ts.URL),
+		KeyPublisher: &fakeKeys{},
+	}
+	svc := NewPushService(setup, ss.log)
+	svc.Bus = ss.bus
+	reg, err := svc.register(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Assert(err, IsNil)
+	c.Check(reg, DeepEquals, []interface{}{"blob-of-bytes"})
+}
+
+func (ss *serviceSuite) TestRegistrationFailsIfNoPublicKey(c *C) {
+	keyErr := errors.New("no entropy")
+	setup := &PushServiceSetup{
+		DeviceId:     "fake-device-id",
+		RegURL:       helpers.ParseURL("http://nowhere"),
+		KeyPublisher: &fakeKeys{err: keyErr},
+	}
+	svc := NewPushService(setup, ss.log)
+	svc.Bus = ss.bus
+	reg, err := svc.register(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Check(reg, IsNil)
+	c.Check(err, Equals, keyErr)
+}
+
+func (ss *serviceSuite) TestUnregistrationForgetsKey(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := registrationRequest{}
+		c.Assert(json.NewDecoder(r.Body).Decode(&req), IsNil)
+		// no key sent on unregister
+		c.Check(req, DeepEquals, registrationRequest{"fake-device-id", anAppId, ""})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true}`)
+	}))
+	defer ts.Close()
+	keys := &fakeKeys{}
+	setup := &PushServiceSetup{
+		DeviceId:     "fake-device-id",
+		RegURL:       helpers.ParseURL(ts.URL),
+		KeyPublisher: keys,
+	}
+	svc := NewPushService(setup, ss.log)
+	svc.Bus = ss.bus
+	c.Assert(svc.Unregister(anAppId), IsNil)
+	c.Check(keys.forgotten, DeepEquals, []string{anAppId})
+}
+
+func (ss *serviceSuite) TestStatusWorks(c *C) {
+	setup := &PushServiceSetup{
+		Status: func() interface{} { return map[string]int{"foo": 42} },
+	}
+	svc := NewPushService(setup, ss.log)
+	svc.Bus = ss.bus
+	rvs, err := svc.getStatus(aPackageOnBus, nil, nil)
+	c.Assert(err, IsNil)
+	c.Check(rvs, DeepEquals, []interface{}{`{"foo":42}`})
+}
+
+func (ss *serviceSuite) TestStatusFails(c *C) {
+	svc := NewPushService(testSetup, ss.log)
+	svc.Bus = ss.bus
+	_, err := svc.getStatus(aPackageOnBus, nil, nil)
+	c.Check(err, Equals, ErrNoStatus)
+	_, err = svc.getStatus(aPackageOnBus, []interface{}{anAppId}, nil)
+	c.Check(err, Equals, ErrBadArgCount)
+}
+
+func (ss *serviceSuite) TestReportEvent(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/event")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+		body, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		c.Check(string(body), Equals, `{"deviceid":"fake-device-id","appid":"`+anAppId+`","msgid":"m1","event":"action","action":"app://foo"}`)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true}`)
+	}))
+	defer ts.Close()
+	setup := &PushServiceSetup{
+		DeviceId: "fake-device-id",
+		RegURL:   helpers.ParseURL(ts.URL),
+	}
+	svc := NewPushService(setup, ss.log)
+	c.Check(svc.ReportEvent(anAppId, "m1", "action", "app://foo"), IsNil)
+}
+
+func (ss *serviceSuite) TestReportEventFails(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal Server Error", 500)
+	}))
+	defer ts.Close()
+	setup := &PushServiceSetup{
+		DeviceId: "fake-device-id",
+		RegURL:   helpers.ParseURL(ts.URL),
+	}
+	svc := NewPushService(setup, ss.log)
+	c.Check(svc.ReportEvent(anAppId, "m1", "dismissed", ""), Equals, ErrBadServer)
+	c.Check(ss.log.Captured(), Matches, "(?ms).*event endpoint replied 500.*")
+
+	setup.RegURL = helpers.ParseURL("xyzzy://")
+	svc = NewPushService(setup, ss.log)
+	c.Check(svc.ReportEvent(anAppId, "m1", "dismissed", ""), ErrorMatches, "unable to report event: .*")
+}
@@ -0,0 +1,128 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"errors"
+	"sync"
+)
+
+// AppSettings are the per-app notification toggles. They're on top of
+// the platform's notification settings, where there are any: for
+// something to be presented both need to allow it. Where there are
+// none they alone decide.
+type AppSettings struct {
+	Enabled            bool `json:"enabled"`
+	Bubbles            bool `json:"bubbles"`
+	Sounds             bool `json:"sounds"`
+	Vibrations         bool `json:"vibrations"`
+	EmblemCounter      bool `json:"emblem_counter"`
+	NotificationCentre bool `json:"notification_centre"`
+}
+
+// DefaultAppSettings are the settings of apps nobody changed the
+// settings of: everything allowed.
+var DefaultAppSettings = AppSettings{
+	Enabled:            true,
+	Bubbles:            true,
+	Sounds:             true,
+	Vibrations:         true,
+	EmblemCounter:      true,
+	NotificationCentre: true,
+}
+
+var ErrUnknownSetting = errors.New("unknown setting")
+
+// set sets the toggle with the given key (its JSON name) to value.
+func (settings *AppSettings) set(key string, value bool) error {
+	switch key {
+	case "enabled":
+		settings.Enabled = value
+	case "bubbles":
+		settings.Bubbles = value
+	case "sounds":
+		settings.Sounds = value
+	case "vibrations":
+		settings.Vibrations = value
+	case "emblem_counter":
+		settings.EmblemCounter = value
+	case "notification_centre":
+		settings.NotificationCentre = value
+	default:
+		return ErrUnknownSetting
+	}
+	return nil
+}
+
+// allows returns whether the settings let the presenter with the given
+// (history) name fire.
+func (settings *AppSettings) allows(presenter string) bool {
+	switch presenter {
+	case "bubble":
+		return settings.Bubbles
+	case "vibration":
+		return settings.Vibrations
+	case "emblem-counter":
+		return settings.EmblemCounter
+	case "notification-centre":
+		return settings.NotificationCentre
+	}
+	return true
+}
+
+// Settings keeps the notification settings of each app, by app id
+// without version so they survive upgrades.
+type Settings interface {
+	// Get returns the settings of app (DefaultAppSettings if they
+	// were never set).
+	Get(app string) (AppSettings, error)
+	// Set sets the settings of app.
+	Set(app string, settings AppSettings) error
+	// Close closes the settings.
+	Close()
+}
+
+// memSettings keeps the settings in memory.
+type memSettings struct {
+	lock     sync.Mutex
+	settings map[string]AppSettings
+}
+
+// NewMemSettings returns Settings kept in memory.
+func NewMemSettings() Settings {
+	return &memSettings{settings: make(map[string]AppSettings)}
+}
+
+func (ms *memSettings) Get(app string) (AppSettings, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	settings, ok := ms.settings[app]
+	if !ok {
+		return DefaultAppSettings, nil
+	}
+	return settings, nil
+}
+
+func (ms *memSettings) Set(app string, settings AppSettings) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.settings[app] = settings
+	return nil
+}
+
+func (ms *memSettings) Close() {
+}
@@ -0,0 +1,83 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type settingsSuite struct {
+	constructor func() (Settings, error)
+}
+
+var _ = Suite(&settingsSuite{})
+
+func (s *settingsSuite) SetUpSuite(c *C) {
+	s.constructor = func() (Settings, error) {
+		return NewMemSettings(), nil
+	}
+}
+
+func (s *settingsSuite) TestGetDefaults(c *C) {
+	st, err := s.constructor()
+	c.Assert(err, IsNil)
+	defer st.Close()
+	settings, err := st.Get("com.example.test_test-app")
+	c.Assert(err, IsNil)
+	c.Check(settings, Equals, DefaultAppSettings)
+}
+
+func (s *settingsSuite) TestSetGet(c *C) {
+	st, err := s.constructor()
+	c.Assert(err, IsNil)
+	defer st.Close()
+	settings := DefaultAppSettings
+	settings.Sounds = false
+	c.Assert(st.Set("com.example.test_test-app", settings), IsNil)
+	got, err := st.Get("com.example.test_test-app")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, settings)
+	// other apps are unaffected
+	got, err = st.Get("com.example.test_other-app")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, DefaultAppSettings)
+	// and it can be set again
+	settings.Sounds = true
+	settings.Bubbles = false
+	c.Assert(st.Set("com.example.test_test-app", settings), IsNil)
+	got, err = st.Get("com.example.test_test-app")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, settings)
+}
+
+func (s *settingsSuite) TestSetKey(c *C) {
+	settings := DefaultAppSettings
+	for _, key := range []string{"enabled", "bubbles", "sounds", "vibrations", "emblem_counter", "notification_centre"} {
+		c.Check(settings.set(key, false), IsNil)
+	}
+	c.Check(settings, Equals, AppSettings{})
+	c.Check(settings.set("telepathy", true), Equals, ErrUnknownSetting)
+}
+
+func (s *settingsSuite) TestAllows(c *C) {
+	settings := AppSettings{Bubbles: true, EmblemCounter: true}
+	c.Check(settings.allows("bubble"), Equals, true)
+	c.Check(settings.allows("emblem-counter"), Equals, true)
+	c.Check(settings.allows("vibration"), Equals, false)
+	c.Check(settings.allows("notification-centre"), Equals, false)
+	c.Check(settings.allows("*service.somethingElse"), Equals, true)
+}
@@ -0,0 +1,131 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteHistory keeps the history in an sqlite database, so it
+// survives restarts.
+type sqliteHistory struct {
+	db         *sql.DB
+	maxEntries int
+}
+
+// NewSqliteHistory returns a History persisted in an sqlite database,
+// with at most maxEntries per app (DefaultHistoryMaxEntries if 0).
+func NewSqliteHistory(filename string, maxEntries int) (History, error) {
+	if maxEntries == 0 {
+		maxEntries = DefaultHistoryMaxEntries
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sqlite history %#v: %v", filename, err)
+	}
+	// one connection, so that transactions and :memory: dbs behave
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS history (app_id text not null, nid text, summary text, body text, ts integer, presenters text, action text)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite history table: %v", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS history_app_id ON history (app_id)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite history index: %v", err)
+	}
+	return &sqliteHistory{db: db, maxEntries: maxEntries}, nil
+}
+
+func (sh *sqliteHistory) Add(entry *HistoryEntry) error {
+	tx, err := sh.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot add to history: %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO history (app_id, nid, summary, body, ts, presenters, action) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.AppId, entry.Nid, entry.Summary, entry.Body, entry.Timestamp, strings.Join(entry.Presenters, ","), entry.Action)
+	if err == nil {
+		// forget all but the newest maxEntries
+		_, err = tx.Exec("DELETE FROM history WHERE app_id = ? AND rowid NOT IN (SELECT rowid FROM history WHERE app_id = ? ORDER BY rowid DESC LIMIT ?)",
+			entry.AppId, entry.AppId, sh.maxEntries)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot add to history: %v", err)
+	}
+	return nil
+}
+
+func (sh *sqliteHistory) SetAction(appId, nid, action string) error {
+	_, err := sh.db.Exec("UPDATE history SET action = ? WHERE rowid = (SELECT MAX(rowid) FROM history WHERE app_id = ? AND nid = ?)",
+		action, appId, nid)
+	if err != nil {
+		return fmt.Errorf("cannot set action in history: %v", err)
+	}
+	return nil
+}
+
+func (sh *sqliteHistory) List(appId, text string, limit int) ([]*HistoryEntry, error) {
+	if limit <= 0 {
+		limit = -1 // no limit, for sqlite
+	}
+	rows, err := sh.db.Query("SELECT nid, summary, body, ts, presenters, action FROM history WHERE app_id = ? AND (? = '' OR instr(lower(summary), lower(?)) > 0 OR instr(lower(body), lower(?)) > 0) ORDER BY rowid DESC LIMIT ?",
+		appId, text, text, text, limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read history: %v", err)
+	}
+	defer rows.Close()
+	var entries []*HistoryEntry
+	for rows.Next() {
+		entry := &HistoryEntry{AppId: appId}
+		var presenters string
+		err = rows.Scan(&entry.Nid, &entry.Summary, &entry.Body, &entry.Timestamp, &presenters, &entry.Action)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read history: %v", err)
+		}
+		if presenters != "" {
+			entry.Presenters = strings.Split(presenters, ",")
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read history: %v", err)
+	}
+	return entries, nil
+}
+
+func (sh *sqliteHistory) Clear(appId string) (int, error) {
+	res, err := sh.db.Exec("DELETE FROM history WHERE app_id = ?", appId)
+	if err != nil {
+		return 0, fmt.Errorf("cannot clear history: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("cannot clear history: %v", err)
+	}
+	return int(n), nil
+}
+
+func (sh *sqliteHistory) Close() {
+	sh.db.Close()
+}
@@ -0,0 +1,54 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+)
+
+type sqlHistorySuite struct{ historySuite }
+
+var _ = Suite(&sqlHistorySuite{})
+
+func (s *sqlHistorySuite) SetUpSuite(c *C) {
+	s.constructor = func(maxEntries int) (History, error) {
+		return NewSqliteHistory(":memory:", maxEntries)
+	}
+}
+
+func (s *sqlHistorySuite) TestNewCanFail(c *C) {
+	h, err := NewSqliteHistory("/does/not/exist", 0)
+	c.Check(h, IsNil)
+	c.Check(err, NotNil)
+}
+
+func (s *sqlHistorySuite) TestPersists(c *C) {
+	filename := filepath.Join(c.MkDir(), "history.db")
+	h, err := NewSqliteHistory(filename, 0)
+	c.Assert(err, IsNil)
+	c.Assert(h.Add(testEntry("app1", "n1", "one")), IsNil)
+	h.Close()
+	// as if after a restart
+	h, err = NewSqliteHistory(filename, 0)
+	c.Assert(err, IsNil)
+	defer h.Close()
+	entries, err := h.List("app1", "", 0)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []*HistoryEntry{testEntry("app1", "n1", "one")})
+}
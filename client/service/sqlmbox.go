@@ -0,0 +1,256 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMailboxes keeps the mailboxes in an sqlite database, so they
+// survive restarts.
+type sqliteMailboxes struct {
+	db     *sql.DB
+	limits MailboxLimits
+	// hook for testing
+	now func() time.Time
+}
+
+// NewSqliteMailboxes returns Mailboxes persisted in an sqlite database.
+func NewSqliteMailboxes(filename string, limits MailboxLimits) (Mailboxes, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sqlite mailboxes %#v: %v", filename, err)
+	}
+	// one connection, so that transactions and :memory: dbs behave
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS mailbox (app_id text not null, nid text, msg blob, size integer, ts integer)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite mailbox table: %v", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS mailbox_app_id ON mailbox (app_id)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite mailbox index: %v", err)
+	}
+	return &sqliteMailboxes{db: db, limits: limits, now: time.Now}, nil
+}
+
+// expire drops the expired messages of all mailboxes.
+func (sm *sqliteMailboxes) expire(tx *sql.Tx) error {
+	cutoff := sm.limits.cutoff(sm.now())
+	if cutoff.IsZero() {
+		return nil
+	}
+	_, err := tx.Exec("DELETE FROM mailbox WHERE ts < ?", cutoff.UnixNano())
+	return err
+}
+
+// makeRoom evicts the oldest messages of appId until sz more bytes fit.
+func (sm *sqliteMailboxes) makeRoom(tx *sql.Tx, appId string, sz int) error {
+	maxSize := sm.limits.MaxSize
+	if maxSize == 0 {
+		maxSize = mBoxMaxMessagesSize
+	}
+	var curSize int
+	err := tx.QueryRow("SELECT COALESCE(SUM(size), 0) FROM mailbox WHERE app_id = ?", appId).Scan(&curSize)
+	if err != nil {
+		return err
+	}
+	if curSize+sz <= maxSize {
+		return nil
+	}
+	rows, err := tx.Query("SELECT rowid, size FROM mailbox WHERE app_id = ? ORDER BY rowid", appId)
+	if err != nil {
+		return err
+	}
+	var evict []int64
+	for rows.Next() && curSize+sz > maxSize {
+		var rowid int64
+		var size int
+		err = rows.Scan(&rowid, &size)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		evict = append(evict, rowid)
+		curSize -= size
+	}
+	rows.Close()
+	for _, rowid := range evict {
+		_, err = tx.Exec("DELETE FROM mailbox WHERE rowid = ?", rowid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTx runs f in a transaction, after dropping expired messages; what
+// says what's being done, for errors.
+func (sm *sqliteMailboxes) inTx(what string, f func(tx *sql.Tx) error) error {
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot %s: %v", what, err)
+	}
+	defer tx.Rollback()
+	err = sm.expire(tx)
+	if err == nil {
+		err = f(tx)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot %s: %v", what, err)
+	}
+	return nil
+}
+
+// messages gets the nids and messages of appId with rowid above
+// after, oldest first.
+func messages(tx *sql.Tx, appId string, after int64) ([]string, []string, error) {
+	rows, err := tx.Query("SELECT nid, msg FROM mailbox WHERE app_id = ? AND rowid > ? ORDER BY rowid", appId, after)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var nids, msgs []string
+	for rows.Next() {
+		var nid string
+		var msg []byte
+		err = rows.Scan(&nid, &msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		nids = append(nids, nid)
+		msgs = append(msgs, string(msg))
+	}
+	return nids, msgs, rows.Err()
+}
+
+func (sm *sqliteMailboxes) Append(appId string, message json.RawMessage, nid string) error {
+	return sm.inTx("append to mailbox", func(tx *sql.Tx) error {
+		err := sm.makeRoom(tx, appId, len(message))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO mailbox (app_id, nid, msg, size, ts) VALUES (?, ?, ?, ?, ?)",
+			appId, nid, []byte(message), len(message), sm.now().UnixNano())
+		return err
+	})
+}
+
+func (sm *sqliteMailboxes) PopAll(appId string) ([]string, error) {
+	var msgs []string
+	err := sm.inTx("pop from mailbox", func(tx *sql.Tx) (err error) {
+		_, msgs, err = messages(tx, appId, 0)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM mailbox WHERE app_id = ?", appId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (sm *sqliteMailboxes) PopById(appId, nid string) (string, bool, error) {
+	var msg []byte
+	found := false
+	err := sm.inTx("pop from mailbox", func(tx *sql.Tx) error {
+		var rowid int64
+		err := tx.QueryRow("SELECT rowid, msg FROM mailbox WHERE app_id = ? AND nid = ? ORDER BY rowid LIMIT 1", appId, nid).Scan(&rowid, &msg)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		_, err = tx.Exec("DELETE FROM mailbox WHERE rowid = ?", rowid)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return string(msg), found, nil
+}
+
+func (sm *sqliteMailboxes) MessagesSince(appId, cursor string) ([]string, []string, error) {
+	var nids, msgs []string
+	err := sm.inTx("read mailbox", func(tx *sql.Tx) (err error) {
+		var after int64
+		if cursor != "" {
+			err = tx.QueryRow("SELECT rowid FROM mailbox WHERE app_id = ? AND nid = ? ORDER BY rowid LIMIT 1", appId, cursor).Scan(&after)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		nids, msgs, err = messages(tx, appId, after)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return nids, msgs, nil
+}
+
+func (sm *sqliteMailboxes) Count(appId string) (int, error) {
+	var n int
+	err := sm.inTx("count mailbox", func(tx *sql.Tx) error {
+		return tx.QueryRow("SELECT COUNT(*) FROM mailbox WHERE app_id = ?", appId).Scan(&n)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (sm *sqliteMailboxes) Counts() (map[string]int, error) {
+	counts := make(map[string]int)
+	err := sm.inTx("count mailboxes", func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT app_id, COUNT(*) FROM mailbox GROUP BY app_id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var appId string
+			var n int
+			err = rows.Scan(&appId, &n)
+			if err != nil {
+				return err
+			}
+			counts[appId] = n
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (sm *sqliteMailboxes) Close() {
+	sm.db.Close()
+}
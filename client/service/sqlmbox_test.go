@@ -0,0 +1,55 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+)
+
+type sqlMailboxesSuite struct{ mailboxesSuite }
+
+var _ = Suite(&sqlMailboxesSuite{})
+
+func (s *sqlMailboxesSuite) SetUpSuite(c *C) {
+	s.constructor = func(limits MailboxLimits) (Mailboxes, error) {
+		return NewSqliteMailboxes(":memory:", limits)
+	}
+}
+
+func (s *sqlMailboxesSuite) TestNewCanFail(c *C) {
+	mb, err := NewSqliteMailboxes("/does/not/exist", DefaultMailboxLimits)
+	c.Check(mb, IsNil)
+	c.Check(err, NotNil)
+}
+
+func (s *sqlMailboxesSuite) TestPersists(c *C) {
+	filename := filepath.Join(c.MkDir(), "mailboxes.db")
+	mb, err := NewSqliteMailboxes(filename, DefaultMailboxLimits)
+	c.Assert(err, IsNil)
+	c.Assert(mb.Append("app1", json.RawMessage(`{"m":1}`), "n1"), IsNil)
+	mb.Close()
+	// as if after a restart
+	mb, err = NewSqliteMailboxes(filename, DefaultMailboxLimits)
+	c.Assert(err, IsNil)
+	defer mb.Close()
+	msgs, err := mb.PopAll("app1")
+	c.Assert(err, IsNil)
+	c.Check(msgs, DeepEquals, []string{`{"m":1}`})
+}
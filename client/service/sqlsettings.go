@@ -0,0 +1,80 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSettings keeps the settings in an sqlite database, so they
+// survive restarts.
+type sqliteSettings struct {
+	db *sql.DB
+}
+
+// NewSqliteSettings returns Settings persisted in an sqlite database.
+func NewSqliteSettings(filename string) (Settings, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sqlite settings %#v: %v", filename, err)
+	}
+	// one connection, so that :memory: dbs behave
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS settings (app text primary key not null, settings text not null)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite settings table: %v", err)
+	}
+	return &sqliteSettings{db: db}, nil
+}
+
+func (ss *sqliteSettings) Get(app string) (AppSettings, error) {
+	var raw string
+	err := ss.db.QueryRow("SELECT settings FROM settings WHERE app = ?", app).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return DefaultAppSettings, nil
+	}
+	if err != nil {
+		return DefaultAppSettings, fmt.Errorf("cannot read settings: %v", err)
+	}
+	// start from the defaults, for toggles added since they were saved
+	settings := DefaultAppSettings
+	err = json.Unmarshal([]byte(raw), &settings)
+	if err != nil {
+		return DefaultAppSettings, fmt.Errorf("cannot read settings: %v", err)
+	}
+	return settings, nil
+}
+
+func (ss *sqliteSettings) Set(app string, settings AppSettings) error {
+	raw, err := json.Marshal(&settings)
+	if err != nil {
+		return fmt.Errorf("cannot marshal settings: %v", err)
+	}
+	_, err = ss.db.Exec("INSERT OR REPLACE INTO settings (app, settings) VALUES (?, ?)", app, string(raw))
+	if err != nil {
+		return fmt.Errorf("cannot write settings: %v", err)
+	}
+	return nil
+}
+
+func (ss *sqliteSettings) Close() {
+	ss.db.Close()
+}
@@ -0,0 +1,70 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package service
+
+import (
+	"path/filepath"
+
+	. "launchpad.net/gocheck"
+)
+
+type sqlSettingsSuite struct{ settingsSuite }
+
+var _ = Suite(&sqlSettingsSuite{})
+
+func (s *sqlSettingsSuite) SetUpSuite(c *C) {
+	s.constructor = func() (Settings, error) {
+		return NewSqliteSettings(":memory:")
+	}
+}
+
+func (s *sqlSettingsSuite) TestNewCanFail(c *C) {
+	st, err := NewSqliteSettings("/does/not/exist")
+	c.Check(st, IsNil)
+	c.Check(err, NotNil)
+}
+
+func (s *sqlSettingsSuite) TestPersists(c *C) {
+	filename := filepath.Join(c.MkDir(), "settings.db")
+	st, err := NewSqliteSettings(filename)
+	c.Assert(err, IsNil)
+	settings := DefaultAppSettings
+	settings.Vibrations = false
+	c.Assert(st.Set("app1", settings), IsNil)
+	st.Close()
+	// as if after a restart
+	st, err = NewSqliteSettings(filename)
+	c.Assert(err, IsNil)
+	defer st.Close()
+	got, err := st.Get("app1")
+	c.Assert(err, IsNil)
+	c.Check(got, Equals, settings)
+}
+
+func (s *sqlSettingsSuite) TestMissingTogglesDefault(c *C) {
+	st, err := NewSqliteSettings(":memory:")
+	c.Assert(err, IsNil)
+	defer st.Close()
+	sst := st.(*sqliteSettings)
+	_, err = sst.db.Exec("INSERT INTO settings (app, settings) VALUES (?, ?)", "app1", `{"bubbles": false}`)
+	c.Assert(err, IsNil)
+	got, err := st.Get("app1")
+	c.Assert(err, IsNil)
+	expected := DefaultAppSettings
+	expected.Bubbles = false
+	c.Check(got, Equals, expected)
+}
@@ -0,0 +1,284 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package session
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/util"
+	"github.com/ubports/ubuntu-push/websocket"
+)
+
+// A Dialer sets up the transport to a delivery host, protected with
+// the given TLS configuration; the session protocol runs on top of
+// what it returns. Hosts are host:port pairs or wss:// URLs.
+type Dialer interface {
+	Dial(host string, tlsConfig *tls.Config) (net.Conn, error)
+}
+
+var (
+	ErrNotWebSocketHost = errors.New("not a wss:// host")
+	ErrPipeClosed       = errors.New("pipe dialer closed")
+	ErrNoPipe           = errors.New("no pipe to dial through")
+)
+
+// isWebSocketHost checks whether host is a wss:// URL rather than
+// a host:port pair.
+func isWebSocketHost(host string) bool {
+	return strings.HasPrefix(host, "wss://")
+}
+
+// dialOver connects to host using rawDial to reach addresses, then
+// does TLS, and for wss:// URLs the WebSocket handshake as well
+// (within handshakeTimeout).
+func dialOver(rawDial func(addr string) (net.Conn, error), host string, tlsConfig *tls.Config, handshakeTimeout time.Duration) (net.Conn, error) {
+	if !isWebSocketHost(host) {
+		conn, err := rawDial(host)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(conn, tlsConfig), nil
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	conn, err := rawDial(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if handshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+	wsConn, err := websocket.Client(tlsConn, u)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return wsConn, nil
+}
+
+// NetDialer connects directly over TCP; this is the default.
+type NetDialer struct {
+	Timeout time.Duration
+	// how long to wait before racing IPv4 against IPv6
+	FallbackDelay    time.Duration
+	HandshakeTimeout time.Duration
+}
+
+func (d *NetDialer) Dial(host string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       d.Timeout,
+		FallbackDelay: d.FallbackDelay,
+	}
+	rawDial := func(addr string) (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	}
+	return dialOver(rawDial, host, tlsConfig, d.HandshakeTimeout)
+}
+
+// WebSocketDialer only connects to wss:// hosts, for networks where
+// nothing but HTTPS gets through.
+type WebSocketDialer struct {
+	NetDialer
+}
+
+func (d *WebSocketDialer) Dial(host string, tlsConfig *tls.Config) (net.Conn, error) {
+	if !isWebSocketHost(host) {
+		return nil, ErrNotWebSocketHost
+	}
+	return d.NetDialer.Dial(host, tlsConfig)
+}
+
+// ProxyDialer connects through an HTTP proxy, using CONNECT; https://
+// proxies are themselves talked to over TLS.
+type ProxyDialer struct {
+	Proxy            *url.URL
+	Timeout          time.Duration
+	HandshakeTimeout time.Duration
+	// for https:// proxies; by default the system roots are trusted
+	ProxyTLS *tls.Config
+}
+
+func (d *ProxyDialer) Dial(host string, tlsConfig *tls.Config) (net.Conn, error) {
+	return dialOver(d.connect, host, tlsConfig, d.HandshakeTimeout)
+}
+
+// connect asks the proxy for a tunnel to addr.
+func (d *ProxyDialer) connect(addr string) (net.Conn, error) {
+	proxyAddr := d.Proxy.Host
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		port := "80"
+		if d.Proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyAddr, port)
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if d.Proxy.Scheme == "https" {
+		proxyTLS := d.ProxyTLS
+		if proxyTLS == nil {
+			proxyTLS = &tls.Config{ServerName: d.Proxy.Hostname()}
+		}
+		conn = tls.Client(conn, proxyTLS)
+	}
+	if d.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.HandshakeTimeout))
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if user := d.Proxy.User; user != nil {
+		pass, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	_, err = io.WriteString(conn, req+"\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() != 0 {
+		// the server can't have said anything yet
+		conn.Close()
+		return nil, fmt.Errorf("unexpected data from proxy connecting to %s", addr)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeDialer connects over in-memory pipes, handing out the other
+// ends through Accept. It's a net.Listener, so a server can be run
+// against it without real sockets.
+type PipeDialer struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeDialer makes a PipeDialer.
+func NewPipeDialer() *PipeDialer {
+	return &PipeDialer{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (d *PipeDialer) Dial(host string, tlsConfig *tls.Config) (net.Conn, error) {
+	rawDial := func(string) (net.Conn, error) {
+		cli, srv := net.Pipe()
+		select {
+		case d.conns <- srv:
+			return cli, nil
+		case <-d.done:
+			return nil, ErrPipeClosed
+		}
+	}
+	return dialOver(rawDial, host, tlsConfig, 0)
+}
+
+// Accept waits for the next connection.
+func (d *PipeDialer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-d.conns:
+		return conn, nil
+	case <-d.done:
+		return nil, ErrPipeClosed
+	}
+}
+
+// Close stops both dialing and accepting.
+func (d *PipeDialer) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+func (d *PipeDialer) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// NewDialer makes the Dialer for the given transport: "tls" (or
+// empty) for direct connections, "websocket" to only use wss://
+// hosts, "proxy" to go through the HTTP proxy at proxyURL (checked
+// like any other configured proxy, see util.ParseProxyURL), or
+// "pipe" for in-memory connections through pipe to a server in the
+// same process.
+func NewDialer(transport, proxyURL string, pipe *PipeDialer, connectTimeout, exchangeTimeout time.Duration) (Dialer, error) {
+	netDialer := NetDialer{
+		Timeout:          connectTimeout,
+		FallbackDelay:    connectStagger,
+		HandshakeTimeout: exchangeTimeout,
+	}
+	switch transport {
+	case "", "tls":
+		return &netDialer, nil
+	case "websocket":
+		return &WebSocketDialer{netDialer}, nil
+	case "pipe":
+		if pipe == nil {
+			return nil, ErrNoPipe
+		}
+		return pipe, nil
+	case "proxy":
+		proxy, err := util.ParseProxyURL(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy url: %v", err)
+		}
+		if proxy == nil {
+			return nil, errors.New("bad proxy url: none given")
+		}
+		return &ProxyDialer{
+			Proxy:            proxy,
+			Timeout:          connectTimeout,
+			HandshakeTimeout: exchangeTimeout,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transport: %#v", transport)
+}
@@ -0,0 +1,214 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package session
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	helpers "github.com/ubports/ubuntu-push/testing"
+)
+
+type dialerSuite struct{}
+
+var _ = Suite(&dialerSuite{})
+
+func (s *dialerSuite) TestNewDialer(c *C) {
+	d, err := NewDialer("", "", nil, time.Second, 2*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(d, DeepEquals, &NetDialer{time.Second, connectStagger, 2 * time.Second})
+	d, err = NewDialer("tls", "", nil, time.Second, 2*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(d, FitsTypeOf, &NetDialer{})
+	d, err = NewDialer("websocket", "", nil, time.Second, 2*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(d, FitsTypeOf, &WebSocketDialer{})
+	d, err = NewDialer("proxy", "http://proxy:3128", nil, time.Second, 2*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(d, FitsTypeOf, &ProxyDialer{})
+	c.Check(d.(*ProxyDialer).Proxy.Host, Equals, "proxy:3128")
+	d, err = NewDialer("proxy", "https://proxy", nil, time.Second, 2*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(d, FitsTypeOf, &ProxyDialer{})
+	c.Check(d.(*ProxyDialer).Proxy.Scheme, Equals, "https")
+	pipe := NewPipeDialer()
+	d, err = NewDialer("pipe", "", pipe, time.Second, 2*time.Second)
+	c.Assert(err, IsNil)
+	c.Check(d, Equals, pipe)
+}
+
+func (s *dialerSuite) TestNewDialerFails(c *C) {
+	_, err := NewDialer("carrier-pigeon", "", nil, 0, 0)
+	c.Check(err, ErrorMatches, `unknown transport: "carrier-pigeon"`)
+	_, err = NewDialer("proxy", "", nil, 0, 0)
+	c.Check(err, ErrorMatches, "bad proxy url: none given")
+	_, err = NewDialer("proxy", "socks5://proxy", nil, 0, 0)
+	c.Check(err, ErrorMatches, "bad proxy url: not an http\\(s\\) url.*")
+	_, err = NewDialer("pipe", "", nil, 0, 0)
+	c.Check(err, Equals, ErrNoPipe)
+}
+
+func (s *dialerSuite) TestWebSocketDialerSkipsPlainHosts(c *C) {
+	d := &WebSocketDialer{}
+	_, err := d.Dial("foo:443", &tls.Config{})
+	c.Check(err, Equals, ErrNotWebSocketHost)
+}
+
+// testProxy runs a CONNECT proxy, sending the requests it gets down reqs.
+func testProxy(c *C, status string, reqs chan<- *http.Request) net.Listener {
+	lst, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, IsNil)
+	return serveTestProxy(lst, status, reqs)
+}
+
+// serveTestProxy is testProxy on the given listener.
+func serveTestProxy(lst net.Listener, status string, reqs chan<- *http.Request) net.Listener {
+	go func() {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				reqs <- req
+				io.WriteString(conn, "HTTP/1.1 "+status+"\r\n\r\n")
+				if status[:3] != "200" {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return lst
+}
+
+func (s *dialerSuite) TestProxyDialerWorks(c *C) {
+	lst, err := tls.Listen("tcp", "localhost:0", helpers.TestTLSServerConfig)
+	c.Assert(err, IsNil)
+	defer lst.Close()
+	go func() {
+		conn, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "hello")
+		conn.Close()
+	}()
+	reqs := make(chan *http.Request, 1)
+	proxy := testProxy(c, "200 Connection established", reqs)
+	defer proxy.Close()
+
+	d, err := NewDialer("proxy", "http://user:pass@"+proxy.Addr().String(), nil, time.Second, time.Second)
+	c.Assert(err, IsNil)
+	conn, err := d.Dial(lst.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, "hello")
+
+	req := <-reqs
+	c.Check(req.Method, Equals, "CONNECT")
+	c.Check(req.Host, Equals, lst.Addr().String())
+	c.Check(req.Header.Get("Proxy-Authorization"), Equals, "Basic dXNlcjpwYXNz")
+}
+
+func (s *dialerSuite) TestProxyDialerOverTLS(c *C) {
+	lst, err := tls.Listen("tcp", "localhost:0", helpers.TestTLSServerConfig)
+	c.Assert(err, IsNil)
+	defer lst.Close()
+	go func() {
+		conn, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "hello")
+		conn.Close()
+	}()
+	proxyLst, err := tls.Listen("tcp", "localhost:0", helpers.TestTLSServerConfig)
+	c.Assert(err, IsNil)
+	reqs := make(chan *http.Request, 1)
+	proxy := serveTestProxy(proxyLst, "200 Connection established", reqs)
+	defer proxy.Close()
+
+	d, err := NewDialer("proxy", "https://"+proxy.Addr().String(), nil, time.Second, time.Second)
+	c.Assert(err, IsNil)
+	d.(*ProxyDialer).ProxyTLS = &tls.Config{InsecureSkipVerify: true}
+	conn, err := d.Dial(lst.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, "hello")
+	c.Check((<-reqs).Method, Equals, "CONNECT")
+}
+
+func (s *dialerSuite) TestProxyDialerRefused(c *C) {
+	reqs := make(chan *http.Request, 1)
+	proxy := testProxy(c, "403 Forbidden", reqs)
+	defer proxy.Close()
+
+	d, err := NewDialer("proxy", "http://"+proxy.Addr().String(), nil, time.Second, time.Second)
+	c.Assert(err, IsNil)
+	_, err = d.Dial("foo:443", &tls.Config{})
+	c.Check(err, ErrorMatches, "proxy refused to connect to foo:443: 403 Forbidden")
+	c.Check((<-reqs).Header.Get("Proxy-Authorization"), Equals, "")
+}
+
+func (s *dialerSuite) TestPipeDialer(c *C) {
+	d := NewPipeDialer()
+	var _ net.Listener = d
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := d.Accept()
+		c.Check(err, IsNil)
+		accepted <- conn
+	}()
+	conn, err := d.Dial("foo:443", &tls.Config{})
+	c.Assert(err, IsNil)
+	c.Check(conn, FitsTypeOf, &tls.Conn{})
+	c.Check(<-accepted, NotNil)
+
+	c.Check(d.Close(), IsNil)
+	// closing twice is fine
+	c.Check(d.Close(), IsNil)
+	_, err = d.Dial("foo:443", &tls.Config{})
+	c.Check(err, Equals, ErrPipeClosed)
+	_, err = d.Accept()
+	c.Check(err, Equals, ErrPipeClosed)
+}
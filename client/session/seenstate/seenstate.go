@@ -19,9 +19,35 @@
 package seenstate
 
 import (
+	"sync"
+	"time"
+
 	"github.com/ubports/ubuntu-push/protocol"
 )
 
+// Retention bounds how many seen message ids get remembered, and for
+// how long.
+type Retention struct {
+	// remember at most this many (0 means no limit)
+	MaxCount int
+	// forget them after this long (0 means no limit)
+	MaxAge time.Duration
+	// how often to drop what's beyond the limits
+	CompactInterval time.Duration
+}
+
+// DefaultRetention is what NewSeenState and NewSqliteSeenState use.
+var DefaultRetention = Retention{
+	MaxCount:        10000,
+	MaxAge:          30 * 24 * time.Hour,
+	CompactInterval: time.Hour,
+}
+
+// compactionDue checks whether it's time to compact again.
+func (r *Retention) compactionDue(last, now time.Time) bool {
+	return now.Sub(last) >= r.CompactInterval
+}
+
 type SeenState interface {
 	// Set() (re)sets the given level to the given value.
 	SetLevel(level string, top int64) error
@@ -30,13 +56,36 @@ type SeenState interface {
 	// FilterBySeen filters notifications already seen, keep track
 	// of them as well.
 	FilterBySeen([]protocol.Notification) ([]protocol.Notification, error)
+	// FilterBySeenAndStore is like FilterBySeen, also keeping the
+	// ones not seen before in the inbox (see StoreNotifications).
+	// It's all or nothing: if they can't be kept they aren't
+	// recorded as seen either.
+	FilterBySeenAndStore([]protocol.Notification) ([]protocol.Notification, error)
+	// StoreNotifications keeps notifications in the inbox until
+	// they are dropped, so they can be replayed if they don't get
+	// delivered.
+	StoreNotifications([]protocol.Notification) error
+	// DropNotification removes a delivered notification from the inbox.
+	DropNotification(msgId string) error
+	// PendingNotifications returns the notifications in the inbox,
+	// oldest first.
+	PendingNotifications() ([]protocol.Notification, error)
 	// Close closes state.
 	Close()
 }
 
 type memSeenState struct {
 	levels   map[string]int64
-	seenMsgs map[string]bool
+	seenMsgs map[string]time.Time
+	// seen msg ids, oldest first
+	seenOrder      []string
+	retention      Retention
+	lastCompaction time.Time
+	// hook for testing
+	now func() time.Time
+	// the inbox is used from more than one goroutine
+	inboxLock sync.Mutex
+	inbox     []protocol.Notification
 }
 
 func (m *memSeenState) SetLevel(level string, top int64) error {
@@ -48,18 +97,78 @@ func (m *memSeenState) GetAllLevels() (map[string]int64, error) {
 }
 
 func (m *memSeenState) FilterBySeen(notifs []protocol.Notification) ([]protocol.Notification, error) {
+	now := m.now()
 	acc := make([]protocol.Notification, 0, len(notifs))
 	for _, notif := range notifs {
-		seen := m.seenMsgs[notif.MsgId]
+		_, seen := m.seenMsgs[notif.MsgId]
 		if seen {
 			continue
 		}
-		m.seenMsgs[notif.MsgId] = true
+		m.seenMsgs[notif.MsgId] = now
+		m.seenOrder = append(m.seenOrder, notif.MsgId)
 		acc = append(acc, notif)
 	}
+	if m.retention.compactionDue(m.lastCompaction, now) {
+		m.compact(now)
+	}
 	return acc, nil
 }
 
+func (m *memSeenState) FilterBySeenAndStore(notifs []protocol.Notification) ([]protocol.Notification, error) {
+	// keeping them in memory can't fail
+	acc, _ := m.FilterBySeen(notifs)
+	m.StoreNotifications(acc)
+	return acc, nil
+}
+
+// compact forgets the seen msgs beyond the retention limits.
+func (m *memSeenState) compact(now time.Time) {
+	m.lastCompaction = now
+	drop := 0
+	if m.retention.MaxCount > 0 && len(m.seenOrder) > m.retention.MaxCount {
+		drop = len(m.seenOrder) - m.retention.MaxCount
+	}
+	if m.retention.MaxAge > 0 {
+		cutoff := now.Add(-m.retention.MaxAge)
+		for drop < len(m.seenOrder) && m.seenMsgs[m.seenOrder[drop]].Before(cutoff) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+	for _, msgId := range m.seenOrder[:drop] {
+		delete(m.seenMsgs, msgId)
+	}
+	// copy so the dropped ones can be collected
+	m.seenOrder = append([]string(nil), m.seenOrder[drop:]...)
+}
+
+func (m *memSeenState) StoreNotifications(notifs []protocol.Notification) error {
+	m.inboxLock.Lock()
+	defer m.inboxLock.Unlock()
+	m.inbox = append(m.inbox, notifs...)
+	return nil
+}
+
+func (m *memSeenState) DropNotification(msgId string) error {
+	m.inboxLock.Lock()
+	defer m.inboxLock.Unlock()
+	for i, notif := range m.inbox {
+		if notif.MsgId == msgId {
+			m.inbox = append(m.inbox[:i], m.inbox[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memSeenState) PendingNotifications() ([]protocol.Notification, error) {
+	m.inboxLock.Lock()
+	defer m.inboxLock.Unlock()
+	return append([]protocol.Notification(nil), m.inbox...), nil
+}
+
 func (m *memSeenState) Close() {
 }
 
@@ -68,8 +177,17 @@ var _ SeenState = (*memSeenState)(nil)
 // NewSeenState returns an implementation of SeenState that is memory-based and
 // does not save state.
 func NewSeenState() (SeenState, error) {
+	return NewSeenStateRetaining(DefaultRetention)
+}
+
+// NewSeenStateRetaining is like NewSeenState, remembering seen
+// messages as specified by retention.
+func NewSeenStateRetaining(retention Retention) (SeenState, error) {
 	return &memSeenState{
-		levels:   make(map[string]int64),
-		seenMsgs: make(map[string]bool),
+		levels:         make(map[string]int64),
+		seenMsgs:       make(map[string]time.Time),
+		retention:      retention,
+		lastCompaction: time.Now(),
+		now:            time.Now,
 	}, nil
 }
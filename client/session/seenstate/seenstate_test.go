@@ -18,6 +18,7 @@ package seenstate
 
 import (
 	"testing"
+	"time"
 
 	. "launchpad.net/gocheck"
 
@@ -28,12 +29,25 @@ func TestSeenState(t *testing.T) { TestingT(t) }
 
 type ssSuite struct {
 	constructor func() (SeenState, error)
+	retaining   func(Retention) (SeenState, error)
 }
 
 var _ = Suite(&ssSuite{})
 
 func (s *ssSuite) SetUpSuite(c *C) {
 	s.constructor = NewSeenState
+	s.retaining = NewSeenStateRetaining
+}
+
+// clock digs out the time related bits of ss
+func clock(ss SeenState) (now *func() time.Time, lastCompaction *time.Time) {
+	switch x := ss.(type) {
+	case *memSeenState:
+		return &x.now, &x.lastCompaction
+	case *sqliteSeenState:
+		return &x.now, &x.lastCompaction
+	}
+	panic("unknown SeenState implementation")
 }
 
 func (s *ssSuite) TestAllTheLevelThings(c *C) {
@@ -79,8 +93,130 @@ func (s *ssSuite) TestFilterBySeen(c *C) {
 	// already seen n1-n3 removed
 	c.Check(res, DeepEquals, []protocol.Notification{n4, n5})
 
+	res, err = ss.FilterBySeen([]protocol.Notification{n4})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+	// the ones before are still remembered, retention decides
+	// when they're forgotten
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+
 	// corner case
 	res, err = ss.FilterBySeen([]protocol.Notification{})
 	c.Assert(err, IsNil)
 	c.Assert(res, HasLen, 0)
 }
+
+func (s *ssSuite) TestInbox(c *C) {
+	ss, err := s.constructor()
+	c.Assert(err, IsNil)
+	n1 := protocol.Notification{AppId: "app1", MsgId: "m1", Payload: []byte(`{"m":1}`)}
+	n2 := protocol.Notification{AppId: "app2", MsgId: "m2", Payload: []byte(`{"m":2}`)}
+	n3 := protocol.Notification{AppId: "app1", MsgId: "m3", Payload: []byte(`{"m":3}`)}
+
+	pending, err := ss.PendingNotifications()
+	c.Assert(err, IsNil)
+	c.Check(pending, HasLen, 0)
+
+	c.Assert(ss.StoreNotifications([]protocol.Notification{n1, n2}), IsNil)
+	c.Assert(ss.StoreNotifications([]protocol.Notification{n3}), IsNil)
+	pending, err = ss.PendingNotifications()
+	c.Assert(err, IsNil)
+	c.Check(pending, DeepEquals, []protocol.Notification{n1, n2, n3})
+
+	c.Assert(ss.DropNotification("m2"), IsNil)
+	// dropping something not there is fine
+	c.Assert(ss.DropNotification("m42"), IsNil)
+	pending, err = ss.PendingNotifications()
+	c.Assert(err, IsNil)
+	c.Check(pending, DeepEquals, []protocol.Notification{n1, n3})
+}
+
+func (s *ssSuite) TestFilterBySeenAndStore(c *C) {
+	ss, err := s.constructor()
+	c.Assert(err, IsNil)
+	n1 := protocol.Notification{AppId: "app1", MsgId: "m1", Payload: []byte(`{"m":1}`)}
+	n2 := protocol.Notification{AppId: "app2", MsgId: "m2", Payload: []byte(`{"m":2}`)}
+
+	res, err := ss.FilterBySeenAndStore([]protocol.Notification{n1})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1})
+	res, err = ss.FilterBySeenAndStore([]protocol.Notification{n1, n2})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n2})
+	// only the unseen ones went in the inbox, once
+	pending, err := ss.PendingNotifications()
+	c.Assert(err, IsNil)
+	c.Check(pending, DeepEquals, []protocol.Notification{n1, n2})
+}
+
+func (s *ssSuite) TestRetainsMaxCount(c *C) {
+	ss, err := s.retaining(Retention{MaxCount: 2})
+	c.Assert(err, IsNil)
+	n1 := protocol.Notification{MsgId: "m1"}
+	n2 := protocol.Notification{MsgId: "m2"}
+	n3 := protocol.Notification{MsgId: "m3"}
+
+	res, err := ss.FilterBySeen([]protocol.Notification{n1, n2, n3})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2, n3})
+	// the oldest was forgotten
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2, n3})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1})
+}
+
+func (s *ssSuite) TestRetainsMaxAge(c *C) {
+	ss, err := s.retaining(Retention{MaxAge: time.Hour})
+	c.Assert(err, IsNil)
+	n1 := protocol.Notification{MsgId: "m1"}
+	n2 := protocol.Notification{MsgId: "m2"}
+	t0 := time.Now()
+	now, _ := clock(ss)
+	*now = func() time.Time { return t0 }
+
+	res, err := ss.FilterBySeen([]protocol.Notification{n1, n2})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2})
+	*now = func() time.Time { return t0.Add(30 * time.Minute) }
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+	// too old now, they get forgotten
+	*now = func() time.Time { return t0.Add(2 * time.Hour) }
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2})
+}
+
+func (s *ssSuite) TestCompactsPeriodically(c *C) {
+	ss, err := s.retaining(Retention{MaxCount: 1, CompactInterval: time.Hour})
+	c.Assert(err, IsNil)
+	n1 := protocol.Notification{MsgId: "m1"}
+	n2 := protocol.Notification{MsgId: "m2"}
+	n3 := protocol.Notification{MsgId: "m3"}
+	now, lastCompaction := clock(ss)
+	t0 := *lastCompaction
+	*now = func() time.Time { return t0.Add(time.Minute) }
+
+	res, err := ss.FilterBySeen([]protocol.Notification{n1, n2, n3})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2, n3})
+	// not compacted yet
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2, n3})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+	*now = func() time.Time { return t0.Add(2 * time.Hour) }
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2, n3})
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+	c.Check(*lastCompaction, Equals, t0.Add(2*time.Hour))
+	// compacted down to the newest
+	res, err = ss.FilterBySeen([]protocol.Notification{n1, n2, n3})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2})
+}
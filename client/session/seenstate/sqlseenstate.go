@@ -18,8 +18,10 @@ package seenstate
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -27,25 +29,65 @@ import (
 )
 
 type sqliteSeenState struct {
-	db *sql.DB
+	db             *sql.DB
+	retention      Retention
+	lastCompaction time.Time
+	// hook for testing
+	now func() time.Time
 }
 
 // NewSqliteSeenState returns an implementation of SeenState that
 // keeps and persists the state in an sqlite database.
 func NewSqliteSeenState(filename string) (SeenState, error) {
+	return NewSqliteSeenStateRetaining(filename, DefaultRetention)
+}
+
+// NewSqliteSeenStateRetaining is like NewSqliteSeenState, remembering
+// seen messages as specified by retention.
+func NewSqliteSeenStateRetaining(filename string, retention Retention) (SeenState, error) {
 	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open sqlite level map %#v: %v", filename, err)
 	}
+	// one connection, so that transactions and :memory: dbs behave
+	db.SetMaxOpenConns(1)
 	_, err = db.Exec("CREATE TABLE IF NOT EXISTS level_map (level text primary key, top integer)")
 	if err != nil {
 		return nil, fmt.Errorf("cannot (re)create sqlite level map table: %v", err)
 	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS seen_msgs (id text primary key)")
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS seen_msgs (id text primary key, ts integer default 0)")
 	if err != nil {
 		return nil, fmt.Errorf("cannot (re)create sqlite seen msgs table: %v", err)
 	}
-	return &sqliteSeenState{db}, nil
+	// tables from before the retention work lack the timestamp;
+	// what they have counts as seen now
+	_, err = db.Exec("ALTER TABLE seen_msgs ADD COLUMN ts integer default 0")
+	if err == nil {
+		_, err = db.Exec("UPDATE seen_msgs SET ts = ?", time.Now().Unix())
+	}
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return nil, fmt.Errorf("cannot upgrade sqlite seen msgs table: %v", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS seen_msgs_ts ON seen_msgs (ts)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite seen msgs index: %v", err)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS inbox (id text primary key, notif blob)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot (re)create sqlite inbox table: %v", err)
+	}
+	ps := &sqliteSeenState{
+		db:        db,
+		retention: retention,
+		now:       time.Now,
+	}
+	// what was left beyond the limits by previous runs goes now,
+	// later it goes as new ones come in
+	err = ps.compact(ps.now())
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
 }
 
 // Closes closes the underlying db.
@@ -78,29 +120,162 @@ func (ps *sqliteSeenState) GetAllLevels() (map[string]int64, error) {
 	return m, nil
 }
 
-func (ps *sqliteSeenState) dropPrevThan(msgId string) error {
-	_, err := ps.db.Exec("DELETE FROM seen_msgs WHERE rowid < (SELECT rowid FROM seen_msgs WHERE id = ?)", msgId)
-	return err
+func (ps *sqliteSeenState) FilterBySeen(notifs []protocol.Notification) ([]protocol.Notification, error) {
+	return ps.filterBySeen(notifs, false)
 }
 
-func (ps *sqliteSeenState) FilterBySeen(notifs []protocol.Notification) ([]protocol.Notification, error) {
+func (ps *sqliteSeenState) FilterBySeenAndStore(notifs []protocol.Notification) ([]protocol.Notification, error) {
+	return ps.filterBySeen(notifs, true)
+}
+
+func (ps *sqliteSeenState) filterBySeen(notifs []protocol.Notification, keep bool) ([]protocol.Notification, error) {
 	if len(notifs) == 0 {
 		return nil, nil
 	}
+	now := ps.now()
+	acc, err := ps.insertSeen(notifs, now, keep)
+	if err != nil {
+		return nil, err
+	}
+	if ps.retention.compactionDue(ps.lastCompaction, now) {
+		err = ps.compact(now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// insertSeen records notifs as seen in one transaction, returning the
+// ones that weren't already. With keep those also go in the inbox, in
+// the same transaction.
+func (ps *sqliteSeenState) insertSeen(notifs []protocol.Notification, now time.Time, keep bool) ([]protocol.Notification, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start inserting in seen msgs: %v", err)
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO seen_msgs (id, ts) VALUES (?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("cannot insert in seen msgs: %v", err)
+	}
+	defer stmt.Close()
+	var inboxStmt *sql.Stmt
+	if keep {
+		inboxStmt, err = tx.Prepare("REPLACE INTO inbox (id, notif) VALUES (?, ?)")
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("cannot insert in inbox: %v", err)
+		}
+		defer inboxStmt.Close()
+	}
+	ts := now.Unix()
 	acc := make([]protocol.Notification, 0, len(notifs))
 	for _, notif := range notifs {
-		_, err := ps.db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", notif.MsgId)
+		res, err := stmt.Exec(notif.MsgId, ts)
 		if err != nil {
-			if strings.HasSuffix(err.Error(), "UNIQUE constraint failed: seen_msgs.id") {
-				continue
-			}
+			tx.Rollback()
 			return nil, fmt.Errorf("cannot insert %#v in seen msgs: %v", notif.MsgId, err)
 		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("cannot insert %#v in seen msgs: %v", notif.MsgId, err)
+		}
+		if n == 0 {
+			// already seen
+			continue
+		}
+		if keep {
+			err = storeNotification(inboxStmt, notif)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
 		acc = append(acc, notif)
 	}
-	err := ps.dropPrevThan(notifs[0].MsgId)
+	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("cannot delete obsolete seen msgs: %v", err)
+		return nil, fmt.Errorf("cannot commit seen msgs: %v", err)
 	}
 	return acc, nil
 }
+
+// compact forgets the seen msgs beyond the retention limits.
+func (ps *sqliteSeenState) compact(now time.Time) error {
+	ps.lastCompaction = now
+	if ps.retention.MaxAge > 0 {
+		cutoff := now.Add(-ps.retention.MaxAge).Unix()
+		_, err := ps.db.Exec("DELETE FROM seen_msgs WHERE ts < ?", cutoff)
+		if err != nil {
+			return fmt.Errorf("cannot delete old seen msgs: %v", err)
+		}
+	}
+	if ps.retention.MaxCount > 0 {
+		_, err := ps.db.Exec("DELETE FROM seen_msgs WHERE rowid <= (SELECT rowid FROM seen_msgs ORDER BY rowid DESC LIMIT 1 OFFSET ?)", ps.retention.MaxCount)
+		if err != nil {
+			return fmt.Errorf("cannot delete excess seen msgs: %v", err)
+		}
+	}
+	return nil
+}
+
+// storeNotification puts notif in the inbox with stmt.
+func storeNotification(stmt *sql.Stmt, notif protocol.Notification) error {
+	b, err := json.Marshal(notif)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %#v for the inbox: %v", notif.MsgId, err)
+	}
+	_, err = stmt.Exec(notif.MsgId, b)
+	if err != nil {
+		return fmt.Errorf("cannot insert %#v in inbox: %v", notif.MsgId, err)
+	}
+	return nil
+}
+
+func (ps *sqliteSeenState) StoreNotifications(notifs []protocol.Notification) error {
+	stmt, err := ps.db.Prepare("REPLACE INTO inbox (id, notif) VALUES (?, ?)")
+	if err != nil {
+		return fmt.Errorf("cannot insert in inbox: %v", err)
+	}
+	defer stmt.Close()
+	for _, notif := range notifs {
+		err = storeNotification(stmt, notif)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *sqliteSeenState) DropNotification(msgId string) error {
+	_, err := ps.db.Exec("DELETE FROM inbox WHERE id = ?", msgId)
+	if err != nil {
+		return fmt.Errorf("cannot delete %#v from inbox: %v", msgId, err)
+	}
+	return nil
+}
+
+func (ps *sqliteSeenState) PendingNotifications() ([]protocol.Notification, error) {
+	rows, err := ps.db.Query("SELECT notif FROM inbox ORDER BY rowid")
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve notifications from inbox: %v", err)
+	}
+	defer rows.Close()
+	var notifs []protocol.Notification
+	for rows.Next() {
+		var b []byte
+		err = rows.Scan(&b)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read notification from inbox: %v", err)
+		}
+		var notif protocol.Notification
+		err = json.Unmarshal(b, &notif)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal notification from inbox: %v", err)
+		}
+		notifs = append(notifs, notif)
+	}
+	return notifs, nil
+}
@@ -18,6 +18,12 @@ package seenstate
 
 import (
 	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	. "launchpad.net/gocheck"
@@ -31,6 +37,9 @@ var _ = Suite(&sqlsSuite{})
 
 func (s *sqlsSuite) SetUpSuite(c *C) {
 	s.constructor = func() (SeenState, error) { return NewSqliteSeenState(":memory:") }
+	s.retaining = func(r Retention) (SeenState, error) {
+		return NewSqliteSeenStateRetaining(":memory:", r)
+	}
 }
 
 func (s *sqlsSuite) TestNewCanFail(c *C) {
@@ -112,68 +121,136 @@ func (s *sqlsSuite) TestFilterBySeenCanFail(c *C) {
 	c.Check(err, ErrorMatches, "cannot insert .*")
 }
 
-func (s *sqlsSuite) TestClose(c *C) {
+func (s *sqlsSuite) TestFilterBySeenAndStoreCanFail(c *C) {
 	dir := c.MkDir()
 	filename := dir + "test.db"
+	db, err := sql.Open("sqlite3", filename)
+	c.Assert(err, IsNil)
+	// create the wrong kind of table
+	_, err = db.Exec("CREATE TABLE inbox AS SELECT 'what'")
+	c.Assert(err, IsNil)
 	sqls, err := NewSqliteSeenState(filename)
 	c.Check(err, IsNil)
 	c.Assert(sqls, NotNil)
-	sqls.Close()
+	n1 := protocol.Notification{MsgId: "m1"}
+	res, err := sqls.FilterBySeenAndStore([]protocol.Notification{n1})
+	c.Check(res, IsNil)
+	c.Check(err, ErrorMatches, "cannot insert in inbox: .*")
+	// and it wasn't recorded as seen either, to get it again
+	res, err = sqls.FilterBySeen([]protocol.Notification{n1})
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{n1})
 }
 
-func (s *sqlsSuite) TestDropPrevThan(c *C) {
+func (s *sqlsSuite) TestClose(c *C) {
 	dir := c.MkDir()
 	filename := dir + "test.db"
-	db, err := sql.Open("sqlite3", filename)
-	c.Assert(err, IsNil)
 	sqls, err := NewSqliteSeenState(filename)
 	c.Check(err, IsNil)
 	c.Assert(sqls, NotNil)
+	sqls.Close()
+}
 
-	_, err = db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", "m1")
+func (s *sqlsSuite) TestInboxSurvivesReopen(c *C) {
+	filename := c.MkDir() + "/test.db"
+	sqls, err := NewSqliteSeenState(filename)
 	c.Assert(err, IsNil)
-	_, err = db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", "m2")
+	n1 := protocol.Notification{AppId: "app1", MsgId: "m1", Payload: []byte(`{"m":1}`)}
+	c.Assert(sqls.StoreNotifications([]protocol.Notification{n1}), IsNil)
+	sqls.Close()
+
+	sqls, err = NewSqliteSeenState(filename)
 	c.Assert(err, IsNil)
-	_, err = db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", "m3")
+	defer sqls.Close()
+	pending, err := sqls.PendingNotifications()
 	c.Assert(err, IsNil)
-	_, err = db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", "m4")
+	c.Check(pending, DeepEquals, []protocol.Notification{n1})
+}
+
+func (s *sqlsSuite) TestUpgradesOldTable(c *C) {
+	filename := c.MkDir() + "/test.db"
+	db, err := sql.Open("sqlite3", filename)
 	c.Assert(err, IsNil)
-	_, err = db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", "m5")
+	defer db.Close()
+	// seen msgs as created by older versions
+	_, err = db.Exec("CREATE TABLE seen_msgs (id text primary key)")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO seen_msgs (id) VALUES (?)", "m1")
 	c.Assert(err, IsNil)
 
-	rows, err := db.Query("SELECT COUNT(*) FROM seen_msgs")
+	sqls, err := NewSqliteSeenState(filename)
 	c.Assert(err, IsNil)
-	rows.Next()
-	var i int
-	err = rows.Scan(&i)
+	defer sqls.Close()
+	n1 := protocol.Notification{MsgId: "m1"}
+	n2 := protocol.Notification{MsgId: "m2"}
+	res, err := sqls.FilterBySeen([]protocol.Notification{n1, n2})
 	c.Assert(err, IsNil)
-	c.Check(i, Equals, 5)
-	rows.Close()
-
-	err = sqls.(*sqliteSeenState).dropPrevThan("m3")
+	c.Check(res, DeepEquals, []protocol.Notification{n2})
+	// and reopening is fine
+	sqls2, err := NewSqliteSeenState(filename)
 	c.Assert(err, IsNil)
+	sqls2.Close()
+}
 
-	rows, err = db.Query("SELECT COUNT(*) FROM seen_msgs")
+func (s *sqlsSuite) TestCompactsOnOpen(c *C) {
+	filename := c.MkDir() + "/test.db"
+	sqls, err := NewSqliteSeenState(filename)
 	c.Assert(err, IsNil)
-	rows.Next()
-	err = rows.Scan(&i)
+	n1 := protocol.Notification{MsgId: "m1"}
+	n2 := protocol.Notification{MsgId: "m2"}
+	res, err := sqls.FilterBySeen([]protocol.Notification{n1, n2})
 	c.Assert(err, IsNil)
-	c.Check(i, Equals, 3)
-	rows.Close()
+	c.Check(res, DeepEquals, []protocol.Notification{n1, n2})
+	sqls.Close()
 
-	var msgId string
-	rows, err = db.Query("SELECT * FROM seen_msgs")
-	rows.Next()
-	err = rows.Scan(&msgId)
-	c.Assert(err, IsNil)
-	c.Check(msgId, Equals, "m3")
-	rows.Next()
-	err = rows.Scan(&msgId)
+	sqls, err = NewSqliteSeenStateRetaining(filename, Retention{MaxCount: 1, CompactInterval: time.Hour})
 	c.Assert(err, IsNil)
-	c.Check(msgId, Equals, "m4")
-	rows.Next()
-	err = rows.Scan(&msgId)
+	defer sqls.Close()
+	// m1 went on open, without waiting for the interval
+	res, err = sqls.FilterBySeen([]protocol.Notification{n1, n2})
 	c.Assert(err, IsNil)
-	c.Check(msgId, Equals, "m5")
-	rows.Close()
+	c.Check(res, DeepEquals, []protocol.Notification{n1})
+}
+
+// benchmarkFilterBySeen measures the cost of filtering a large unicast
+// batch, also keeping it in the inbox if keep.
+func benchmarkFilterBySeen(b *testing.B, keep bool) {
+	dir, err := ioutil.TempDir("", "seenstate")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqls, err := NewSqliteSeenState(filepath.Join(dir, "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sqls.Close()
+	filter := sqls.FilterBySeen
+	if keep {
+		filter = sqls.FilterBySeenAndStore
+	}
+	const batch = 1000
+	notifs := make([]protocol.Notification, batch)
+	for j := range notifs {
+		notifs[j].AppId = "com.example.test_app"
+		notifs[j].Payload = []byte(`{"message":"hello"}`)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range notifs {
+			notifs[j].MsgId = fmt.Sprintf("m%d-%d", i, j)
+		}
+		_, err := filter(notifs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFilterBySeen(b *testing.B) {
+	benchmarkFilterBySeen(b, false)
+}
+
+func BenchmarkFilterBySeenAndStore(b *testing.B) {
+	benchmarkFilterBySeen(b, true)
 }
@@ -28,6 +28,8 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -49,8 +51,20 @@ const (
 	cmdResetCookie
 )
 
+const (
+	// the delay between starting connection attempts to successive hosts
+	connectStagger = 250 * time.Millisecond
+	// the most we'll wait before redialing when the server asks us to
+	maxServerRedialDelay = 30 * time.Minute
+	// the server asked delay gets jittered by up to this fraction of it
+	serverRedialJitterFraction = 5
+)
+
 var (
 	wireVersionBytes = []byte{protocol.ProtocolWireVersion}
+	// the server rejected our authorization, and we got a fresh one
+	// to reconnect with
+	ErrAuthRefreshed = errors.New("authorization refreshed")
 )
 
 type BroadcastNotification struct {
@@ -121,6 +135,19 @@ type AddressedNotification struct {
 	Notification *protocol.Notification
 }
 
+// AuthGetter obtains the device authorization sent on connect.
+type AuthGetter interface {
+	// Authorization returns the current authorization; with
+	// refresh set any cached value is discarded first.
+	Authorization(refresh bool) (string, error)
+}
+
+// PayloadVerifier checks payloads come from whom they should, and
+// were meant for to, returning what was signed.
+type PayloadVerifier interface {
+	Verify(payload json.RawMessage, to, msgId string) (json.RawMessage, error)
+}
+
 // ClientSessionConfig groups the client session configuration.
 type ClientSessionConfig struct {
 	ConnectTimeout         time.Duration
@@ -132,12 +159,32 @@ type ClientSessionConfig struct {
 	AddresseeChecker       AddresseeChecking
 	BroadcastCh            chan *BroadcastNotification
 	NotificationsCh        chan AddressedNotification
+	AuthGetter             AuthGetter
+	BroadcastVerifier      PayloadVerifier
+	// how to reach the delivery hosts; direct TLS if not set
+	Dialer Dialer
+	// the HTTP proxy for host discovery; the environment's if nil
+	HTTPProxy *url.URL
+}
+
+// Status is a snapshot of the session internals, for introspection.
+type Status struct {
+	State           ClientSessionState
+	HasConnectivity bool
+	// the host we are connected to, if any
+	Host         string
+	PingInterval time.Duration
+	// when we last acked a broadcast or notifications
+	LastAck     time.Time
+	RedialDelay time.Duration
+	Levels      map[string]int64
 }
 
 // ClientSession holds a client<->server session and its configuration.
 type ClientSession interface {
 	ResetCookie()
 	State() ClientSessionState
+	Status() Status
 	HasConnectivity(bool)
 	KeepConnection() error
 	StopKeepConnection()
@@ -157,6 +204,10 @@ type clientSession struct {
 	lastAttemptTimestamp   time.Time
 	leftToTry              int
 	tryHost                int
+	// consecutive connect failures per host, to order future attempts
+	hostFailures map[string]int
+	// how long to wait on a connect attempt before racing the next host
+	connectStagger time.Duration
 	// hook for testing
 	timeSince func(time.Time) time.Duration
 	// connection
@@ -168,9 +219,20 @@ type clientSession struct {
 	pingInterval time.Duration
 	retrier      util.AutoRedialer
 	cookie       string
+	// redial delay requested by the server, see redialDelay
+	serverRedialDelay time.Duration
+	// the authorization sent on connect
+	auth string
 	// status
 	stateLock sync.RWMutex
 	state     ClientSessionState
+	// introspection, see Status()
+	statusLock      sync.RWMutex
+	hasConn         bool
+	currentHost     string
+	lastAck         time.Time
+	lastRedialDelay time.Duration
+	levels          map[string]int64
 	// autoredial knobs
 	shouldDelayP    *uint32
 	lastAutoRedial  time.Time
@@ -195,6 +257,19 @@ type clientSession struct {
 }
 
 func redialDelay(sess *clientSession) time.Duration {
+	if t := sess.takeServerRedialDelay(); t > 0 {
+		// jitter it so clients don't all come back together, but
+		// only upwards and by a fraction, and still within the cap
+		j := sess.redialJitter(t / serverRedialJitterFraction)
+		if j < 0 {
+			j = -j
+		}
+		t += j
+		if t > maxServerRedialDelay {
+			t = maxServerRedialDelay
+		}
+		return t
+	}
 	if sess.ShouldDelay() {
 		t := sess.redialDelays[sess.redialDelaysIdx]
 		if len(sess.redialDelays) > sess.redialDelaysIdx+1 {
@@ -218,7 +293,7 @@ func NewSession(serverAddrSpec string, conf ClientSessionConfig,
 	log.Infof("using addr: %v", serverAddrSpec)
 	hostsEndpoint, fallbackHosts := parseServerAddrSpec(serverAddrSpec)
 	if hostsEndpoint != "" {
-		getHost = gethosts.New(deviceId, hostsEndpoint, conf.ExchangeTimeout)
+		getHost = gethosts.New(deviceId, hostsEndpoint, conf.ExchangeTimeout, conf.HTTPProxy)
 	}
 	var shouldDelay uint32 = 0
 	sess := &clientSession{
@@ -235,8 +310,17 @@ func NewSession(serverAddrSpec string, conf ClientSessionConfig,
 		shouldDelayP:        &shouldDelay,
 		redialDelay:         redialDelay, // NOTE there are tests that use calling sess.redialDelay as an indication of calling autoRedial!
 		redialDelays:        util.Timeouts(),
+		hostFailures:        make(map[string]int),
+		connectStagger:      connectStagger,
 	}
 	sess.redialJitter = sess.Jitter
+	if sess.Dialer == nil {
+		sess.Dialer = &NetDialer{
+			Timeout:          conf.ConnectTimeout,
+			FallbackDelay:    connectStagger,
+			HandshakeTimeout: conf.ExchangeTimeout,
+		}
+	}
 	if sess.PEM != nil {
 		cp := x509.NewCertPool()
 		ok := cp.AppendCertsFromPEM(sess.PEM)
@@ -298,6 +382,38 @@ func (sess *clientSession) setState(state ClientSessionState) {
 	sess.state = state
 }
 
+// Status returns a snapshot of the session internals.
+func (sess *clientSession) Status() Status {
+	state := sess.State()
+	sess.statusLock.RLock()
+	defer sess.statusLock.RUnlock()
+	levels := make(map[string]int64, len(sess.levels))
+	for chanId, level := range sess.levels {
+		levels[chanId] = level
+	}
+	return Status{
+		State:           state,
+		HasConnectivity: sess.hasConn,
+		Host:            sess.currentHost,
+		PingInterval:    sess.pingInterval,
+		LastAck:         sess.lastAck,
+		RedialDelay:     sess.lastRedialDelay,
+		Levels:          levels,
+	}
+}
+
+func (sess *clientSession) setCurrentHost(host string) {
+	sess.statusLock.Lock()
+	defer sess.statusLock.Unlock()
+	sess.currentHost = host
+}
+
+func (sess *clientSession) acked() {
+	sess.statusLock.Lock()
+	defer sess.statusLock.Unlock()
+	sess.lastAck = time.Now()
+}
+
 func (sess *clientSession) setConnection(conn net.Conn) {
 	sess.connLock.Lock()
 	defer sess.connLock.Unlock()
@@ -322,6 +438,27 @@ func (sess *clientSession) getCookie() string {
 	return sess.cookie
 }
 
+// setServerRedialDelay records the delay the server asked us to wait
+// before redialing, capped at maxServerRedialDelay.
+func (sess *clientSession) setServerRedialDelay(t time.Duration) {
+	if t > maxServerRedialDelay {
+		t = maxServerRedialDelay
+	}
+	sess.connLock.Lock()
+	defer sess.connLock.Unlock()
+	sess.serverRedialDelay = t
+}
+
+// takeServerRedialDelay returns the delay the server asked for, if
+// any; it's only honoured once.
+func (sess *clientSession) takeServerRedialDelay() time.Duration {
+	sess.connLock.Lock()
+	defer sess.connLock.Unlock()
+	t := sess.serverRedialDelay
+	sess.serverRedialDelay = 0
+	return t
+}
+
 func (sess *clientSession) ResetCookie() {
 	sess.cmdCh <- cmdResetCookie
 }
@@ -344,16 +481,36 @@ func (sess *clientSession) getHosts() error {
 			return err
 		}
 		sess.deliveryHostsTimestamp = time.Now()
-		sess.deliveryHosts = host.Hosts
+		sess.deliveryHosts = directHostsFirst(host.Hosts)
 		if sess.TLS != nil {
 			sess.TLS.ServerName = host.Domain
 		}
 	} else {
-		sess.deliveryHosts = sess.fallbackHosts
+		sess.deliveryHosts = directHostsFirst(sess.fallbackHosts)
 	}
 	return nil
 }
 
+// directHostsFirst reorders hosts so that wss:// URLs are only tried
+// after direct connections have failed.
+func directHostsFirst(hosts []string) []string {
+	if hosts == nil {
+		return nil
+	}
+	res := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !isWebSocketHost(host) {
+			res = append(res, host)
+		}
+	}
+	for _, host := range hosts {
+		if isWebSocketHost(host) {
+			res = append(res, host)
+		}
+	}
+	return res
+}
+
 func (sess *clientSession) resetHosts() {
 	sess.deliveryHosts = nil
 }
@@ -391,26 +548,111 @@ func (sess *clientSession) started() {
 	sess.setState(Started)
 }
 
+type dialResult struct {
+	host string
+	conn net.Conn
+	err  error
+}
+
+// raceHosts tries to connect to hosts in order, starting the next
+// attempt after connectStagger or as soon as one fails, and returns
+// the first connection established. Connections established later
+// are closed.
+func (sess *clientSession) raceHosts(hosts []string) (string, net.Conn, error) {
+	results := make(chan dialResult, len(hosts))
+	next, pending := 0, 0
+	dialNext := func() {
+		host := hosts[next]
+		next++
+		pending++
+		sess.Log.Debugf("trying to connect to: %v", host)
+		go func() {
+			conn, err := sess.Dialer.Dial(host, sess.TLS)
+			results <- dialResult{host, conn, err}
+		}()
+	}
+	var err error
+	dialNext()
+	for pending > 0 {
+		var staggerCh <-chan time.Time
+		if next < len(hosts) {
+			staggerCh = time.After(sess.connectStagger)
+		}
+		select {
+		case <-staggerCh:
+			dialNext()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				sess.hostFailures[res.host] = 0
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if late := <-results; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.host, res.conn, nil
+			}
+			sess.Log.Debugf("connect to %v failed: %v", res.host, res.err)
+			sess.hostFailures[res.host]++
+			err = res.err
+			if next < len(hosts) {
+				dialNext()
+			}
+		}
+	}
+	return "", nil, err
+}
+
+// orderByHealth moves hosts that failed recently after the ones that
+// didn't, keeping the order otherwise.
+func (sess *clientSession) orderByHealth(hosts []string) []string {
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return sess.hostFailures[hosts[i]] < sess.hostFailures[hosts[j]]
+	})
+	return hosts
+}
+
 // connect to a server using the configuration in the ClientSession
 // and set up the connection.
 func (sess *clientSession) connect() error {
 	sess.setShouldDelay()
 	sess.startConnectionAttempt()
-	var err error
+	// wss:// hosts are only raced once all the direct ones failed
+	var direct, webSocket []string
+	for host := sess.nextHostToTry(); host != ""; host = sess.nextHostToTry() {
+		if isWebSocketHost(host) {
+			webSocket = append(webSocket, host)
+		} else {
+			direct = append(direct, host)
+		}
+	}
+	var host string
 	var conn net.Conn
-	for {
-		host := sess.nextHostToTry()
-		if host == "" {
-			sess.setState(Error)
-			return fmt.Errorf("connect: %s", err)
+	err := errors.New("no hosts to try")
+	for _, hosts := range [][]string{direct, webSocket} {
+		if len(hosts) == 0 {
+			continue
 		}
-		sess.Log.Debugf("trying to connect to: %v", host)
-		conn, err = net.DialTimeout("tcp", host, sess.ConnectTimeout)
+		host, conn, err = sess.raceHosts(sess.orderByHealth(hosts))
 		if err == nil {
 			break
 		}
 	}
-	sess.setConnection(tls.Client(conn, sess.TLS))
+	if err != nil {
+		sess.setState(Error)
+		return fmt.Errorf("connect: %s", err)
+	}
+	// continue from the host after the one we got, see started()
+	for i, h := range sess.deliveryHosts {
+		if h == host {
+			sess.tryHost = (i + 1) % len(sess.deliveryHosts)
+			break
+		}
+	}
+	sess.setConnection(conn)
+	sess.setCurrentHost(host)
 	sess.setState(Connected)
 	return nil
 }
@@ -429,6 +671,9 @@ func (sess *clientSession) autoRedial() {
 	}
 	// xxx should we really wait on the caller goroutine?
 	delay := sess.redialDelay(sess)
+	sess.statusLock.Lock()
+	sess.lastRedialDelay = delay
+	sess.statusLock.Unlock()
 	sess.Log.Debugf("session redial delay: %v, wait", delay)
 	time.Sleep(delay)
 	sess.Log.Debugf("session redial delay: %v, cont", delay)
@@ -451,6 +696,7 @@ func (sess *clientSession) doClose(resetCookie bool) {
 		sess.cookie = ""
 	}
 	sess.closeConnection()
+	sess.setCurrentHost("")
 	sess.setState(Disconnected)
 }
 
@@ -478,9 +724,21 @@ func (sess *clientSession) handlePing() error {
 	return err
 }
 
+// decodeBroadcast verifies and decodes the broadcast payloads; it
+// returns nil if none of them could be verified.
 func (sess *clientSession) decodeBroadcast(bcast *serverMsg) *BroadcastNotification {
 	decoded := make([]map[string]interface{}, 0)
+	unverified := 0
 	for _, p := range bcast.Payloads {
+		if sess.BroadcastVerifier != nil {
+			var err error
+			p, err = sess.BroadcastVerifier.Verify(p, bcast.ChanId, "")
+			if err != nil {
+				sess.Log.Errorf("dropping unverifiable broadcast payload: %v", err)
+				unverified++
+				continue
+			}
+		}
 		var v map[string]interface{}
 		err := json.Unmarshal(p, &v)
 		if err != nil {
@@ -489,6 +747,10 @@ func (sess *clientSession) decodeBroadcast(bcast *serverMsg) *BroadcastNotificat
 		}
 		decoded = append(decoded, v)
 	}
+	if unverified > 0 && len(decoded) == 0 {
+		// nothing trustworthy left
+		return nil
+	}
 	return &BroadcastNotification{
 		TopLevel: bcast.TopLevel,
 		Decoded:  decoded,
@@ -504,6 +766,12 @@ func (sess *clientSession) handleBroadcast(bcast *serverMsg) error {
 		sess.proto.WriteMessage(protocol.AckMsg{"nak"})
 		return err
 	}
+	sess.statusLock.Lock()
+	if sess.levels == nil {
+		sess.levels = make(map[string]int64)
+	}
+	sess.levels[bcast.ChanId] = bcast.TopLevel
+	sess.statusLock.Unlock()
 	// the server assumes if we ack the broadcast, we've updated
 	// our levels. Hence the order.
 	err = sess.proto.WriteMessage(protocol.AckMsg{"ack"})
@@ -512,13 +780,18 @@ func (sess *clientSession) handleBroadcast(bcast *serverMsg) error {
 		sess.Log.Errorf("unable to ack broadcast: %s", err)
 		return err
 	}
+	sess.acked()
 	sess.clearShouldDelay()
 	sess.Log.Infof("broadcast chan:%v app:%v topLevel:%d payloads:%s",
 		bcast.ChanId, bcast.AppId, bcast.TopLevel, bcast.Payloads)
 	if bcast.ChanId == protocol.SystemChannelId {
 		// the system channel id, the only one we care about for now
+		bn := sess.decodeBroadcast(bcast)
+		if bn == nil {
+			return nil
+		}
 		sess.Log.Debugf("sending bcast over")
-		sess.BroadcastCh <- sess.decodeBroadcast(bcast)
+		sess.BroadcastCh <- bn
 		sess.Log.Debugf("sent bcast over")
 	} else {
 		sess.Log.Errorf("what is this weird channel, %#v?", bcast.ChanId)
@@ -528,7 +801,10 @@ func (sess *clientSession) handleBroadcast(bcast *serverMsg) error {
 
 // handle "notifications" messages
 func (sess *clientSession) handleNotifications(ucast *serverMsg) error {
-	notifs, err := sess.SeenState.FilterBySeen(ucast.Notifications)
+	// keep them in the inbox until delivered, so they aren't lost
+	// if we go away before that; they're only recorded as seen if
+	// that works, otherwise the server will send them again
+	notifs, err := sess.SeenState.FilterBySeenAndStore(ucast.Notifications)
 	if err != nil {
 		sess.setState(Error)
 		sess.Log.Errorf("unable to record msgs seen: %v", err)
@@ -543,12 +819,15 @@ func (sess *clientSession) handleNotifications(ucast *serverMsg) error {
 		sess.Log.Errorf("unable to ack notifications: %s", err)
 		return err
 	}
+	sess.acked()
 	sess.clearShouldDelay()
 	sess.AddresseeChecker.StartAddresseeBatch()
 	for i := range notifs {
 		notif := &notifs[i]
 		to := sess.AddresseeChecker.CheckForAddressee(notif)
 		if to == nil {
+			// won't ever be delivered
+			sess.dropFromInbox(notif.MsgId)
 			continue
 		}
 		sess.Log.Infof("unicast app:%v msg:%s payload:%s",
@@ -560,6 +839,13 @@ func (sess *clientSession) handleNotifications(ucast *serverMsg) error {
 	return nil
 }
 
+func (sess *clientSession) dropFromInbox(msgId string) {
+	err := sess.SeenState.DropNotification(msgId)
+	if err != nil {
+		sess.Log.Errorf("unable to drop msg from inbox: %v", err)
+	}
+}
+
 // handle "connbroken" messages
 func (sess *clientSession) handleConnBroken(connBroken *serverMsg) error {
 	sess.setState(Error)
@@ -578,9 +864,50 @@ func (sess *clientSession) handleSetParams(setParams *serverMsg) error {
 	if setParams.SetCookie != "" {
 		sess.setCookie(setParams.SetCookie)
 	}
+	if setParams.RedialDelay != "" {
+		t, err := time.ParseDuration(setParams.RedialDelay)
+		if err != nil || t < 0 {
+			sess.Log.Errorf("server sent bad redial delay: %q", setParams.RedialDelay)
+		} else {
+			sess.setServerRedialDelay(t)
+		}
+	}
 	return nil
 }
 
+// handle "connwarn" messages
+func (sess *clientSession) handleConnWarn(connWarn *serverMsg) error {
+	sess.Log.Errorf("server sent warning: %s", connWarn.Reason)
+	if connWarn.Reason != protocol.WarnUnauthorized || sess.AuthGetter == nil {
+		return nil
+	}
+	auth, err := sess.AuthGetter.Authorization(true)
+	if err != nil {
+		sess.Log.Errorf("unable to refresh authorization: %v", err)
+		return nil
+	}
+	if auth == sess.auth {
+		// nothing new to try
+		return nil
+	}
+	// reconnect with the fresh authorization
+	sess.setState(Error)
+	return ErrAuthRefreshed
+}
+
+// getAuthorization gets the authorization to send on connect, if any.
+func (sess *clientSession) getAuthorization() string {
+	if sess.AuthGetter == nil {
+		return ""
+	}
+	auth, err := sess.AuthGetter.Authorization(false)
+	if err != nil {
+		sess.Log.Errorf("unable to get authorization: %v", err)
+		return ""
+	}
+	return auth
+}
+
 // loop runs the session with the server, emits a stream of events.
 func (sess *clientSession) loop() error {
 	var err error
@@ -610,7 +937,7 @@ func (sess *clientSession) loop() error {
 			// XXX: current message "warn" should be "connwarn"
 			fallthrough
 		case "connwarn":
-			sess.Log.Errorf("server sent warning: %s", recv.Reason)
+			err = sess.handleConnWarn(&recv)
 		}
 		if err != nil {
 			sess.Log.Debugf("session aborting with error from handler.")
@@ -644,9 +971,11 @@ func (sess *clientSession) start() error {
 		sess.Log.Errorf("unable to start: get levels: %v", err)
 		return err
 	}
+	sess.auth = sess.getAuthorization()
 	err = proto.WriteMessage(protocol.ConnectMsg{
 		Type:          "connect",
 		DeviceId:      sess.DeviceId,
+		Authorization: sess.auth,
 		Cookie:        sess.getCookie(),
 		Levels:        levels,
 		Info:          sess.Info,
@@ -674,7 +1003,13 @@ func (sess *clientSession) start() error {
 		return err
 	}
 	sess.proto = proto
+	sess.statusLock.Lock()
 	sess.pingInterval = pingInterval
+	sess.levels = make(map[string]int64, len(levels))
+	for chanId, level := range levels {
+		sess.levels[chanId] = level
+	}
+	sess.statusLock.Unlock()
 	sess.Log.Debugf("connected %v.", conn.RemoteAddr())
 	sess.started() // deals with choosing which host to retry with as well
 	return nil
@@ -753,6 +1088,9 @@ func (sess *clientSession) doKeepConnection() {
 
 func (sess *clientSession) handleConn(hasConn bool) {
 	sess.lastConn = hasConn
+	sess.statusLock.Lock()
+	sess.hasConn = hasConn
+	sess.statusLock.Unlock()
 
 	// Note this does not depend on the current state!  That's because Dial
 	// starts with doClose, which gets you to Disconnected even if you're
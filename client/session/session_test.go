@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,9 +37,16 @@ import (
 	"github.com/ubports/ubuntu-push/client/gethosts"
 	"github.com/ubports/ubuntu-push/client/session/seenstate"
 	"github.com/ubports/ubuntu-push/protocol"
+	"github.com/ubports/ubuntu-push/server/broker"
+	"github.com/ubports/ubuntu-push/server/broker/simple"
+	"github.com/ubports/ubuntu-push/server/listener"
+	srvsession "github.com/ubports/ubuntu-push/server/session"
+	"github.com/ubports/ubuntu-push/server/statistics"
+	"github.com/ubports/ubuntu-push/server/store"
 	helpers "github.com/ubports/ubuntu-push/testing"
 	"github.com/ubports/ubuntu-push/testing/condition"
 	"github.com/ubports/ubuntu-push/util"
+	"github.com/ubports/ubuntu-push/websocket"
 )
 
 func TestSession(t *testing.T) { TestingT(t) }
@@ -52,6 +60,13 @@ type xAddr string
 func (x xAddr) Network() string { return "<:>" }
 func (x xAddr) String() string  { return string(x) }
 
+// funcDialer dials using a plain function.
+type funcDialer func(host string) (net.Conn, error)
+
+func (f funcDialer) Dial(host string, _ *tls.Config) (net.Conn, error) {
+	return f(host)
+}
+
 // testConn (roughly based on the one in protocol_test)
 
 type testConn struct {
@@ -166,6 +181,16 @@ func (*brokenSeenState) Close()                                  {}
 func (*brokenSeenState) FilterBySeen([]protocol.Notification) ([]protocol.Notification, error) {
 	return nil, errors.New("broken.")
 }
+func (*brokenSeenState) FilterBySeenAndStore([]protocol.Notification) ([]protocol.Notification, error) {
+	return nil, errors.New("broken.")
+}
+func (*brokenSeenState) StoreNotifications([]protocol.Notification) error {
+	return errors.New("broken.")
+}
+func (*brokenSeenState) DropNotification(string) error { return errors.New("broken.") }
+func (*brokenSeenState) PendingNotifications() ([]protocol.Notification, error) {
+	return nil, errors.New("broken.")
+}
 
 /////
 
@@ -259,6 +284,21 @@ func (cs *clientSessionSuite) TestNewSessionHostEndpointWorks(c *C) {
 	c.Check(sess.getHost, NotNil)
 }
 
+func (cs *clientSessionSuite) TestNewSessionHostEndpointThroughProxy(c *C) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Host, Equals, "foo")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"domain":"example.com","hosts":["bar:443"]}`))
+	}))
+	defer proxy.Close()
+	conf := dummyConf()
+	conf.HTTPProxy = helpers.ParseURL("http://" + proxy.Listener.Addr().String())
+	sess, err := NewSession("http://foo/hosts", conf, "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	c.Assert(sess.getHosts(), IsNil)
+	c.Check(sess.deliveryHosts, DeepEquals, []string{"bar:443"})
+}
+
 func (cs *clientSessionSuite) TestNewSessionPEMWorks(c *C) {
 	pem, err := ioutil.ReadFile(helpers.SourceRelative("../../server/acceptance/ssl/testing.cert"))
 	c.Assert(err, IsNil)
@@ -296,6 +336,14 @@ func (cs *clientSessionSuite) TestGetHostsFallback(c *C) {
 	c.Check(sess.deliveryHosts, DeepEquals, fallback)
 }
 
+func (cs *clientSessionSuite) TestGetHostsFallbackWebSocketLast(c *C) {
+	fallback := []string{"wss://foo/device", "foo:443", "bar:443"}
+	sess := &clientSession{fallbackHosts: fallback}
+	err := sess.getHosts()
+	c.Assert(err, IsNil)
+	c.Check(sess.deliveryHosts, DeepEquals, []string{"foo:443", "bar:443", "wss://foo/device"})
+}
+
 type testHostGetter struct {
 	domain string
 	hosts  []string
@@ -468,6 +516,16 @@ func (cs *clientSessionSuite) TestConnectFailsWithNoAddress(c *C) {
 	c.Check(sess.State(), Equals, Error)
 }
 
+func (cs *clientSessionSuite) TestConnectFailsWithNoHosts(c *C) {
+	sess, err := NewSession("", dummyConf(), "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	c.Assert(sess.getHosts(), IsNil)
+	err = sess.connect()
+	c.Check(err, ErrorMatches, "connect: no hosts to try")
+	c.Check(sess.Connection, IsNil)
+	c.Check(sess.State(), Equals, Error)
+}
+
 func (cs *clientSessionSuite) TestConnectConnects(c *C) {
 	srv, err := net.Listen("tcp", "localhost:0")
 	c.Assert(err, IsNil)
@@ -497,6 +555,9 @@ func (cs *clientSessionSuite) TestConnectSecondConnects(c *C) {
 	c.Check(sess.Connection, NotNil)
 	c.Check(sess.State(), Equals, Connected)
 	c.Check(sess.tryHost, Equals, 0)
+	// the failure is remembered
+	c.Check(sess.hostFailures, DeepEquals, map[string]int{"nowhere": 1, srv.Addr().String(): 0})
+	c.Check(sess.orderByHealth([]string{"nowhere", srv.Addr().String()}), DeepEquals, []string{srv.Addr().String(), "nowhere"})
 }
 
 func (cs *clientSessionSuite) TestConnectConnectFail(c *C) {
@@ -513,6 +574,85 @@ func (cs *clientSessionSuite) TestConnectConnectFail(c *C) {
 	c.Check(sess.State(), Equals, Error)
 }
 
+func (cs *clientSessionSuite) TestRaceHostsKeepsFastest(c *C) {
+	sess, err := NewSession("", dummyConf(), "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	sess.connectStagger = time.Millisecond
+	slowConn, slowPeer := net.Pipe()
+	defer slowPeer.Close()
+	release := make(chan bool)
+	fast := &testConn{Name: "fast"}
+	sess.Dialer = funcDialer(func(host string) (net.Conn, error) {
+		if host == "slow:443" {
+			<-release
+			return slowConn, nil
+		}
+		return fast, nil
+	})
+	host, conn, err := sess.raceHosts([]string{"slow:443", "fast:443"})
+	c.Assert(err, IsNil)
+	c.Check(host, Equals, "fast:443")
+	c.Check(conn, Equals, fast)
+	// the slow one, when it gets there, is closed
+	close(release)
+	_, err = slowPeer.Read(make([]byte, 1))
+	c.Check(err, Equals, io.EOF)
+}
+
+func (cs *clientSessionSuite) TestRaceHostsAllFail(c *C) {
+	sess, err := NewSession("", dummyConf(), "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	sess.connectStagger = time.Hour // failures don't wait for this
+	sess.Dialer = funcDialer(func(host string) (net.Conn, error) {
+		return nil, errors.New("no " + host)
+	})
+	_, _, err = sess.raceHosts([]string{"foo:443", "bar:443"})
+	c.Check(err, ErrorMatches, "no bar:443")
+	c.Check(sess.hostFailures, DeepEquals, map[string]int{"foo:443": 1, "bar:443": 1})
+}
+
+func (cs *clientSessionSuite) TestConnectRacesWebSocketHostsLast(c *C) {
+	sess, err := NewSession("", dummyConf(), "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	sess.connectStagger = time.Hour // failures don't wait for this
+	var dialed []string
+	fail := map[string]bool{"foo:443": true}
+	sess.Dialer = funcDialer(func(host string) (net.Conn, error) {
+		dialed = append(dialed, host)
+		if fail[host] {
+			return nil, errors.New("no " + host)
+		}
+		return &testConn{Name: host}, nil
+	})
+	sess.deliveryHosts = []string{"wss://ws.example.com", "foo:443", "bar:443"}
+	// the web socket host has the better record, but that doesn't
+	// get it raced with the direct ones
+	sess.hostFailures["foo:443"] = 1
+	sess.hostFailures["bar:443"] = 1
+
+	err = sess.connect()
+	c.Assert(err, IsNil)
+	c.Check(sess.currentHost, Equals, "bar:443")
+	c.Check(dialed, DeepEquals, []string{"foo:443", "bar:443"})
+
+	// once the direct ones all fail, it's the web socket one's turn
+	dialed = nil
+	fail["bar:443"] = true
+	err = sess.connect()
+	c.Assert(err, IsNil)
+	c.Check(sess.currentHost, Equals, "wss://ws.example.com")
+	c.Check(dialed, DeepEquals, []string{"bar:443", "foo:443", "wss://ws.example.com"})
+}
+
+func (cs *clientSessionSuite) TestOrderByHealth(c *C) {
+	sess := &clientSession{
+		hostFailures: map[string]int{"foo:443": 2, "bar:443": 1},
+	}
+	hosts := []string{"foo:443", "bar:443", "baz:443", "quux:443"}
+	c.Check(sess.orderByHealth(hosts), DeepEquals,
+		[]string{"baz:443", "quux:443", "bar:443", "foo:443"})
+}
+
 type dumbRetrier struct{ stopped bool }
 
 func (*dumbRetrier) Redial() uint32 { return 0 }
@@ -667,6 +807,90 @@ func (s *msgSuite) TestHandleBroadcastWorks(c *C) {
 	c.Check(levels, DeepEquals, map[string]int64{"0": 2})
 }
 
+// testVerifier takes {"sig":X} to be X signed, for the system channel
+type testVerifier struct{}
+
+func (tv testVerifier) Verify(payload json.RawMessage, to, msgId string) (json.RawMessage, error) {
+	if to != protocol.SystemChannelId {
+		return nil, errors.New("wrong target")
+	}
+	s := string(payload)
+	if !strings.HasPrefix(s, `{"sig":`) {
+		return nil, errors.New("unsigned")
+	}
+	return json.RawMessage(s[len(`{"sig":`) : len(s)-1]), nil
+}
+
+func (s *msgSuite) TestHandleBroadcastVerifies(c *C) {
+	s.sess.BroadcastVerifier = testVerifier{}
+	msg := new(serverMsg)
+	msg.Type = "broadcast"
+	msg.BroadcastMsg = protocol.BroadcastMsg{
+		Type:     "broadcast",
+		ChanId:   "0",
+		TopLevel: 2,
+		Payloads: []json.RawMessage{
+			json.RawMessage(`{"sig":{"img1/m1":[101,"tubular"]}}`),
+			json.RawMessage(`{"img1/m1":[666,"evil"]}`),
+		},
+	}
+	go func() { s.sess.errCh <- s.sess.handleBroadcast(msg) }()
+	c.Check(takeNext(s.downCh), Equals, protocol.AckMsg{"ack"})
+	s.upCh <- nil // ack ok
+	c.Check(<-s.sess.errCh, Equals, nil)
+	c.Assert(len(s.sess.BroadcastCh), Equals, 1)
+	c.Check(<-s.sess.BroadcastCh, DeepEquals, &BroadcastNotification{
+		TopLevel: 2,
+		Decoded: []map[string]interface{}{
+			map[string]interface{}{
+				"img1/m1": []interface{}{float64(101), "tubular"},
+			},
+		},
+	})
+	c.Check(s.sess.Log.(*helpers.TestLogger).Captured(), Matches, `(?ms).*dropping unverifiable broadcast payload: unsigned.*`)
+}
+
+func (s *msgSuite) TestHandleBroadcastDropsAllUnverifiable(c *C) {
+	s.sess.BroadcastVerifier = testVerifier{}
+	msg := new(serverMsg)
+	msg.Type = "broadcast"
+	msg.BroadcastMsg = protocol.BroadcastMsg{
+		Type:     "broadcast",
+		ChanId:   "0",
+		TopLevel: 3,
+		Payloads: []json.RawMessage{json.RawMessage(`{"img1/m1":[666,"evil"]}`)},
+	}
+	go func() { s.sess.errCh <- s.sess.handleBroadcast(msg) }()
+	c.Check(takeNext(s.downCh), Equals, protocol.AckMsg{"ack"})
+	s.upCh <- nil // ack ok
+	c.Check(<-s.sess.errCh, IsNil)
+	c.Check(len(s.sess.BroadcastCh), Equals, 0)
+	// the level still moves on
+	levels, err := s.sess.SeenState.GetAllLevels()
+	c.Check(err, IsNil)
+	c.Check(levels, DeepEquals, map[string]int64{"0": 3})
+}
+
+func (s *msgSuite) TestHandleBroadcastUpdatesStatus(c *C) {
+	msg := new(serverMsg)
+	msg.Type = "broadcast"
+	msg.BroadcastMsg = protocol.BroadcastMsg{
+		Type:     "broadcast",
+		AppId:    "--ignored--",
+		ChanId:   "0",
+		TopLevel: 2,
+		Payloads: []json.RawMessage{json.RawMessage(`{"img1/m1":[101,"tubular"]}`)},
+	}
+	c.Check(s.sess.Status().LastAck.IsZero(), Equals, true)
+	go func() { s.sess.errCh <- s.sess.handleBroadcast(msg) }()
+	c.Check(takeNext(s.downCh), Equals, protocol.AckMsg{"ack"})
+	s.upCh <- nil // ack ok
+	c.Check(<-s.sess.errCh, Equals, nil)
+	status := s.sess.Status()
+	c.Check(status.Levels, DeepEquals, map[string]int64{"0": 2})
+	c.Check(status.LastAck.IsZero(), Equals, false)
+}
+
 func (s *msgSuite) TestHandleBroadcastBadAckWrite(c *C) {
 	msg := new(serverMsg)
 	msg.Type = "broadcast"
@@ -816,6 +1040,10 @@ func (s *msgSuite) TestHandleNotificationsWorks(c *C) {
 	c.Check(<-ac.ops, Equals, "start")
 	c.Check(<-ac.ops, Equals, "com.example.app1_app1")
 	c.Check(<-ac.ops, Equals, "com.example.app2_app2")
+	// they're kept in the inbox until delivered
+	pending, err := s.sess.SeenState.PendingNotifications()
+	c.Assert(err, IsNil)
+	c.Check(pending, DeepEquals, []protocol.Notification{n1, n2})
 }
 
 func (s *msgSuite) TestHandleNotificationsAddresseeCheck(c *C) {
@@ -855,6 +1083,10 @@ func (s *msgSuite) TestHandleNotificationsAddresseeCheck(c *C) {
 	c.Check(ac.ops, HasLen, 3)
 	c.Check(<-ac.ops, Equals, "start")
 	c.Check(<-ac.ops, Equals, "com.example.app1_app1")
+	// the undeliverable one was dropped from the inbox
+	pending, err := s.sess.SeenState.PendingNotifications()
+	c.Assert(err, IsNil)
+	c.Check(pending, DeepEquals, []protocol.Notification{n2})
 }
 
 func (s *msgSuite) TestHandleNotificationsFiltersSeen(c *C) {
@@ -1091,6 +1323,36 @@ func (s *loopSuite) TestLoopSetParams(c *C) {
 	c.Check(s.sess.getCookie(), Equals, "COOKIE")
 }
 
+func (s *loopSuite) TestLoopSetParamsRedialDelay(c *C) {
+	s.waitUntilRunning(c)
+	setParams := protocol.SetParamsMsg{
+		Type:        "setparams",
+		RedialDelay: "2m",
+	}
+	c.Check(takeNext(s.downCh), Equals, "deadline 1ms")
+	s.upCh <- setParams
+	failure := errors.New("fail")
+	s.upCh <- failure
+	c.Assert(<-s.sess.errCh, Equals, failure)
+	c.Check(s.sess.takeServerRedialDelay(), Equals, 2*time.Minute)
+}
+
+func (s *loopSuite) TestLoopSetParamsBadRedialDelay(c *C) {
+	s.waitUntilRunning(c)
+	setParams := protocol.SetParamsMsg{
+		Type:        "setparams",
+		RedialDelay: "soon",
+	}
+	c.Check(takeNext(s.downCh), Equals, "deadline 1ms")
+	s.upCh <- setParams
+	failure := errors.New("fail")
+	s.upCh <- failure
+	c.Assert(<-s.sess.errCh, Equals, failure)
+	c.Check(s.sess.takeServerRedialDelay(), Equals, time.Duration(0))
+	c.Check(s.sess.Log.(*helpers.TestLogger).Captured(),
+		Matches, `(?ms).*server sent bad redial delay: "soon"$`)
+}
+
 func (s *loopSuite) TestLoopConnBroken(c *C) {
 	s.waitUntilRunning(c)
 	broken := protocol.ConnBrokenMsg{
@@ -1127,6 +1389,61 @@ func (s *loopSuite) TestLoopConnWarn(c *C) {
 		Matches, `(?ms).* warning: REASON$`)
 }
 
+type testAuthGetter struct {
+	auths     []string
+	refreshed int
+	err       error
+}
+
+func (tag *testAuthGetter) Authorization(refresh bool) (string, error) {
+	if refresh {
+		tag.refreshed++
+	}
+	if tag.err != nil {
+		return "", tag.err
+	}
+	return tag.auths[tag.refreshed], nil
+}
+
+func (s *msgSuite) TestHandleConnWarnRefreshesAuth(c *C) {
+	tag := &testAuthGetter{auths: []string{"auth1", "auth2"}}
+	s.sess.AuthGetter = tag
+	s.sess.auth = "auth1"
+	warn := &serverMsg{Type: "connwarn"}
+	warn.Reason = protocol.WarnUnauthorized
+	c.Check(s.sess.handleConnWarn(warn), Equals, ErrAuthRefreshed)
+	c.Check(tag.refreshed, Equals, 1)
+	c.Check(s.sess.State(), Equals, Error)
+}
+
+func (s *msgSuite) TestHandleConnWarnSameAuth(c *C) {
+	tag := &testAuthGetter{auths: []string{"auth1", "auth1"}}
+	s.sess.AuthGetter = tag
+	s.sess.auth = "auth1"
+	warn := &serverMsg{Type: "connwarn"}
+	warn.Reason = protocol.WarnUnauthorized
+	c.Check(s.sess.handleConnWarn(warn), IsNil)
+	c.Check(tag.refreshed, Equals, 1)
+}
+
+func (s *msgSuite) TestHandleConnWarnRefreshFails(c *C) {
+	s.sess.AuthGetter = &testAuthGetter{err: errors.New("no auth for you")}
+	warn := &serverMsg{Type: "connwarn"}
+	warn.Reason = protocol.WarnUnauthorized
+	c.Check(s.sess.handleConnWarn(warn), IsNil)
+	c.Check(s.sess.Log.(*helpers.TestLogger).Captured(),
+		Matches, `(?ms).*unable to refresh authorization: no auth for you$`)
+}
+
+func (s *msgSuite) TestHandleConnWarnOtherReason(c *C) {
+	tag := &testAuthGetter{auths: []string{"auth1", "auth2"}}
+	s.sess.AuthGetter = tag
+	warn := &serverMsg{Type: "connwarn"}
+	warn.Reason = "REASON"
+	c.Check(s.sess.handleConnWarn(warn), IsNil)
+	c.Check(tag.refreshed, Equals, 0)
+}
+
 /****************************************************************
   start() tests
 ****************************************************************/
@@ -1296,6 +1613,7 @@ func (cs *clientSessionSuite) TestStartWorks(c *C) {
 	c.Check(msg.DeviceId, Equals, "wah")
 	c.Check(msg.Cookie, Equals, "COOKIE")
 	c.Check(msg.Info, DeepEquals, info)
+	c.Check(msg.Authorization, Equals, "")
 	upCh <- nil // no error
 	upCh <- protocol.ConnAckMsg{
 		Type:   "connack",
@@ -1307,6 +1625,36 @@ func (cs *clientSessionSuite) TestStartWorks(c *C) {
 	c.Check(sess.State(), Equals, Started)
 }
 
+func (cs *clientSessionSuite) TestStartSendsAuthorization(c *C) {
+	conf := ClientSessionConfig{
+		AuthGetter: &testAuthGetter{auths: []string{"AUTH"}},
+	}
+	sess, err := NewSession("", conf, "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	sess.Connection = &testConn{Name: "TestStartSendsAuthorization"}
+	errCh := make(chan error, 1)
+	upCh := make(chan interface{}, 5)
+	downCh := make(chan interface{}, 5)
+	proto := &testProtocol{up: upCh, down: downCh}
+	sess.Protocolator = func(_ net.Conn) protocol.Protocol { return proto }
+
+	go func() {
+		errCh <- sess.start()
+	}()
+
+	c.Check(takeNext(downCh), Equals, "deadline 0")
+	msg, ok := takeNext(downCh).(protocol.ConnectMsg)
+	c.Check(ok, Equals, true)
+	c.Check(msg.Authorization, Equals, "AUTH")
+	upCh <- nil // no error
+	upCh <- protocol.ConnAckMsg{
+		Type:   "connack",
+		Params: protocol.ConnAckParams{(10 * time.Millisecond).String()},
+	}
+	c.Check(<-errCh, IsNil)
+	c.Check(sess.auth, Equals, "AUTH")
+}
+
 /****************************************************************
   run() tests
 ****************************************************************/
@@ -1619,6 +1967,150 @@ func (cs *clientSessionSuite) TestDialWorksDirect(c *C) {
 	// connect done
 }
 
+func (cs *clientSessionSuite) TestDialWorksWebSocket(c *C) {
+	connCh := make(chan net.Conn, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := websocket.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		connCh <- conn
+	}))
+	srv.TLS = helpers.TestTLSServerConfig
+	srv.StartTLS()
+	defer srv.Close()
+	// nothing is listening on the direct address
+	lst, err := net.Listen("tcp", "localhost:0")
+	c.Assert(err, IsNil)
+	direct := lst.Addr().String()
+	lst.Close()
+	wsURL := strings.Replace(srv.URL, "https://", "wss://", 1) + "/device"
+	sess, err := NewSession(wsURL+"|"+direct, dialTestConf(nil), "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	defer sess.StopKeepConnection()
+
+	upCh := make(chan interface{}, 5)
+	downCh := make(chan interface{}, 5)
+	proto := &testProtocol{up: upCh, down: downCh}
+	sess.Protocolator = func(net.Conn) protocol.Protocol { return proto }
+
+	go sess.Dial()
+
+	var cli net.Conn
+	select {
+	case cli = <-connCh:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for websocket connection")
+	}
+	defer cli.Close()
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [1]byte
+	_, err = cli.Read(buf[:])
+	c.Assert(err, IsNil)
+	c.Check(buf[0], Equals, byte(protocol.ProtocolWireVersion))
+	// connect done
+}
+
+// pipeServerConfig configures the in-process server the pipe
+// transport is tested against.
+type pipeServerConfig struct{}
+
+func (pipeServerConfig) Addr() string                   { return "pipe" }
+func (pipeServerConfig) TLSServerConfig() *tls.Config   { return helpers.TestTLSServerConfig }
+func (pipeServerConfig) PingInterval() time.Duration    { return time.Second }
+func (pipeServerConfig) ExchangeTimeout() time.Duration { return dialTestTimeout }
+func (pipeServerConfig) SessionQueueSize() uint         { return 10 }
+func (pipeServerConfig) BrokerQueueSize() uint          { return 100 }
+
+// registeredTracker signals when the server session got registered.
+type registeredTracker struct {
+	srvsession.SessionTracker
+	registered chan bool
+}
+
+func (trk *registeredTracker) Registered(sess broker.BrokerSession) {
+	trk.SessionTracker.Registered(sess)
+	trk.registered <- true
+}
+
+func (cs *clientSessionSuite) TestDialPipeEndToEnd(c *C) {
+	pipe := NewPipeDialer()
+	defer pipe.Close()
+
+	// a real server, in process, listening on the other end
+	cfg := pipeServerConfig{}
+	sto := store.NewInMemoryPendingStore()
+	brkr := simple.NewSimpleBroker(sto, cfg, cs.log, statistics.NewStatistics(cs.log))
+	brkr.Start()
+	defer brkr.Stop()
+	lst, err := listener.DeviceListen(pipe, cfg)
+	c.Assert(err, IsNil)
+	registered := make(chan bool, 1)
+	go lst.AcceptLoop(func(conn net.Conn) error {
+		track := &registeredTracker{srvsession.NewTracker(cs.log), registered}
+		return srvsession.Session(conn, brkr, cfg, track)
+	}, &listener.NopSessionResourceManager{}, cs.log)
+
+	conf := dialTestConf(nil)
+	conf.Dialer = pipe
+	conf.AddresseeChecker = &testAddresseeChecking{ops: make(chan string, 10)}
+	sess, err := NewSession("anywhere:443", conf, "DEV1", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	defer sess.StopKeepConnection()
+	go sess.Dial()
+
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		c.Fatal("session didn't get registered over the pipe")
+	}
+	// deliver a unicast the way the api does
+	chanId := store.UnicastInternalChannelId("DEV1", "DEV1")
+	payload := json.RawMessage(`{"m": 42}`)
+	err = sto.AppendToUnicastChannel(chanId, "com.example.test_hello", payload, "msg1", store.Metadata{Expiration: time.Now().Add(time.Hour)})
+	c.Assert(err, IsNil)
+	brkr.Unicast(chanId)
+
+	select {
+	case notif := <-conf.NotificationsCh:
+		c.Check(notif.To.Original(), Equals, "com.example.test_hello")
+		c.Check(notif.Notification.MsgId, Equals, "msg1")
+		// compacted on the way, as with any unicast
+		c.Check(string(notif.Notification.Payload), Equals, `{"m":42}`)
+	case <-time.After(5 * time.Second):
+		c.Fatal("notification didn't make it over the pipe")
+	}
+}
+
+func (cs *clientSessionSuite) TestDialWorksPipe(c *C) {
+	pipe := NewPipeDialer()
+	defer pipe.Close()
+	lst := tls.NewListener(pipe, helpers.TestTLSServerConfig)
+	conf := dialTestConf(nil)
+	conf.Dialer = pipe
+	sess, err := NewSession("anywhere:443", conf, "wah", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	defer sess.StopKeepConnection()
+
+	upCh := make(chan interface{}, 5)
+	downCh := make(chan interface{}, 5)
+	proto := &testProtocol{up: upCh, down: downCh}
+	sess.Protocolator = func(net.Conn) protocol.Protocol { return proto }
+
+	go sess.Dial()
+
+	cli, err := lst.Accept()
+	c.Assert(err, IsNil)
+	// no closing cli: nothing reads the other end of the pipe, so
+	// saying goodbye over TLS would block
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [1]byte
+	_, err = cli.Read(buf[:])
+	c.Assert(err, IsNil)
+	c.Check(buf[0], Equals, byte(protocol.ProtocolWireVersion))
+	// connect done
+}
+
 func (cs *clientSessionSuite) TestDialWorksDirectSHA512Cert(c *C) {
 	// happy path thoughts
 	lst, err := tls.Listen("tcp", "localhost:0", helpers.TestTLSServerConfigs["sha512"])
@@ -1680,6 +2172,25 @@ func (cs *clientSessionSuite) TestRedialDelay(c *C) {
 	c.Check(n, Equals, 4)
 }
 
+func (cs *clientSessionSuite) TestRedialDelayServerHint(c *C) {
+	sess, err := NewSession("foo:443", dummyConf(), "", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	sess.redialDelays = []time.Duration{17, 42}
+	// the most jitter there can be, downwards
+	sess.redialJitter = func(spread time.Duration) time.Duration { return -spread }
+	sess.clearShouldDelay()
+	sess.setServerRedialDelay(10 * time.Second)
+	// the server hint wins, jittered only upwards by a fifth
+	c.Check(redialDelay(sess), Equals, 12*time.Second)
+	// but only once
+	c.Check(redialDelay(sess), Equals, time.Duration(0))
+	// and it's capped, jitter included
+	sess.setServerRedialDelay(10 * time.Hour)
+	c.Check(redialDelay(sess), Equals, maxServerRedialDelay)
+	sess.setServerRedialDelay(maxServerRedialDelay - time.Minute)
+	c.Check(redialDelay(sess), Equals, maxServerRedialDelay)
+}
+
 /****************************************************************
   ResetCookie() tests
 ****************************************************************/
@@ -1748,6 +2259,24 @@ func (cs *clientSessionSuite) TestHasConnectivityTriggersConnectivityHandler(c *
 	c.Check(<-testCh, Equals, false)
 }
 
+func (cs *clientSessionSuite) TestStatus(c *C) {
+	sess, err := NewSession("foo:443", dummyConf(), "", cs.lvls, cs.log)
+	c.Assert(err, IsNil)
+	sess.setCurrentHost("foo:443")
+	sess.pingInterval = 10 * time.Second
+	status := sess.Status()
+	c.Check(status.State, Equals, Pristine)
+	c.Check(status.Host, Equals, "foo:443")
+	c.Check(status.PingInterval, Equals, 10*time.Second)
+	c.Check(status.Levels, HasLen, 0)
+	// losing connectivity closes the session
+	sess.handleConn(false)
+	status = sess.Status()
+	c.Check(status.State, Equals, Disconnected)
+	c.Check(status.HasConnectivity, Equals, false)
+	c.Check(status.Host, Equals, "")
+}
+
 func (cs *clientSessionSuite) TestDoneChIsEmptiedAndLogged(c *C) {
 	sess, err := NewSession("", dummyConf(), "wah", cs.lvls, cs.log)
 	c.Assert(err, IsNil)
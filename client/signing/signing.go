@@ -0,0 +1,214 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package signing implements verification of payloads signed by
+// their sender.
+//
+// A signed payload looks like
+//
+//	{"signed": {"data": <payload>, "to": <recipient>, "ts": <time>, "sig": <signature>}}
+//
+// with data and sig base64 encoded (standard encoding, padded), to
+// being the channel (for broadcasts) or the versionless app id (for
+// unicasts) the payload is meant for, and ts the signing time in
+// seconds since the epoch. The signature is over the SHA-256 of to,
+// ts (in decimal) and the payload bytes, each followed by a NUL
+// byte, either ECDSA (ASN.1 encoded) or RSA PKCS #1 v1.5.
+//
+// Signatures are only accepted for the recipient they name, for
+// MaxAge after they were made, and once (per message id).
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsigned     = errors.New("payload is not signed")
+	ErrBadSignature = errors.New("bad payload signature")
+	ErrWrongTarget  = errors.New("payload signed for someone else")
+	ErrStale        = errors.New("payload signature is stale")
+	ErrReplayed     = errors.New("payload signature already used")
+)
+
+const (
+	// MaxAge is how long after being made a signature is good for.
+	MaxAge = 30 * 24 * time.Hour
+	// signatures from a bit in the future are let through, for
+	// clock skew's sake
+	maxSkew = time.Hour
+)
+
+// hook for testing
+var timeNow = time.Now
+
+type signed struct {
+	Data []byte `json:"data"`
+	To   string `json:"to"`
+	TS   int64  `json:"ts"`
+	Sig  []byte `json:"sig"`
+}
+
+// digest is what gets signed.
+func (s *signed) digest() []byte {
+	h := sha256.New()
+	for _, part := range [][]byte{[]byte(s.To), []byte(strconv.FormatInt(s.TS, 10)), s.Data} {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+type envelope struct {
+	Signed *signed `json:"signed"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// Verifier checks payloads were signed by one of a set of keys.
+type Verifier struct {
+	keys []crypto.PublicKey
+	lock sync.Mutex
+	// the signatures accepted within MaxAge, with the message ids
+	// they came in
+	used map[string]usedSig
+}
+
+type usedSig struct {
+	msgId string
+	ts    time.Time
+}
+
+// NewVerifier makes a Verifier trusting the given base64 encoded
+// PKIX (DER) public keys. With no keys the Verifier lets everything
+// through untouched.
+func NewVerifier(encodedKeys []string) (*Verifier, error) {
+	keys := make([]crypto.PublicKey, len(encodedKeys))
+	for i, enc := range encodedKeys {
+		der, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode signing key #%d: %v", i, err)
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse signing key #%d: %v", i, err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported signing key #%d: %T", i, key)
+		}
+		keys[i] = key
+	}
+	return &Verifier{keys: keys, used: make(map[string]usedSig)}, nil
+}
+
+// Enabled returns whether the Verifier checks anything at all.
+func (v *Verifier) Enabled() bool {
+	return len(v.keys) > 0
+}
+
+// Verify checks payload is signed by one of the keys, for to, and
+// that the signature is neither stale nor already used by another
+// message than msgId; it returns what was signed.
+func (v *Verifier) Verify(payload json.RawMessage, to, msgId string) (json.RawMessage, error) {
+	if !v.Enabled() {
+		return payload, nil
+	}
+	var env envelope
+	if json.Unmarshal(payload, &env) != nil || env.Signed == nil {
+		return nil, ErrUnsigned
+	}
+	sgn := env.Signed
+	if sgn.To != to {
+		return nil, ErrWrongTarget
+	}
+	now := timeNow()
+	ts := time.Unix(sgn.TS, 0)
+	if now.Sub(ts) > MaxAge || ts.Sub(now) > maxSkew {
+		return nil, ErrStale
+	}
+	h := sgn.digest()
+	for _, key := range v.keys {
+		if verify(key, h, sgn.Sig) {
+			if !v.use(string(sgn.Sig), msgId, ts, now) {
+				return nil, ErrReplayed
+			}
+			return json.RawMessage(sgn.Data), nil
+		}
+	}
+	return nil, ErrBadSignature
+}
+
+// use records sig as used by msgId, unless it already was by another
+// message. Signatures past MaxAge are forgotten, as they'd be stale
+// anyway.
+func (v *Verifier) use(sig, msgId string, ts, now time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for s, u := range v.used {
+		if now.Sub(u.ts) > MaxAge {
+			delete(v.used, s)
+		}
+	}
+	if u, ok := v.used[sig]; ok && (u.msgId != msgId || msgId == "") {
+		return false
+	}
+	v.used[sig] = usedSig{msgId, ts}
+	return true
+}
+
+func verify(key crypto.PublicKey, hash, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var esig ecdsaSignature
+		rest, err := asn1.Unmarshal(sig, &esig)
+		if err != nil || len(rest) != 0 || esig.R == nil || esig.S == nil {
+			return false
+		}
+		return ecdsa.Verify(k, hash, esig.R, esig.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, sig) == nil
+	}
+	return false
+}
+
+// Sign signs payload for to at ts with key, as a sender would.
+func Sign(key crypto.Signer, payload []byte, to string, ts time.Time) (json.RawMessage, error) {
+	sgn := &signed{Data: payload, To: to, TS: ts.Unix()}
+	sig, err := key.Sign(rand.Reader, sgn.digest(), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sgn.Sig = sig
+	return json.Marshal(envelope{sgn})
+}
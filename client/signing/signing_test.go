@@ -0,0 +1,204 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestSigning(t *testing.T) { TestingT(t) }
+
+type signingSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&signingSuite{})
+
+func (s *signingSuite) SetUpTest(c *C) {
+	s.now = time.Unix(1400000000, 0)
+	timeNow = func() time.Time { return s.now }
+}
+
+func (s *signingSuite) TearDownTest(c *C) {
+	timeNow = time.Now
+}
+
+func encodeKey(c *C, pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	c.Assert(err, IsNil)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func (s *signingSuite) TestNoKeysLetsAllThrough(c *C) {
+	v, err := NewVerifier(nil)
+	c.Assert(err, IsNil)
+	c.Check(v.Enabled(), Equals, false)
+	payload, err := v.Verify(json.RawMessage(`{"a":1}`), "0", "")
+	c.Assert(err, IsNil)
+	c.Check(string(payload), Equals, `{"a":1}`)
+}
+
+func (s *signingSuite) TestVerifyECDSA(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	v, err := NewVerifier([]string{encodeKey(c, &key.PublicKey)})
+	c.Assert(err, IsNil)
+	c.Check(v.Enabled(), Equals, true)
+	sp, err := Sign(key, []byte(`{"a":1}`), "com.example.test_app", s.now)
+	c.Assert(err, IsNil)
+	payload, err := v.Verify(sp, "com.example.test_app", "m1")
+	c.Assert(err, IsNil)
+	c.Check(string(payload), Equals, `{"a":1}`)
+}
+
+func (s *signingSuite) TestVerifyRSAWithSeveralKeys(c *C) {
+	ekey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	rkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	v, err := NewVerifier([]string{encodeKey(c, &ekey.PublicKey), encodeKey(c, &rkey.PublicKey)})
+	c.Assert(err, IsNil)
+	sp, err := Sign(rkey, []byte(`[1]`), "0", s.now)
+	c.Assert(err, IsNil)
+	payload, err := v.Verify(sp, "0", "")
+	c.Assert(err, IsNil)
+	c.Check(string(payload), Equals, `[1]`)
+}
+
+func (s *signingSuite) TestVerifyFails(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	v, err := NewVerifier([]string{encodeKey(c, &key.PublicKey)})
+	c.Assert(err, IsNil)
+
+	_, err = v.Verify(json.RawMessage(`{"a":1}`), "0", "")
+	c.Check(err, Equals, ErrUnsigned)
+	_, err = v.Verify(json.RawMessage(`"foo"`), "0", "")
+	c.Check(err, Equals, ErrUnsigned)
+	// signed by someone else
+	sp, err := Sign(other, []byte(`{"a":1}`), "0", s.now)
+	c.Assert(err, IsNil)
+	_, err = v.Verify(sp, "0", "")
+	c.Check(err, Equals, ErrBadSignature)
+	// tampered with
+	for _, tamper := range []func(*signed){
+		func(sgn *signed) { sgn.Data = []byte(`{"a":2}`) },
+		func(sgn *signed) { sgn.TS++ },
+	} {
+		sp, err = Sign(key, []byte(`{"a":1}`), "0", s.now)
+		c.Assert(err, IsNil)
+		var env envelope
+		c.Assert(json.Unmarshal(sp, &env), IsNil)
+		tamper(env.Signed)
+		sp, err = json.Marshal(env)
+		c.Assert(err, IsNil)
+		_, err = v.Verify(sp, "0", "")
+		c.Check(err, Equals, ErrBadSignature)
+	}
+	// garbage signature
+	_, err = v.Verify(json.RawMessage(`{"signed":{"data":"e30=","to":"0","ts":1400000000,"sig":"AAAA"}}`), "0", "")
+	c.Check(err, Equals, ErrBadSignature)
+}
+
+func (s *signingSuite) TestVerifyChecksTarget(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	v, err := NewVerifier([]string{encodeKey(c, &key.PublicKey)})
+	c.Assert(err, IsNil)
+	sp, err := Sign(key, []byte(`{"a":1}`), "com.example.test_app", s.now)
+	c.Assert(err, IsNil)
+	_, err = v.Verify(sp, "com.example.test_other", "m1")
+	c.Check(err, Equals, ErrWrongTarget)
+	// rewriting the target breaks the signature
+	var env envelope
+	c.Assert(json.Unmarshal(sp, &env), IsNil)
+	env.Signed.To = "com.example.test_other"
+	sp, err = json.Marshal(env)
+	c.Assert(err, IsNil)
+	_, err = v.Verify(sp, "com.example.test_other", "m1")
+	c.Check(err, Equals, ErrBadSignature)
+}
+
+func (s *signingSuite) TestVerifyChecksAge(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	v, err := NewVerifier([]string{encodeKey(c, &key.PublicKey)})
+	c.Assert(err, IsNil)
+	old, err := Sign(key, []byte(`{"a":1}`), "0", s.now.Add(-MaxAge-time.Second))
+	c.Assert(err, IsNil)
+	_, err = v.Verify(old, "0", "")
+	c.Check(err, Equals, ErrStale)
+	future, err := Sign(key, []byte(`{"a":1}`), "0", s.now.Add(2*time.Hour))
+	c.Assert(err, IsNil)
+	_, err = v.Verify(future, "0", "")
+	c.Check(err, Equals, ErrStale)
+	skewed, err := Sign(key, []byte(`{"a":1}`), "0", s.now.Add(time.Minute))
+	c.Assert(err, IsNil)
+	_, err = v.Verify(skewed, "0", "")
+	c.Check(err, IsNil)
+}
+
+func (s *signingSuite) TestVerifyRejectsReplays(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	v, err := NewVerifier([]string{encodeKey(c, &key.PublicKey)})
+	c.Assert(err, IsNil)
+	sp, err := Sign(key, []byte(`{"a":1}`), "com.example.test_app", s.now)
+	c.Assert(err, IsNil)
+	_, err = v.Verify(sp, "com.example.test_app", "m1")
+	c.Check(err, IsNil)
+	// the same message again is fine
+	_, err = v.Verify(sp, "com.example.test_app", "m1")
+	c.Check(err, IsNil)
+	// but not as another one
+	_, err = v.Verify(sp, "com.example.test_app", "m2")
+	c.Check(err, Equals, ErrReplayed)
+	// without message ids (broadcasts) it can only be used once
+	bp, err := Sign(key, []byte(`{"a":1}`), "0", s.now)
+	c.Assert(err, IsNil)
+	_, err = v.Verify(bp, "0", "")
+	c.Check(err, IsNil)
+	_, err = v.Verify(bp, "0", "")
+	c.Check(err, Equals, ErrReplayed)
+	// used signatures are forgotten once stale
+	s.now = s.now.Add(MaxAge + time.Second)
+	fresh, err := Sign(key, []byte(`{"a":2}`), "0", s.now)
+	c.Assert(err, IsNil)
+	_, err = v.Verify(fresh, "0", "")
+	c.Check(err, IsNil)
+	c.Check(v.used, HasLen, 1)
+}
+
+func (s *signingSuite) TestNewVerifierFails(c *C) {
+	_, err := NewVerifier([]string{"!!"})
+	c.Check(err, ErrorMatches, "cannot decode signing key #0: .*")
+	_, err = NewVerifier([]string{"AAAA"})
+	c.Check(err, ErrorMatches, "cannot parse signing key #0: .*")
+}
@@ -160,6 +160,29 @@ func (ctd ConfigTimeDuration) TimeDuration() time.Duration {
 	return ctd.Duration
 }
 
+// ConfigInterval can hold a positive time.Duration, as for how often
+// to do something, in a configuration struct.
+type ConfigInterval struct {
+	ConfigTimeDuration
+}
+
+func (ci *ConfigInterval) UnmarshalJSON(b []byte) error {
+	return UnmarshalJSONViaString(ci, b)
+}
+
+func (ci *ConfigInterval) SetFromString(enc string) error {
+	var ctd ConfigTimeDuration
+	err := ctd.SetFromString(enc)
+	if err != nil {
+		return err
+	}
+	if ctd.Duration <= 0 {
+		return errors.New("interval should be > 0")
+	}
+	*ci = ConfigInterval{ctd}
+	return nil
+}
+
 // ConfigHostPort can hold a host:port string in a configuration struct.
 type ConfigHostPort string
 
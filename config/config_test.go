@@ -123,6 +123,25 @@ func (s *configSuite) TestReadConfigQueueSizeErrors(c *C) {
 	checkError(c, `{"qS": 0}`, &cfg, "qS: queue size should be > 0")
 }
 
+type testIntervalConfig struct {
+	I ConfigInterval
+}
+
+func (s *configSuite) TestReadConfigInterval(c *C) {
+	buf := bytes.NewBufferString(`{"i": "2s"}`)
+	var cfg testIntervalConfig
+	err := ReadConfig(buf, &cfg)
+	c.Assert(err, IsNil)
+	c.Check(cfg.I.TimeDuration(), Equals, 2*time.Second)
+}
+
+func (s *configSuite) TestReadConfigIntervalErrors(c *C) {
+	var cfg testIntervalConfig
+	checkError(c, `{"i": "x"}`, &cfg, "i: time: invalid duration.*")
+	checkError(c, `{"i": "0s"}`, &cfg, "i: interval should be > 0")
+	checkError(c, `{"i": "-1s"}`, &cfg, "i: interval should be > 0")
+}
+
 func (s *configSuite) TestLoadFile(c *C) {
 	tmpDir := c.MkDir()
 	d, err := LoadFile("", tmpDir)
@@ -33,6 +33,10 @@ type Card struct {
 	RawTimestamp int      `json:"timestamp"` // seconds since epoch, only used for persist (for now). Timestamp() returns this if non-zero, current timestamp otherwise.
 	Persist      bool     `json:"persist"`   // whether to show in notification centre; defaults to false
 	Popup        bool     `json:"popup"`     // whether to show in a bubble. Users can disable this, and can easily miss them, so don't rely on it exclusively. Defaults to false.
+	Reply        string   `json:"reply"`     // if set, the label of a text-input reply action on the card in the notification centre; what the user types goes back to the app. Defaults to empty (no reply).
+	Image        string   `json:"image"`     // a large image, either a local path or an http(s) url that gets downloaded (up to 2MB) into the app's cache before presenting. Defaults to empty (no image).
+	Progress     *int     `json:"progress"`  // how far along (0 to 100) an ongoing operation is, shown as a gauge in the bubble. Defaults to null (no progress).
+	RawExpire    int      `json:"expire"`    // seconds since epoch after which the card is taken out of the notification centre and bubbles. Expire() returns it as a time. Defaults to 0 (never).
 }
 
 // an EmblemCounter puts a number on an emblem on an app's icon in the launcher
@@ -50,13 +54,18 @@ type Vibration struct {
 
 // a Notification can be any of the above
 type Notification struct {
-	Card          *Card           `json:"card"`           // defaults to nil (no card)
-	RawSound      json.RawMessage `json:"sound"`          // a boolean, or the relative path to a sound file. Users can disable this, so don't rely on it exclusively. Defaults to empty (no sound).
-	RawVibration  json.RawMessage `json:"vibrate"`        // users can disable this, blah blah. Can be Vibration, or boolean. Defaults to null (no vibration)
-	EmblemCounter *EmblemCounter  `json:"emblem-counter"` // puts a counter on an emblem in the launcher. Defaults to nil (no change to emblem counter).
-	Tag           string          `json:"tag,omitempty"`  // tag used for Clear/ListPersistent.
+	Card          *Card           `json:"card"`               // defaults to nil (no card)
+	RawSound      json.RawMessage `json:"sound"`              // a boolean, or the relative path to a sound file. Users can disable this, so don't rely on it exclusively. Defaults to empty (no sound).
+	RawVibration  json.RawMessage `json:"vibrate"`            // users can disable this, blah blah. Can be Vibration, or boolean. Defaults to null (no vibration)
+	EmblemCounter *EmblemCounter  `json:"emblem-counter"`     // puts a counter on an emblem in the launcher. Defaults to nil (no change to emblem counter).
+	Tag           string          `json:"tag,omitempty"`      // tag used for Clear/ListPersistent.
+	Priority      string          `json:"priority,omitempty"` // "high" gets through do-not-disturb. Defaults to empty (normal).
 }
 
+// PriorityHigh is the Notification priority that gets through
+// do-not-disturb.
+const PriorityHigh = "high"
+
 // HelperOutput is the expected output of a helper
 type HelperOutput struct {
 	Message      json.RawMessage `json:"message,omitempty"`      // what to put in the post office's queue
@@ -87,6 +96,15 @@ func (card *Card) Timestamp() int64 {
 	}
 }
 
+// Expire() returns when the card expires, or the zero time if it
+// doesn't.
+func (card *Card) Expire() time.Time {
+	if card.RawExpire == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(card.RawExpire), 0)
+}
+
 func (notification *Notification) Vibration(fallback *Vibration) *Vibration {
 	var b bool
 	var vib *Vibration
@@ -37,6 +37,17 @@ func (*outSuite) TestCardGetTimestamp(c *C) {
 	c.Check((&Card{RawTimestamp: 42}).Timestamp(), Equals, int64(42))
 }
 
+func (*outSuite) TestCardRichFields(c *C) {
+	var card Card
+	err := json.Unmarshal([]byte(`{"image": "http://example.com/a.png", "progress": 0, "expire": 1400000000}`), &card)
+	c.Assert(err, IsNil)
+	c.Check(card.Image, Equals, "http://example.com/a.png")
+	c.Assert(card.Progress, NotNil)
+	c.Check(*card.Progress, Equals, 0)
+	c.Check(card.Expire(), Equals, time.Unix(1400000000, 0))
+	c.Check((&Card{}).Expire().IsZero(), Equals, true)
+}
+
 func (*outSuite) TestBadVibeBegetsNilVibe(c *C) {
 	fbck := &Vibration{Repeat: 2}
 	for _, s := range []string{
@@ -24,7 +24,7 @@ package cmessaging
 
 void add_notification(const gchar* desktop_id, const gchar* notification_id,
           const gchar* icon_path, const gchar* summary, const gchar* body,
-          gint64 timestamp, const gchar** actions, gpointer obj);
+          gint64 timestamp, const gchar** actions, const gchar* reply_label, gpointer obj);
 
 void remove_notification(const gchar* desktop_id, const gchar* notification_id);
 
@@ -55,10 +55,15 @@ func gfree(s *C.gchar) {
 }
 
 //export handleActivate
-func handleActivate(c_action *C.char, c_notification *C.char, obj unsafe.Pointer) {
+func handleActivate(c_action *C.char, c_notification *C.char, c_reply *C.char, obj unsafe.Pointer) {
 	payload := (*Payload)(obj)
 	action := C.GoString(c_action)
-	// Default action, only support ATM, is always "".
+	if action == reply.ReplyAction {
+		mmar := &reply.MMActionReply{Notification: C.GoString(c_notification), App: payload.App, Reply: C.GoString(c_reply)}
+		payload.Ch <- mmar
+		return
+	}
+	// Default action, only other one supported ATM, is always "".
 	// Use the first action as the default if it's available.
 	if action == "" && len(payload.Actions) >= 2 {
 		action = payload.Actions[1]
@@ -85,7 +90,10 @@ func AddNotification(desktopId string, notificationId string, card *launch_helpe
 
 	timestamp := (C.gint64)(card.Timestamp() * 1000000)
 
-	C.add_notification(desktop_id, notification_id, icon_path, summary, body, timestamp, nil, (C.gpointer)(payload))
+	reply_label := gchar(card.Reply)
+	defer gfree(reply_label)
+
+	C.add_notification(desktop_id, notification_id, icon_path, summary, body, timestamp, nil, reply_label, (C.gpointer)(payload))
 }
 
 func RemoveNotification(desktopId string, notificationId string) {
@@ -21,17 +21,22 @@ package cmessaging
 
 // this is a .go file instead of a .c file because of dh-golang limitations
 
-void handleActivate(gchar* c_action, const gchar * c_notification , gpointer obj);
+void handleActivate(gchar* c_action, const gchar * c_notification , gchar* c_reply, gpointer obj);
 
 static void activate_cb(MessagingMenuMessage* msg, gchar* action, GVariant* parameter, gpointer obj) {
-    handleActivate(action, messaging_menu_message_get_id(msg), obj);
+    // the reply action's parameter is the text the user typed
+    const gchar* reply = "";
+    if (parameter != NULL && g_variant_is_of_type (parameter, G_VARIANT_TYPE_STRING)) {
+        reply = g_variant_get_string (parameter, NULL);
+    }
+    handleActivate(action, messaging_menu_message_get_id(msg), (gchar*) reply, obj);
 }
 
 static GHashTable* map = NULL;
 
 void add_notification (const gchar* desktop_id, const gchar* notification_id,
           const gchar* icon_path, const gchar* summary, const gchar* body,
-          gint64 timestamp, const gchar** actions, gpointer obj) {
+          gint64 timestamp, const gchar** actions, const gchar* reply_label, gpointer obj) {
     if (map == NULL) {
         map = g_hash_table_new_full (g_str_hash, g_str_equal, g_free, g_object_unref);
     }
@@ -51,7 +56,11 @@ void add_notification (const gchar* desktop_id, const gchar* notification_id,
     MessagingMenuMessage* msg = messaging_menu_message_new(notification_id, icon, summary,
                                                            "", body,
                                                            timestamp);
-    // unity8 support for actions in the messaging menu is strange. Not doing that for now.
+    // unity8 support for actions in the messaging menu is strange. Not doing that for now,
+    // except for the text-input reply one.
+    if (reply_label != NULL && reply_label[0] != '\0') {
+        messaging_menu_message_add_action(msg, "reply", reply_label, G_VARIANT_TYPE_STRING, NULL);
+    }
     messaging_menu_app_append_message(app, msg, "postal", TRUE);
 
     g_signal_connect(msg, "activate", G_CALLBACK(activate_cb), obj);
@@ -38,6 +38,11 @@ type MessagingMenu struct {
 	notifications   map[string]*cmessaging.Payload // keep a ref to the Payload used in the MMU callback
 	lock            sync.RWMutex
 	lastCleanupTime time.Time
+	// OnDismiss, if set, is called for each notification found to
+	// have been cleared from the messaging menu without being acted
+	// on. It's called with the lock held, so it mustn't call back
+	// into the MessagingMenu.
+	OnDismiss func(app *click.AppId, nid string)
 }
 
 type cleanUp func()
@@ -59,6 +64,17 @@ func (mmu *MessagingMenu) GetCh() chan *reply.MMActionReply {
 func (mmu *MessagingMenu) addNotification(app *click.AppId, notificationId string, tag string, card *launch_helper.Card, actions []string, testingCleanUpFunction cleanUp) {
 	mmu.lock.Lock()
 	defer mmu.lock.Unlock()
+	if tag != "" {
+		// the new notification replaces any earlier one of the app with the same tag
+		orig := app.Original()
+		for nid, payload := range mmu.notifications {
+			if nid != notificationId && payload.Tag == tag && payload.App.Original() == orig {
+				mmu.Log.Debugf("[%s] replacing notification centre entry %s (tag: %s)", notificationId, nid, tag)
+				delete(mmu.notifications, nid)
+				cRemoveNotification(payload.App.DesktopId(), nid)
+			}
+		}
+	}
 	payload := &cmessaging.Payload{Ch: mmu.Ch, Actions: actions, App: app, Tag: tag}
 	mmu.notifications[notificationId] = payload
 	cAddNotification(app.DesktopId(), notificationId, card, payload)
@@ -96,6 +112,9 @@ func (mmu *MessagingMenu) doCleanUpNotifications() {
 	for nid, payload := range mmu.notifications {
 		if !cNotificationExists(payload.App.DesktopId(), nid) {
 			delete(mmu.notifications, nid)
+			if mmu.OnDismiss != nil {
+				mmu.OnDismiss(payload.App, nid)
+			}
 		}
 	}
 }
@@ -164,6 +164,30 @@ func (ms *MessagingSuite) TestTagsListsTags(c *C) {
 	c.Check(mmu.Tags(ms.app), IsNil)
 }
 
+func (ms *MessagingSuite) TestPresentReplacesSameTag(c *C) {
+	mmu := New(ms.log)
+	app2 := clickhelp.MustParseAppId("com.example.test_test-2_0")
+	f := func(tag string) *launch_helper.Notification {
+		card := launch_helper.Card{Summary: "tag: \"" + tag + "\"", Persist: true}
+		return &launch_helper.Notification{Card: &card, Tag: tag}
+	}
+	c.Assert(mmu.Present(ms.app, "notif1", f("one")), Equals, true)
+	c.Assert(mmu.Present(ms.app, "notif2", f("two")), Equals, true)
+	c.Assert(mmu.Present(ms.app, "notif3", f("")), Equals, true)
+	c.Assert(mmu.Present(app2, "notif4", f("one")), Equals, true)
+	c.Assert(mmu.Present(ms.app, "notif5", f("")), Equals, true)
+	c.Check(mmu.notifications, HasLen, 5)
+
+	c.Assert(mmu.Present(ms.app, "notif6", f("one")), Equals, true)
+	// notif1 got replaced; the other app's, and the untagged ones, stay
+	c.Check(mmu.notifications, HasLen, 5)
+	_, ok := mmu.notifications["notif1"]
+	c.Check(ok, Equals, false)
+	c.Check(mmu.notifications["notif6"].Tag, Equals, "one")
+	c.Check(mmu.notifications["notif4"].App, Equals, app2)
+	c.Check(ms.log.Captured(), Matches, `(?s).*\[notif6\] replacing notification centre entry notif1 \(tag: one\).*REMOVE: app: com.example.test_test_0.desktop, not: notif1.*`)
+}
+
 func (ms *MessagingSuite) TestClearClears(c *C) {
 	app1 := ms.app
 	app2 := clickhelp.MustParseAppId("com.example.test_test-2_0")
@@ -308,6 +332,26 @@ func (ms *MessagingSuite) TestCleanupStaleNotification(c *C) {
 	c.Check(ok, Equals, false)
 }
 
+func (ms *MessagingSuite) TestCleanupReportsDismissed(c *C) {
+	mmu := New(ms.log)
+	var dismissed []string
+	mmu.OnDismiss = func(app *click.AppId, nid string) {
+		c.Check(app, Equals, ms.app)
+		dismissed = append(dismissed, nid)
+	}
+	card := launch_helper.Card{Summary: "ehlo", Persist: true}
+	mmu.addNotification(ms.app, "notif-id-1", "", &card, nil, nil)
+	mmu.addNotification(ms.app, "notif-id-2", "", &card, nil, nil)
+	// one was acted on (and so isn't a dismissal)
+	mmu.RemoveNotification("notif-id-1", false)
+
+	cNotificationExists = func(did string, nid string) bool {
+		return false
+	}
+	mmu.cleanUpNotifications()
+	c.Check(dismissed, DeepEquals, []string{"notif-id-2"})
+}
+
 func (ms *MessagingSuite) TestCleanupInAddNotification(c *C) {
 	mmu := New(ms.log)
 
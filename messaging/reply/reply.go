@@ -20,9 +20,15 @@ package reply
 
 import "github.com/ubports/ubuntu-push/click"
 
+// ReplyAction is the id of the text-input reply action of a
+// notification
+const ReplyAction = "reply"
+
 // MMActionReply holds the reply from a MessagingMenu action
 type MMActionReply struct {
 	Notification string
 	Action       string
 	App          *click.AppId
+	// the text the user typed, for the reply action
+	Reply string
 }
@@ -51,11 +51,20 @@ type Times struct {
 	BusyWait           time.Duration
 }
 
+// Status is a snapshot of the poller state, for introspection.
+type Status struct {
+	HasConnectivity bool
+	// zero if no wakeup is requested
+	NextWakeup    time.Time
+	HoldsWakeLock bool
+}
+
 type Poller interface {
 	IsConnected() bool
 	Start() error
 	Run() error
 	HasConnectivity(bool)
+	Status() Status
 }
 
 type PollerSetup struct {
@@ -75,6 +84,8 @@ type poller struct {
 	requestWakeupCh      chan struct{}
 	requestedWakeupErrCh chan error
 	holdsWakeLockCh      chan bool
+	statusLock           sync.Mutex
+	status               Status
 }
 
 func New(setup *PollerSetup) Poller {
@@ -95,6 +106,18 @@ func (p *poller) IsConnected() bool {
 	return p.sessionState.State() == session.Running
 }
 
+func (p *poller) Status() Status {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	return p.status
+}
+
+func (p *poller) setStatus(status Status) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+	p.status = status
+}
+
 func (p *poller) HasConnectivity(hasConn bool) {
 	p.connCh <- hasConn
 }
@@ -248,6 +271,7 @@ func (p *poller) control(wakeupCh <-chan bool, filteredWakeUpCh chan<- bool) {
 				}
 			}
 		}
+		p.setStatus(Status{connected, t, holdsWakeLock})
 	}
 }
 
@@ -151,6 +151,12 @@ func (s *PrSuite) TestControl(c *C) {
 	err = p.requestWakeup()
 	c.Assert(err, IsNil)
 	c.Check(s.myd.watchWakeCh, HasLen, 0)
+	// and the status reflects it (the previous loop iteration is
+	// done by now)
+	status := p.Status()
+	c.Check(status.HasConnectivity, Equals, true)
+	c.Check(status.NextWakeup.IsZero(), Equals, false)
+	c.Check(status.HoldsWakeLock, Equals, false)
 
 	// wakeup happens
 	wakeUpCh <- true
@@ -108,6 +108,9 @@ const (
 type SetParamsMsg struct {
 	Type      string `json:"T"`
 	SetCookie string
+	// how long the client should wait before redialing the next
+	// time it loses the connection, formatted time.Duration
+	RedialDelay string `json:",omitempty"`
 }
 
 func (m *SetParamsMsg) Split() bool {
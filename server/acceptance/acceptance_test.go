@@ -35,6 +35,8 @@ func testServerConfig(addr, httpAddr string) map[string]interface{} {
 	suites.FillServerConfig(cfg, addr)
 	suites.FillHTTPServerConfig(cfg, httpAddr)
 	cfg["delivery_domain"] = "push-delivery"
+	cfg["scheduler_interval"] = "0.1s"
+	cfg["shutdown_redial_delay"] = "1m"
 	return cfg
 }
 
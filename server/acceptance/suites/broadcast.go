@@ -228,6 +228,33 @@ func (s *BroadcastAcceptanceSuite) TestBroadcastWayBehind(c *C) {
 	c.Check(len(errCh), Equals, 0)
 }
 
+func (s *BroadcastAcceptanceSuite) TestBroadcastReplaceTagWayBehind(c *C) {
+	// send broadcasts that will be pending, superseding each other
+	got, err := s.PostRequest("/broadcast", &api.Broadcast{
+		Channel:    "system",
+		ExpireOn:   future,
+		Data:       json.RawMessage(`{"img1/m1": 1}`),
+		ReplaceTag: "upgrade",
+	})
+	c.Assert(err, IsNil, Commentf("%v", got))
+	got, err = s.PostRequest("/broadcast", &api.Broadcast{
+		Channel:    "system",
+		ExpireOn:   future,
+		Data:       json.RawMessage(`{"img1/m1": 2}`),
+		ReplaceTag: "upgrade",
+	})
+	c.Assert(err, IsNil, Commentf("%v", got))
+
+	events, errCh, stop := s.StartClient(c, "DEVB", map[string]int64{
+		protocol.SystemChannelId: -10,
+	})
+	// only the latest for the tag is pending on connect
+	c.Check(NextEvent(events, errCh), Equals, `broadcast chan:0 app: topLevel:2 payloads:[{"img1/m1":2}]`)
+	stop()
+	c.Assert(NextEvent(s.ServerEvents, nil), Matches, `.* ended with:.*EOF`)
+	c.Check(len(errCh), Equals, 0)
+}
+
 func (s *BroadcastAcceptanceSuite) TestBroadcastExpiration(c *C) {
 	// send broadcast that will be pending, and one that will expire
 	got, err := s.PostRequest("/broadcast", &api.Broadcast{
@@ -257,7 +284,7 @@ func (s *BroadcastAcceptanceSuite) TestBroadcastExpiration(c *C) {
 // test /delivery-hosts
 
 func (s *BroadcastAcceptanceSuite) TestGetHosts(c *C) {
-	gh := gethosts.New("", s.ServerAPIURL+"/delivery-hosts", 2*time.Second)
+	gh := gethosts.New("", s.ServerAPIURL+"/delivery-hosts", 2*time.Second, nil)
 	host, err := gh.Get()
 	c.Assert(err, IsNil)
 	expected := &gethosts.Host{
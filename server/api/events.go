@@ -0,0 +1,273 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/logger"
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+const (
+	// how long after a notification expires its events are still
+	// reported
+	callbackGrace = 24 * time.Hour
+	// how long posting an event can take
+	callbackTimeout = 30 * time.Second
+	// how many events can be waiting to be posted
+	eventQueueSize = 1000
+	// how many events get posted at the same time
+	eventPosters = 4
+)
+
+// the events devices report
+const (
+	EventAction    = "action"
+	EventDismissed = "dismissed"
+	EventReply     = "reply"
+)
+
+// Event is what devices report when the user acts on, or dismisses, a
+// notification; it's also what gets posted to the callback url (without
+// the device id).
+type Event struct {
+	DeviceId string `json:"deviceid,omitempty"`
+	AppId    string `json:"appid"`
+	MsgId    string `json:"msgid"`
+	// action, dismissed or reply
+	Event string `json:"event"`
+	// the action taken, if any; for replies, the text of the reply
+	// (unless the app gets end-to-end encrypted notifications)
+	Action string `json:"action,omitempty"`
+}
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // RFC 1918
+		"100.64.0.0/10", // carrier-grade NAT
+		"fc00::/7",      // unique local
+	} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNets = append(privateNets, ipNet)
+	}
+}
+
+// isPublicIP returns whether ip is reachable from the outside, i.e.
+// isn't loopback, link-local, private or otherwise special.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, ipNet := range privateNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkCallbackURL(callbackURL string) *APIError {
+	if callbackURL == "" {
+		return nil
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidCallbackURL
+	}
+	// callbacks are made from inside the server's network, so they
+	// mustn't point back into it
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrInvalidCallbackURL
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return ErrInvalidCallbackURL
+	}
+	return nil
+}
+
+// setCallback records where to report the events of the unicast msgId,
+// if the app server asked for it, returning what to reply with.
+func setCallback(ctx *context, sto store.PendingStore, ucast *Unicast, chanId store.InternalChannelId, msgId string, expire time.Time) (map[string]interface{}, *APIError) {
+	if ucast.CallbackURL == "" {
+		return nil, nil
+	}
+	_, deviceId := chanId.UnicastUserAndDevice()
+	err := sto.SetCallback(msgId, &store.Callback{
+		AppId:      ucast.AppId,
+		DeviceId:   deviceId,
+		URL:        ucast.CallbackURL,
+		Expiration: expire.Add(callbackGrace),
+	})
+	if err != nil {
+		ctx.logger.Errorf("could not store callback: %v", err)
+		return nil, ErrCouldNotStoreNotification
+	}
+	return map[string]interface{}{"msgid": msgId}, nil
+}
+
+func checkEvent(event *Event) *APIError {
+	if event.DeviceId == "" || event.AppId == "" || event.MsgId == "" {
+		return ErrMissingIdField
+	}
+	switch event.Event {
+	case EventAction, EventDismissed, EventReply:
+	default:
+		return ErrInvalidEvent
+	}
+	return nil
+}
+
+// hook for testing
+var lookupIP = net.LookupIP
+
+// dialPublic dials addr only if its host resolves to public
+// addresses, as the names in callback urls can point anywhere by the
+// time they're used.
+func dialPublic(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %v", host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, fmt.Errorf("%v is not a public address", ip)
+		}
+	}
+	return net.DialTimeout(network, net.JoinHostPort(ips[0].String(), port), callbackTimeout)
+}
+
+var callbackClient = &http.Client{
+	Timeout:   callbackTimeout,
+	Transport: &http.Transport{Dial: dialPublic},
+}
+
+// an eventPost is an event waiting to be posted.
+type eventPost struct {
+	log         logger.Logger
+	callbackURL string
+	body        []byte
+}
+
+// eventPoster posts events in the background, with a fixed number of
+// workers and a bounded queue.
+type eventPoster struct {
+	queue   chan eventPost
+	workers int
+	start   sync.Once
+}
+
+func newEventPoster(queueSize, workers int) *eventPoster {
+	return &eventPoster{queue: make(chan eventPost, queueSize), workers: workers}
+}
+
+// post queues the JSON-encoded event to be posted to callbackURL;
+// it's dropped if too many are waiting already.
+func (p *eventPoster) post(log logger.Logger, callbackURL string, body []byte) {
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+	})
+	select {
+	case p.queue <- eventPost{log, callbackURL, body}:
+	default:
+		log.Errorf("too many events waiting, dropping the one for %v", callbackURL)
+	}
+}
+
+func (p *eventPoster) work() {
+	for ev := range p.queue {
+		resp, err := callbackClient.Post(ev.callbackURL, JSONMediaType, bytes.NewReader(ev.body))
+		if err != nil {
+			ev.log.Errorf("could not post event to %v: %v", ev.callbackURL, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			ev.log.Errorf("posting event to %v got %v", ev.callbackURL, resp.Status)
+		}
+	}
+}
+
+// postEvent posts the JSON-encoded event to callbackURL, in the
+// background.
+var postEvent = newEventPoster(eventQueueSize, eventPosters).post
+
+func doEvent(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	event := parsedBodyObj.(*Event)
+	apiErr := checkEvent(event)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	cb, err := sto.GetCallback(event.MsgId)
+	if err != nil {
+		ctx.logger.Errorf("could not get callback: %v", err)
+		return nil, ErrUnknown
+	}
+	// whether there is a callback is none of the device's business
+	if cb == nil || cb.AppId != event.AppId || cb.DeviceId != event.DeviceId {
+		ctx.logger.Debugf("event: %v %v no callback", event.AppId, event.MsgId)
+		return nil, nil
+	}
+	// each event gets reported once, however many times the device
+	// sends it
+	already, err := sto.MarkReported(event.MsgId, event.Event)
+	if err != nil {
+		ctx.logger.Errorf("could not mark event as reported: %v", err)
+		return nil, ErrUnknown
+	}
+	if already {
+		ctx.logger.Debugf("event: %v %v %v already reported", event.AppId, event.MsgId, event.Event)
+		return nil, nil
+	}
+	reported := *event
+	reported.DeviceId = ""
+	body, err := json.Marshal(&reported)
+	if err != nil {
+		panic(err)
+	}
+	ctx.logger.Debugf("event: %v %v %v -> %v", event.AppId, event.MsgId, event.Event, cb.URL)
+	postEvent(ctx.logger, cb.URL, body)
+	return nil, nil
+}
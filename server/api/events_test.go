@@ -0,0 +1,314 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/logger"
+	"github.com/ubports/ubuntu-push/server/store"
+	help "github.com/ubports/ubuntu-push/testing"
+)
+
+type eventsSuite struct {
+	testlog      *help.TestLogger
+	prevGenMsgId func() string
+	prevPost     func(logger.Logger, string, []byte)
+	posted       []string
+}
+
+var _ = Suite(&eventsSuite{})
+
+func (s *eventsSuite) SetUpTest(c *C) {
+	s.testlog = help.NewTestLogger(c, "error")
+	s.prevGenMsgId = generateMsgId
+	generateMsgId = func() string {
+		return "MSG-ID"
+	}
+	s.prevPost = postEvent
+	s.posted = nil
+	postEvent = func(_ logger.Logger, callbackURL string, body []byte) {
+		s.posted = append(s.posted, callbackURL+" "+string(body))
+	}
+}
+
+func (s *eventsSuite) TearDownTest(c *C) {
+	generateMsgId = s.prevGenMsgId
+	postEvent = s.prevPost
+}
+
+func (s *eventsSuite) TestCheckCallbackURL(c *C) {
+	c.Check(checkCallbackURL(""), IsNil)
+	c.Check(checkCallbackURL("http://example.com/cb"), IsNil)
+	c.Check(checkCallbackURL("https://example.com/cb?id=1"), IsNil)
+	c.Check(checkCallbackURL("ftp://example.com/cb"), Equals, ErrInvalidCallbackURL)
+	c.Check(checkCallbackURL("http:///cb"), Equals, ErrInvalidCallbackURL)
+	c.Check(checkCallbackURL(":"), Equals, ErrInvalidCallbackURL)
+	// nothing on the server's own network
+	for _, u := range []string{
+		"http://localhost/cb",
+		"http://foo.localhost:8080/cb",
+		"http://127.0.0.1/cb",
+		"https://[::1]:8443/cb",
+		"http://10.1.2.3/cb",
+		"http://172.20.0.1/cb",
+		"http://192.168.1.1/cb",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/cb",
+		"http://[fd00::1]/cb",
+		"http://[fe80::1]/cb",
+	} {
+		c.Check(checkCallbackURL(u), Equals, ErrInvalidCallbackURL, Commentf(u))
+	}
+	c.Check(checkCallbackURL("http://93.184.216.34/cb"), IsNil)
+	c.Check(checkCallbackURL("http://[2001:db8::1]:8080/cb"), IsNil)
+}
+
+func (s *eventsSuite) TestDialPublic(c *C) {
+	prevLookup := lookupIP
+	defer func() { lookupIP = prevLookup }()
+	resolved := map[string][]net.IP{
+		"private.example.com": []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.1")},
+		"none.example.com":    nil,
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "broken.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return resolved[host], nil
+	}
+	_, err := dialPublic("tcp", "private.example.com:80")
+	c.Check(err, ErrorMatches, "10.0.0.1 is not a public address")
+	_, err = dialPublic("tcp", "none.example.com:80")
+	c.Check(err, ErrorMatches, "no addresses for none.example.com")
+	_, err = dialPublic("tcp", "broken.example.com:80")
+	c.Check(err, ErrorMatches, "no such host")
+	_, err = dialPublic("tcp", "broken.example.com")
+	c.Check(err, NotNil)
+	// names resolving to loopback are no better than the address
+	lookupIP = func(string) ([]net.IP, error) { return []net.IP{net.ParseIP("127.0.0.1")}, nil }
+	_, err = dialPublic("tcp", "loopback.example.com:80")
+	c.Check(err, ErrorMatches, "127.0.0.1 is not a public address")
+}
+
+func (s *eventsSuite) TestDoUnicastWithCallback(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	res, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:      "user1",
+		DeviceId:    "DEV1",
+		AppId:       "app1",
+		ExpireOn:    future,
+		Data:        json.RawMessage(`{"a": 1}`),
+		CallbackURL: "https://example.com/cb",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
+	cb, err := sto.GetCallback("MSG-ID")
+	c.Assert(err, IsNil)
+	c.Assert(cb, NotNil)
+	c.Check(cb.AppId, Equals, "app1")
+	c.Check(cb.DeviceId, Equals, "DEV1")
+	c.Check(cb.URL, Equals, "https://example.com/cb")
+	c.Check(cb.Expiration.After(time.Now().Add(callbackGrace)), Equals, true)
+}
+
+func (s *eventsSuite) TestDoUnicastDeliverAfterWithCallback(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	res, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		Data:         json.RawMessage(`{"a": 1}`),
+		DeliverAfter: time.Now().Add(time.Hour).Format(time.RFC3339),
+		CallbackURL:  "https://example.com/cb",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"msgid": "MSG-ID"})
+	cb, err := sto.GetCallback("MSG-ID")
+	c.Assert(err, IsNil)
+	c.Check(cb, NotNil)
+}
+
+func (s *eventsSuite) TestDoUnicastBadCallbackURL(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	_, apiErr := doUnicast(nil, sto, &Unicast{
+		UserId:      "user1",
+		DeviceId:    "DEV1",
+		AppId:       "app1",
+		ExpireOn:    future,
+		Data:        json.RawMessage(`{"a": 1}`),
+		CallbackURL: "mailto:someone@example.com",
+	})
+	c.Check(apiErr, Equals, ErrInvalidCallbackURL)
+}
+
+func (s *eventsSuite) TestCheckEvent(c *C) {
+	c.Check(checkEvent(&Event{DeviceId: "DEV1", AppId: "app1", MsgId: "m1", Event: "action"}), IsNil)
+	c.Check(checkEvent(&Event{DeviceId: "DEV1", AppId: "app1", MsgId: "m1", Event: "dismissed"}), IsNil)
+	c.Check(checkEvent(&Event{DeviceId: "DEV1", AppId: "app1", MsgId: "m1", Event: "reply", Action: "hi"}), IsNil)
+	c.Check(checkEvent(&Event{AppId: "app1", MsgId: "m1", Event: "action"}), Equals, ErrMissingIdField)
+	c.Check(checkEvent(&Event{DeviceId: "DEV1", MsgId: "m1", Event: "action"}), Equals, ErrMissingIdField)
+	c.Check(checkEvent(&Event{DeviceId: "DEV1", AppId: "app1", Event: "action"}), Equals, ErrMissingIdField)
+	c.Check(checkEvent(&Event{DeviceId: "DEV1", AppId: "app1", MsgId: "m1", Event: "read"}), Equals, ErrInvalidEvent)
+}
+
+func (s *eventsSuite) TestDoEvent(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.SetCallback("m1", &store.Callback{
+		AppId:      "app1",
+		DeviceId:   "DEV1",
+		URL:        "https://example.com/cb",
+		Expiration: time.Now().Add(time.Hour),
+	}), IsNil)
+	ctx := &context{testStoreAccess(nil), nil, s.testlog}
+	res, apiErr := doEvent(ctx, sto, &Event{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+		Event:    "action",
+		Action:   "app://foo",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, IsNil)
+	c.Check(s.posted, DeepEquals, []string{
+		`https://example.com/cb {"appid":"app1","msgid":"m1","event":"action","action":"app://foo"}`,
+	})
+	// the same event again isn't reported again
+	_, apiErr = doEvent(ctx, sto, &Event{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+		Event:    "action",
+		Action:   "app://foo",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(s.posted, HasLen, 1)
+	// but another one is
+	_, apiErr = doEvent(ctx, sto, &Event{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+		Event:    "dismissed",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(s.posted, HasLen, 2)
+}
+
+func (s *eventsSuite) TestDoEventIgnoresWithoutCallback(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.SetCallback("m1", &store.Callback{
+		AppId:      "app1",
+		DeviceId:   "DEV1",
+		URL:        "https://example.com/cb",
+		Expiration: time.Now().Add(time.Hour),
+	}), IsNil)
+	ctx := &context{testStoreAccess(nil), nil, s.testlog}
+	for i, event := range []*Event{
+		{DeviceId: "DEV1", AppId: "app1", MsgId: "m2", Event: "dismissed"},
+		{DeviceId: "DEV1", AppId: "app2", MsgId: "m1", Event: "dismissed"},
+		{DeviceId: "DEV2", AppId: "app1", MsgId: "m1", Event: "dismissed"},
+	} {
+		res, apiErr := doEvent(ctx, sto, event)
+		c.Check(apiErr, IsNil, Commentf("iteration #%d", i))
+		c.Check(res, IsNil, Commentf("iteration #%d", i))
+	}
+	c.Check(s.posted, HasLen, 0)
+}
+
+func (s *eventsSuite) TestDoEventBadEvent(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	_, apiErr := doEvent(nil, sto, &Event{DeviceId: "DEV1", AppId: "app1", MsgId: "m1"})
+	c.Check(apiErr, Equals, ErrInvalidEvent)
+}
+
+func (s *eventsSuite) TestPostEvent(c *C) {
+	postEvent = s.prevPost
+	// the test server is local
+	prevClient := callbackClient
+	callbackClient = &http.Client{Timeout: callbackTimeout}
+	defer func() { callbackClient = prevClient }()
+	bodyCh := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c.Check(r.Header.Get("Content-Type"), Equals, JSONMediaType)
+		bodyCh <- string(body)
+	}))
+	defer ts.Close()
+	postEvent(s.testlog, ts.URL, []byte(`{"event":"dismissed"}`))
+	select {
+	case body := <-bodyCh:
+		c.Check(body, Equals, `{"event":"dismissed"}`)
+	case <-time.After(5 * time.Second):
+		c.Fatal("event not posted")
+	}
+}
+
+func (s *eventsSuite) TestEventPosterDropsWhenFull(c *C) {
+	// with no workers nothing gets taken off the queue
+	p := newEventPoster(1, 0)
+	p.post(s.testlog, "https://example.com/cb1", []byte(`{}`))
+	c.Check(s.testlog.Captured(), Equals, "")
+	p.post(s.testlog, "https://example.com/cb2", []byte(`{}`))
+	c.Check(s.testlog.Captured(), Equals, "ERROR too many events waiting, dropping the one for https://example.com/cb2\n")
+	c.Check(len(p.queue), Equals, 1)
+}
+
+func (s *eventsSuite) TestRespondsToEvent(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	c.Assert(sto.SetCallback("m1", &store.Callback{
+		AppId:      "app1",
+		DeviceId:   "DEV1",
+		URL:        "https://example.com/cb",
+		Expiration: time.Now().Add(time.Hour),
+	}), IsNil)
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return sto, nil
+	})
+	testServer := httptest.NewServer(MakeHandlersMux(storage, nil, s.testlog))
+	defer testServer.Close()
+
+	request := newPostRequest("/event", &Event{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		MsgId:    "m1",
+		Event:    "dismissed",
+	}, testServer)
+
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, OK)
+	c.Check(s.posted, DeepEquals, []string{
+		`https://example.com/cb {"appid":"app1","msgid":"m1","event":"dismissed"}`,
+	})
+}
@@ -25,6 +25,7 @@ import (
 	"io"
 	"mime"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/pborman/uuid"
@@ -57,6 +58,8 @@ const (
 	invalidRequest = "invalid-request"
 	unknownChannel = "unknown-channel"
 	unknownToken   = "unknown-token"
+	unknownUser    = "unknown-user"
+	unknownKey     = "unknown-public-key"
 	unauthorized   = "unauthorized"
 	unavailable    = "unavailable"
 	internalError  = "internal"
@@ -147,6 +150,36 @@ var (
 		"Past expiration date",
 		nil,
 	}
+	ErrInvalidDeliverAfter = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Invalid deliver after date",
+		nil,
+	}
+	ErrDeliverAfterExpiration = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Deliver after date past expiration date",
+		nil,
+	}
+	ErrInvalidPriority = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Invalid priority, should be high, normal or low",
+		nil,
+	}
+	ErrInvalidCallbackURL = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Invalid callback url, should be a public http or https one",
+		nil,
+	}
+	ErrInvalidEvent = &APIError{
+		http.StatusBadRequest,
+		invalidRequest,
+		"Invalid event, should be action, dismissed or reply",
+		nil,
+	}
 	ErrUnknownChannel = &APIError{
 		http.StatusBadRequest,
 		unknownChannel,
@@ -159,6 +192,18 @@ var (
 		"Unknown token",
 		nil,
 	}
+	ErrUnknownUser = &APIError{
+		http.StatusBadRequest,
+		unknownUser,
+		"No devices registered for the user",
+		nil,
+	}
+	ErrUnknownPublicKey = &APIError{
+		http.StatusBadRequest,
+		unknownKey,
+		"No public key published by the device for the application",
+		nil,
+	}
 	ErrUnknown = &APIError{
 		http.StatusInternalServerError,
 		internalError,
@@ -183,6 +228,24 @@ var (
 		"Could not make token",
 		nil,
 	}
+	ErrCouldNotStorePublicKey = &APIError{
+		http.StatusServiceUnavailable,
+		unavailable,
+		"Could not store public key",
+		nil,
+	}
+	ErrCouldNotRegisterUserDevice = &APIError{
+		http.StatusServiceUnavailable,
+		unavailable,
+		"Could not register device for user",
+		nil,
+	}
+	ErrCouldNotResolveUser = &APIError{
+		http.StatusServiceUnavailable,
+		unavailable,
+		"Could not resolve user devices",
+		nil,
+	}
 	ErrCouldNotRemoveToken = &APIError{
 		http.StatusServiceUnavailable,
 		unavailable,
@@ -222,6 +285,18 @@ func apiErrorWithExtra(apiErr *APIError, extra interface{}) *APIError {
 type Registration struct {
 	DeviceId string `json:"deviceid"`
 	AppId    string `json:"appid"`
+	// optionally associate the device with a user for /notify-user
+	UserId string `json:"userid,omitempty"`
+	// the key the app server can encrypt payloads to, see /publickey
+	PublicKey string `json:"publickey,omitempty"`
+}
+
+// PublicKeyLookup request JSON object.
+type PublicKeyLookup struct {
+	Token    string `json:"token"`
+	UserId   string `json:"userid"`   // not part of the official API
+	DeviceId string `json:"deviceid"` // not part of the official API
+	AppId    string `json:"appid"`
 }
 
 type Unicast struct {
@@ -235,6 +310,13 @@ type Unicast struct {
 	ClearPending bool `json:"clear_pending,omitempty"`
 	// replace pending messages with the same replace_tag
 	ReplaceTag string `json:"replace_tag,omitempty"`
+	// hold the message until this time
+	DeliverAfter string `json:"deliver_after,omitempty"`
+	// high, normal (default) or low
+	Priority string `json:"priority,omitempty"`
+	// where to report the user acting on, or dismissing, the
+	// notification; the msgid to expect is in the reply
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
 // Broadcast request JSON object.
@@ -242,6 +324,12 @@ type Broadcast struct {
 	Channel  string          `json:"channel"`
 	ExpireOn string          `json:"expire_on"`
 	Data     json.RawMessage `json:"data"`
+	// replace pending broadcasts with the same replace_tag
+	ReplaceTag string `json:"replace_tag,omitempty"`
+	// supersede all pending broadcasts in the channel
+	Sticky bool `json:"sticky,omitempty"`
+	// hold the broadcast until this time
+	DeliverAfter string `json:"deliver_after,omitempty"`
 }
 
 // RespondError writes back a JSON error response for a APIError.
@@ -314,10 +402,90 @@ func checkCastCommon(data json.RawMessage, expireOn string) (time.Time, *APIErro
 	return expire, nil
 }
 
+// checkDeliverAfter parses an optional deliver after date, the zero
+// time is returned if delivery should not be delayed.
+func checkDeliverAfter(deliverAfter string, expire time.Time) (time.Time, *APIError) {
+	if deliverAfter == "" {
+		return zeroTime, nil
+	}
+	after, err := time.Parse(time.RFC3339, deliverAfter)
+	if err != nil {
+		return zeroTime, ErrInvalidDeliverAfter
+	}
+	if !after.Before(expire) {
+		return zeroTime, ErrDeliverAfterExpiration
+	}
+	if !after.After(time.Now()) {
+		return zeroTime, nil
+	}
+	return after, nil
+}
+
 func checkBroadcast(bcast *Broadcast) (time.Time, *APIError) {
 	return checkCastCommon(bcast.Data, bcast.ExpireOn)
 }
 
+// scrubCriteriaFor returns the Scrub criteria to apply before
+// appending a notification for appId with the given metadata.
+func scrubCriteriaFor(appId string, clearPending bool, meta store.Metadata) []string {
+	if clearPending || meta.Sticky {
+		return []string{appId}
+	} else if meta.ReplaceTag != "" {
+		return []string{appId, meta.ReplaceTag}
+	}
+	return nil
+}
+
+// pendingNotifications is what inspectPending finds in a unicast
+// channel: how many notifications are expired, how many would be
+// replaced, and how many others are there for the app, as well as
+// the last unexpired one that isn't replaced.
+type pendingNotifications struct {
+	expired     int
+	replaceable int
+	forApp      int
+	last        *protocol.Notification
+}
+
+// inspectPending looks at the notifications pending at now in the
+// unicast channel chanId, before appending one for appId with
+// replaceTag.
+func inspectPending(sto store.PendingStore, chanId store.InternalChannelId, appId, replaceTag string, now time.Time) (*pendingNotifications, error) {
+	_, notifs, meta, err := sto.GetChannelUnfiltered(chanId)
+	if err != nil {
+		return nil, err
+	}
+	pending := &pendingNotifications{}
+	for i, notif := range notifs {
+		if meta[i].Before(now) {
+			pending.expired++
+			continue
+		}
+		if notif.AppId == appId {
+			if replaceTag != "" && replaceTag == meta[i].ReplaceTag {
+				// this we will scrub
+				pending.replaceable++
+				continue
+			}
+			pending.forApp++
+		}
+		notif := notif
+		pending.last = &notif
+	}
+	return pending, nil
+}
+
+// schedule stores a notification to be delivered once due.
+func schedule(ctx *context, sto store.PendingStore, sched *store.Scheduled) *APIError {
+	err := sto.AddScheduled(sched)
+	if err != nil {
+		ctx.logger.Errorf("could not schedule notification: %v", err)
+		return ErrCouldNotStoreNotification
+	}
+	ctx.logger.Debugf("scheduled: %v %v id:%v after:%v", sched.AppId, sched.ChanId, sched.Id, sched.DeliverAfter)
+	return nil
+}
+
 // StoreAccess lets get a notification pending store and parameters
 // for storage.
 type StoreAccess interface {
@@ -413,6 +581,10 @@ func doBroadcast(ctx *context, sto store.PendingStore, parsedBodyObj interface{}
 	if apiErr != nil {
 		return nil, apiErr
 	}
+	deliverAfter, apiErr := checkDeliverAfter(bcast.DeliverAfter, expire)
+	if apiErr != nil {
+		return nil, apiErr
+	}
 	chanId, err := sto.GetInternalChannelId(bcast.Channel)
 	if err != nil {
 		switch err {
@@ -422,7 +594,26 @@ func doBroadcast(ctx *context, sto store.PendingStore, parsedBodyObj interface{}
 			return nil, ErrUnknown
 		}
 	}
-	err = sto.AppendToChannel(chanId, bcast.Data, expire)
+
+	meta1 := store.Metadata{
+		Expiration: expire,
+		ReplaceTag: bcast.ReplaceTag,
+		Sticky:     bcast.Sticky,
+	}
+
+	if !deliverAfter.IsZero() {
+		return nil, schedule(ctx, sto, &store.Scheduled{
+			Id:           generateMsgId(),
+			ChanId:       chanId,
+			Payload:      bcast.Data,
+			Meta:         meta1,
+			DeliverAfter: deliverAfter,
+		})
+	}
+
+	// superseded broadcasts are not scrubbed, clients' levels map
+	// to positions in the channel; they are dropped on delivery
+	err = sto.AppendToChannel(chanId, bcast.Data, meta1)
 	if err != nil {
 		ctx.logger.Errorf("could not store notification: %v", err)
 		return nil, ErrCouldNotStoreNotification
@@ -432,6 +623,21 @@ func doBroadcast(ctx *context, sto store.PendingStore, parsedBodyObj interface{}
 	return nil, nil
 }
 
+var priorities = map[string]store.Priority{
+	"":       store.NormalPriority,
+	"normal": store.NormalPriority,
+	"high":   store.HighPriority,
+	"low":    store.LowPriority,
+}
+
+func checkPriority(priority string) (store.Priority, *APIError) {
+	prio, ok := priorities[priority]
+	if !ok {
+		return store.NormalPriority, ErrInvalidPriority
+	}
+	return prio, nil
+}
+
 func checkUnicast(ucast *Unicast) (time.Time, *APIError) {
 	if ucast.AppId == "" {
 		return zeroTime, ErrMissingIdField
@@ -456,6 +662,18 @@ func doUnicast(ctx *context, sto store.PendingStore, parsedBodyObj interface{})
 	if apiErr != nil {
 		return nil, apiErr
 	}
+	deliverAfter, apiErr := checkDeliverAfter(ucast.DeliverAfter, expire)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	priority, apiErr := checkPriority(ucast.Priority)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	apiErr = checkCallbackURL(ucast.CallbackURL)
+	if apiErr != nil {
+		return nil, apiErr
+	}
 	chanId, err := sto.GetInternalChannelIdFromToken(ucast.Token, ucast.AppId, ucast.UserId, ucast.DeviceId)
 	if err != nil {
 		switch err {
@@ -472,43 +690,51 @@ func doUnicast(ctx *context, sto store.PendingStore, parsedBodyObj interface{})
 	}
 	ctx.logger.Infof("notify: %v %v -> %v", ucast.AppId, ucast.Token, chanId)
 
-	_, notifs, meta, err := sto.GetChannelUnfiltered(chanId)
+	pending, err := inspectPending(sto, chanId, ucast.AppId, ucast.ReplaceTag, time.Now())
 	if err != nil {
 		ctx.logger.Errorf("could not peek at notifications: %v", err)
 		return nil, ErrCouldNotStoreNotification
 	}
-	expired := 0
-	replaceable := 0
-	forApp := 0
-	replaceTag := ucast.ReplaceTag
-	scrubCriteria := []string(nil)
-	now := time.Now()
-	var last *protocol.Notification
-	for i, notif := range notifs {
-		if meta[i].Before(now) {
-			expired++
-			continue
+	// with nothing pending for the app there is no limit to hit
+	if !ucast.ClearPending && pending.forApp > 0 && pending.forApp >= ctx.storage.GetMaxNotificationsPerApplication() {
+		ctx.logger.Debugf("notify: %v %v too many pending", ucast.AppId, chanId)
+		return nil, apiErrorWithExtra(ErrTooManyPendingNotifications,
+			&pending.last.Payload)
+	}
+
+	if !deliverAfter.IsZero() {
+		// the limit is checked again when it's due
+		msgId := generateMsgId()
+		res, apiErr := setCallback(ctx, sto, ucast, chanId, msgId, expire)
+		if apiErr != nil {
+			return nil, apiErr
 		}
-		if notif.AppId == ucast.AppId {
-			if replaceTag != "" && replaceTag == meta[i].ReplaceTag {
-				// this we will scrub
-				replaceable++
-				continue
-			}
-			forApp++
+		apiErr = schedule(ctx, sto, &store.Scheduled{
+			Id:      msgId,
+			ChanId:  chanId,
+			AppId:   ucast.AppId,
+			Payload: ucast.Data,
+			Meta: store.Metadata{
+				Expiration: expire,
+				ReplaceTag: ucast.ReplaceTag,
+				Priority:   priority,
+			},
+			ClearPending: ucast.ClearPending,
+			DeliverAfter: deliverAfter,
+		})
+		if apiErr != nil {
+			return nil, apiErr
 		}
-		last = &notif
+		return res, nil
 	}
+
+	scrubCriteria := []string(nil)
 	if ucast.ClearPending {
 		scrubCriteria = []string{ucast.AppId}
-	} else if forApp >= ctx.storage.GetMaxNotificationsPerApplication() {
-		ctx.logger.Debugf("notify: %v %v too many pending", ucast.AppId, chanId)
-		return nil, apiErrorWithExtra(ErrTooManyPendingNotifications,
-			&last.Payload)
-	} else if replaceable > 0 {
-		scrubCriteria = []string{ucast.AppId, replaceTag}
+	} else if pending.replaceable > 0 {
+		scrubCriteria = []string{ucast.AppId, ucast.ReplaceTag}
 	}
-	if expired > 0 || scrubCriteria != nil {
+	if pending.expired > 0 || scrubCriteria != nil {
 		err := sto.Scrub(chanId, scrubCriteria...)
 		if err != nil {
 			ctx.logger.Errorf("could not scrub channel: %v", err)
@@ -521,6 +747,12 @@ func doUnicast(ctx *context, sto store.PendingStore, parsedBodyObj interface{})
 	meta1 := store.Metadata{
 		Expiration: expire,
 		ReplaceTag: ucast.ReplaceTag,
+		Priority:   priority,
+	}
+
+	res, apiErr := setCallback(ctx, sto, ucast, chanId, msgId, expire)
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
 	err = sto.AppendToUnicastChannel(chanId, ucast.AppId, ucast.Data, msgId, meta1)
@@ -529,10 +761,13 @@ func doUnicast(ctx *context, sto store.PendingStore, parsedBodyObj interface{})
 		return nil, ErrCouldNotStoreNotification
 	}
 
-	ctx.broker.Unicast(chanId)
+	// low priority ones wait for the next exchange with the device
+	if priority != store.LowPriority {
+		ctx.broker.Unicast(chanId)
+	}
 
-	ctx.logger.Debugf("notify: ok %v %v id:%v clear:%v replace:%v expired:%v", ucast.AppId, chanId, msgId, ucast.ClearPending, replaceable, expired)
-	return nil, nil
+	ctx.logger.Debugf("notify: ok %v %v id:%v clear:%v replace:%v expired:%v priority:%v", ucast.AppId, chanId, msgId, ucast.ClearPending, pending.replaceable, pending.expired, priority)
+	return res, nil
 }
 
 func checkRegister(reg *Registration) *APIError {
@@ -553,6 +788,19 @@ func doRegister(ctx *context, sto store.PendingStore, parsedBodyObj interface{})
 		ctx.logger.Errorf("could not make a token: %v", err)
 		return nil, ErrCouldNotMakeToken
 	}
+	// registering without a key forgets any earlier one
+	err = sto.SetPublicKey(reg.DeviceId, reg.AppId, reg.PublicKey)
+	if err != nil {
+		ctx.logger.Errorf("could not store public key: %v", err)
+		return nil, ErrCouldNotStorePublicKey
+	}
+	if reg.UserId != "" {
+		err = sto.AddUserDevice(reg.UserId, reg.AppId, reg.DeviceId, token)
+		if err != nil {
+			ctx.logger.Errorf("could not register user device: %v", err)
+			return nil, ErrCouldNotRegisterUserDevice
+		}
+	}
 	return map[string]interface{}{"token": token}, nil
 }
 
@@ -567,9 +815,77 @@ func doUnregister(ctx *context, sto store.PendingStore, parsedBodyObj interface{
 		ctx.logger.Errorf("could not remove token: %v", err)
 		return nil, ErrCouldNotRemoveToken
 	}
+	if reg.UserId != "" {
+		err = sto.RemoveUserDevice(reg.UserId, reg.AppId, reg.DeviceId)
+		if err != nil {
+			ctx.logger.Errorf("could not remove user device: %v", err)
+			return nil, ErrCouldNotRemoveToken
+		}
+	}
 	return nil, nil
 }
 
+func doPublicKey(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	lookup := parsedBodyObj.(*PublicKeyLookup)
+	if lookup.AppId == "" || (lookup.Token == "" && (lookup.UserId == "" || lookup.DeviceId == "")) {
+		return nil, ErrMissingIdField
+	}
+	publicKey, err := sto.GetPublicKey(lookup.Token, lookup.AppId, lookup.UserId, lookup.DeviceId)
+	if err != nil {
+		switch err {
+		case store.ErrUnknownToken:
+			return nil, ErrUnknownToken
+		case store.ErrUnauthorized:
+			return nil, ErrUnauthorized
+		default:
+			ctx.logger.Errorf("could not resolve token: %v", err)
+			return nil, ErrCouldNotResolveToken
+		}
+	}
+	if publicKey == "" {
+		return nil, ErrUnknownPublicKey
+	}
+	return map[string]interface{}{"publickey": publicKey}, nil
+}
+
+func doNotifyUser(ctx *context, sto store.PendingStore, parsedBodyObj interface{}) (map[string]interface{}, *APIError) {
+	ucast := parsedBodyObj.(*Unicast)
+	if ucast.UserId == "" || ucast.AppId == "" {
+		return nil, ErrMissingIdField
+	}
+	devices, err := sto.GetUserDevices(ucast.UserId, ucast.AppId)
+	if err != nil {
+		ctx.logger.Errorf("could not resolve user devices: %v", err)
+		return nil, ErrCouldNotResolveUser
+	}
+	if len(devices) == 0 {
+		ctx.logger.Debugf("notify-user: %v %v no devices", ucast.AppId, ucast.UserId)
+		return nil, ErrUnknownUser
+	}
+	deviceIds := make([]string, 0, len(devices))
+	for deviceId := range devices {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	sort.Strings(deviceIds)
+	results := make(map[string]interface{}, len(devices))
+	for _, deviceId := range deviceIds {
+		deviceUcast := *ucast
+		deviceUcast.Token = devices[deviceId]
+		deviceUcast.UserId = ""
+		deviceUcast.DeviceId = ""
+		res, apiErr := doUnicast(ctx, sto, &deviceUcast)
+		if apiErr != nil {
+			results[deviceId] = apiErr
+		} else if res != nil {
+			res["ok"] = true
+			results[deviceId] = res
+		} else {
+			results[deviceId] = map[string]bool{"ok": true}
+		}
+	}
+	return map[string]interface{}{"devices": results}, nil
+}
+
 // MakeHandlersMux makes a handler that dispatches for the various API endpoints.
 func MakeHandlersMux(storage StoreAccess, broker broker.BrokerSending, logger logger.Logger) *http.ServeMux {
 	ctx := &context{
@@ -588,6 +904,11 @@ func MakeHandlersMux(storage StoreAccess, broker broker.BrokerSending, logger lo
 		parsingBodyObj: func() interface{} { return &Unicast{} },
 		doHandle:       doUnicast,
 	})
+	mux.Handle("/notify-user", &JSONPostHandler{
+		context:        ctx,
+		parsingBodyObj: func() interface{} { return &Unicast{} },
+		doHandle:       doNotifyUser,
+	})
 	mux.Handle("/register", &JSONPostHandler{
 		context:        ctx,
 		parsingBodyObj: func() interface{} { return &Registration{} },
@@ -598,5 +919,15 @@ func MakeHandlersMux(storage StoreAccess, broker broker.BrokerSending, logger lo
 		parsingBodyObj: func() interface{} { return &Registration{} },
 		doHandle:       doUnregister,
 	})
+	mux.Handle("/publickey", &JSONPostHandler{
+		context:        ctx,
+		parsingBodyObj: func() interface{} { return &PublicKeyLookup{} },
+		doHandle:       doPublicKey,
+	})
+	mux.Handle("/event", &JSONPostHandler{
+		context:        ctx,
+		parsingBodyObj: func() interface{} { return &Event{} },
+		doHandle:       doEvent,
+	})
 	return mux
 }
@@ -156,6 +156,29 @@ func (s *handlersSuite) TestCheckCastBroadcastAndCommon(c *C) {
 	c.Check(err, Equals, ErrPastExpiration)
 }
 
+func (s *handlersSuite) TestCheckDeliverAfter(c *C) {
+	expire := time.Now().Add(4 * time.Hour)
+	after, err := checkDeliverAfter("", expire)
+	c.Check(err, IsNil)
+	c.Check(after.IsZero(), Equals, true)
+
+	soon := time.Now().Add(time.Hour).Format(time.RFC3339)
+	after, err = checkDeliverAfter(soon, expire)
+	c.Check(err, IsNil)
+	c.Check(after.Format(time.RFC3339), Equals, soon)
+
+	// past means right away
+	after, err = checkDeliverAfter(time.Now().Add(-time.Hour).Format(time.RFC3339), expire)
+	c.Check(err, IsNil)
+	c.Check(after.IsZero(), Equals, true)
+
+	_, err = checkDeliverAfter("12:00", expire)
+	c.Check(err, Equals, ErrInvalidDeliverAfter)
+
+	_, err = checkDeliverAfter(time.Now().Add(5*time.Hour).Format(time.RFC3339), expire)
+	c.Check(err, Equals, ErrDeliverAfterExpiration)
+}
+
 type checkBrokerSending struct {
 	store         store.PendingStore
 	chanId        store.InternalChannelId
@@ -200,6 +223,107 @@ func (s *handlersSuite) TestDoBroadcast(c *C) {
 	c.Check(bsend.notifications, DeepEquals, help.Ns(payload))
 }
 
+func (s *handlersSuite) TestDoBroadcastReplaceTag(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{nil, bsend, nil}
+	payload1 := json.RawMessage(`{"a": 1}`)
+	payload2 := json.RawMessage(`{"a": 2}`)
+	payload3 := json.RawMessage(`{"a": 3}`)
+	for _, payload := range []json.RawMessage{payload1, payload2} {
+		_, apiErr := doBroadcast(ctx, sto, &Broadcast{
+			Channel:    "system",
+			ExpireOn:   future,
+			Data:       payload,
+			ReplaceTag: "update",
+		})
+		c.Assert(apiErr, IsNil)
+	}
+	_, apiErr := doBroadcast(ctx, sto, &Broadcast{
+		Channel:  "system",
+		ExpireOn: future,
+		Data:     payload3,
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(bsend.err, IsNil)
+	c.Check(bsend.top, Equals, int64(3))
+	// the superseded one stays in place, to keep levels
+	c.Check(bsend.notifications, DeepEquals, help.Ns(payload1, payload2, payload3))
+	c.Check(store.FilterOutObsolete(bsend.notifications, bsend.meta), DeepEquals, help.Ns(payload2, payload3))
+	c.Check(bsend.meta[1].ReplaceTag, Equals, "update")
+}
+
+func (s *handlersSuite) TestDoBroadcastSticky(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{nil, bsend, nil}
+	payload1 := json.RawMessage(`{"a": 1}`)
+	payload2 := json.RawMessage(`{"a": 2}`)
+	payload3 := json.RawMessage(`{"a": 3}`)
+	_, apiErr := doBroadcast(ctx, sto, &Broadcast{
+		Channel:    "system",
+		ExpireOn:   future,
+		Data:       payload1,
+		ReplaceTag: "update",
+	})
+	c.Assert(apiErr, IsNil)
+	_, apiErr = doBroadcast(ctx, sto, &Broadcast{
+		Channel:  "system",
+		ExpireOn: future,
+		Data:     payload2,
+	})
+	c.Assert(apiErr, IsNil)
+	_, apiErr = doBroadcast(ctx, sto, &Broadcast{
+		Channel:  "system",
+		ExpireOn: future,
+		Data:     payload3,
+		Sticky:   true,
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(bsend.err, IsNil)
+	c.Check(bsend.top, Equals, int64(3))
+	c.Check(bsend.notifications, HasLen, 3)
+	c.Check(store.FilterOutObsolete(bsend.notifications, bsend.meta), DeepEquals, help.Ns(payload3))
+	c.Check(bsend.meta[2].Sticky, Equals, true)
+}
+
+func (s *handlersSuite) TestDoBroadcastDeliverAfter(c *C) {
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		return "SCHED-ID"
+	}
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{nil, bsend, s.testlog}
+	payload := json.RawMessage(`{"a": 1}`)
+	deliverAfter := time.Now().Add(time.Hour)
+	res, apiErr := doBroadcast(ctx, sto, &Broadcast{
+		Channel:      "system",
+		ExpireOn:     future,
+		Data:         payload,
+		DeliverAfter: deliverAfter.Format(time.RFC3339),
+	})
+	c.Assert(apiErr, IsNil)
+	c.Assert(res, IsNil)
+	// nothing delivered yet
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	top, notifs, err := sto.GetChannelSnapshot(store.SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(0))
+	c.Check(notifs, HasLen, 0)
+	// but scheduled
+	due, err := sto.GetDueScheduled(deliverAfter.Add(time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(due, HasLen, 1)
+	c.Check(due[0].Id, Equals, "SCHED-ID")
+	c.Check(due[0].ChanId, Equals, store.SystemInternalChannelId)
+	c.Check(due[0].Payload, DeepEquals, payload)
+	c.Check(due[0].Meta.Expiration.Format(time.RFC3339), Equals, future)
+}
+
 func (s *handlersSuite) TestDoBroadcastUnknownChannel(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	_, apiErr := doBroadcast(nil, sto, &Broadcast{
@@ -225,6 +349,26 @@ func (isto *interceptInMemoryPendingStore) Unregister(appId, deviceId string) er
 	return isto.intercept("Unregister", err)
 }
 
+func (isto *interceptInMemoryPendingStore) SetPublicKey(deviceId, appId, publicKey string) error {
+	err := isto.InMemoryPendingStore.SetPublicKey(deviceId, appId, publicKey)
+	return isto.intercept("SetPublicKey", err)
+}
+
+func (isto *interceptInMemoryPendingStore) GetPublicKey(token, appId, userId, deviceId string) (string, error) {
+	publicKey, err := isto.InMemoryPendingStore.GetPublicKey(token, appId, userId, deviceId)
+	return publicKey, isto.intercept("GetPublicKey", err)
+}
+
+func (isto *interceptInMemoryPendingStore) AddUserDevice(userId, appId, deviceId, token string) error {
+	err := isto.InMemoryPendingStore.AddUserDevice(userId, appId, deviceId, token)
+	return isto.intercept("AddUserDevice", err)
+}
+
+func (isto *interceptInMemoryPendingStore) GetUserDevices(userId, appId string) (map[string]string, error) {
+	devices, err := isto.InMemoryPendingStore.GetUserDevices(userId, appId)
+	return devices, isto.intercept("GetUserDevices", err)
+}
+
 func (isto *interceptInMemoryPendingStore) GetInternalChannelIdFromToken(token, appId, userId, deviceId string) (store.InternalChannelId, error) {
 	chanId, err := isto.InMemoryPendingStore.GetInternalChannelIdFromToken(token, appId, userId, deviceId)
 	return chanId, isto.intercept("GetInternalChannelIdFromToken", err)
@@ -235,8 +379,8 @@ func (isto *interceptInMemoryPendingStore) GetInternalChannelId(channel string)
 	return chanId, isto.intercept("GetInternalChannelId", err)
 }
 
-func (isto *interceptInMemoryPendingStore) AppendToChannel(chanId store.InternalChannelId, payload json.RawMessage, expiration time.Time) error {
-	err := isto.InMemoryPendingStore.AppendToChannel(chanId, payload, expiration)
+func (isto *interceptInMemoryPendingStore) AppendToChannel(chanId store.InternalChannelId, payload json.RawMessage, meta store.Metadata) error {
+	err := isto.InMemoryPendingStore.AppendToChannel(chanId, payload, meta)
 	return isto.intercept("AppendToChannel", err)
 }
 
@@ -255,6 +399,21 @@ func (isto *interceptInMemoryPendingStore) Scrub(chanId store.InternalChannelId,
 	return isto.intercept("Scrub", err)
 }
 
+func (isto *interceptInMemoryPendingStore) AddScheduled(sched *store.Scheduled) error {
+	err := isto.InMemoryPendingStore.AddScheduled(sched)
+	return isto.intercept("AddScheduled", err)
+}
+
+func (isto *interceptInMemoryPendingStore) GetDueScheduled(ref time.Time) ([]*store.Scheduled, error) {
+	due, err := isto.InMemoryPendingStore.GetDueScheduled(ref)
+	return due, isto.intercept("GetDueScheduled", err)
+}
+
+func (isto *interceptInMemoryPendingStore) DropScheduled(id string) error {
+	err := isto.InMemoryPendingStore.DropScheduled(id)
+	return isto.intercept("DropScheduled", err)
+}
+
 func (s *handlersSuite) TestDoBroadcastUnknownError(c *C) {
 	sto := &interceptInMemoryPendingStore{
 		store.NewInMemoryPendingStore(),
@@ -385,6 +544,139 @@ func (s *handlersSuite) TestDoUnicast(c *C) {
 	})
 }
 
+func (s *handlersSuite) TestDoUnicastDeliverAfter(c *C) {
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		return "MSG-ID"
+	}
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	payload := json.RawMessage(`{"a": 1}`)
+	deliverAfter := time.Now().Add(time.Hour)
+	res, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		Data:         payload,
+		ReplaceTag:   "tag",
+		DeliverAfter: deliverAfter.Format(time.RFC3339),
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, IsNil)
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	// nothing delivered yet
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 0)
+	// but scheduled
+	due, err := sto.GetDueScheduled(deliverAfter.Add(time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(due, HasLen, 1)
+	c.Check(due[0].Id, Equals, "MSG-ID")
+	c.Check(due[0].ChanId, Equals, chanId)
+	c.Check(due[0].AppId, Equals, "app1")
+	c.Check(due[0].Payload, DeepEquals, payload)
+	c.Check(due[0].Meta.ReplaceTag, Equals, "tag")
+}
+
+func (s *handlersSuite) TestDoUnicastPriority(c *C) {
+	msgIds := []string{"m1", "m2", "m3"}
+	prevGenMsgId := generateMsgId
+	defer func() {
+		generateMsgId = prevGenMsgId
+	}()
+	generateMsgId = func() string {
+		msgId := msgIds[0]
+		msgIds = msgIds[1:]
+		return msgId
+	}
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	for _, priority := range []string{"low", "", "high"} {
+		bsend.chanId = ""
+		_, apiErr := doUnicast(ctx, sto, &Unicast{
+			UserId:   "user1",
+			DeviceId: "DEV1",
+			AppId:    "app1",
+			ExpireOn: future,
+			Data:     json.RawMessage(`{"a": 1}`),
+			Priority: priority,
+		})
+		c.Assert(apiErr, IsNil)
+		if priority == "low" {
+			// held back until the next exchange
+			c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+		} else {
+			c.Check(bsend.chanId, Equals, chanId)
+		}
+	}
+	c.Check(bsend.meta[0].Priority, Equals, store.LowPriority)
+	c.Check(bsend.meta[2].Priority, Equals, store.HighPriority)
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Assert(notifs, HasLen, 3)
+	c.Check(notifs[0].MsgId, Equals, "m3")
+	c.Check(notifs[1].MsgId, Equals, "m2")
+	c.Check(notifs[2].MsgId, Equals, "m1")
+}
+
+func (s *handlersSuite) TestDoUnicastInvalidPriority(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	_, apiErr := doUnicast(nil, sto, &Unicast{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+		Priority: "urgent",
+	})
+	c.Check(apiErr, Equals, ErrInvalidPriority)
+}
+
+func (s *handlersSuite) TestDoUnicastInvalidDeliverAfter(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	_, apiErr := doUnicast(nil, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		Data:         json.RawMessage(`{"a": 1}`),
+		DeliverAfter: "tomorrow",
+	})
+	c.Check(apiErr, Equals, ErrInvalidDeliverAfter)
+}
+
+func (s *handlersSuite) TestDoUnicastCouldNotSchedule(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "AddScheduled" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{logger: s.testlog}
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		Data:         json.RawMessage(`{"a": 1}`),
+		DeliverAfter: time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	c.Check(apiErr, Equals, ErrCouldNotStoreNotification)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not schedule notification: fail\n")
+}
+
 func (s *handlersSuite) TestDoUnicastMissingIdField(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	_, apiErr := doUnicast(nil, sto, &Unicast{
@@ -468,6 +760,35 @@ func (s *handlersSuite) TestDoUnicastTooManyNotifications(c *C) {
 	c.Check(s.testlog.Captured(), Equals, "")
 }
 
+func (s *handlersSuite) TestDoUnicastDeliverAfterTooManyNotifications(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+
+	expire := store.Metadata{Expiration: time.Now().Add(4 * time.Hour)}
+	for i := 1; i <= 4; i++ {
+		sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(fmt.Sprintf(`{"o":%d}`, i)), fmt.Sprintf("m%d", i), expire)
+	}
+
+	ctx := &context{storage: testStoreAccess(nil), logger: s.testlog}
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		Data:         json.RawMessage(`{"a": 1}`),
+		DeliverAfter: time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	c.Assert(apiErr, NotNil)
+	extra := apiErr.Extra
+	apiErr.Extra = nil
+	c.Check(apiErr, DeepEquals, ErrTooManyPendingNotifications)
+	c.Check(extra, DeepEquals, json.RawMessage(`{"o":4}`))
+	// and nothing got scheduled
+	due, err := sto.GetDueScheduled(time.Now().Add(2 * time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(due, HasLen, 0)
+}
+
 func (s *handlersSuite) TestDoUnicastWithScrub(c *C) {
 	prevGenMsgId := generateMsgId
 	defer func() {
@@ -1115,6 +1436,310 @@ func (s *handlersSuite) TestRespondsToRegisterAndUnicast(c *C) {
 	c.Check(notifications, HasLen, 1)
 }
 
+func (s *handlersSuite) TestDoRegisterWithUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{logger: s.testlog}
+	res, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		UserId:   "user1",
+	})
+	c.Assert(apiErr, IsNil)
+	devices, err := sto.GetUserDevices("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(devices, DeepEquals, map[string]string{"DEV1": res["token"].(string)})
+
+	_, apiErr = doUnregister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		UserId:   "user1",
+	})
+	c.Assert(apiErr, IsNil)
+	devices, err = sto.GetUserDevices("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(devices, HasLen, 0)
+}
+
+func (s *handlersSuite) TestDoRegisterCouldNotRegisterUserDevice(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "AddUserDevice" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{logger: s.testlog}
+	_, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+		UserId:   "user1",
+	})
+	c.Check(apiErr, Equals, ErrCouldNotRegisterUserDevice)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not register user device: fail\n")
+}
+
+func (s *handlersSuite) TestDoRegisterWithPublicKey(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{logger: s.testlog}
+	res, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId:  "DEV1",
+		AppId:     "app1",
+		UserId:    "user1",
+		PublicKey: "KEY",
+	})
+	c.Assert(apiErr, IsNil)
+	token := res["token"].(string)
+
+	res, apiErr = doPublicKey(ctx, sto, &PublicKeyLookup{
+		Token: token,
+		AppId: "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"publickey": "KEY"})
+	res, apiErr = doPublicKey(ctx, sto, &PublicKeyLookup{
+		UserId:   "user1",
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{"publickey": "KEY"})
+	// it's for the app
+	_, apiErr = doPublicKey(ctx, sto, &PublicKeyLookup{
+		Token: token,
+		AppId: "app2",
+	})
+	c.Check(apiErr, Equals, ErrUnauthorized)
+
+	// registering again without a key forgets it
+	_, apiErr = doRegister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	_, apiErr = doPublicKey(ctx, sto, &PublicKeyLookup{
+		Token: token,
+		AppId: "app1",
+	})
+	c.Check(apiErr, Equals, ErrUnknownPublicKey)
+
+	// and so does unregistering
+	_, apiErr = doRegister(ctx, sto, &Registration{
+		DeviceId:  "DEV1",
+		AppId:     "app1",
+		PublicKey: "KEY",
+	})
+	c.Assert(apiErr, IsNil)
+	_, apiErr = doUnregister(ctx, sto, &Registration{
+		DeviceId: "DEV1",
+		AppId:    "app1",
+	})
+	c.Assert(apiErr, IsNil)
+	_, apiErr = doPublicKey(ctx, sto, &PublicKeyLookup{
+		Token: token,
+		AppId: "app1",
+	})
+	c.Check(apiErr, Equals, ErrUnknownPublicKey)
+}
+
+func (s *handlersSuite) TestDoRegisterCouldNotStorePublicKey(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "SetPublicKey" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{logger: s.testlog}
+	_, apiErr := doRegister(ctx, sto, &Registration{
+		DeviceId:  "DEV1",
+		AppId:     "app1",
+		PublicKey: "KEY",
+	})
+	c.Check(apiErr, Equals, ErrCouldNotStorePublicKey)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not store public key: fail\n")
+}
+
+func (s *handlersSuite) TestDoPublicKeyMissingIdField(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	for _, lookup := range []*PublicKeyLookup{
+		{},
+		{Token: "tok"},
+		{AppId: "app1"},
+		{AppId: "app1", DeviceId: "DEV1"},
+	} {
+		_, apiErr := doPublicKey(nil, sto, lookup)
+		c.Check(apiErr, Equals, ErrMissingIdField)
+	}
+}
+
+func (s *handlersSuite) TestDoPublicKeyCouldNotResolveToken(c *C) {
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "GetPublicKey" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	ctx := &context{logger: s.testlog}
+	_, apiErr := doPublicKey(ctx, sto, &PublicKeyLookup{
+		Token: "tok",
+		AppId: "app1",
+	})
+	c.Check(apiErr, Equals, ErrCouldNotResolveToken)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not resolve token: fail\n")
+}
+
+func (s *handlersSuite) TestRespondsToRegisterAndPublicKey(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return sto, nil
+	})
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, s.testlog))
+	defer testServer.Close()
+
+	request := newPostRequest("/register", &Registration{
+		DeviceId:  "dev3",
+		AppId:     "app2",
+		PublicKey: "KEY",
+	}, testServer)
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	var reg map[string]interface{}
+	err = json.Unmarshal(body, &reg)
+	c.Assert(err, IsNil)
+
+	request = newPostRequest("/publickey", &PublicKeyLookup{
+		Token: reg["token"].(string),
+		AppId: "app2",
+	}, testServer)
+	response, err = s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	body, err = getResponseBody(response)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, `{"ok":true,"publickey":"KEY"}`)
+}
+
+func (s *handlersSuite) TestDoNotifyUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	ctx := &context{testStoreAccess(nil), bsend, s.testlog}
+	for _, deviceId := range []string{"DEV1", "DEV2"} {
+		_, apiErr := doRegister(ctx, sto, &Registration{
+			DeviceId: deviceId,
+			AppId:    "app1",
+			UserId:   "user1",
+		})
+		c.Assert(apiErr, IsNil)
+	}
+	// a stale registration
+	err := sto.AddUserDevice("user1", "app1", "DEV3", "bogus")
+	c.Assert(err, IsNil)
+
+	payload := json.RawMessage(`{"a": 1}`)
+	res, apiErr := doNotifyUser(ctx, sto, &Unicast{
+		UserId:   "user1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     payload,
+	})
+	c.Assert(apiErr, IsNil)
+	c.Check(res, DeepEquals, map[string]interface{}{
+		"devices": map[string]interface{}{
+			"DEV1": map[string]bool{"ok": true},
+			"DEV2": map[string]bool{"ok": true},
+			"DEV3": ErrUnknownToken,
+		},
+	})
+	for _, deviceId := range []string{"DEV1", "DEV2"} {
+		_, notifs, err := sto.GetChannelSnapshot(store.UnicastInternalChannelId(deviceId, deviceId))
+		c.Assert(err, IsNil)
+		c.Assert(notifs, HasLen, 1)
+		c.Check(notifs[0].Payload, DeepEquals, payload)
+	}
+}
+
+func (s *handlersSuite) TestDoNotifyUserErrors(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{logger: s.testlog}
+	_, apiErr := doNotifyUser(ctx, sto, &Unicast{
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+	})
+	c.Check(apiErr, Equals, ErrMissingIdField)
+
+	_, apiErr = doNotifyUser(ctx, sto, &Unicast{
+		UserId:   "user1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+	})
+	c.Check(apiErr, Equals, ErrUnknownUser)
+
+	isto := &interceptInMemoryPendingStore{
+		sto,
+		func(meth string, err error) error {
+			if meth == "GetUserDevices" {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	_, apiErr = doNotifyUser(ctx, isto, &Unicast{
+		UserId:   "user1",
+		AppId:    "app1",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"a": 1}`),
+	})
+	c.Check(apiErr, Equals, ErrCouldNotResolveUser)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not resolve user devices: fail\n")
+}
+
+func (s *handlersSuite) TestRespondsToNotifyUser(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	storage := testStoreAccess(func(http.ResponseWriter, *http.Request) (store.PendingStore, error) {
+		return sto, nil
+	})
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	testServer := httptest.NewServer(MakeHandlersMux(storage, bsend, s.testlog))
+	defer testServer.Close()
+
+	request := newPostRequest("/register", &Registration{
+		DeviceId: "dev3",
+		AppId:    "app2",
+		UserId:   "user2",
+	}, testServer)
+	response, err := s.client.Do(request)
+	c.Assert(err, IsNil)
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+
+	request = newPostRequest("/notify-user", &Unicast{
+		UserId:   "user2",
+		AppId:    "app2",
+		ExpireOn: future,
+		Data:     json.RawMessage(`{"foo":"bar"}`),
+	}, testServer)
+	response, err = s.client.Do(request)
+	c.Assert(err, IsNil)
+
+	c.Check(response.StatusCode, Equals, http.StatusOK)
+	body, err := getResponseBody(response)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, `{"devices":{"dev3":{"ok":true}},"ok":true}`)
+	c.Check(<-bsend.chanId, Equals, store.UnicastInternalChannelId("dev3", "dev3"))
+}
+
 func (s *handlersSuite) TestRespondsToUnregister(c *C) {
 	yay := make(chan bool, 1)
 	sto := &interceptInMemoryPendingStore{
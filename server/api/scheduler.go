@@ -0,0 +1,163 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ubports/ubuntu-push/logger"
+	"github.com/ubports/ubuntu-push/server/broker"
+	"github.com/ubports/ubuntu-push/server/store"
+)
+
+// Scheduler moves scheduled notifications (see deliver_after) into
+// their channels once they are due and requests their delivery.
+// Scheduled notifications are kept in the store until delivered, so
+// with a persistent store they survive restarts; the first check
+// happens right on Start.
+type Scheduler struct {
+	sto       store.PendingStore
+	broker    broker.BrokerSending
+	logger    logger.Logger
+	interval  time.Duration
+	maxPerApp int
+	// running state
+	runMutex sync.Mutex
+	running  bool
+	stop     chan bool
+	stopped  chan bool
+}
+
+// NewScheduler makes a new Scheduler checking for due notifications
+// every interval (which must be positive), holding back unicast ones
+// while their app has maxPerApp notifications pending.
+func NewScheduler(sto store.PendingStore, broker broker.BrokerSending, logger logger.Logger, interval time.Duration, maxPerApp int) *Scheduler {
+	return &Scheduler{
+		sto:       sto,
+		broker:    broker,
+		logger:    logger,
+		interval:  interval,
+		maxPerApp: maxPerApp,
+		stop:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+}
+
+// Start starts the scheduler.
+func (s *Scheduler) Start() {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	go s.run()
+}
+
+// Stop stops the scheduler.
+func (s *Scheduler) Stop() {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	if !s.running {
+		return
+	}
+	s.stop <- true
+	<-s.stopped
+	s.running = false
+}
+
+func (s *Scheduler) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	s.deliverDue(time.Now())
+	for {
+		select {
+		case <-s.stop:
+			s.stopped <- true
+			return
+		case now := <-ticker.C:
+			s.deliverDue(now)
+		}
+	}
+}
+
+// deliverDue appends the scheduled notifications due at now to their
+// channels and requests their delivery. The ones that can't be
+// delivered are left for the next check (until they expire), without
+// holding up the others.
+func (s *Scheduler) deliverDue(now time.Time) {
+	due, err := s.sto.GetDueScheduled(now)
+	if err != nil {
+		s.logger.Errorf("could not get scheduled notifications: %v", err)
+		return
+	}
+	for _, sched := range due {
+		if sched.Meta.Before(now) {
+			s.logger.Debugf("scheduled: %v %v id:%v expired", sched.AppId, sched.ChanId, sched.Id)
+		} else if !s.deliver(sched, now) {
+			continue
+		}
+		err = s.sto.DropScheduled(sched.Id)
+		if err != nil {
+			s.logger.Errorf("could not drop scheduled notification: %v", err)
+		}
+	}
+}
+
+func (s *Scheduler) deliver(sched *store.Scheduled, now time.Time) bool {
+	chanId := sched.ChanId
+	var err error
+	if chanId.UnicastChannel() {
+		if !sched.ClearPending && !sched.Meta.Sticky {
+			pending, err := inspectPending(s.sto, chanId, sched.AppId, sched.Meta.ReplaceTag, now)
+			if err != nil {
+				s.logger.Errorf("could not peek at notifications: %v", err)
+				return false
+			}
+			if pending.forApp >= s.maxPerApp {
+				s.logger.Debugf("scheduled: %v %v id:%v too many pending", sched.AppId, chanId, sched.Id)
+				return false
+			}
+		}
+		scrubCriteria := scrubCriteriaFor(sched.AppId, sched.ClearPending, sched.Meta)
+		if scrubCriteria != nil {
+			err := s.sto.Scrub(chanId, scrubCriteria...)
+			if err != nil {
+				s.logger.Errorf("could not scrub channel: %v", err)
+				return false
+			}
+		}
+		err = s.sto.AppendToUnicastChannel(chanId, sched.AppId, sched.Payload, sched.Id, sched.Meta)
+	} else {
+		err = s.sto.AppendToChannel(chanId, sched.Payload, sched.Meta)
+	}
+	if err != nil {
+		s.logger.Errorf("could not store notification: %v", err)
+		return false
+	}
+	if chanId.UnicastChannel() {
+		// low priority ones wait for the next exchange with the device
+		if sched.Meta.Priority != store.LowPriority {
+			s.broker.Unicast(chanId)
+		}
+	} else {
+		s.broker.Broadcast(chanId)
+	}
+	s.logger.Debugf("scheduled: %v %v id:%v delivered", sched.AppId, chanId, sched.Id)
+	return true
+}
@@ -0,0 +1,331 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/ubports/ubuntu-push/protocol"
+	"github.com/ubports/ubuntu-push/server/store"
+	help "github.com/ubports/ubuntu-push/testing"
+)
+
+type schedulerSuite struct {
+	testlog *help.TestLogger
+}
+
+var _ = Suite(&schedulerSuite{})
+
+func (s *schedulerSuite) SetUpTest(c *C) {
+	s.testlog = help.NewTestLogger(c, "error")
+}
+
+func (s *schedulerSuite) TestDeliverDueUnicast(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 10)
+	now := time.Now()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	muchLater := store.Metadata{Expiration: now.Add(time.Hour), ReplaceTag: "tag"}
+	// already pending, to be replaced
+	err := sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"a": 0}`), "m0", muchLater)
+	c.Assert(err, IsNil)
+	payload := json.RawMessage(`{"a": 1}`)
+	err = sto.AddScheduled(&store.Scheduled{
+		Id:           "m1",
+		ChanId:       chanId,
+		AppId:        "app1",
+		Payload:      payload,
+		Meta:         muchLater,
+		DeliverAfter: now.Add(time.Minute),
+	})
+	c.Assert(err, IsNil)
+
+	// not yet
+	sched.deliverDue(now)
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+
+	sched.deliverDue(now.Add(time.Minute))
+	c.Check(bsend.err, IsNil)
+	c.Check(bsend.chanId, Equals, chanId)
+	c.Check(bsend.notifications, DeepEquals, []protocol.Notification{
+		protocol.Notification{AppId: "app1", MsgId: "m1", Payload: payload},
+	})
+	due, err := sto.GetDueScheduled(now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(due, HasLen, 0)
+}
+
+func (s *schedulerSuite) TestDeliverDueLowPriority(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 10)
+	now := time.Now()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	err := sto.AddScheduled(&store.Scheduled{
+		Id:           "m1",
+		ChanId:       chanId,
+		AppId:        "app1",
+		Payload:      json.RawMessage(`{"a": 1}`),
+		Meta:         store.Metadata{Expiration: now.Add(time.Hour), Priority: store.LowPriority},
+		DeliverAfter: now,
+	})
+	c.Assert(err, IsNil)
+
+	sched.deliverDue(now)
+	// stored but waiting for the next exchange
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(notifs, HasLen, 1)
+}
+
+func (s *schedulerSuite) TestDeliverDueBroadcast(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 10)
+	now := time.Now()
+	muchLater := store.Metadata{Expiration: now.Add(time.Hour)}
+	payload1 := json.RawMessage(`{"a": 1}`)
+	payload2 := json.RawMessage(`{"a": 2}`)
+	for i, payload := range []json.RawMessage{payload2, payload1} {
+		err := sto.AddScheduled(&store.Scheduled{
+			Id:           fmt.Sprintf("m%d", i),
+			ChanId:       store.SystemInternalChannelId,
+			Payload:      payload,
+			Meta:         muchLater,
+			DeliverAfter: now.Add(time.Duration(2-i) * time.Minute),
+		})
+		c.Assert(err, IsNil)
+	}
+
+	sched.deliverDue(now.Add(2 * time.Minute))
+	c.Check(bsend.err, IsNil)
+	c.Check(bsend.chanId, Equals, store.SystemInternalChannelId)
+	// in order of due time
+	c.Check(bsend.top, Equals, int64(2))
+	c.Check(bsend.notifications, DeepEquals, help.Ns(payload1, payload2))
+}
+
+func (s *schedulerSuite) TestDeliverDueExpired(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 10)
+	now := time.Now()
+	err := sto.AddScheduled(&store.Scheduled{
+		Id:           "m1",
+		ChanId:       store.SystemInternalChannelId,
+		Payload:      json.RawMessage(`{"a": 1}`),
+		Meta:         store.Metadata{Expiration: now.Add(time.Minute)},
+		DeliverAfter: now,
+	})
+	c.Assert(err, IsNil)
+
+	// the server was down past expiration
+	sched.deliverDue(now.Add(time.Hour))
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	due, err := sto.GetDueScheduled(now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(due, HasLen, 0)
+}
+
+func (s *schedulerSuite) TestDeliverDueErrorRetries(c *C) {
+	fail := true
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "Scrub" && fail {
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 10)
+	now := time.Now()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	err := sto.AddScheduled(&store.Scheduled{
+		Id:           "m1",
+		ChanId:       chanId,
+		AppId:        "app1",
+		Payload:      json.RawMessage(`{"a": 1}`),
+		Meta:         store.Metadata{Expiration: now.Add(time.Hour), ReplaceTag: "tag"},
+		DeliverAfter: now,
+	})
+	c.Assert(err, IsNil)
+
+	sched.deliverDue(now)
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not scrub channel: fail\n")
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+
+	fail = false
+	sched.deliverDue(now)
+	c.Check(bsend.chanId, Equals, chanId)
+	c.Check(bsend.notifications, HasLen, 1)
+}
+
+func (s *schedulerSuite) TestDeliverDueErrorSkips(c *C) {
+	failures := 1
+	sto := &interceptInMemoryPendingStore{
+		store.NewInMemoryPendingStore(),
+		func(meth string, err error) error {
+			if meth == "Scrub" && failures > 0 {
+				failures--
+				return errors.New("fail")
+			}
+			return err
+		},
+	}
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 10)
+	now := time.Now()
+	chanId1 := store.UnicastInternalChannelId("user1", "DEV1")
+	chanId2 := store.UnicastInternalChannelId("user2", "DEV2")
+	for i, chanId := range []store.InternalChannelId{chanId1, chanId2} {
+		err := sto.AddScheduled(&store.Scheduled{
+			Id:           fmt.Sprintf("m%d", i+1),
+			ChanId:       chanId,
+			AppId:        "app1",
+			Payload:      json.RawMessage(`{"a": 1}`),
+			Meta:         store.Metadata{Expiration: now.Add(time.Hour), ReplaceTag: "tag"},
+			DeliverAfter: now.Add(time.Duration(i) * time.Second),
+		})
+		c.Assert(err, IsNil)
+	}
+
+	sched.deliverDue(now.Add(time.Minute))
+	c.Check(s.testlog.Captured(), Equals, "ERROR could not scrub channel: fail\n")
+	// the one after the failing one still got delivered
+	c.Check(bsend.chanId, Equals, chanId2)
+	c.Check(bsend.notifications, HasLen, 1)
+	// and the failing one is left for the next time
+	due, err := sto.GetDueScheduled(now.Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(due, HasLen, 1)
+	c.Check(due[0].Id, Equals, "m1")
+	sched.deliverDue(now.Add(time.Minute))
+	c.Check(bsend.chanId, Equals, chanId1)
+}
+
+func (s *schedulerSuite) TestDeliverDueTooManyPending(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	bsend := &checkBrokerSending{store: sto}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Minute, 1)
+	now := time.Now()
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	muchLater := store.Metadata{Expiration: now.Add(time.Hour)}
+	err := sto.AppendToUnicastChannel(chanId, "app1", json.RawMessage(`{"a": 0}`), "m0", muchLater)
+	c.Assert(err, IsNil)
+	err = sto.AddScheduled(&store.Scheduled{
+		Id:           "m1",
+		ChanId:       chanId,
+		AppId:        "app1",
+		Payload:      json.RawMessage(`{"a": 1}`),
+		Meta:         muchLater,
+		DeliverAfter: now,
+	})
+	c.Assert(err, IsNil)
+
+	sched.deliverDue(now)
+	// held back while the app has too many pending
+	c.Check(bsend.chanId, Equals, store.InternalChannelId(""))
+	due, err := sto.GetDueScheduled(now)
+	c.Assert(err, IsNil)
+	c.Check(due, HasLen, 1)
+
+	// the device got it
+	err = sto.DropByMsgId(chanId, []protocol.Notification{{AppId: "app1", MsgId: "m0"}})
+	c.Assert(err, IsNil)
+	sched.deliverDue(now)
+	c.Check(bsend.chanId, Equals, chanId)
+	c.Check(bsend.notifications, DeepEquals, []protocol.Notification{
+		protocol.Notification{AppId: "app1", MsgId: "m1", Payload: json.RawMessage(`{"a": 1}`)},
+	})
+}
+
+func (s *schedulerSuite) TestSurvivesRestart(c *C) {
+	// the store outlives the scheduler, as a persistent one would
+	// outlive the process
+	sto := store.NewInMemoryPendingStore()
+	ctx := &context{testStoreAccess(nil), nil, s.testlog}
+	chanId := store.UnicastInternalChannelId("user1", "DEV1")
+	now := time.Now()
+	_, apiErr := doUnicast(ctx, sto, &Unicast{
+		UserId:       "user1",
+		DeviceId:     "DEV1",
+		AppId:        "app1",
+		ExpireOn:     future,
+		Data:         json.RawMessage(`{"a": 1}`),
+		DeliverAfter: now.Add(200 * time.Millisecond).Format(time.RFC3339Nano),
+	})
+	c.Assert(apiErr, IsNil)
+
+	// first run, stopped before it's due
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Hour, 10)
+	sched.Start()
+	sched.Stop()
+	c.Check(bsend.chanId, HasLen, 0)
+
+	// after the restart, it gets delivered once due
+	time.Sleep(300 * time.Millisecond)
+	sched = NewScheduler(sto, bsend, s.testlog, time.Hour, 10)
+	sched.Start()
+	defer sched.Stop()
+	select {
+	case got := <-bsend.chanId:
+		c.Check(got, Equals, chanId)
+	case <-time.After(5 * time.Second):
+		c.Fatal("scheduled notification not delivered after restart")
+	}
+	_, notifs, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Assert(notifs, HasLen, 1)
+	c.Check(notifs[0].Payload, DeepEquals, json.RawMessage(`{"a": 1}`))
+}
+
+func (s *schedulerSuite) TestStartCatchesUp(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	now := time.Now()
+	// scheduled before a (re)start and already due
+	err := sto.AddScheduled(&store.Scheduled{
+		Id:           "m1",
+		ChanId:       store.SystemInternalChannelId,
+		Payload:      json.RawMessage(`{"a": 1}`),
+		Meta:         store.Metadata{Expiration: now.Add(time.Hour)},
+		DeliverAfter: now.Add(-time.Minute),
+	})
+	c.Assert(err, IsNil)
+	bsend := testBrokerSending{make(chan store.InternalChannelId, 1)}
+	sched := NewScheduler(sto, bsend, s.testlog, time.Hour, 10)
+	sched.Start()
+	defer sched.Stop()
+	select {
+	case chanId := <-bsend.chanId:
+		c.Check(chanId, Equals, store.SystemInternalChannelId)
+	case <-time.After(5 * time.Second):
+		c.Fatal("scheduled notification not delivered")
+	}
+	sched.Stop()
+	// idempotent
+	sched.Stop()
+}
@@ -63,6 +63,10 @@ func (sbe *BroadcastExchange) Init() {
 	}
 }
 
+// filterByLevel returns the notifications a client at clientLevel
+// hasn't got yet. The last notification is at topLevel, and the ones
+// before at one level less each: superseded ones are blanked (see
+// store.BlankOutObsolete), not removed.
 func filterByLevel(clientLevel, topLevel int64, notifs []protocol.Notification) []protocol.Notification {
 	c := int64(len(notifs))
 	if c == 0 {
@@ -84,13 +88,21 @@ func channelFilter(tag string, chanId store.InternalChannelId, notifs []protocol
 		decoded := decoded[len(decoded)-len(notifs):]
 		filtered := make([]json.RawMessage, 0)
 		for i, decoded1 := range decoded {
+			// blanked ones decode to nil
 			if _, ok := decoded1[tag]; ok {
 				filtered = append(filtered, notifs[i].Payload)
 			}
 		}
 		return filtered
 	}
-	return protocol.ExtractPayloads(notifs)
+	payloads := protocol.ExtractPayloads(notifs)
+	filtered := payloads[:0]
+	for _, payload := range payloads {
+		if payload != nil {
+			filtered = append(filtered, payload)
+		}
+	}
+	return filtered
 }
 
 // Prepare session for a BROADCAST.
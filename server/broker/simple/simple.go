@@ -19,6 +19,7 @@ package simple
 
 import (
 	"sync"
+	"time"
 
 	"github.com/ubports/ubuntu-push/logger"
 	"github.com/ubports/ubuntu-push/protocol"
@@ -65,12 +66,16 @@ type deliveryKind int
 const (
 	broadcastDelivery deliveryKind = iota
 	unicastDelivery
+	drainDelivery
 )
 
 // delivery holds all the information to request a delivery
 type delivery struct {
 	kind   deliveryKind
 	chanId store.InternalChannelId
+	// for draining
+	redialDelay time.Duration
+	drained     chan bool
 }
 
 func (sess *simpleBrokerSession) SessionChannel() <-chan broker.Exchange {
@@ -207,7 +212,19 @@ func (b *SimpleBroker) Unregister(s broker.BrokerSession) {
 }
 
 func (b *SimpleBroker) get(chanId store.InternalChannelId, cachedOk bool) (int64, []protocol.Notification, error) {
-	topLevel, notifications, err := b.sto.GetChannelSnapshot(chanId)
+	var topLevel int64
+	var notifications []protocol.Notification
+	var err error
+	if chanId.BroadcastChannel() {
+		// keep positions matching levels, see filterByLevel
+		var meta []store.Metadata
+		topLevel, notifications, meta, err = b.sto.GetChannelUnfiltered(chanId)
+		if err == nil {
+			notifications = store.BlankOutObsolete(notifications, meta)
+		}
+	} else {
+		topLevel, notifications, err = b.sto.GetChannelSnapshot(chanId)
+	}
 	if err != nil {
 		b.logger.Errorf("unsuccessful, get channel snapshot for %v (cachedOk=%v): %v", chanId, cachedOk, err)
 	}
@@ -271,6 +288,19 @@ Loop:
 				if sess != nil {
 					sess.exchanges <- &broker.UnicastExchange{ChanId: chanId, CachedOk: false}
 				}
+			case drainDelivery:
+				setParams := &broker.ConnMetaExchange{
+					Msg: &protocol.SetParamsMsg{
+						Type:        "setparams",
+						RedialDelay: delivery.redialDelay.String(),
+					},
+				}
+				for _, sess := range b.registry {
+					sess.exchanges <- setParams
+					// and kick it
+					sess.exchanges <- nil
+				}
+				delivery.drained <- true
 			}
 		}
 	}
@@ -284,6 +314,20 @@ func (b *SimpleBroker) Broadcast(chanId store.InternalChannelId) {
 	}
 }
 
+// Drain disconnects all the sessions, telling the devices to wait
+// redialDelay before reconnecting (to this or another server), for
+// when going away or overloaded. It returns once all the sessions
+// have been told.
+func (b *SimpleBroker) Drain(redialDelay time.Duration) {
+	drained := make(chan bool)
+	b.deliveryCh <- &delivery{
+		kind:        drainDelivery,
+		redialDelay: redialDelay,
+		drained:     drained,
+	}
+	<-drained
+}
+
 // Unicast requests unicast for the channels.
 func (b *SimpleBroker) Unicast(chanIds ...store.InternalChannelId) {
 	for _, chanId := range chanIds {
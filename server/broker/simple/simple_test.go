@@ -17,12 +17,17 @@
 package simple
 
 import (
+	"encoding/json"
 	stdtesting "testing"
+	"time"
 
 	. "launchpad.net/gocheck"
 
+	"github.com/ubports/ubuntu-push/protocol"
+	"github.com/ubports/ubuntu-push/server/broker"
 	"github.com/ubports/ubuntu-push/server/broker/testing"
 	"github.com/ubports/ubuntu-push/server/store"
+	help "github.com/ubports/ubuntu-push/testing"
 )
 
 func TestSimple(t *stdtesting.T) { TestingT(t) }
@@ -45,3 +50,62 @@ func (s *simpleSuite) TestSessionInternalChannelId(c *C) {
 	sess := &simpleBrokerSession{deviceId: "dev21"}
 	c.Check(sess.InternalChannelId(), Equals, store.UnicastInternalChannelId("dev21", "dev21"))
 }
+
+func (s *simpleSuite) TestBroadcastSupersededKeepsLevels(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	b := NewSimpleBroker(sto, testBrokerConfig, nil, nil)
+	muchLater := time.Now().Add(time.Minute)
+	for _, n := range []struct {
+		payload string
+		tag     string
+	}{{`{"img1/m1":"A"}`, ""}, {`{"img1/m1":"B"}`, "t"}, {`{"img1/m1":"B'"}`, "t"}, {`{"img1/m1":"C"}`, ""}} {
+		err := sto.AppendToChannel(store.SystemInternalChannelId, json.RawMessage(n.payload), store.Metadata{Expiration: muchLater, ReplaceTag: n.tag})
+		c.Assert(err, IsNil)
+	}
+	topLevel, notifs, err := b.get(store.SystemInternalChannelId, false)
+	c.Assert(err, IsNil)
+	exchg := &broker.BroadcastExchange{
+		ChanId:        store.SystemInternalChannelId,
+		TopLevel:      topLevel,
+		Notifications: notifs,
+	}
+	exchg.Init()
+	// the client got A already
+	sess := &testing.TestBrokerSession{
+		LevelsMap: broker.LevelsMap(map[store.InternalChannelId]int64{
+			store.SystemInternalChannelId: 1,
+		}),
+		Model:        "m1",
+		ImageChannel: "img1",
+	}
+	outMsg, _, err := exchg.Prepare(sess)
+	c.Assert(err, IsNil)
+	marshalled, err := json.Marshal(outMsg)
+	c.Assert(err, IsNil)
+	c.Check(string(marshalled), Equals, `{"T":"broadcast","ChanId":"0","TopLevel":4,"Payloads":[{"img1/m1":"B'"},{"img1/m1":"C"}]}`)
+}
+
+func (s *simpleSuite) TestDrain(c *C) {
+	sto := store.NewInMemoryPendingStore()
+	b := NewSimpleBroker(sto, testBrokerConfig, help.NewTestLogger(c, "error"), nil)
+	b.Start()
+	defer b.Stop()
+	sess, err := b.Register(&protocol.ConnectMsg{Type: "connect", DeviceId: "dev-1"}, testTracker("s1"))
+	c.Assert(err, IsNil)
+	// the pending unicasts
+	<-sess.SessionChannel()
+
+	b.Drain(5 * time.Minute)
+	var exchg broker.Exchange
+	select {
+	case <-time.After(5 * time.Second):
+		c.Fatal("taking too long to get drained")
+	case exchg = <-sess.SessionChannel():
+	}
+	outMsg, inMsg, err := exchg.Prepare(sess)
+	c.Assert(err, IsNil)
+	c.Check(inMsg, IsNil)
+	c.Check(outMsg, DeepEquals, &protocol.SetParamsMsg{Type: "setparams", RedialDelay: "5m0s"})
+	// and then it gets kicked
+	c.Check(<-sess.SessionChannel(), IsNil)
+}
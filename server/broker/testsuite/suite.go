@@ -139,7 +139,7 @@ func (s *CommonBrokerSuite) TestRegistrationFeedPending(c *C) {
 	sto := store.NewInMemoryPendingStore()
 	notification1 := json.RawMessage(`{"m": "M"}`)
 	muchLater := time.Now().Add(10 * time.Minute)
-	sto.AppendToChannel(store.SystemInternalChannelId, notification1, muchLater)
+	sto.AppendToChannel(store.SystemInternalChannelId, notification1, store.Metadata{Expiration: muchLater})
 	b := s.MakeBroker(sto, testBrokerConfig, s.testlog)
 	b.Start()
 	defer b.Stop()
@@ -208,7 +208,7 @@ func (s *CommonBrokerSuite) TestBroadcast(c *C) {
 	clearOfPending(c, sess2)
 	// add notification to channel *after* the registrations
 	muchLater := time.Now().Add(10 * time.Minute)
-	sto.AppendToChannel(store.SystemInternalChannelId, notification1, muchLater)
+	sto.AppendToChannel(store.SystemInternalChannelId, notification1, store.Metadata{Expiration: muchLater})
 	b.Broadcast(store.SystemInternalChannelId)
 	select {
 	case <-time.After(5 * time.Second):
@@ -247,6 +247,11 @@ func (sto *testFailingStore) GetChannelSnapshot(chanId store.InternalChannelId)
 	return 0, nil, nil
 }
 
+func (sto *testFailingStore) GetChannelUnfiltered(chanId store.InternalChannelId) (int64, []protocol.Notification, []store.Metadata, error) {
+	topLevel, notifications, err := sto.GetChannelSnapshot(chanId)
+	return topLevel, notifications, nil, err
+}
+
 func (sto *testFailingStore) DropByMsgId(chanId store.InternalChannelId, targets []protocol.Notification) error {
 	return errors.New("drop fail")
 }
@@ -22,7 +22,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/ubports/ubuntu-push/config"
 	"github.com/ubports/ubuntu-push/logger"
@@ -44,6 +47,11 @@ type configuration struct {
 	DeliveryDomain string `json:"delivery_domain"`
 	// max notifications per application
 	MaxNotificationsPerApplication int `json:"max_notifications_per_app"`
+	// how often to check for due scheduled notifications
+	SchedulerInterval config.ConfigInterval `json:"scheduler_interval"`
+	// how long devices are told to wait before reconnecting when
+	// the server shuts down
+	ShutdownRedialDelay config.ConfigTimeDuration `json:"shutdown_redial_delay"`
 }
 
 type Storage struct {
@@ -78,6 +86,10 @@ func main() {
 	broker := simple.NewSimpleBroker(sto, cfg, logger, currentStats)
 	broker.Start()
 	defer broker.Stop()
+	// deliver scheduled notifications when due
+	scheduler := api.NewScheduler(sto, broker, logger, cfg.SchedulerInterval.TimeDuration(), cfg.MaxNotificationsPerApplication)
+	scheduler.Start()
+	defer scheduler.Stop()
 	// serve the http api
 	storage := &Storage{
 		sto: sto,
@@ -87,6 +99,11 @@ func main() {
 	if err != nil {
 		server.BootLogFatalf("start device listening: %v", err)
 	}
+	deviceSession := func(conn net.Conn) error {
+		track := session.NewTracker(logger)
+		return session.Session(conn, broker, cfg, track)
+	}
+	resource := &listener.NopSessionResourceManager{}
 	mux := api.MakeHandlersMux(storage, broker, logger)
 	// & /delivery-hosts
 	mux.HandleFunc("/delivery-hosts", func(w http.ResponseWriter, req *http.Request) {
@@ -94,16 +111,27 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		enc := json.NewEncoder(w)
 		enc.Encode(map[string]interface{}{
-			"hosts":  []string{lst.Addr().String()},
+			"hosts": []string{
+				lst.Addr().String(),
+				// fallback for when only https gets through
+				"wss://" + req.Host + "/device",
+			},
 			"domain": cfg.DeliveryDomain,
 		})
 	})
+	// & /device for sessions tunneled over websocket
+	mux.Handle("/device", listener.WebSocketHandler(deviceSession, resource, logger))
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	handler := api.PanicTo500Handler(mux, logger)
 	go server.HTTPServeRunner(nil, handler, &cfg.HTTPServeParsedConfig, cfg.DevicesParsedConfig.TLSServerConfig())()
 	// listen for device connections
-	resource := &listener.NopSessionResourceManager{}
-	server.DevicesRunner(lst, func(conn net.Conn) error {
-		track := session.NewTracker(logger)
-		return session.Session(conn, broker, cfg, track)
-	}, logger, resource, &cfg.DevicesParsedConfig)()
+	go server.DevicesRunner(lst, deviceSession, logger, resource, &cfg.DevicesParsedConfig)()
+	<-sigs
+	// on shutdown have the devices come back spread out, not all
+	// at once
+	broker.Drain(cfg.ShutdownRedialDelay.TimeDuration())
+	// give the sessions the time to tell them, then returning stops
+	// the scheduler and the broker
+	time.Sleep(cfg.ExchangeTimeout())
 }
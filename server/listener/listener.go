@@ -21,9 +21,11 @@ package listener
 import (
 	"crypto/tls"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/ubports/ubuntu-push/logger"
+	"github.com/ubports/ubuntu-push/websocket"
 )
 
 // A DeviceListenerConfig offers the DeviceListener configuration.
@@ -99,3 +101,22 @@ func (dl *DeviceListener) AcceptLoop(session func(net.Conn) error, resource Sess
 		}()
 	}
 }
+
+// WebSocketHandler returns a http.Handler that accepts device
+// connections tunneled over WebSocket and starts sessions for them.
+func WebSocketHandler(session func(net.Conn) error, resource SessionResourceManager, logger logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resource.ConsumeConn()
+		conn, err := websocket.Upgrade(w, req)
+		if err != nil {
+			logger.Debugf("device websocket upgrade from %v failed: %v", req.RemoteAddr, err)
+			return
+		}
+		defer func() {
+			if err := recover(); err != nil {
+				logger.PanicStackf("terminating device connection on: %v", err)
+			}
+		}()
+		session(conn)
+	})
+}
@@ -20,6 +20,8 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"net/http/httptest"
+	"net/url"
 	"os/exec"
 	"regexp"
 	"syscall"
@@ -30,6 +32,7 @@ import (
 	. "launchpad.net/gocheck"
 
 	helpers "github.com/ubports/ubuntu-push/testing"
+	"github.com/ubports/ubuntu-push/websocket"
 )
 
 func TestListener(t *testing.T) { TestingT(t) }
@@ -272,3 +275,38 @@ func (s *listenerSuite) TestForeignListener(c *C) {
 	c.Check(<-errCh, ErrorMatches, ".*use of closed.*")
 	c.Check(s.testlog.Captured(), Equals, "")
 }
+
+func (s *listenerSuite) TestWebSocketHandler(c *C) {
+	rEvent := make(chan string, 2)
+	resource := &testSessionResourceManager{rEvent}
+	srv := httptest.NewServer(WebSocketHandler(testSession, resource, s.testlog))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL + "/device")
+	c.Assert(err, IsNil)
+	conn, err := net.Dial("tcp", u.Host)
+	c.Assert(err, IsNil)
+	wsConn, err := websocket.Client(conn, u)
+	c.Assert(err, IsNil)
+	defer wsConn.Close()
+	c.Check(takeNext(rEvent), Equals, "consume")
+	testWriteByte(c, wsConn, '1')
+	testReadByte(c, wsConn, '1')
+	c.Check(s.testlog.Captured(), Equals, "")
+}
+
+func (s *listenerSuite) TestWebSocketHandlerPanic(c *C) {
+	resource := &NopSessionResourceManager{}
+	srv := httptest.NewServer(WebSocketHandler(func(conn net.Conn) error {
+		defer conn.Close()
+		panic("session crash")
+	}, resource, s.testlog))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL + "/device")
+	c.Assert(err, IsNil)
+	conn, err := net.Dial("tcp", u.Host)
+	c.Assert(err, IsNil)
+	wsConn, err := websocket.Client(conn, u)
+	c.Assert(err, IsNil)
+	defer wsConn.Close()
+	s.waitForLogs(c, "(?s)ERROR\\(PANIC\\) terminating device connection on: session crash:.*")
+}
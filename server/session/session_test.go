@@ -612,6 +612,28 @@ func (s *sessionSuite) TestSessionLoopConnWarnExchange(c *C) {
 	c.Check(err, Equals, io.EOF)
 }
 
+func (s *sessionSuite) TestSessionLoopSetParamsThenKicked(c *C) {
+	nopTrack := NewTracker(s.testlog)
+	errCh := make(chan error, 1)
+	up := make(chan interface{}, 5)
+	down := make(chan interface{}, 5)
+	tp := &testProtocol{up, down}
+	exchanges := make(chan broker.Exchange, 2)
+	// what draining sends
+	msg := &protocol.SetParamsMsg{Type: "setparams", RedialDelay: "5m0s"}
+	exchanges <- &broker.ConnMetaExchange{msg}
+	exchanges <- nil
+	sess := &testing.TestBrokerSession{Exchanges: exchanges}
+	go func() {
+		errCh <- sessionLoop(tp, sess, cfg5msPingInterval2msExchangeTout, nopTrack)
+	}()
+	c.Check(takeNext(down), Equals, "deadline 2ms")
+	c.Check(takeNext(down), DeepEquals, protocol.SetParamsMsg{Type: "setparams", RedialDelay: "5m0s"})
+	up <- nil // no write error
+	err := <-errCh
+	c.Check(err, DeepEquals, &broker.ErrAbort{"terminated"})
+}
+
 type testTracker struct {
 	SessionTracker
 	interval chan interface{}
@@ -20,6 +20,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -36,14 +37,32 @@ type channel struct {
 
 // InMemoryPendingStore is a basic in-memory pending notification store.
 type InMemoryPendingStore struct {
-	lock  sync.Mutex
-	store map[InternalChannelId]*channel
+	lock      sync.Mutex
+	store     map[InternalChannelId]*channel
+	scheduled []*Scheduled
+	// user id, app id -> device id -> token
+	userDevices map[userApp]map[string]string
+	// msg id -> callback
+	callbacks map[string]*Callback
+	// device id, app id -> public key
+	publicKeys map[deviceApp]string
+}
+
+type userApp struct {
+	userId, appId string
+}
+
+type deviceApp struct {
+	deviceId, appId string
 }
 
 // NewInMemoryPendingStore returns a new InMemoryStore.
 func NewInMemoryPendingStore() *InMemoryPendingStore {
 	return &InMemoryPendingStore{
-		store: make(map[InternalChannelId]*channel),
+		store:       make(map[InternalChannelId]*channel),
+		userDevices: make(map[userApp]map[string]string),
+		callbacks:   make(map[string]*Callback),
+		publicKeys:  make(map[deviceApp]string),
 	}
 }
 
@@ -52,21 +71,85 @@ func (sto *InMemoryPendingStore) Register(deviceId, appId string) (string, error
 }
 
 func (sto *InMemoryPendingStore) Unregister(deviceId, appId string) error {
-	// do nothing, tokens here are computed deterministically and not stored
+	// tokens here are computed deterministically and not stored
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	delete(sto.publicKeys, deviceApp{deviceId, appId})
 	return nil
 }
 
+func (sto *InMemoryPendingStore) SetPublicKey(deviceId, appId, publicKey string) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	key := deviceApp{deviceId, appId}
+	if publicKey == "" {
+		delete(sto.publicKeys, key)
+	} else {
+		sto.publicKeys[key] = publicKey
+	}
+	return nil
+}
+
+func (sto *InMemoryPendingStore) GetPublicKey(token, appId, userId, deviceId string) (string, error) {
+	if appId == "" {
+		return "", ErrUnknownToken
+	}
+	if token != "" {
+		var err error
+		deviceId, err = deviceIdFromToken(token, appId)
+		if err != nil {
+			return "", err
+		}
+	} else if userId == "" || deviceId == "" {
+		return "", ErrUnknownToken
+	}
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	return sto.publicKeys[deviceApp{deviceId, appId}], nil
+}
+
+func (sto *InMemoryPendingStore) AddUserDevice(userId, appId, deviceId, token string) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	key := userApp{userId, appId}
+	devices := sto.userDevices[key]
+	if devices == nil {
+		devices = make(map[string]string)
+		sto.userDevices[key] = devices
+	}
+	devices[deviceId] = token
+	return nil
+}
+
+func (sto *InMemoryPendingStore) RemoveUserDevice(userId, appId, deviceId string) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	key := userApp{userId, appId}
+	devices := sto.userDevices[key]
+	delete(devices, deviceId)
+	if len(devices) == 0 {
+		delete(sto.userDevices, key)
+	}
+	return nil
+}
+
+func (sto *InMemoryPendingStore) GetUserDevices(userId, appId string) (map[string]string, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	devices := sto.userDevices[userApp{userId, appId}]
+	res := make(map[string]string, len(devices))
+	for deviceId, token := range devices {
+		res[deviceId] = token
+	}
+	return res, nil
+}
+
 func (sto *InMemoryPendingStore) GetInternalChannelIdFromToken(token, appId, userId, deviceId string) (InternalChannelId, error) {
 	if token != "" && appId != "" {
-		decoded, err := base64.StdEncoding.DecodeString(token)
+		deviceId, err := deviceIdFromToken(token, appId)
 		if err != nil {
-			return "", ErrUnknownToken
-		}
-		token = string(decoded)
-		if !strings.HasPrefix(token, appId+"::") {
-			return "", ErrUnauthorized
+			return "", err
 		}
-		deviceId := token[len(appId)+2:]
 		return UnicastInternalChannelId(deviceId, deviceId), nil
 	}
 	if userId != "" && deviceId != "" {
@@ -75,6 +158,20 @@ func (sto *InMemoryPendingStore) GetInternalChannelIdFromToken(token, appId, use
 	return "", ErrUnknownToken
 }
 
+// deviceIdFromToken returns the device id a token made by Register
+// for appId is for.
+func deviceIdFromToken(token, appId string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", ErrUnknownToken
+	}
+	token = string(decoded)
+	if !strings.HasPrefix(token, appId+"::") {
+		return "", ErrUnauthorized
+	}
+	return token[len(appId)+2:], nil
+}
+
 func (sto *InMemoryPendingStore) GetInternalChannelId(name string) (InternalChannelId, error) {
 	if name == "system" {
 		return SystemInternalChannelId, nil
@@ -96,10 +193,9 @@ func (sto *InMemoryPendingStore) appendToChannel(chanId InternalChannelId, newNo
 	return nil
 }
 
-func (sto *InMemoryPendingStore) AppendToChannel(chanId InternalChannelId, notificationPayload json.RawMessage, expiration time.Time) error {
+func (sto *InMemoryPendingStore) AppendToChannel(chanId InternalChannelId, notificationPayload json.RawMessage, meta Metadata) error {
 	newNotification := protocol.Notification{Payload: notificationPayload}
-	meta1 := Metadata{Expiration: expiration}
-	return sto.appendToChannel(chanId, newNotification, 1, meta1)
+	return sto.appendToChannel(chanId, newNotification, 1, meta)
 }
 
 func (sto *InMemoryPendingStore) AppendToUnicastChannel(chanId InternalChannelId, appId string, notificationPayload json.RawMessage, msgId string, meta Metadata) error {
@@ -163,15 +259,14 @@ func (sto *InMemoryPendingStore) Scrub(chanId InternalChannelId, criteria ...str
 		return nil
 	}
 	fresh := FilterOutObsolete(res, meta)
+	all := res
 	res = make([]protocol.Notification, 0, len(fresh))
 	resMeta := make([]Metadata, 0, len(fresh))
-	i := 0
 	for j := range meta {
 		if meta[j].Obsolete {
 			continue
 		}
-		notif := fresh[i]
-		i++
+		notif := all[j]
 		if replaceTag != "" {
 			if notif.AppId == appId && meta[j].ReplaceTag == replaceTag {
 				continue
@@ -212,5 +307,91 @@ func (sto *InMemoryPendingStore) DropByMsgId(chanId InternalChannelId, targets [
 	return nil
 }
 
+func (sto *InMemoryPendingStore) AddScheduled(sched *Scheduled) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	sched1 := *sched
+	sto.scheduled = append(sto.scheduled, &sched1)
+	return nil
+}
+
+type byDeliverAfter []*Scheduled
+
+func (s byDeliverAfter) Len() int           { return len(s) }
+func (s byDeliverAfter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDeliverAfter) Less(i, j int) bool { return s[i].DeliverAfter.Before(s[j].DeliverAfter) }
+
+func (sto *InMemoryPendingStore) GetDueScheduled(ref time.Time) ([]*Scheduled, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	var due []*Scheduled
+	for _, sched := range sto.scheduled {
+		if !sched.DeliverAfter.After(ref) {
+			sched1 := *sched
+			due = append(due, &sched1)
+		}
+	}
+	sort.Stable(byDeliverAfter(due))
+	return due, nil
+}
+
+func (sto *InMemoryPendingStore) DropScheduled(id string) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	for i, sched := range sto.scheduled {
+		if sched.Id == id {
+			sto.scheduled = append(sto.scheduled[:i], sto.scheduled[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (sto *InMemoryPendingStore) SetCallback(msgId string, cb *Callback) error {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	now := time.Now()
+	for id, other := range sto.callbacks {
+		if other.Expiration.Before(now) {
+			delete(sto.callbacks, id)
+		}
+	}
+	cb1 := *cb
+	sto.callbacks[msgId] = &cb1
+	return nil
+}
+
+func (sto *InMemoryPendingStore) GetCallback(msgId string) (*Callback, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	cb := sto.callbacks[msgId]
+	if cb == nil {
+		return nil, nil
+	}
+	if cb.Expiration.Before(time.Now()) {
+		delete(sto.callbacks, msgId)
+		return nil, nil
+	}
+	cb1 := *cb
+	return &cb1, nil
+}
+
+func (sto *InMemoryPendingStore) MarkReported(msgId, event string) (bool, error) {
+	sto.lock.Lock()
+	defer sto.lock.Unlock()
+	cb := sto.callbacks[msgId]
+	if cb == nil {
+		return false, nil
+	}
+	for _, reported := range cb.Reported {
+		if reported == event {
+			return true, nil
+		}
+	}
+	// a fresh slice, as copies handed out share the old one
+	cb.Reported = append(cb.Reported[:len(cb.Reported):len(cb.Reported)], event)
+	return false, nil
+}
+
 // sanity check we implement the interface
 var _ PendingStore = (*InMemoryPendingStore)(nil)
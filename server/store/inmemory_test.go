@@ -48,6 +48,65 @@ func (s *inMemorySuite) TestUnregister(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *inMemorySuite) TestUserDevices(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	devices, err := sto.GetUserDevices("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(devices, HasLen, 0)
+
+	c.Assert(sto.AddUserDevice("user1", "app1", "DEV1", "tok1"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "app1", "DEV2", "tok2"), IsNil)
+	c.Assert(sto.AddUserDevice("user1", "app2", "DEV1", "tok3"), IsNil)
+	c.Assert(sto.AddUserDevice("user2", "app1", "DEV3", "tok4"), IsNil)
+
+	devices, err = sto.GetUserDevices("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(devices, DeepEquals, map[string]string{"DEV1": "tok1", "DEV2": "tok2"})
+
+	c.Assert(sto.RemoveUserDevice("user1", "app1", "DEV1"), IsNil)
+	// unknown is fine
+	c.Assert(sto.RemoveUserDevice("user3", "app1", "DEV1"), IsNil)
+	devices, err = sto.GetUserDevices("user1", "app1")
+	c.Assert(err, IsNil)
+	c.Check(devices, DeepEquals, map[string]string{"DEV2": "tok2"})
+	devices, err = sto.GetUserDevices("user1", "app2")
+	c.Assert(err, IsNil)
+	c.Check(devices, DeepEquals, map[string]string{"DEV1": "tok3"})
+}
+
+func (s *inMemorySuite) TestPublicKeys(c *C) {
+	sto := NewInMemoryPendingStore()
+	tok, err := sto.Register("DEV1", "app1")
+	c.Assert(err, IsNil)
+
+	key, err := sto.GetPublicKey(tok, "app1", "", "")
+	c.Assert(err, IsNil)
+	c.Check(key, Equals, "")
+
+	c.Assert(sto.SetPublicKey("DEV1", "app1", "KEY1"), IsNil)
+	c.Assert(sto.SetPublicKey("DEV1", "app2", "KEY2"), IsNil)
+	key, err = sto.GetPublicKey(tok, "app1", "", "")
+	c.Assert(err, IsNil)
+	c.Check(key, Equals, "KEY1")
+	key, err = sto.GetPublicKey("", "app2", "user1", "DEV1")
+	c.Assert(err, IsNil)
+	c.Check(key, Equals, "KEY2")
+	_, err = sto.GetPublicKey(tok, "app2", "", "")
+	c.Check(err, Equals, ErrUnauthorized)
+	_, err = sto.GetPublicKey("", "app1", "", "DEV1")
+	c.Check(err, Equals, ErrUnknownToken)
+
+	c.Assert(sto.SetPublicKey("DEV1", "app1", ""), IsNil)
+	key, err = sto.GetPublicKey(tok, "app1", "", "")
+	c.Assert(err, IsNil)
+	c.Check(key, Equals, "")
+	c.Assert(sto.Unregister("DEV1", "app2"), IsNil)
+	key, err = sto.GetPublicKey("", "app2", "user1", "DEV1")
+	c.Assert(err, IsNil)
+	c.Check(key, Equals, "")
+}
+
 func (s *inMemorySuite) TestGetInternalChannelIdFromToken(c *C) {
 	sto := NewInMemoryPendingStore()
 
@@ -120,8 +179,8 @@ func (s *inMemorySuite) TestAppendToChannelAndGetChannelSnapshot(c *C) {
 
 	muchLater := time.Now().Add(time.Minute)
 
-	sto.AppendToChannel(SystemInternalChannelId, notification1, muchLater)
-	sto.AppendToChannel(SystemInternalChannelId, notification2, muchLater)
+	sto.AppendToChannel(SystemInternalChannelId, notification1, Metadata{Expiration: muchLater})
+	sto.AppendToChannel(SystemInternalChannelId, notification2, Metadata{Expiration: muchLater})
 	top, res, err := sto.GetChannelSnapshot(SystemInternalChannelId)
 	c.Assert(err, IsNil)
 	c.Check(top, Equals, int64(2))
@@ -159,8 +218,8 @@ func (s *inMemorySuite) TestAppendToChannelAndGetChannelUnfiltered(c *C) {
 	gone := time.Now().Add(-1 * time.Minute)
 	muchLater := time.Now().Add(time.Minute)
 
-	sto.AppendToChannel(SystemInternalChannelId, notification1, muchLater)
-	sto.AppendToChannel(SystemInternalChannelId, notification2, gone)
+	sto.AppendToChannel(SystemInternalChannelId, notification1, Metadata{Expiration: muchLater})
+	sto.AppendToChannel(SystemInternalChannelId, notification2, Metadata{Expiration: gone})
 
 	top, res, meta, err := sto.GetChannelUnfiltered(SystemInternalChannelId)
 	c.Assert(err, IsNil)
@@ -207,8 +266,8 @@ func (s *inMemorySuite) TestAppendToChannelAndGetChannelSnapshotWithExpiration(c
 	gone := time.Now().Add(-1 * time.Minute)
 	muchLater := time.Now().Add(time.Minute)
 
-	sto.AppendToChannel(SystemInternalChannelId, notification1, muchLater)
-	sto.AppendToChannel(SystemInternalChannelId, notification2, gone)
+	sto.AppendToChannel(SystemInternalChannelId, notification1, Metadata{Expiration: muchLater})
+	sto.AppendToChannel(SystemInternalChannelId, notification2, Metadata{Expiration: gone})
 
 	top, res, err := sto.GetChannelSnapshot(SystemInternalChannelId)
 	c.Assert(err, IsNil)
@@ -216,6 +275,35 @@ func (s *inMemorySuite) TestAppendToChannelAndGetChannelSnapshotWithExpiration(c
 	c.Check(res, DeepEquals, help.Ns(notification1))
 }
 
+func (s *inMemorySuite) TestAppendToChannelAndGetChannelSnapshotWithReplaceTagAndSticky(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	notification1 := json.RawMessage(`{"a":1}`)
+	notification2 := json.RawMessage(`{"a":2}`)
+	notification3 := json.RawMessage(`{"a":3}`)
+	notification4 := json.RawMessage(`{"a":4}`)
+	notification5 := json.RawMessage(`{"a":5}`)
+
+	muchLater := time.Now().Add(time.Minute)
+
+	sto.AppendToChannel(SystemInternalChannelId, notification1, Metadata{Expiration: muchLater, ReplaceTag: "t"})
+	sto.AppendToChannel(SystemInternalChannelId, notification2, Metadata{Expiration: muchLater})
+	sto.AppendToChannel(SystemInternalChannelId, notification3, Metadata{Expiration: muchLater, ReplaceTag: "t"})
+
+	top, res, err := sto.GetChannelSnapshot(SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(3))
+	c.Check(res, DeepEquals, help.Ns(notification2, notification3))
+
+	sto.AppendToChannel(SystemInternalChannelId, notification4, Metadata{Expiration: muchLater, Sticky: true})
+	sto.AppendToChannel(SystemInternalChannelId, notification5, Metadata{Expiration: muchLater})
+
+	top, res, err = sto.GetChannelSnapshot(SystemInternalChannelId)
+	c.Assert(err, IsNil)
+	c.Check(top, Equals, int64(5))
+	c.Check(res, DeepEquals, help.Ns(notification4, notification5))
+}
+
 func (s *inMemorySuite) TestAppendToUnicastChannelAndGetChannelSnapshotWithExpirationAndCoalescing(c *C) {
 	sto := NewInMemoryPendingStore()
 
@@ -385,6 +473,49 @@ func (s *inMemorySuite) TestScrubReplaceTag(c *C) {
 	c.Check(meta, DeepEquals, []Metadata{meta4})
 }
 
+func (s *inMemorySuite) TestScrubKeepsMetaWithPriorities(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	chanId := UnicastInternalChannelId("user", "dev1")
+	notification1 := json.RawMessage(`{"a":1}`)
+	notification2 := json.RawMessage(`{"a":2}`)
+	notification3 := json.RawMessage(`{"b":3}`)
+
+	meta1 := Metadata{Expiration: time.Now().Add(1 * time.Minute)}
+	meta2 := Metadata{
+		Expiration: time.Now().Add(1 * time.Minute),
+		Priority:   HighPriority,
+	}
+	meta3 := Metadata{Expiration: time.Now().Add(1 * time.Minute)}
+
+	err := sto.AppendToUnicastChannel(chanId, "app1", notification1, "m1", meta1)
+	c.Assert(err, IsNil)
+	err = sto.AppendToUnicastChannel(chanId, "app2", notification2, "m2", meta2)
+	c.Assert(err, IsNil)
+	err = sto.AppendToUnicastChannel(chanId, "app1", notification3, "m3", meta3)
+	c.Assert(err, IsNil)
+
+	// high priority first
+	_, res, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{
+		protocol.Notification{Payload: notification2, AppId: "app2", MsgId: "m2"},
+		protocol.Notification{Payload: notification1, AppId: "app1", MsgId: "m1"},
+		protocol.Notification{Payload: notification3, AppId: "app1", MsgId: "m3"},
+	})
+
+	err = sto.Scrub(chanId, "app2")
+	c.Assert(err, IsNil)
+
+	_, res, meta, err := sto.GetChannelUnfiltered(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, DeepEquals, []protocol.Notification{
+		protocol.Notification{Payload: notification1, AppId: "app1", MsgId: "m1"},
+		protocol.Notification{Payload: notification3, AppId: "app1", MsgId: "m3"},
+	})
+	c.Check(meta, DeepEquals, []Metadata{meta1, meta3})
+}
+
 func (s *inMemorySuite) TestDropByMsgId(c *C) {
 	sto := NewInMemoryPendingStore()
 
@@ -419,3 +550,99 @@ func (s *inMemorySuite) TestDropByMsgId(c *C) {
 		protocol.Notification{Payload: notification3, AppId: "app1", MsgId: "m3"},
 	})
 }
+
+func (s *inMemorySuite) TestScheduled(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	now := time.Now()
+	chanId := UnicastInternalChannelId("user", "dev3")
+	muchLater := Metadata{Expiration: now.Add(time.Hour)}
+	sched1 := &Scheduled{
+		Id:           "s1",
+		ChanId:       chanId,
+		AppId:        "app1",
+		Payload:      json.RawMessage(`{"a":1}`),
+		Meta:         muchLater,
+		DeliverAfter: now.Add(2 * time.Minute),
+	}
+	sched2 := &Scheduled{
+		Id:           "s2",
+		ChanId:       SystemInternalChannelId,
+		Payload:      json.RawMessage(`{"b":1}`),
+		Meta:         muchLater,
+		DeliverAfter: now.Add(time.Minute),
+	}
+	c.Assert(sto.AddScheduled(sched1), IsNil)
+	c.Assert(sto.AddScheduled(sched2), IsNil)
+
+	// nothing due yet
+	due, err := sto.GetDueScheduled(now)
+	c.Assert(err, IsNil)
+	c.Check(due, HasLen, 0)
+	// and nothing visible in the channels
+	_, res, err := sto.GetChannelSnapshot(chanId)
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 0)
+
+	due, err = sto.GetDueScheduled(now.Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Check(due, DeepEquals, []*Scheduled{sched2})
+
+	due, err = sto.GetDueScheduled(now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(due, DeepEquals, []*Scheduled{sched2, sched1})
+
+	c.Assert(sto.DropScheduled("s2"), IsNil)
+	// unknown is fine
+	c.Assert(sto.DropScheduled("s0"), IsNil)
+	due, err = sto.GetDueScheduled(now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(due, DeepEquals, []*Scheduled{sched1})
+}
+
+func (s *inMemorySuite) TestCallbacks(c *C) {
+	sto := NewInMemoryPendingStore()
+
+	cb, err := sto.GetCallback("m1")
+	c.Assert(err, IsNil)
+	c.Check(cb, IsNil)
+
+	now := time.Now()
+	cb1 := &Callback{AppId: "app1", DeviceId: "dev1", URL: "https://example.com/cb", Expiration: now.Add(time.Hour)}
+	c.Assert(sto.SetCallback("m1", cb1), IsNil)
+	cb, err = sto.GetCallback("m1")
+	c.Assert(err, IsNil)
+	c.Check(cb, DeepEquals, cb1)
+
+	// expired ones are forgotten
+	c.Assert(sto.SetCallback("m2", &Callback{AppId: "app1", URL: "https://example.com/cb", Expiration: now.Add(-time.Second)}), IsNil)
+	cb, err = sto.GetCallback("m2")
+	c.Assert(err, IsNil)
+	c.Check(cb, IsNil)
+	c.Check(sto.callbacks, HasLen, 1)
+}
+
+func (s *inMemorySuite) TestMarkReported(c *C) {
+	sto := NewInMemoryPendingStore()
+	// nothing to mark without a callback
+	already, err := sto.MarkReported("m1", "action")
+	c.Assert(err, IsNil)
+	c.Check(already, Equals, false)
+
+	c.Assert(sto.SetCallback("m1", &Callback{AppId: "app1", URL: "https://example.com/cb", Expiration: time.Now().Add(time.Hour)}), IsNil)
+	before, err := sto.GetCallback("m1")
+	c.Assert(err, IsNil)
+	for _, event := range []string{"action", "dismissed"} {
+		already, err = sto.MarkReported("m1", event)
+		c.Assert(err, IsNil)
+		c.Check(already, Equals, false)
+		already, err = sto.MarkReported("m1", event)
+		c.Assert(err, IsNil)
+		c.Check(already, Equals, true)
+	}
+	cb, err := sto.GetCallback("m1")
+	c.Assert(err, IsNil)
+	c.Check(cb.Reported, DeepEquals, []string{"action", "dismissed"})
+	// earlier copies are left alone
+	c.Check(before.Reported, HasLen, 0)
+}
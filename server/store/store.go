@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -98,11 +99,24 @@ func UnicastInternalChannelId(userId, deviceId string) InternalChannelId {
 	return InternalChannelId(fmt.Sprintf("U%s:%s", userId, deviceId))
 }
 
+// Priority of a unicast notification.
+type Priority int
+
+const (
+	LowPriority    Priority = -1
+	NormalPriority Priority = 0
+	HighPriority   Priority = 1
+)
+
 // Metadata holds the metadata stored for a notification.
 type Metadata struct {
 	Expiration time.Time
 	ReplaceTag string
-	Obsolete   bool
+	// Sticky notifications supersede all the earlier ones in the
+	// channel (for the same application).
+	Sticky   bool
+	Priority Priority
+	Obsolete bool
 }
 
 // Before checks whether the expiration date in the metadata is before ref.
@@ -110,17 +124,59 @@ func (m *Metadata) Before(ref time.Time) bool {
 	return m.Expiration.Before(ref)
 }
 
+// Scheduled holds a notification to be appended to its channel only
+// once it is due.
+type Scheduled struct {
+	// Id identifies the entry, for unicasts it is also the msg id.
+	Id           string
+	ChanId       InternalChannelId
+	AppId        string
+	Payload      json.RawMessage
+	Meta         Metadata
+	ClearPending bool
+	DeliverAfter time.Time
+}
+
+// Callback holds where to report the events (like the user acting on
+// it) of a unicast notification, and for whom.
+type Callback struct {
+	AppId    string
+	DeviceId string
+	URL      string
+	// the callback is forgotten after this
+	Expiration time.Time
+	// the events already reported
+	Reported []string
+}
+
 // PendingStore let store notifications into channels.
 type PendingStore interface {
 	// Register returns a token for a device id, application id pair.
 	Register(deviceId, appId string) (token string, err error)
-	// Unregister forgets the token for a device id, application id pair.
+	// Unregister forgets the token, and the public key, for a device
+	// id, application id pair.
 	Unregister(deviceId, appId string) error
+	// SetPublicKey records the key the device published for the
+	// application to encrypt payloads to; an empty key forgets it.
+	SetPublicKey(deviceId, appId, publicKey string) error
+	// GetPublicKey returns the key published for the application by
+	// the device given by a registered token or a user id, device id
+	// pair; empty if none.
+	GetPublicKey(token, appId, userId, deviceId string) (string, error)
+	// AddUserDevice records that the device, registered for the
+	// application with token, belongs to the user.
+	AddUserDevice(userId, appId, deviceId, token string) error
+	// RemoveUserDevice forgets about the device of the user for the
+	// application.
+	RemoveUserDevice(userId, appId, deviceId string) error
+	// GetUserDevices returns the devices of the user registered for
+	// the application as a map from device ids to tokens.
+	GetUserDevices(userId, appId string) (map[string]string, error)
 	// GetInternalChannelId returns the internal store id for a channel
 	// given the name.
 	GetInternalChannelId(name string) (InternalChannelId, error)
-	// AppendToChannel appends a notification to the channel.
-	AppendToChannel(chanId InternalChannelId, notification json.RawMessage, expiration time.Time) error
+	// AppendToChannel appends a notification to the broadcast channel.
+	AppendToChannel(chanId InternalChannelId, notification json.RawMessage, meta Metadata) error
 	// GetInternalChannelIdFromToken returns the matching internal store
 	// id for a channel given a registered token and application id or
 	// directly a device id, user id pair.
@@ -144,6 +200,22 @@ type PendingStore interface {
 	// DropByMsgId drops notifications from a unicast channel
 	// based on message ids.
 	DropByMsgId(chanId InternalChannelId, targets []protocol.Notification) error
+	// AddScheduled stores a notification to be delivered later.
+	AddScheduled(sched *Scheduled) error
+	// GetDueScheduled gets the scheduled notifications that are due
+	// at ref, earliest first.
+	GetDueScheduled(ref time.Time) ([]*Scheduled, error)
+	// DropScheduled forgets a scheduled notification by id.
+	DropScheduled(id string) error
+	// SetCallback records where to report the events of the unicast
+	// notification with msgId.
+	SetCallback(msgId string, cb *Callback) error
+	// GetCallback returns where to report the events of the unicast
+	// notification with msgId; nil if nowhere, or expired.
+	GetCallback(msgId string) (*Callback, error)
+	// MarkReported records event as reported for the unicast
+	// notification with msgId, returning whether it already was.
+	MarkReported(msgId, event string) (bool, error)
 	// Close is to be called when done with the store.
 	Close()
 }
@@ -180,16 +252,45 @@ func FilterOutByMsgId(orig, targets []protocol.Notification) []protocol.Notifica
 	return acc
 }
 
+// BlankOutObsolete returns the notifications of a broadcast channel,
+// as got from GetChannelUnfiltered, with the ones FilterOutObsolete
+// would filter out blanked (nil payload) rather than removed, so that
+// their positions still match the levels clients have.
+func BlankOutObsolete(notifications []protocol.Notification, meta []Metadata) []protocol.Notification {
+	FilterOutObsolete(notifications, meta)
+	res := make([]protocol.Notification, len(notifications))
+	for i := range meta {
+		if !meta[i].Obsolete {
+			res[i] = notifications[i]
+		}
+	}
+	return res
+}
+
 type tagKey struct {
 	appId, replaceTag string
 }
 
-// FilterOutObsolete filters out expired notifications and superseded
-// notifications sharing a replace tag based on paired meta
-// information.
+type byPriority struct {
+	notifications []protocol.Notification
+	priorities    []Priority
+}
+
+func (s byPriority) Len() int { return len(s.notifications) }
+func (s byPriority) Swap(i, j int) {
+	s.notifications[i], s.notifications[j] = s.notifications[j], s.notifications[i]
+	s.priorities[i], s.priorities[j] = s.priorities[j], s.priorities[i]
+}
+func (s byPriority) Less(i, j int) bool { return s.priorities[i] > s.priorities[j] }
+
+// FilterOutObsolete filters out expired notifications, superseded
+// notifications sharing a replace tag and notifications preceding a
+// sticky one based on paired meta information. The remaining ones are
+// returned with higher priority ones first, otherwise in order.
 func FilterOutObsolete(notifications []protocol.Notification, meta []Metadata) []protocol.Notification {
 	now := time.Now()
 	seenTags := make(map[tagKey]bool, 10)
+	seenSticky := make(map[string]bool)
 	n := 0
 	// walk backward to keep the latest ones with a given ReplaceTag
 	for j := len(meta) - 1; j >= 0; j-- {
@@ -197,8 +298,16 @@ func FilterOutObsolete(notifications []protocol.Notification, meta []Metadata) [
 			meta[j].Obsolete = true
 			continue
 		}
+		appId := notifications[j].AppId
+		if seenSticky[appId] {
+			meta[j].Obsolete = true
+			continue
+		}
+		if meta[j].Sticky {
+			seenSticky[appId] = true
+		}
 		if meta[j].ReplaceTag != "" {
-			key := tagKey{notifications[j].AppId, meta[j].ReplaceTag}
+			key := tagKey{appId, meta[j].ReplaceTag}
 			seen := seenTags[key]
 			if seen {
 				meta[j].Obsolete = true
@@ -210,12 +319,21 @@ func FilterOutObsolete(notifications []protocol.Notification, meta []Metadata) [
 		n++
 	}
 	res := make([]protocol.Notification, n)
+	priorities := make([]Priority, n)
+	prioritized := false
 	j := 0
 	for i := range meta {
 		if !meta[i].Obsolete {
 			res[j] = notifications[i]
+			priorities[j] = meta[i].Priority
+			if priorities[j] != NormalPriority {
+				prioritized = true
+			}
 			j++
 		}
 	}
+	if prioritized {
+		sort.Stable(byPriority{res, priorities})
+	}
 	return res
 }
@@ -19,6 +19,7 @@ package store
 import (
 	// "fmt"
 	"testing"
+	"time"
 
 	. "launchpad.net/gocheck"
 
@@ -97,3 +98,54 @@ func (s *storeSuite) TestFilterOutByMsgId(c *C) {
 	})
 
 }
+
+func (s *storeSuite) TestFilterOutObsoletePriority(c *C) {
+	later := time.Now().Add(time.Minute)
+	notifs := []protocol.Notification{
+		protocol.Notification{MsgId: "a"},
+		protocol.Notification{MsgId: "b"},
+		protocol.Notification{MsgId: "c"},
+		protocol.Notification{MsgId: "d"},
+		protocol.Notification{MsgId: "e"},
+	}
+	meta := []Metadata{
+		Metadata{Expiration: later, Priority: LowPriority},
+		Metadata{Expiration: later},
+		Metadata{Expiration: later, Priority: HighPriority, ReplaceTag: "t"},
+		Metadata{Expiration: later, Priority: HighPriority},
+		Metadata{Expiration: later, ReplaceTag: "t"},
+	}
+	res := FilterOutObsolete(notifs, meta)
+	// replace tags are applied in arrival order, high priority goes first
+	c.Check(res, DeepEquals, []protocol.Notification{
+		protocol.Notification{MsgId: "d"},
+		protocol.Notification{MsgId: "b"},
+		protocol.Notification{MsgId: "e"},
+		protocol.Notification{MsgId: "a"},
+	})
+	c.Check(meta[2].Obsolete, Equals, true)
+}
+
+func (s *storeSuite) TestBlankOutObsolete(c *C) {
+	later := time.Now().Add(time.Minute)
+	gone := time.Now().Add(-time.Minute)
+	notifs := []protocol.Notification{
+		protocol.Notification{Payload: []byte(`{"a":1}`)},
+		protocol.Notification{Payload: []byte(`{"a":2}`)},
+		protocol.Notification{Payload: []byte(`{"a":3}`)},
+		protocol.Notification{Payload: []byte(`{"a":4}`)},
+	}
+	meta := []Metadata{
+		Metadata{Expiration: gone},
+		Metadata{Expiration: later, ReplaceTag: "t"},
+		Metadata{Expiration: later, ReplaceTag: "t"},
+		Metadata{Expiration: later},
+	}
+	res := BlankOutObsolete(notifs, meta)
+	c.Check(res, DeepEquals, []protocol.Notification{
+		protocol.Notification{},
+		protocol.Notification{},
+		protocol.Notification{Payload: []byte(`{"a":3}`)},
+		protocol.Notification{Payload: []byte(`{"a":4}`)},
+	})
+}
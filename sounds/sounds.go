@@ -86,10 +86,13 @@ func (snd *sound) Present(app *click.AppId, nid string, notification *launch_hel
 }
 
 var canUseSoundsNotify = cnotificationsettings.CanUseSoundsNotify
+var platformSettingsAvailable = cnotificationsettings.Available
 
 // Returns the absolute path of the sound to be played for app, nid and notification.
+// Without platform notification settings whether the app may play sounds
+// is up to the caller (the postal service's own settings).
 func (snd *sound) GetSound(app *click.AppId, nid string, notification *launch_helper.Notification) string {
-	if !canUseSoundsNotify(app) {
+	if platformSettingsAvailable() && !canUseSoundsNotify(app) {
 		snd.log.Debugf("[%s] sounds disabled by user for this app.", nid)
 		return ""
 	}
@@ -169,3 +169,24 @@ func (ss *soundsSuite) TestSkipIfSilentMode(c *C) {
 	c.Check(s.Present(ss.app, "",
 		&launch_helper.Notification{RawSound: json.RawMessage(`true`)}), Equals, false)
 }
+
+func (ss *soundsSuite) TestPlatformSettings(c *C) {
+	oldAvailable, oldCanUse := platformSettingsAvailable, canUseSoundsNotify
+	defer func() { platformSettingsAvailable, canUseSoundsNotify = oldAvailable, oldCanUse }()
+	canUseSoundsNotify = func(*click.AppId) bool { return false }
+	s := &sound{
+		player:   "echo",
+		log:      ss.log,
+		acc:      ss.acc,
+		fallback: "fallback",
+		dataFind: func(s string) (string, error) { return s, nil },
+	}
+	notif := &launch_helper.Notification{RawSound: json.RawMessage(`true`)}
+
+	platformSettingsAvailable = func() bool { return true }
+	c.Check(s.GetSound(ss.app, "", notif), Equals, "")
+	c.Check(ss.log.Captured(), Matches, `(?sm).*sounds disabled by user for this app.*`)
+	// without the platform's settings they're not consulted
+	platformSettingsAvailable = func() bool { return false }
+	c.Check(s.GetSound(ss.app, "", notif), Equals, "com.example.test/fallback")
+}
@@ -17,6 +17,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -25,7 +28,10 @@ import (
 
 	"launchpad.net/go-xdg/v0"
 
+	"github.com/ubports/ubuntu-push/bus"
 	"github.com/ubports/ubuntu-push/client"
+	"github.com/ubports/ubuntu-push/client/service"
+	"github.com/ubports/ubuntu-push/logger"
 )
 
 func installSigQuitHandler() {
@@ -41,7 +47,35 @@ func installSigQuitHandler() {
 	}()
 }
 
+// printStatus asks the running client for its status over D-Bus and
+// prints it.
+func printStatus() {
+	addr := service.PushServiceBusAddress
+	addr.Path += "/status"
+	endp := bus.SessionBus.Endpoint(addr, logger.NewSimpleLogger(os.Stderr, "error"))
+	err := endp.Dial()
+	if err != nil {
+		log.Fatalf("unable to connect to the session bus: %v", err)
+	}
+	defer endp.Close()
+	var status string
+	err = endp.Call("Status", bus.Args(), &status)
+	if err != nil {
+		log.Fatalf("unable to get status: %v", err)
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, []byte(status), "", "  ")
+	if err != nil {
+		log.Fatalf("bad status: %v", err)
+	}
+	fmt.Println(out.String())
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		printStatus()
+		return
+	}
 	installSigQuitHandler()
 	cfgFname, err := xdg.Config.Find("ubuntu-push-client/config.json")
 	if err != nil {
@@ -0,0 +1,336 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package websocket implements just enough of RFC 6455 to tunnel a
+// stream (like the push protocol) over binary WebSocket messages.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subprotocol is the WebSocket subprotocol name used for push sessions.
+const Subprotocol = "ubuntu-push"
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const maxControlPayload = 125
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadFrame     = errors.New("websocket: bad frame")
+)
+
+// Conn is a net.Conn that reads and writes the payloads of binary
+// WebSocket messages as a stream.
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool
+	// reading state
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	closed    bool
+	// writing
+	writeLock sync.Mutex
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{Conn: conn, br: br, client: client}
+}
+
+func computeAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Client performs the client side of the WebSocket handshake for u
+// over conn, returning the resulting Conn. The handshake is subject
+// to the deadlines already set on conn.
+func Client(conn net.Conn, u *url.URL) (*Conn, error) {
+	var nonce [16]byte
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	path := u.RequestURI()
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n\r\n", path, u.Host, key, Subprotocol)
+	_, err = io.WriteString(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET", URL: u})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != computeAccept(key) {
+		return nil, ErrBadHandshake
+	}
+	return newConn(conn, br, true), nil
+}
+
+// Upgrade performs the server side of the WebSocket handshake taking
+// over the connection of the request. On failure an error response
+// is written and an error returned.
+func Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" ||
+		!headerContains(req.Header, "Upgrade", "websocket") ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAccept(key) + "\r\n"
+	if headerContains(req.Header, "Sec-WebSocket-Protocol", Subprotocol) {
+		resp += "Sec-WebSocket-Protocol: " + Subprotocol + "\r\n"
+	}
+	resp += "\r\n"
+	// clear any deadlines left over from the http server
+	conn.SetDeadline(time.Time{})
+	_, err = io.WriteString(conn, resp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// writeFrame writes a single final frame with the given opcode.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | opcode
+	n := len(payload)
+	switch {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = hdr[:4]
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = hdr[:10]
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	frame := payload
+	if c.client {
+		var mask [4]byte
+		_, err := io.ReadFull(rand.Reader, mask[:])
+		if err != nil {
+			return err
+		}
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+		frame = make([]byte, n)
+		for i := range payload {
+			frame[i] = payload[i] ^ mask[i%4]
+		}
+	}
+	_, err := c.Conn.Write(append(hdr, frame...))
+	return err
+}
+
+// Write writes buf as one binary message.
+func (c *Conn) Write(buf []byte) (int, error) {
+	err := c.writeFrame(opBinary, buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// Close sends a close frame (best effort) and closes the connection.
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
+
+// readPayload reads and unmasks up to len(buf) bytes of the current frame.
+func (c *Conn) readPayload(buf []byte) (int, error) {
+	if int64(len(buf)) > c.remaining {
+		buf = buf[:c.remaining]
+	}
+	n, err := c.br.Read(buf)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			buf[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers, handling control frames, until a
+// data frame is found.
+func (c *Conn) nextFrame() error {
+	for {
+		var hdr [2]byte
+		_, err := io.ReadFull(c.br, hdr[:])
+		if err != nil {
+			return err
+		}
+		opcode := hdr[0] & 0x0f
+		c.masked = hdr[1]&0x80 != 0
+		if c.masked == c.client {
+			// clients must mask, servers must not
+			return ErrBadFrame
+		}
+		length := int64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			_, err = io.ReadFull(c.br, ext[:])
+			length = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			_, err = io.ReadFull(c.br, ext[:])
+			length = int64(binary.BigEndian.Uint64(ext[:]))
+		}
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			return ErrBadFrame
+		}
+		if c.masked {
+			_, err = io.ReadFull(c.br, c.mask[:])
+			if err != nil {
+				return err
+			}
+		}
+		c.maskPos = 0
+		c.remaining = length
+		switch opcode {
+		case opContinuation, opBinary, opText:
+			if length == 0 {
+				continue
+			}
+			return nil
+		case opPing, opPong, opClose:
+			if length > maxControlPayload {
+				return ErrBadFrame
+			}
+			payload := make([]byte, length)
+			_, err = io.ReadFull(readerFunc(c.readPayload), payload)
+			if err != nil {
+				return err
+			}
+			switch opcode {
+			case opPing:
+				err = c.writeFrame(opPong, payload)
+				if err != nil {
+					return err
+				}
+			case opClose:
+				c.closed = true
+				c.writeFrame(opClose, nil)
+				return io.EOF
+			}
+		default:
+			return ErrBadFrame
+		}
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(buf []byte) (int, error) {
+	return f(buf)
+}
+
+// Read reads from the payloads of the incoming data frames.
+func (c *Conn) Read(buf []byte) (int, error) {
+	if c.closed {
+		return 0, io.EOF
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if c.remaining == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.readPayload(buf)
+}
@@ -0,0 +1,136 @@
+/*
+ Copyright 2016 Canonical Ltd.
+
+ This program is free software: you can redistribute it and/or modify it
+ under the terms of the GNU General Public License version 3, as published
+ by the Free Software Foundation.
+
+ This program is distributed in the hope that it will be useful, but
+ WITHOUT ANY WARRANTY; without even the implied warranties of
+ MERCHANTABILITY, SATISFACTORY QUALITY, or FITNESS FOR A PARTICULAR
+ PURPOSE.  See the GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License along
+ with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package websocket
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func TestWebSocket(t *testing.T) { TestingT(t) }
+
+type wsSuite struct{}
+
+var _ = Suite(&wsSuite{})
+
+func (s *wsSuite) TestComputeAccept(c *C) {
+	// example from RFC 6455
+	c.Check(computeAccept("dGhlIHNhbXBsZSBub25jZQ=="), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func echoHandler(c *C) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+}
+
+func dialTest(c *C, srv *httptest.Server) (net.Conn, *url.URL) {
+	u, err := url.Parse(srv.URL + "/device")
+	c.Assert(err, IsNil)
+	conn, err := net.Dial("tcp", u.Host)
+	c.Assert(err, IsNil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, u
+}
+
+func (s *wsSuite) TestRoundTrip(c *C) {
+	srv := httptest.NewServer(echoHandler(c))
+	defer srv.Close()
+	conn, u := dialTest(c, srv)
+	wsConn, err := Client(conn, u)
+	c.Assert(err, IsNil)
+	defer wsConn.Close()
+
+	big := make([]byte, 70000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	for _, msg := range [][]byte{[]byte("\x00hello"), make([]byte, 300), big} {
+		_, err = wsConn.Write(msg)
+		c.Assert(err, IsNil)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(wsConn, got)
+		c.Assert(err, IsNil)
+		c.Check(got, DeepEquals, msg)
+	}
+}
+
+func (s *wsSuite) TestPingGetsPong(c *C) {
+	srv := httptest.NewServer(echoHandler(c))
+	defer srv.Close()
+	conn, u := dialTest(c, srv)
+	wsConn, err := Client(conn, u)
+	c.Assert(err, IsNil)
+	defer wsConn.Close()
+	// pings are answered transparently and don't show up as data
+	err = wsConn.writeFrame(opPing, []byte("x"))
+	c.Assert(err, IsNil)
+	_, err = wsConn.Write([]byte("ab"))
+	c.Assert(err, IsNil)
+	got := make([]byte, 2)
+	_, err = io.ReadFull(wsConn, got)
+	c.Assert(err, IsNil)
+	c.Check(string(got), Equals, "ab")
+}
+
+func (s *wsSuite) TestCloseGivesEOF(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+	conn, u := dialTest(c, srv)
+	wsConn, err := Client(conn, u)
+	c.Assert(err, IsNil)
+	defer wsConn.Close()
+	var buf [1]byte
+	_, err = wsConn.Read(buf[:])
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *wsSuite) TestUpgradeRejectsPlainRequests(c *C) {
+	srv := httptest.NewServer(echoHandler(c))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/device")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *wsSuite) TestClientBadHandshake(c *C) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	conn, u := dialTest(c, srv)
+	defer conn.Close()
+	_, err := Client(conn, u)
+	c.Check(err, Equals, ErrBadHandshake)
+}